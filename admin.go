@@ -0,0 +1,252 @@
+package bunnymq
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ConsumerState is what the database records about a consumer of a queue.
+type ConsumerState struct {
+	ID         string
+	Progress   uint64 // last acknowledged sequence number, 0 if none
+	LeaseSeq   uint64 // message being delivered, tracked when MaxDeliveries is set
+	Deliveries int    // how many times LeaseSeq has been delivered
+}
+
+// RawMessage is a stored message as it sits in the queue, without decoding
+// the payload.
+type RawMessage struct {
+	Seq     uint64
+	Time    time.Time // when it was enqueued, zero for messages from before headers
+	Headers Headers
+	Payload []byte
+}
+
+// Consumers returns the consumers that have progress or a lease on the queue,
+// sorted by ID.
+func (db *DB) Consumers(queue string) ([]ConsumerState, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	states := make(map[string]*ConsumerState)
+	// state returns the consumer of queue that key belongs to, or nil
+	state := func(key string) *ConsumerState {
+		id, q, ok := splitProgressKey(key)
+		if !ok || q != queue {
+			return nil
+		}
+		if states[id] == nil {
+			states[id] = &ConsumerState{ID: id}
+		}
+		return states[id]
+	}
+	err := db.client.view(func(tx Tx) error {
+		err := tx.ForEach(consumerProgressBucket, func(key string, value []byte) error {
+			s := state(key)
+			if s == nil {
+				return nil
+			}
+			progress, err := strconv.ParseUint(string(value), 10, 64)
+			if err != nil {
+				return NewDBError(CodeInvalidProgress, err, key)
+			}
+			s.Progress = progress
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrBucketNotFound) {
+			return err
+		}
+		err = tx.ForEach(consumerLeaseBucket, func(key string, value []byte) error {
+			if seq, attempts, ok := parseLease(value); ok {
+				if s := state(key); s != nil {
+					s.LeaseSeq, s.Deliveries = uint64(seq), attempts
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	consumers := make([]ConsumerState, 0, len(states))
+	for _, s := range states {
+		consumers = append(consumers, *s)
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].ID < consumers[j].ID })
+	return consumers, nil
+}
+
+// Seek moves consumerID on the queue so that its next Dequeue returns the
+// first message with a sequence number of at least seq. It can move the
+// consumer back as well as forward, and clears its delivery count.
+func (db *DB) Seek(queue, consumerID string, seq uint64) error {
+	if err := checkQueueName(queue); err != nil {
+		return err
+	}
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	key := progressKey(consumerID, queue)
+	progress := uint64(0)
+	if seq > 0 {
+		progress = seq - 1
+	}
+	err := db.client.update(func(tx Tx) error {
+		if err := tx.Put(consumerProgressBucket, key, []byte(strconv.FormatUint(progress, 10))); err != nil {
+			return err
+		}
+		return tx.Delete(consumerLeaseBucket, key)
+	})
+	if err != nil {
+		return err
+	}
+	db.client.logger.Info("bunnymq: moved consumer", "path", db.path, "queue", queue, "consumer", consumerID, "seq", seq)
+	return nil
+}
+
+// Peek returns up to n stored messages of the queue, starting at sequence
+// number from, without affecting any consumer. It returns ErrBucketNotFound
+// if the queue does not exist.
+func (db *DB) Peek(queue string, from uint64, n int) ([]RawMessage, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	var msgs []RawMessage
+	err := db.client.view(func(tx Tx) error {
+		// 只确认队列存在，Stats 要数一遍整个队列
+		if _, _, err := tx.Seek(queue, from); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		var decodeErr error
+		err := tx.Scan(queue, from, func(seq uint64, value []byte) bool {
+			env, err := decodeEnvelope(value)
+			if err != nil {
+				decodeErr = NewDBError(CodeFailedToDeserialize, err, queue+"/"+strconv.FormatUint(seq, 10))
+				return false
+			}
+			msgs = append(msgs, RawMessage{
+				Seq:     seq,
+				Time:    env.timestamp,
+				Headers: env.headers,
+				Payload: append([]byte(nil), env.payload...),
+			})
+			return len(msgs) < n
+		})
+		if err != nil {
+			return err
+		}
+		return decodeErr
+	})
+	return msgs, err
+}
+
+// Purge removes every message stored in the queue and returns how many there
+// were. The sequence counter and the progress of consumers are kept, so
+// consumers simply find nothing to consume.
+func (db *DB) Purge(queue string) (int, error) {
+	if err := checkQueueName(queue); err != nil {
+		return 0, err
+	}
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	var removed int
+	err := db.client.update(func(tx Tx) error {
+		stats, err := tx.Stats(queue)
+		if err != nil {
+			return err
+		}
+		removed = stats.Count
+		if stats.Count == 0 {
+			return nil
+		}
+		return tx.DeleteRange(queue, stats.FirstSeq, stats.LastSeq)
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.client.notifyFreed(queue)
+	db.client.logger.Info("bunnymq: purged queue", "path", db.path, "queue", queue, "messages", removed)
+	return removed, nil
+}
+
+// ReplayDeadLetters moves up to max messages, or all of them if max is 0,
+// from the dead-letter queue of queue back to the end of queue, oldest first,
+// and returns how many were moved. The dead-letter headers are removed; the
+// other headers and the enqueue time are kept. Replayed messages get new
+// sequence numbers. The limits of queue apply as they do to Enqueue, except
+// that OverflowBlock does not wait: replay stops at the first message that
+// does not fit, and returns ErrQueueFull if that is the first one. It returns
+// ErrBucketNotFound if nothing was ever dead-lettered from queue.
+func (db *DB) ReplayDeadLetters(queue string, max int) (int, error) {
+	if err := checkQueueName(queue); err != nil {
+		return 0, err
+	}
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	dlq := DeadLetterQueueName(queue)
+	var moved, dropped int
+	err := db.client.update(func(tx Tx) error {
+		if _, _, err := tx.Seek(dlq, 1); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		var msgs []keyValue
+		err := tx.Scan(dlq, 1, func(seq uint64, value []byte) bool {
+			msgs = append(msgs, keyValue{key: strconv.FormatUint(seq, 10), value: append([]byte(nil), value...)})
+			return max <= 0 || len(msgs) < max
+		})
+		if err != nil {
+			return err
+		}
+		var last string
+		for _, m := range msgs {
+			env, err := decodeEnvelope(m.value)
+			if err != nil {
+				return err
+			}
+			for _, h := range []string{DeadLetterQueueHeader, DeadLetterConsumerHeader, DeadLetterSeqHeader, DeadLetterAttemptsHeader, DeadLetterReasonHeader} {
+				delete(env.headers, h)
+			}
+			if len(env.headers) == 0 {
+				env.headers = nil
+			}
+			_, n, err := appendMessage(tx, queue, encodeEnvelope(env))
+			if errors.Is(err, ErrQueueFull) && moved > 0 {
+				// 放不下的留在死信队列里
+				break
+			}
+			if err != nil {
+				return err
+			}
+			moved++
+			dropped += n
+			last = m.key
+		}
+		if moved == 0 {
+			return nil
+		}
+		to, _ := strconv.ParseUint(last, 10, 64)
+		return tx.DeleteRange(dlq, 1, to)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if dropped > 0 {
+		db.client.logger.Warn("bunnymq: dropped oldest messages to make room", "path", db.path, "queue", queue, "count", dropped)
+	}
+	if moved > 0 {
+		db.client.notifyEnqueued(queue)
+		db.client.logger.Info("bunnymq: replayed dead letters", "path", db.path, "queue", queue, "messages", moved)
+	}
+	return moved, nil
+}
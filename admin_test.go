@@ -0,0 +1,129 @@
+package bunnymq
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAdminOperations(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		queue, err := OpenQueue[testStruct](db, "jobs", &JsonCoder[testStruct]{}, WithMaxDeliveries(1))
+		if err != nil {
+			t.Fatalf("OpenQueue: %v", err)
+		}
+		for _, m := range []string{"a", "b", "c"} {
+			queue.Enqueue(testStruct{Message: m})
+		}
+		msg, _ := queue.Dequeue("fast")
+		msg.Ack()
+		msg, _ = queue.Dequeue("fast")
+		msg.Ack()
+		queue.Dequeue("slow")
+
+		consumers, err := db.Consumers("jobs")
+		if err != nil {
+			t.Fatalf("Consumers: %v", err)
+		}
+		want := []ConsumerState{{ID: "fast", Progress: 2}, {ID: "slow", LeaseSeq: 1, Deliveries: 1}}
+		if len(consumers) != 2 || consumers[0] != want[0] || consumers[1] != want[1] {
+			t.Fatalf("Consumers = %+v, want %+v", consumers, want)
+		}
+
+		msgs, err := db.Peek("jobs", 2, 10)
+		if err != nil || len(msgs) != 2 || msgs[0].Seq != 2 || !strings.Contains(string(msgs[0].Payload), `"Message":"b"`) || msgs[0].Time.IsZero() {
+			t.Fatalf("Peek = %+v, %v", msgs, err)
+		}
+		if _, err := db.Peek("missing", 1, 1); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("Peek of a missing queue: got %v, want ErrBucketNotFound", err)
+		}
+
+		// 回退到 1 之后重新投递，投递次数也清零
+		if err := db.Seek("jobs", "fast", 1); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+		if msg, err := queue.Dequeue("fast"); err != nil || msg.Seq() != 1 {
+			t.Fatalf("Dequeue after Seek = %v, %v; want seq 1", msg, err)
+		}
+
+		// slow 第二次取 a 超过 MaxDeliveries，被移到死信队列
+		if msg, err := queue.Dequeue("slow"); err != nil || msg.Data().Message != "b" {
+			t.Fatalf("Dequeue = %v, %v; want b after a was dead-lettered", msg, err)
+		}
+		if n, err := db.ReplayDeadLetters("jobs", 0); err != nil || n != 1 {
+			t.Fatalf("ReplayDeadLetters = %d, %v; want 1", n, err)
+		}
+		msgs, _ = db.Peek("jobs", 4, 1)
+		if len(msgs) != 1 || !strings.Contains(string(msgs[0].Payload), `"Message":"a"`) || msgs[0].Headers.Get(DeadLetterQueueHeader) != "" {
+			t.Fatalf("replayed message = %+v", msgs)
+		}
+		if stats, _ := db.Stats(); stats.Queues[DeadLetterQueueName("jobs")].Count != 0 {
+			t.Errorf("dead-letter queue not emptied: %+v", stats.Queues)
+		}
+
+		if n, err := db.Purge("jobs"); err != nil || n != 4 {
+			t.Fatalf("Purge = %d, %v; want 4", n, err)
+		}
+		if _, err := queue.Dequeue("fast"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Dequeue after Purge: got %v, want ErrKeyNotFound", err)
+		}
+		queue.Enqueue(testStruct{Message: "e"})
+		if msg, err := queue.Dequeue("fast"); err != nil || msg.Seq() != 5 {
+			t.Errorf("Dequeue after Purge = %v, %v; want seq 5", msg, err)
+		}
+	})
+}
+
+func TestReplayDeadLettersAppliesLimits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		queue, err := OpenQueue[testStruct](db, "jobs", &JsonCoder[testStruct]{}, WithMaxDeliveries(1))
+		if err != nil {
+			t.Fatalf("OpenQueue: %v", err)
+		}
+		for _, m := range []string{"a", "b", "c"} {
+			queue.Enqueue(testStruct{Message: m})
+		}
+		// 第二次取 a、b 都超过 MaxDeliveries，进了死信队列
+		queue.Dequeue("slow")
+		queue.Dequeue("slow")
+		if msg, err := queue.Dequeue("slow"); err != nil || msg.Data().Message != "c" {
+			t.Fatalf("Dequeue = %v, %v; want c after a and b were dead-lettered", msg, err)
+		}
+		stats, _ := db.Stats()
+		if n := stats.Queues[DeadLetterQueueName("jobs")].Count; n != 2 {
+			t.Fatalf("dead-letter queue holds %d messages, want 2", n)
+		}
+		// 只放得下一条
+		limit := stats.Queues["jobs"].Count + 1
+		if err := db.SetQueueLimits("jobs", QueueLimits{MaxLength: limit}); err != nil {
+			t.Fatalf("SetQueueLimits: %v", err)
+		}
+
+		ready := db.Enqueued("jobs")
+		if n, err := db.ReplayDeadLetters("jobs", 0); err != nil || n != 1 {
+			t.Fatalf("ReplayDeadLetters = %d, %v; want 1", n, err)
+		}
+		select {
+		case <-ready:
+		default:
+			t.Errorf("ReplayDeadLetters did not wake consumers waiting for messages")
+		}
+		stats, _ = db.Stats()
+		if stats.Queues["jobs"].Count != limit || stats.Queues[DeadLetterQueueName("jobs")].Count != 1 {
+			t.Errorf("after replay: %+v, want %d in jobs and 1 dead letter", stats.Queues, limit)
+		}
+		if n, err := db.ReplayDeadLetters("jobs", 0); !errors.Is(err, ErrQueueFull) || n != 0 {
+			t.Errorf("ReplayDeadLetters into a full queue = %d, %v; want ErrQueueFull", n, err)
+		}
+	})
+}
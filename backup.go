@@ -0,0 +1,274 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent copy of the database to w and returns the number
+// of bytes written. It runs in a read transaction, so producers and consumers
+// keep working while it is taken. The copy is a bbolt file that can be opened
+// with Open or passed to Restore. Only the default bbolt store can be backed
+// up; other stores return an error matching errors.ErrUnsupported.
+func (db *DB) Backup(w io.Writer) (int64, error) {
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	b, ok := db.client.store.(backuper)
+	if !ok {
+		return 0, fmt.Errorf("backup of %s: %w", db.path, errors.ErrUnsupported)
+	}
+	return b.backup(w)
+}
+
+// SnapshotTo writes a backup of the database to path, replacing any file
+// there. The snapshot is written to a temporary file and synced before it is
+// renamed to path, so path never holds a partial snapshot.
+func (db *DB) SnapshotTo(path string) error {
+	if same, err := samePath(path, db.path); err != nil {
+		return err
+	} else if same {
+		return invalidOption("snapshot path", "must not be the database itself")
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, db.opts.FileMode)
+	if err != nil {
+		return err
+	}
+	_, err = db.Backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	db.client.log().Info("bunnymq: wrote snapshot", "path", db.path, "snapshot", path)
+	return nil
+}
+
+// Restore replaces the contents of the database with the snapshot at path, as
+// written by Backup or SnapshotTo. The snapshot is checked first: its bbolt
+// page structure, the sequence numbers of its queues and the progress of its
+// consumers. If the check fails Restore returns an error matching ErrCorrupt
+// and leaves the database untouched. The snapshot file itself is copied, not
+// moved.
+//
+// Queues opened from the database stay open and see the restored messages and
+// progress; consumers waiting for messages are woken. Transactions wait while
+// the file is swapped. If the file cannot be opened again after the swap,
+// Restore returns ErrReopeningDatabase and every later operation fails with
+// ErrDatabaseClosed.
+func (db *DB) Restore(path string) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	if db.client.readOnly {
+		return ErrReadOnly
+	}
+	b, ok := db.client.store.(backuper)
+	if !ok {
+		return fmt.Errorf("restore of %s: %w", db.path, errors.ErrUnsupported)
+	}
+	if same, err := samePath(path, db.path); err != nil {
+		return err
+	} else if same {
+		return invalidOption("snapshot path", "must not be the database itself")
+	}
+	if err := b.restore(path); err != nil {
+		return err
+	}
+	// 快照可能是旧格式写的
+	if err := migrate(db.client.store, db.path, false, db.client.log()); err != nil {
+		return err
+	}
+	db.client.log().Info("bunnymq: restored snapshot", "path", db.path, "snapshot", path)
+	// 恢复后队列里可能多出消息，叫醒等待的消费者
+	names, err := db.ListQueues()
+	for _, name := range names {
+		db.client.notifyEnqueued(name)
+	}
+	return err
+}
+
+// samePath reports whether a and b name the same file.
+func samePath(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return absA == absB, nil
+}
+
+func (s *boltStore) backup(w io.Writer) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrDatabaseClosed
+	}
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// restore checks the snapshot at path, copies it next to the database file and
+// swaps it in.
+func (s *boltStore) restore(path string) error {
+	if err := checkSnapshot(path); err != nil {
+		return err
+	}
+	tmp := s.path + ".restore"
+	if err := copyFile(tmp, path, s.fileMode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.mu.Lock()
+	reopenFailed := false
+	defer func() {
+		s.mu.Unlock()
+		if reopenFailed {
+			// 后台 fsync 要拿读锁，解锁之后再停
+			s.syncer.close()
+			os.Remove(s.path + pidFileSuffix)
+		}
+	}()
+	if s.closed {
+		os.Remove(tmp)
+		return ErrDatabaseClosed
+	}
+	if err := s.db.Close(); err != nil {
+		s.log().Warn("bunnymq: closing database before restore", "path", s.path, "err", err)
+	}
+	renameErr := os.Rename(tmp, s.path)
+	if renameErr != nil {
+		// 换不过去就重新打开原来的文件
+		s.log().Error("bunnymq: replacing database file", "path", s.path, "err", renameErr)
+		os.Remove(tmp)
+	} else if err := syncDir(filepath.Dir(s.path)); err != nil {
+		s.log().Warn("bunnymq: syncing database directory", "path", s.path, "err", err)
+	}
+	db, err := bolt.Open(s.path, s.fileMode, s.opts)
+	if err != nil {
+		s.log().Error("bunnymq: reopening database", "path", s.path, "err", err)
+		// 原来的句柄已经关了，之后的操作返回 ErrDatabaseClosed，Close 也不会再关一次
+		s.closed = true
+		reopenFailed = true
+		return ErrReopeningDatabase
+	}
+	s.db = db
+	if renameErr != nil {
+		return ErrRenamingDatabaseFile
+	}
+	return nil
+}
+
+// checkSnapshot opens the bbolt file at path read-only and checks its page
+// structure and the values bunnymq relies on.
+func checkSnapshot(path string) error {
+	snap, err := bolt.Open(path, 0, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return NewDBError(CodeOpeningBackupDatabase, err, path)
+	}
+	defer snap.Close()
+	return snap.View(func(tx *bolt.Tx) error {
+		// Check 的错误要读完，否则检查的 goroutine 会一直阻塞
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		if checkErr != nil {
+			return NewDBError(CodeCorrupt, checkErr, path)
+		}
+		t := newBoltTx(tx)
+		version, err := readFormatVersion(t)
+		if err != nil {
+			return NewDBError(CodeCorrupt, err, path)
+		}
+		if version > formatVersion {
+			return NewDBError(CodeUnsupportedFormat, fmt.Errorf("format version %d is newer than %d, the newest this version supports", version, formatVersion), path)
+		}
+		err = tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			return checkSnapshotBucket(string(name), bucket, t.decimalKeys)
+		})
+		if err != nil {
+			return NewDBError(CodeCorrupt, err, path)
+		}
+		return nil
+	})
+}
+
+func checkSnapshotBucket(name string, bucket *bolt.Bucket, decimal bool) error {
+	return bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return fmt.Errorf("bucket %q: unexpected nested bucket %q", name, k)
+		}
+		switch {
+		case name == consumerProgressBucket:
+			if _, err := strconv.ParseUint(string(v), 10, 64); err != nil {
+				return fmt.Errorf("progress of %q: %w", k, err)
+			}
+		case name == consumerLeaseBucket:
+			if _, _, ok := parseLease(v); !ok {
+				return fmt.Errorf("lease of %q: malformed value %q", k, v)
+			}
+		case strings.HasPrefix(name, queueBucketPrefix):
+			seq, ok := parseSeqKey(k, decimal)
+			if !ok {
+				return fmt.Errorf("queue %q: key %q is not a sequence number", strings.TrimPrefix(name, queueBucketPrefix), k)
+			}
+			if seq > bucket.Sequence() {
+				return fmt.Errorf("queue %q: message %d is past the sequence counter %d", strings.TrimPrefix(name, queueBucketPrefix), seq, bucket.Sequence())
+			}
+		}
+		return nil
+	})
+}
+
+// copyFile copies src to a new file dst with the given mode and syncs it.
+func copyFile(dst, src string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
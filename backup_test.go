@@ -0,0 +1,140 @@
+package bunnymq
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "live.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	queue, _ := OpenQueue[testStruct](db, "jobs", &JsonCoder[testStruct]{})
+	for _, m := range []string{"a", "b", "c"} {
+		queue.Enqueue(testStruct{Message: m})
+	}
+	msg, _ := queue.Dequeue("w")
+	msg.Ack()
+
+	snap := filepath.Join(dir, "snap.db")
+	if err := db.SnapshotTo(snap); err != nil {
+		t.Fatalf("SnapshotTo: %v", err)
+	}
+	var buf bytes.Buffer
+	if n, err := db.Backup(&buf); err != nil || n != int64(buf.Len()) || n == 0 {
+		t.Fatalf("Backup = %d, %v (wrote %d bytes)", n, err, buf.Len())
+	}
+
+	// 快照之后的改动在恢复后消失
+	queue.Enqueue(testStruct{Message: "d"})
+	for i := 0; i < 2; i++ {
+		msg, _ := queue.Dequeue("w")
+		msg.Ack()
+	}
+	if err := db.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if msg, err := queue.Dequeue("w"); err != nil || msg.Seq() != 2 || msg.Data().Message != "b" {
+		t.Fatalf("Dequeue after Restore = %v, %v; want b at seq 2", msg, err)
+	}
+	if stats, _ := db.Stats(); stats.Queues["jobs"].LastSeq != 3 {
+		t.Errorf("LastSeq after Restore = %d, want 3", stats.Queues["jobs"].LastSeq)
+	}
+	if _, err := os.Stat(snap); err != nil {
+		t.Errorf("Restore consumed the snapshot: %v", err)
+	}
+
+	if err := db.SnapshotTo(filepath.Join(dir, "live.db")); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("SnapshotTo the database itself: got %v, want ErrInvalidOption", err)
+	}
+}
+
+func TestRestoreRejectsCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "live.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	queue, _ := OpenQueue[testStruct](db, "jobs", &JsonCoder[testStruct]{})
+	queue.Enqueue(testStruct{Message: "kept"})
+
+	bad := filepath.Join(dir, "bad.db")
+	raw, err := bolt.Open(bad, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucket([]byte(consumerProgressBucket))
+		return b.Put([]byte("w:jobs"), []byte("not a number"))
+	})
+	raw.Close()
+	if err := db.Restore(bad); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Restore of a bad snapshot: got %v, want ErrCorrupt", err)
+	}
+	garbage := filepath.Join(dir, "garbage.db")
+	os.WriteFile(garbage, bytes.Repeat([]byte("x"), 8192), 0600)
+	if err := db.Restore(garbage); !errors.Is(err, ErrOpeningBackupDatabase) {
+		t.Fatalf("Restore of a non-bbolt file: got %v, want ErrOpeningBackupDatabase", err)
+	}
+	if msg, err := queue.Dequeue("w"); err != nil || msg.Data().Message != "kept" {
+		t.Fatalf("Dequeue after failed Restore = %v, %v", msg, err)
+	}
+}
+
+func TestRestoreReopenFailure(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "live.db")
+	db, err := Open(dbPath, WithOpenTimeout(50*time.Millisecond), WithDurability(DurabilityBatched))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	queue, _ := OpenQueue[testStruct](db, "jobs", &JsonCoder[testStruct]{})
+	queue.Enqueue(testStruct{Message: "a"})
+	snap := filepath.Join(dir, "snap.db")
+	if err := db.SnapshotTo(snap); err != nil {
+		t.Fatalf("SnapshotTo: %v", err)
+	}
+	// Restore 把快照拷到这个文件再换过去；别的句柄占着它的锁，换过去之后打不开
+	holder, err := bolt.Open(dbPath+".restore", 0600, nil)
+	if err != nil {
+		t.Fatalf("bolt.Open: %v", err)
+	}
+	defer holder.Close()
+
+	if err := db.Restore(snap); !errors.Is(err, ErrReopeningDatabase) {
+		t.Fatalf("Restore: got %v, want ErrReopeningDatabase", err)
+	}
+	if err := queue.Enqueue(testStruct{Message: "b"}); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Enqueue after failed reopen: got %v, want ErrDatabaseClosed", err)
+	}
+	if _, err := db.Stats(); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Stats after failed reopen: got %v, want ErrDatabaseClosed", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Close after failed reopen: %v", err)
+	}
+	if _, err := os.Stat(dbPath + pidFileSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("pid file left after Close: %v", err)
+	}
+}
+
+func TestBackupUnsupportedStore(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "mem.db"), WithMemoryStore())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Backup(&bytes.Buffer{}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Backup of a memory store: got %v, want ErrUnsupported", err)
+	}
+}
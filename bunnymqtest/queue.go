@@ -0,0 +1,169 @@
+// Package bunnymqtest provides an in-memory fake of a bunnymq queue for tests
+// of code written against bunnymq.Producer and bunnymq.Consumer.
+package bunnymqtest
+
+import (
+	"context"
+	"sync"
+
+	"gitlab.cnns/luoying/bunnymq"
+)
+
+// Queue is an in-memory bunnymq.ProducerConsumer. Like a real queue, every
+// consumer reads every message and gets the same message back until it is
+// acknowledged. Nothing is encoded, so items are returned as enqueued.
+//
+// The zero value is not usable; call NewQueue.
+type Queue[T any] struct {
+	mu         sync.Mutex
+	items      []T
+	headers    []bunnymq.Headers
+	progress   map[string]uint64 // consumerID -> last acknowledged seq
+	enqueueErr error
+	dequeueErr error
+	acks       int
+	nacks      int
+	closed     bool
+}
+
+var _ bunnymq.ProducerConsumer[struct{}] = (*Queue[struct{}])(nil)
+
+// NewQueue returns an empty fake queue.
+func NewQueue[T any]() *Queue[T] {
+	return &Queue[T]{progress: make(map[string]uint64)}
+}
+
+// FailEnqueue makes Enqueue and EnqueueContext return err until it is called
+// again with nil.
+func (q *Queue[T]) FailEnqueue(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.enqueueErr = err
+}
+
+// FailDequeue makes Dequeue return err until it is called again with nil.
+func (q *Queue[T]) FailDequeue(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dequeueErr = err
+}
+
+func (q *Queue[T]) Enqueue(data T) error {
+	return q.EnqueueContext(context.Background(), data)
+}
+
+// EnqueueContext stores data. The context is ignored.
+func (q *Queue[T]) EnqueueContext(_ context.Context, data T) error {
+	return q.EnqueueWithHeaders(data, nil)
+}
+
+// EnqueueWithHeaders stores data with headers, which the returned messages
+// report from Headers.
+func (q *Queue[T]) EnqueueWithHeaders(data T, headers bunnymq.Headers) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return bunnymq.ErrDatabaseClosed
+	}
+	if q.enqueueErr != nil {
+		return q.enqueueErr
+	}
+	q.items = append(q.items, data)
+	q.headers = append(q.headers, headers)
+	return nil
+}
+
+// Dequeue returns the first message consumerID has not acknowledged, or
+// bunnymq.ErrKeyNotFound.
+func (q *Queue[T]) Dequeue(consumerID string) (bunnymq.Msg[T], error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, bunnymq.ErrDatabaseClosed
+	}
+	if q.dequeueErr != nil {
+		return nil, q.dequeueErr
+	}
+	next := q.progress[consumerID]
+	if next >= uint64(len(q.items)) {
+		return nil, bunnymq.ErrKeyNotFound
+	}
+	return &msg[T]{q: q, consumerID: consumerID, seq: next + 1, data: q.items[next], headers: q.headers[next]}, nil
+}
+
+// Close makes later calls fail with bunnymq.ErrDatabaseClosed.
+func (q *Queue[T]) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	return nil
+}
+
+// Items returns every item enqueued so far, in order.
+func (q *Queue[T]) Items() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]T(nil), q.items...)
+}
+
+// Pending returns the items consumerID has not acknowledged yet.
+func (q *Queue[T]) Pending(consumerID string) []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]T(nil), q.items[q.progress[consumerID]:]...)
+}
+
+// Acks returns how many times messages were acknowledged.
+func (q *Queue[T]) Acks() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.acks
+}
+
+// NAcks returns how many times messages were rejected.
+func (q *Queue[T]) NAcks() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.nacks
+}
+
+// msg is a message of the fake queue.
+type msg[T any] struct {
+	q          *Queue[T]
+	consumerID string
+	seq        uint64
+	data       T
+	headers    bunnymq.Headers
+	acked      bool
+}
+
+// Ack moves the consumer past the message. Acknowledging twice is a no-op.
+func (m *msg[T]) Ack() error {
+	m.q.mu.Lock()
+	defer m.q.mu.Unlock()
+	if m.acked {
+		return nil
+	}
+	if m.q.closed {
+		return bunnymq.ErrDatabaseClosed
+	}
+	m.acked = true
+	m.q.acks++
+	if m.seq > m.q.progress[m.consumerID] {
+		m.q.progress[m.consumerID] = m.seq
+	}
+	return nil
+}
+
+// NAck leaves the message to be delivered again.
+func (m *msg[T]) NAck() error {
+	m.q.mu.Lock()
+	defer m.q.mu.Unlock()
+	m.q.nacks++
+	return nil
+}
+
+func (m *msg[T]) Data() T                  { return m.data }
+func (m *msg[T]) Seq() uint64              { return m.seq }
+func (m *msg[T]) Headers() bunnymq.Headers { return m.headers }
+func (m *msg[T]) Context() context.Context { return context.Background() }
@@ -0,0 +1,75 @@
+package bunnymqtest
+
+import (
+	"errors"
+	"testing"
+
+	"gitlab.cnns/luoying/bunnymq"
+)
+
+// drain is the kind of code the fake stands in for: it only knows the
+// Consumer interface.
+func drain(c bunnymq.Consumer[string], consumerID string) ([]string, error) {
+	var got []string
+	for {
+		msg, err := c.Dequeue(consumerID)
+		if errors.Is(err, bunnymq.ErrKeyNotFound) {
+			return got, nil
+		}
+		if err != nil {
+			return got, err
+		}
+		got = append(got, msg.Data())
+		if err := msg.Ack(); err != nil {
+			return got, err
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	q := NewQueue[string]()
+	var p bunnymq.Producer[string] = q
+	for _, m := range []string{"a", "b", "c"} {
+		if err := p.Enqueue(m); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+
+	msg, err := q.Dequeue("c1")
+	if err != nil || msg.Data() != "a" || msg.Seq() != 1 {
+		t.Fatalf("Dequeue = %v, %v; want a", msg, err)
+	}
+	msg.NAck()
+	if again, _ := q.Dequeue("c1"); again.Data() != "a" {
+		t.Fatalf("after NAck got %q, want a again", again.Data())
+	}
+	if got, err := drain(q, "c1"); err != nil || len(got) != 3 {
+		t.Fatalf("drain(c1) = %v, %v", got, err)
+	}
+	// 每个消费者各自有进度
+	if pending := q.Pending("c2"); len(pending) != 3 {
+		t.Errorf("Pending(c2) = %v, want all three", pending)
+	}
+	if q.Acks() != 3 || q.NAcks() != 1 {
+		t.Errorf("Acks, NAcks = %d, %d; want 3, 1", q.Acks(), q.NAcks())
+	}
+
+	boom := errors.New("boom")
+	q.FailDequeue(boom)
+	if _, err := drain(q, "c2"); !errors.Is(err, boom) {
+		t.Errorf("drain with a failing Dequeue: got %v, want boom", err)
+	}
+	q.FailDequeue(nil)
+	q.FailEnqueue(boom)
+	if err := q.Enqueue("d"); !errors.Is(err, boom) {
+		t.Errorf("Enqueue: got %v, want boom", err)
+	}
+	if items := q.Items(); len(items) != 3 {
+		t.Errorf("Items = %v after a failed Enqueue", items)
+	}
+
+	q.Close()
+	if _, err := q.Dequeue("c2"); !errors.Is(err, bunnymq.ErrDatabaseClosed) {
+		t.Errorf("Dequeue after Close: got %v, want ErrDatabaseClosed", err)
+	}
+}
@@ -0,0 +1,418 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DeadLetterReasonHeader is set on messages that Repair moved to a dead-letter
+// queue because they could not be decoded.
+const DeadLetterReasonHeader = "x-dead-letter-reason"
+
+// ProblemKind says what is wrong in a Problem found by Check.
+type ProblemKind int
+
+const (
+	ProblemInvalidProgress  ProblemKind = iota + 1 // progress that is not a number
+	ProblemProgressAhead                           // progress past the last sequence number of the queue
+	ProblemInvalidLease                            // lease that is not "seq:attempts"
+	ProblemStaleLease                              // lease on a message that was acknowledged or is gone
+	ProblemOrphanedProgress                        // progress on a queue that does not exist
+	ProblemOrphanedLease                           // lease on a queue that does not exist
+	ProblemCounterBehind                           // stored message past the sequence counter of the queue
+	ProblemBadEnvelope                             // message whose envelope does not decode
+	ProblemBadPayload                              // message the queue's Coder cannot decode
+	ProblemBadKey                                  // key in a queue that is not a sequence number
+)
+
+var problemNames = map[ProblemKind]string{
+	ProblemInvalidProgress:  "invalid progress",
+	ProblemProgressAhead:    "progress ahead of queue",
+	ProblemInvalidLease:     "invalid lease",
+	ProblemStaleLease:       "stale lease",
+	ProblemOrphanedProgress: "orphaned progress",
+	ProblemOrphanedLease:    "orphaned lease",
+	ProblemCounterBehind:    "sequence counter behind",
+	ProblemBadEnvelope:      "bad envelope",
+	ProblemBadPayload:       "bad payload",
+	ProblemBadKey:           "bad key",
+}
+
+func (k ProblemKind) String() string {
+	if name, ok := problemNames[k]; ok {
+		return name
+	}
+	return "ProblemKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Kind     ProblemKind
+	Queue    string
+	Consumer string // for progress and lease problems
+	Key      string // bucket key of the progress or lease, or the bad key
+	Seq      uint64 // the message, or the highest stored message for ProblemCounterBehind
+	Detail   string
+}
+
+func (p Problem) String() string {
+	s := p.Kind.String() + ": queue " + strconv.Quote(p.Queue)
+	if p.Consumer != "" {
+		s += " consumer " + strconv.Quote(p.Consumer)
+	}
+	if p.Seq > 0 {
+		s += " seq " + strconv.FormatUint(p.Seq, 10)
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	return s
+}
+
+// Repairable reports whether Repair can fix the problem.
+func (p Problem) Repairable() bool {
+	return p.Kind != ProblemBadKey
+}
+
+// CheckReport is the result of Check.
+type CheckReport struct {
+	Queues   int // queues checked
+	Messages int // messages checked
+	Problems []Problem
+}
+
+// OK reports whether no problems were found.
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// layoutChecker is implemented by stores whose format can hold what the Tx
+// interface does not show, such as queue keys that are not sequence numbers.
+type layoutChecker interface {
+	checkLayout(include func(queue string) bool) ([]Problem, error)
+}
+
+// Check reads the whole database in one read transaction and reports what is
+// inconsistent: progress and leases that do not parse, point past the end of
+// their queue or belong to no queue, leases on messages that were already
+// acknowledged, messages past their queue's sequence counter, messages whose
+// envelope does not decode and, in a bbolt file, keys that are not sequence
+// numbers. Payloads are not decoded; Queue.Check does that with the queue's
+// Coder. Problems are not errors: the error is only for failing to read.
+func (db *DB) Check() (*CheckReport, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	return db.client.check("", nil)
+}
+
+// Check is like DB.Check restricted to the queue, and also reports messages
+// the queue's Coder cannot decode.
+func (q *Queue[T]) Check() (*CheckReport, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkOpen(); err != nil {
+		return nil, err
+	}
+	return q.db.check(q.queueName, func(payload []byte) error {
+		_, err := q.coder.Decode(payload)
+		return err
+	})
+}
+
+// check builds the report for one queue, or for all of them if queue is "".
+// decode, if not nil, is applied to every payload.
+func (client *dbClient) check(queue string, decode func([]byte) error) (*CheckReport, error) {
+	report := &CheckReport{}
+	include := func(name string) bool { return queue == "" || name == queue }
+	err := client.view(func(tx Tx) error {
+		names, err := tx.Queues()
+		if err != nil {
+			return err
+		}
+		stats := make(map[string]QueueStats, len(names))
+		for _, name := range names {
+			if stats[name], err = tx.Stats(name); err != nil {
+				return err
+			}
+			if include(name) {
+				report.Queues++
+				if err := checkMessages(tx, name, stats[name], decode, report); err != nil {
+					return err
+				}
+			}
+		}
+		progress, err := checkProgress(tx, stats, include, report)
+		if err != nil {
+			return err
+		}
+		return checkLeases(tx, stats, progress, include, report)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lc, ok := client.store.(layoutChecker); ok {
+		problems, err := lc.checkLayout(include)
+		if err != nil {
+			return nil, err
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+	return report, nil
+}
+
+func checkMessages(tx Tx, queue string, stats QueueStats, decode func([]byte) error, report *CheckReport) error {
+	var highest uint64
+	err := tx.Scan(queue, 1, func(seq uint64, value []byte) bool {
+		report.Messages++
+		highest = seq
+		env, err := decodeEnvelope(value)
+		if err != nil {
+			report.Problems = append(report.Problems, Problem{Kind: ProblemBadEnvelope, Queue: queue, Seq: seq, Detail: err.Error()})
+			return true
+		}
+		if decode != nil {
+			if err := decode(env.payload); err != nil {
+				report.Problems = append(report.Problems, Problem{Kind: ProblemBadPayload, Queue: queue, Seq: seq, Detail: err.Error()})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if highest > stats.LastSeq {
+		report.Problems = append(report.Problems, Problem{
+			Kind: ProblemCounterBehind, Queue: queue, Seq: highest,
+			Detail: fmt.Sprintf("counter is %d", stats.LastSeq),
+		})
+	}
+	return nil
+}
+
+// splitConsumerKey splits a progress or lease key into the consumer and the
+// queue; ok is false if the key names no existing queue.
+func splitConsumerKey(key string, stats map[string]QueueStats) (consumer, queue string, ok bool) {
+	consumer, queue, found := splitProgressKey(key)
+	if !found {
+		return key, "", false
+	}
+	_, ok = stats[queue]
+	return consumer, queue, ok
+}
+
+// checkProgress checks the progress bucket and returns the progress that
+// parsed, by key.
+func checkProgress(tx Tx, stats map[string]QueueStats, include func(string) bool, report *CheckReport) (map[string]uint64, error) {
+	progress := make(map[string]uint64)
+	err := tx.ForEach(consumerProgressBucket, func(key string, value []byte) error {
+		consumer, queue, exists := splitConsumerKey(key, stats)
+		if !include(queue) {
+			return nil
+		}
+		p := Problem{Queue: queue, Consumer: consumer, Key: key}
+		n, err := strconv.ParseUint(string(value), 10, 64)
+		switch {
+		case err != nil:
+			p.Kind, p.Detail = ProblemInvalidProgress, strconv.Quote(string(value))
+		case !exists:
+			p.Kind, p.Detail = ProblemOrphanedProgress, fmt.Sprintf("progress %d", n)
+		case n > stats[queue].LastSeq:
+			p.Kind, p.Detail = ProblemProgressAhead, fmt.Sprintf("progress %d, last seq %d", n, stats[queue].LastSeq)
+		default:
+			progress[key] = n
+			return nil
+		}
+		report.Problems = append(report.Problems, p)
+		return nil
+	})
+	if errors.Is(err, ErrBucketNotFound) {
+		err = nil
+	}
+	return progress, err
+}
+
+func checkLeases(tx Tx, stats map[string]QueueStats, progress map[string]uint64, include func(string) bool, report *CheckReport) error {
+	err := tx.ForEach(consumerLeaseBucket, func(key string, value []byte) error {
+		consumer, queue, exists := splitConsumerKey(key, stats)
+		if !include(queue) {
+			return nil
+		}
+		p := Problem{Queue: queue, Consumer: consumer, Key: key}
+		seq, _, ok := parseLease(value)
+		switch {
+		case !ok || seq <= 0:
+			p.Kind, p.Detail = ProblemInvalidLease, strconv.Quote(string(value))
+		case !exists:
+			p.Kind, p.Seq = ProblemOrphanedLease, uint64(seq)
+		case uint64(seq) <= progress[key]:
+			p.Kind, p.Seq, p.Detail = ProblemStaleLease, uint64(seq), fmt.Sprintf("already acknowledged, progress %d", progress[key])
+		default:
+			if found, _, err := tx.Seek(queue, uint64(seq)); err == nil && found == uint64(seq) {
+				return nil
+			} else if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				return err
+			}
+			p.Kind, p.Seq, p.Detail = ProblemStaleLease, uint64(seq), "message is gone"
+		}
+		report.Problems = append(report.Problems, p)
+		return nil
+	})
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Repair fixes the repairable problems of a report from Check or Queue.Check
+// and returns how many it fixed. Each problem is checked again first, so
+// problems that went away since the report are left alone. Repair never
+// drops a message:
+//
+//   - progress that is not a number is removed, so the consumer starts again
+//     from the oldest stored message; progress past the end of the queue is
+//     set to its last sequence number;
+//   - invalid, stale and orphaned leases and orphaned progress are removed;
+//   - a sequence counter behind the stored messages is raised past them;
+//   - messages that cannot be decoded are moved to the queue's dead-letter
+//     queue with DeadLetterReasonHeader set.
+//
+// Everything is repaired in one transaction.
+func (db *DB) Repair(report *CheckReport) (int, error) {
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	var (
+		fixed   int
+		touched = make(map[string]bool) // dead-letter queues that got messages
+	)
+	err := db.client.update(func(tx Tx) error {
+		for _, p := range report.Problems {
+			ok, err := repairProblem(tx, p)
+			if err != nil {
+				return fmt.Errorf("repairing %v: %w", p, err)
+			}
+			if ok {
+				fixed++
+				if p.Kind == ProblemBadEnvelope || p.Kind == ProblemBadPayload {
+					touched[DeadLetterQueueName(p.Queue)] = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for name := range touched {
+		db.client.notifyEnqueued(name)
+	}
+	db.client.log().Info("bunnymq: repaired database", "path", db.path, "problems", len(report.Problems), "fixed", fixed)
+	return fixed, nil
+}
+
+// repairProblem fixes p if it is still there.
+func repairProblem(tx Tx, p Problem) (bool, error) {
+	switch p.Kind {
+	case ProblemInvalidProgress:
+		value, err := tx.Get(consumerProgressBucket, p.Key)
+		if err != nil {
+			return false, nil
+		}
+		if _, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return false, nil
+		}
+		return true, tx.Delete(consumerProgressBucket, p.Key)
+	case ProblemProgressAhead:
+		value, err := tx.Get(consumerProgressBucket, p.Key)
+		if err != nil {
+			return false, nil
+		}
+		n, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return false, nil
+		}
+		stats, err := tx.Stats(p.Queue)
+		if err != nil || n <= stats.LastSeq {
+			return false, nil
+		}
+		return true, tx.Put(consumerProgressBucket, p.Key, []byte(strconv.FormatUint(stats.LastSeq, 10)))
+	case ProblemOrphanedProgress:
+		if _, err := tx.Stats(p.Queue); err == nil {
+			return false, nil
+		}
+		if _, err := tx.Get(consumerProgressBucket, p.Key); err != nil {
+			return false, nil
+		}
+		return true, tx.Delete(consumerProgressBucket, p.Key)
+	case ProblemInvalidLease, ProblemStaleLease, ProblemOrphanedLease:
+		value, err := tx.Get(consumerLeaseBucket, p.Key)
+		if err != nil {
+			return false, nil
+		}
+		// 租约在报告之后换过了，说明消费者还在正常工作
+		if seq, _, ok := parseLease(value); ok && p.Kind != ProblemInvalidLease && uint64(seq) != p.Seq {
+			return false, nil
+		}
+		return true, tx.Delete(consumerLeaseBucket, p.Key)
+	case ProblemCounterBehind:
+		stats, err := tx.Stats(p.Queue)
+		if err != nil || stats.LastSeq >= p.Seq {
+			return false, nil
+		}
+		return true, tx.SetSequence(p.Queue, p.Seq)
+	case ProblemBadEnvelope, ProblemBadPayload:
+		seq, value, err := tx.Seek(p.Queue, p.Seq)
+		if err != nil || seq != p.Seq {
+			return false, nil
+		}
+		env, err := decodeEnvelope(value)
+		if err != nil {
+			env = envelope{payload: value}
+		}
+		headers := Headers{}
+		for k, v := range env.headers {
+			headers[k] = v
+		}
+		headers.Set(DeadLetterQueueHeader, p.Queue)
+		headers.Set(DeadLetterSeqHeader, strconv.FormatUint(p.Seq, 10))
+		headers.Set(DeadLetterReasonHeader, p.Kind.String()+": "+p.Detail)
+		moved := encodeEnvelope(envelope{headers: headers, timestamp: env.timestamp, payload: env.payload})
+		if _, err := tx.Append(DeadLetterQueueName(p.Queue), moved); err != nil {
+			return false, err
+		}
+		return true, tx.DeleteRange(p.Queue, p.Seq, p.Seq)
+	}
+	return false, nil
+}
+
+func (s *boltStore) checkLayout(include func(queue string) bool) ([]Problem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrDatabaseClosed
+	}
+	var problems []Problem
+	err := s.db.View(func(tx *bolt.Tx) error {
+		decimal := newBoltTx(tx).decimalKeys
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			queue, ok := strings.CutPrefix(string(name), queueBucketPrefix)
+			if !ok || !include(queue) {
+				return nil
+			}
+			return bucket.ForEach(func(k, v []byte) error {
+				if v == nil {
+					problems = append(problems, Problem{Kind: ProblemBadKey, Queue: queue, Key: string(k), Detail: "nested bucket"})
+				} else if _, ok := parseSeqKey(k, decimal); !ok {
+					problems = append(problems, Problem{Kind: ProblemBadKey, Queue: queue, Key: string(k), Detail: "key " + strconv.Quote(string(k)) + " is not a sequence number"})
+				}
+				return nil
+			})
+		})
+	})
+	return problems, err
+}
@@ -0,0 +1,138 @@
+package bunnymq
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func problemKinds(r *CheckReport) []string {
+	var kinds []string
+	for _, p := range r.Problems {
+		kinds = append(kinds, p.Kind.String())
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func TestCheckAndRepair(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		queue, _ := OpenQueue[testStruct](db, "jobs", &JsonCoder[testStruct]{})
+		for _, m := range []string{"a", "b", "c"} {
+			queue.Enqueue(testStruct{Message: m})
+		}
+		if report, err := db.Check(); err != nil || !report.OK() || report.Queues != 1 || report.Messages != 3 {
+			t.Fatalf("Check of a healthy database = %+v, %v", report, err)
+		}
+
+		// 模拟崩溃后留下的各种问题
+		err = db.client.update(func(tx Tx) error {
+			for bucket, kv := range map[string][][2]string{
+				consumerProgressBucket: {{"bad:jobs", "x"}, {"ahead:jobs", "99"}, {"ghost:gone", "1"}, {"w:jobs", "2"}},
+				consumerLeaseBucket:    {{"w:jobs", "1:1"}, {"junk:jobs", "zz"}},
+			} {
+				for _, e := range kv {
+					if err := tx.Put(bucket, e[0], []byte(e[1])); err != nil {
+						return err
+					}
+				}
+			}
+			if _, err := tx.Append("jobs", []byte{envelopeMagic, 99}); err != nil {
+				return err
+			}
+			_, err := tx.Append("jobs", encodeEnvelope(envelope{payload: []byte("not json")}))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+
+		report, err := db.Check()
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		want := "bad envelope,invalid lease,invalid progress,orphaned progress,progress ahead of queue,stale lease"
+		if got := strings.Join(problemKinds(report), ","); got != want {
+			t.Fatalf("Check found %s, want %s\n%v", got, want, report.Problems)
+		}
+		report, err = queue.Check()
+		if err != nil {
+			t.Fatalf("Queue.Check: %v", err)
+		}
+		want = "bad envelope,bad payload,invalid lease,invalid progress,progress ahead of queue,stale lease"
+		if got := strings.Join(problemKinds(report), ","); got != want {
+			t.Fatalf("Queue.Check found %s, want %s", got, want)
+		}
+
+		if n, err := db.Repair(report); err != nil || n != 6 {
+			t.Fatalf("Repair = %d, %v; want 6", n, err)
+		}
+		if n, err := db.Repair(report); err != nil || n != 0 {
+			t.Errorf("second Repair = %d, %v; want 0", n, err)
+		}
+		if after, _ := queue.Check(); !after.OK() {
+			t.Fatalf("problems left after Repair: %v", after.Problems)
+		}
+		msgs, _ := db.Peek(DeadLetterQueueName("jobs"), 1, 10)
+		if len(msgs) != 2 || msgs[0].Headers.Get(DeadLetterSeqHeader) != "4" || !strings.HasPrefix(msgs[1].Headers.Get(DeadLetterReasonHeader), "bad payload") {
+			t.Fatalf("dead-lettered messages = %+v", msgs)
+		}
+		consumers, _ := db.Consumers("jobs")
+		for _, c := range consumers {
+			if c.ID == "ahead" && c.Progress != 5 {
+				t.Errorf("progress ahead repaired to %d, want 5", c.Progress)
+			}
+			if c.ID == "bad" || c.LeaseSeq != 0 {
+				t.Errorf("consumer state left after Repair: %+v", c)
+			}
+		}
+
+		// 只查 jobs 时看不到别的队列的问题
+		report, _ = db.Check()
+		if n, err := db.Repair(report); err != nil || n != 1 || report.Problems[0].Kind != ProblemOrphanedProgress {
+			t.Fatalf("Repair of orphaned progress = %d, %v (%v)", n, err, report.Problems)
+		}
+	})
+}
+
+func TestCheckBoltLayout(t *testing.T) {
+	db, err := Open(t.TempDir() + "/layout.db")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	queue, _ := OpenQueue[testStruct](db, "jobs", &JsonCoder[testStruct]{})
+	queue.Enqueue(testStruct{Message: "a"})
+	queue.Enqueue(testStruct{Message: "b"})
+	err = db.client.store.(*boltStore).db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queueBucket("jobs"))
+		if err := b.Put([]byte("0x10"), []byte("v")); err != nil {
+			return err
+		}
+		return b.SetSequence(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.Check()
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if got := strings.Join(problemKinds(report), ","); got != "bad key,sequence counter behind" {
+		t.Fatalf("Check found %s: %v", got, report.Problems)
+	}
+	if n, err := db.Repair(report); err != nil || n != 1 {
+		t.Fatalf("Repair = %d, %v; want 1", n, err)
+	}
+	queue.Enqueue(testStruct{Message: "c"})
+	if msgs, _ := db.Peek("jobs", 1, 10); len(msgs) != 3 || msgs[1].Seq != 2 || !strings.Contains(string(msgs[1].Payload), `"b"`) {
+		t.Fatalf("messages after repairing the counter = %+v", msgs)
+	}
+}
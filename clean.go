@@ -1,116 +1,119 @@
 package bunnymq
 
 import (
-	bolt "go.etcd.io/bbolt"
 	"os"
 	"strconv"
 	"time"
-)
-
-func (client *dbClient) isBucketConsumedByAll(tx *bolt.Tx, bucketName string) (bool, error) {
-	progressBucket := tx.Bucket([]byte(consumerProgressBucket))
-	bucket := tx.Bucket([]byte(bucketName))
-	if bucket == nil {
-		return false, ErrBucketNotFound
-	}
 
-	maxKey, _ := bucket.Cursor().Last()
-	maxID, err := strconv.ParseInt(string(maxKey), 10, 64)
-	if err != nil {
-		return false, err
-	}
-
-	consumedByAll := true
+	bolt "go.etcd.io/bbolt"
+)
 
-	// 遍历所有消费者进度
-	cursor := progressBucket.Cursor()
-	for consumerID, progress := cursor.First(); consumerID != nil; consumerID, progress = cursor.Next() {
-		progressInt, err := strconv.ParseInt(string(progress), 10, 64)
-		if err != nil {
-			return false, err
-		}
-		if progressInt < maxID {
-			consumedByAll = false
-			break
+// cleanupAllConsumed removes, from every queue, the messages that all of the
+// queue's consumers have acknowledged and the messages past the queue's
+// retention, then lets the store reclaim the space. A queue nobody has consumed
+// from yet keeps all of its messages.
+func (client *dbClient) cleanupAllConsumed() (err error) {
+	start := time.Now()
+	defer func() {
+		client.finishCleanup(start, err)
+	}()
+
+	var queues []string
+	err = client.update(func(tx Tx) error {
+		var err error
+		if queues, err = tx.Queues(); err != nil {
+			return err
 		}
-	}
-
-	return consumedByAll, nil
-}
-
-func (client *dbClient) cleanupAllConsumed() error {
-	err := client.update(func(tx *bolt.Tx) error {
-		return tx.ForEach(func(bucketName []byte, _ *bolt.Bucket) error {
-			if string(bucketName) == consumerProgressBucket {
-				return nil
+		for _, name := range queues {
+			if retention := client.retentionFor(name); retention > 0 {
+				if err := client.expireQueue(tx, name, time.Now().Add(-retention)); err != nil {
+					return err
+				}
 			}
-			consumedByAll, err := client.isBucketConsumedByAll(tx, string(bucketName))
+			consumed, err := consumedByAll(tx, name)
 			if err != nil {
 				return err
 			}
-
-			if consumedByAll {
-				//如果全部已经消费完毕就删掉整个bucket 创建个新的
-				err = tx.DeleteBucket(bucketName)
-				if err != nil {
-
-					return err
-				}
-				_, err = tx.CreateBucket(bucketName) // 创建一个新的空 bucket
-				if err != nil {
-
-					return err
-				}
-
-			} else {
-				//如果还未完全消费，则只删除当前已消费完成的消息，保留未消费的消息
-				err = client.cleanupBucket(tx, string(bucketName))
-				if err != nil {
+			if consumed > 0 {
+				// 只删除所有消费者都已确认的消息，保留未消费的消息
+				if err := tx.DeleteRange(name, 1, consumed); err != nil {
 					return err
 				}
 			}
-
-			return nil
-		})
+		}
+		return nil
 	})
 
 	if err == nil {
-		err = client.backupAndReopen()
+		client.notifyFreed(queues...)
+		if c, ok := client.store.(compacter); ok {
+			err = c.compact()
+		}
 	}
 	return err
 }
 
-func (client *dbClient) cleanupBucket(tx *bolt.Tx, bucketName string) error {
-	bucket := tx.Bucket([]byte(bucketName))
-	if bucket == nil {
-		return ErrBucketNotFound
-	}
-	cursor := bucket.Cursor()
-	// 仅删除当前消费完成最小的一条消息
-	_, v := cursor.First()
-	if v != nil {
-		if err := bucket.Delete([]byte(v)); err != nil {
-			return ErrFailedToDelete
+// consumedByAll returns the highest sequence number acknowledged by every
+// consumer of the queue, or 0 if the queue has no consumers.
+func consumedByAll(tx Tx, queueName string) (uint64, error) {
+	var (
+		lowest uint64
+		found  bool
+	)
+	err := tx.ForEach(consumerProgressBucket, func(key string, value []byte) error {
+		if _, queue, ok := splitProgressKey(key); !ok || queue != queueName {
+			return nil
 		}
+		progress, err := strconv.ParseUint(string(value), 10, 64)
+		if err != nil {
+			return ErrInvalidProgress
+		}
+		if !found || progress < lowest {
+			lowest, found = progress, true
+		}
+		return nil
+	})
+	return lowest, err
+}
 
+// expireQueue deletes messages enqueued before cutoff. Messages written before
+// envelopes carried a timestamp are kept.
+func (client *dbClient) expireQueue(tx Tx, queueName string, cutoff time.Time) error {
+	var expired []uint64
+	err := tx.Scan(queueName, 0, func(seq uint64, value []byte) bool {
+		env, err := decodeEnvelope(value)
+		if err == nil && !env.timestamp.IsZero() && env.timestamp.Before(cutoff) {
+			expired = append(expired, seq)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, seq := range expired {
+		if err := tx.DeleteRange(queueName, seq, seq); err != nil {
+			return err
+		}
+	}
+	if len(expired) > 0 {
+		client.log().Info("bunnymq: expired messages", "path", client.dbPath, "queue", queueName, "count", len(expired))
 	}
-
 	return nil
 }
 
-func (client *dbClient) rebuildDatabase(backupPath string) error {
+func (s *boltStore) rebuildDatabase(backupPath string) error {
 	var backupDB *bolt.DB
 	var err error
 
-	err = client.db.Update(func(tx *bolt.Tx) error {
-		backupDB, err = client.processBackup(tx, backupPath)
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		backupDB, err = s.processBackup(tx, backupPath)
 		return err
 	})
 
 	if backupDB != nil {
 		defer func() {
 			if cerr := backupDB.Close(); cerr != nil {
-
+				s.log().Warn("bunnymq: closing backup database", "path", backupPath, "err", cerr)
 			}
 		}()
 	}
@@ -118,78 +121,92 @@ func (client *dbClient) rebuildDatabase(backupPath string) error {
 	return err
 }
 
-func (client *dbClient) processBackup(tx *bolt.Tx, backupPath string) (*bolt.DB, error) {
-	backupDB, err := bolt.Open(backupPath, 0600, nil)
+func (s *boltStore) processBackup(tx *bolt.Tx, backupPath string) (*bolt.DB, error) {
+	backupDB, err := bolt.Open(backupPath, s.fileMode, nil)
 	if err != nil {
-
+		s.log().Error("bunnymq: opening backup database", "path", backupPath, "err", err)
 		return nil, ErrOpeningBackupDatabase
 	}
 
 	err = backupDB.View(func(backupTx *bolt.Tx) error {
 		return backupTx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
-			return client.restoreBucket(tx, name, bucket)
+			return s.restoreBucket(tx, name, bucket)
 		})
 	})
 	if err != nil {
-
+		s.log().Error("bunnymq: restoring from backup", "path", backupPath, "err", err)
 		return backupDB, err
 	}
 
 	return backupDB, nil
 }
 
-func (client *dbClient) restoreBucket(tx *bolt.Tx, name []byte, bucket *bolt.Bucket) error {
+func (s *boltStore) restoreBucket(tx *bolt.Tx, name []byte, bucket *bolt.Bucket) error {
 	if bucket == nil {
-
+		s.log().Debug("bunnymq: skipping nil bucket during restore", "bucket", string(name))
 		return nil
 	}
 
 	newBucket, err := tx.CreateBucketIfNotExists(name)
 	if err != nil {
-
+		s.log().Error("bunnymq: recreating bucket during restore", "bucket", string(name), "err", err)
 		return ErrBucketNotFound
 	}
 
-	cursor := bucket.Cursor()
-
-	for k, v := cursor.First(); k != nil && v != nil; k, v = cursor.Next() {
-		if k == nil || v == nil {
-
-			continue
-		}
-		err = newBucket.Put(k, v)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return copyBucket(newBucket, bucket)
 }
 
-func (client *dbClient) deleteBackup(backupPath string) error {
+func (s *boltStore) deleteBackup(backupPath string) error {
 	return os.Remove(backupPath)
 }
 
-func (client *dbClient) backupAndReopen() error {
-	client.db.Close()
-
-	backupPath := client.dbPath + ".bak"
-	if err := os.Rename(client.dbPath, backupPath); err != nil {
+func (s *boltStore) backupAndReopen() error {
+	if err := s.db.Close(); err != nil {
+		s.log().Warn("bunnymq: closing database before compaction", "path", s.path, "err", err)
+	}
 
+	backupPath := s.path + ".bak"
+	if err := os.Rename(s.path, backupPath); err != nil {
+		s.log().Error("bunnymq: renaming database file", "path", s.path, "err", err)
 		return ErrRenamingDatabaseFile
 	}
 
-	db, err := bolt.Open(client.dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	db, err := bolt.Open(s.path, s.fileMode, s.opts)
 	if err != nil {
-		_ = os.Rename(backupPath, client.dbPath)
-
+		s.log().Error("bunnymq: reopening database", "path", s.path, "err", err)
+		if rerr := os.Rename(backupPath, s.path); rerr != nil {
+			s.log().Error("bunnymq: restoring database file", "path", s.path, "err", rerr)
+		}
 		return ErrReopeningDatabase
 	}
 
-	client.db = db
-	err = client.rebuildDatabase(backupPath)
-	defer client.deleteBackup(backupPath)
+	s.db = db
+	err = s.rebuildDatabase(backupPath)
+	if err == nil && db.NoSync {
+		// 删除备份前确保重建的文件已经落盘
+		err = db.Sync()
+	}
 	if err != nil {
+		// 重建失败时保留备份，便于手工恢复
+		s.log().Error("bunnymq: compaction failed, keeping backup", "path", s.path, "backup", backupPath, "err", err)
 		return err
 	}
+	if derr := s.deleteBackup(backupPath); derr != nil {
+		s.log().Warn("bunnymq: deleting backup file", "path", backupPath, "err", derr)
+	}
 	return nil
 }
+
+// finishCleanup logs the outcome of a cleanup run and fires the OnCleanup hook.
+func (client *dbClient) finishCleanup(start time.Time, err error) {
+	elapsed := time.Since(start)
+	if err != nil {
+		client.log().Error("bunnymq: cleanup failed", "path", client.dbPath, "duration", elapsed, "err", err)
+	} else {
+		client.log().Info("bunnymq: cleanup finished", "path", client.dbPath, "duration", elapsed)
+	}
+	client.stateMu.Lock()
+	hooks := client.hooks
+	client.stateMu.Unlock()
+	hooks.cleanup(CleanupEvent{Path: client.dbPath, Duration: elapsed, Err: err})
+}
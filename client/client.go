@@ -0,0 +1,331 @@
+// Package client talks to a bunnymq server over the binary protocol served by
+// server.ServeWire.
+//
+// A Client holds one connection, shared by every queue opened on it. When the
+// connection breaks, the request in flight fails and the next request dials
+// again; subscriptions reconnect by themselves, backing off between attempts.
+// Requests are never resent, so a publish whose response was lost may or may
+// not have been enqueued.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+	"gitlab.cnns/luoying/bunnymq/internal/wire"
+)
+
+// Defaults for the corresponding options.
+const (
+	DefaultDialTimeout = 5 * time.Second
+	DefaultMinBackoff  = 100 * time.Millisecond
+	DefaultMaxBackoff  = 10 * time.Second
+)
+
+// ErrClosed is returned by requests on a closed Client.
+var ErrClosed = errors.New("bunnymq client: closed")
+
+// Client is a connection to a bunnymq server. It is safe for concurrent use.
+type Client struct {
+	network, addr string
+	dialTimeout   time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxFrame      int
+	logger        bunnymq.Logger
+
+	nextID atomic.Uint64
+	done   chan struct{}
+
+	mu     sync.Mutex
+	conn   *conn // nil until dialed and after it breaks
+	closed bool
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithDialTimeout bounds each attempt to connect.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) { c.dialTimeout = d }
+}
+
+// WithBackoff sets the delays between reconnection attempts of
+// subscriptions, doubling from min up to max.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// WithMaxFrameSize sets the largest frame accepted from the server.
+func WithMaxFrameSize(n int) Option {
+	return func(c *Client) { c.maxFrame = n }
+}
+
+// WithLogger sets the logger that receives reconnections and messages that
+// could not be decoded.
+func WithLogger(logger bunnymq.Logger) Option {
+	return func(c *Client) { c.logger = logger }
+}
+
+// Dial connects to the server at addr. network is "tcp" or "unix", as for
+// net.Dial.
+func Dial(network, addr string, opts ...Option) (*Client, error) {
+	c := &Client{
+		network:     network,
+		addr:        addr,
+		dialTimeout: DefaultDialTimeout,
+		minBackoff:  DefaultMinBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		maxFrame:    wire.DefaultMaxFrameSize,
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if _, err := c.connection(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection and ends the subscriptions. Requests in flight
+// fail with ErrClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		return c.conn.nc.Close()
+	}
+	return nil
+}
+
+// connection returns the current connection, dialing a new one if needed.
+func (c *Client) connection() (*conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	nc, err := net.DialTimeout(c.network, c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{
+		nc:      nc,
+		pending: make(map[uint64]chan wire.Frame),
+		streams: make(map[uint64]*inbox),
+		done:    make(chan struct{}),
+	}
+	c.conn = cn
+	go c.read(cn)
+	return cn, nil
+}
+
+// read dispatches the frames of cn until it breaks.
+func (c *Client) read(cn *conn) {
+	var err error
+	for {
+		var f wire.Frame
+		f, err = wire.ReadFrame(cn.nc, c.maxFrame)
+		if err != nil {
+			break
+		}
+		cn.mu.Lock()
+		ch, in := cn.pending[f.ID], cn.streams[f.ID]
+		cn.mu.Unlock()
+		// 读循环是所有请求和订阅共用的，不能等任何一个
+		if in != nil {
+			in.put(f)
+		} else if ch != nil {
+			select {
+			case ch <- f:
+			default:
+			}
+		}
+	}
+	cn.nc.Close()
+	c.mu.Lock()
+	if c.conn == cn {
+		c.conn = nil
+	}
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		err = ErrClosed
+	}
+	cn.mu.Lock()
+	cn.err = err
+	cn.mu.Unlock()
+	close(cn.done)
+}
+
+// conn is one connection to the server. Responses are routed to pending and
+// the frames of subscriptions to streams, by request id.
+type conn struct {
+	nc  net.Conn
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint64]chan wire.Frame
+	streams map[uint64]*inbox
+	err     error // why the connection broke, set before done is closed
+	done    chan struct{}
+}
+
+// open registers a channel for the single response to request id.
+func (cn *conn) open(id uint64) chan wire.Frame {
+	ch := make(chan wire.Frame, 1)
+	cn.mu.Lock()
+	cn.pending[id] = ch
+	cn.mu.Unlock()
+	return ch
+}
+
+// openStream registers an inbox for the frames of subscription id.
+func (cn *conn) openStream(id uint64) *inbox {
+	in := &inbox{ready: make(chan struct{}, 1)}
+	cn.mu.Lock()
+	cn.streams[id] = in
+	cn.mu.Unlock()
+	return in
+}
+
+func (cn *conn) forget(id uint64) {
+	cn.mu.Lock()
+	delete(cn.pending, id)
+	delete(cn.streams, id)
+	cn.mu.Unlock()
+}
+
+func (cn *conn) write(f wire.Frame) error {
+	cn.wmu.Lock()
+	defer cn.wmu.Unlock()
+	if err := wire.WriteFrame(cn.nc, f); err != nil {
+		cn.nc.Close()
+		return err
+	}
+	return nil
+}
+
+// broken returns the error that ended the connection.
+func (cn *conn) broken() error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if errors.Is(cn.err, ErrClosed) {
+		return ErrClosed
+	}
+	return fmt.Errorf("bunnymq client: connection lost: %w", cn.err)
+}
+
+// inbox queues the frames of a subscription without bound. After a NAck the
+// server pushes the rejected messages again while the first copies may still
+// be queued, so no fixed buffer is large enough.
+type inbox struct {
+	mu     sync.Mutex
+	frames []wire.Frame
+	ready  chan struct{} // holds a value while frames may be non-empty
+}
+
+func (in *inbox) put(f wire.Frame) {
+	in.mu.Lock()
+	in.frames = append(in.frames, f)
+	in.mu.Unlock()
+	in.signal()
+}
+
+// take removes and returns the oldest frame, if there is one.
+func (in *inbox) take() (wire.Frame, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.frames) == 0 {
+		return wire.Frame{}, false
+	}
+	f := in.frames[0]
+	in.frames[0] = wire.Frame{}
+	in.frames = in.frames[1:]
+	if len(in.frames) > 0 {
+		in.signal()
+	}
+	return f, true
+}
+
+func (in *inbox) signal() {
+	select {
+	case in.ready <- struct{}{}:
+	default:
+	}
+}
+
+// roundTrip sends a request and waits for its response, turning Error frames
+// into errors.
+func (c *Client) roundTrip(ctx context.Context, typ wire.Type, body []byte) (wire.Frame, error) {
+	cn, err := c.connection()
+	if err != nil {
+		return wire.Frame{}, err
+	}
+	id := c.nextID.Add(1)
+	ch := cn.open(id)
+	defer cn.forget(id)
+	if err := cn.write(wire.Frame{Type: typ, ID: id, Body: body}); err != nil {
+		return wire.Frame{}, err
+	}
+	var f wire.Frame
+	select {
+	case f = <-ch:
+	case <-cn.done:
+		// 响应可能在连接断开前已经到了
+		select {
+		case f = <-ch:
+		default:
+			return wire.Frame{}, cn.broken()
+		}
+	case <-ctx.Done():
+		return wire.Frame{}, ctx.Err()
+	}
+	if f.Type == wire.TypeError {
+		return wire.Frame{}, remoteError(f.Body)
+	}
+	return f, nil
+}
+
+// remoteError turns an Error frame into a *bunnymq.DBError, so that errors.Is
+// matches the predefined bunnymq errors.
+func remoteError(body []byte) error {
+	var e wire.Error
+	if err := e.Decode(body); err != nil {
+		return err
+	}
+	return bunnymq.NewDBError(bunnymq.DBErrorCode(e.Code), errors.New(e.Message), "remote")
+}
+
+// backoff waits before the next reconnection attempt and returns the delay
+// to use after it. It returns false if ctx or the client ends first.
+func (c *Client) backoff(ctx context.Context, delay time.Duration) (time.Duration, bool) {
+	if delay == 0 {
+		delay = c.minBackoff
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return min(2*delay, c.maxBackoff), true
+	case <-ctx.Done():
+		return 0, false
+	case <-c.done:
+		return 0, false
+	}
+}
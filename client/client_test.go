@@ -0,0 +1,330 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+	"gitlab.cnns/luoying/bunnymq/server"
+)
+
+var _ bunnymq.Msg[string] = (*remoteMsg[string])(nil)
+
+type testStruct struct {
+	Message string
+}
+
+// startServer serves db over the wire protocol on addr, or on a fresh port if
+// addr is empty, and returns the address it listens on.
+func startServer(t *testing.T, db *bunnymq.DB, addr string) (*server.Server, string) {
+	t.Helper()
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv := server.New(db)
+	go srv.ServeWire(ln)
+	t.Cleanup(func() { srv.Close() })
+	return srv, ln.Addr().String()
+}
+
+func openDB(t *testing.T) *bunnymq.DB {
+	t.Helper()
+	db, err := bunnymq.Open(filepath.Join(t.TempDir(), "client.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func dial(t *testing.T, addr string, opts ...Option) *Client {
+	t.Helper()
+	c, err := Dial("tcp", addr, opts...)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func receive(t *testing.T, msgs <-chan bunnymq.Msg[testStruct]) bunnymq.Msg[testStruct] {
+	t.Helper()
+	select {
+	case msg, ok := <-msgs:
+		if !ok {
+			t.Fatalf("subscription ended")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message within 5s")
+	}
+	return nil
+}
+
+func expectNothing(t *testing.T, msgs <-chan bunnymq.Msg[testStruct]) {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		t.Fatalf("unexpected message %d", msg.Seq())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRemoteQueue(t *testing.T) {
+	_, addr := startServer(t, openDB(t), "")
+	c := dial(t, addr)
+	q := Open[testStruct](c, "orders", &bunnymq.JsonCoder[testStruct]{})
+	if _, err := q.Dequeue("c"); !errors.Is(err, bunnymq.ErrKeyNotFound) {
+		t.Fatalf("Dequeue from an empty queue: got %v, want ErrKeyNotFound", err)
+	}
+	for _, m := range []string{"a", "b"} {
+		if err := q.Enqueue(testStruct{Message: m}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	msg, err := q.Dequeue("c")
+	if err != nil || msg.Data().Message != "a" || msg.Seq() != 1 {
+		t.Fatalf("Dequeue = %v, %v; want a", msg, err)
+	}
+	if err := msg.NAck(); err != nil {
+		t.Fatalf("NAck: %v", err)
+	}
+	msg, _ = q.Dequeue("c")
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	msg, err = q.Dequeue("c")
+	if err != nil || msg.Data().Message != "b" {
+		t.Fatalf("Dequeue after Ack = %v, %v; want b", msg, err)
+	}
+
+	start := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Enqueue(testStruct{Message: "late"})
+	}()
+	msg.Ack()
+	msg, err = q.DequeueWait(context.Background(), "c", 5*time.Second)
+	if err != nil || msg.Data().Message != "late" {
+		t.Fatalf("DequeueWait = %v, %v; want late", msg, err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("DequeueWait was not woken by the enqueue, took %v", elapsed)
+	}
+
+	reserved := Open[testStruct](c, "_meta", &bunnymq.JsonCoder[testStruct]{})
+	if err := reserved.Enqueue(testStruct{}); !errors.Is(err, bunnymq.ErrReservedQueueName) {
+		t.Errorf("Enqueue on a reserved name: got %v, want ErrReservedQueueName", err)
+	}
+	q.Close()
+	if err := q.Enqueue(testStruct{}); !errors.Is(err, bunnymq.ErrDatabaseClosed) {
+		t.Errorf("Enqueue after Close: got %v, want ErrDatabaseClosed", err)
+	}
+}
+
+func TestRemoteFilter(t *testing.T) {
+	db := openDB(t)
+	_, addr := startServer(t, db, "")
+	c := dial(t, addr)
+	q := Open[testStruct](c, "events", &bunnymq.JsonCoder[testStruct]{})
+	ctx := context.Background()
+	for i, kind := range []string{"click", "view", "click", "view"} {
+		if err := q.EnqueueWithHeaders(ctx, testStruct{Message: kind}, bunnymq.Headers{"kind": kind, "n": string(rune('1' + i))}); err != nil {
+			t.Fatalf("EnqueueWithHeaders: %v", err)
+		}
+	}
+
+	views := bunnymq.MustParseFilter("kind == view")
+	msg, err := q.DequeueFilter(ctx, "d", views, 0)
+	if err != nil || msg.Seq() != 2 || msg.Headers().Get("n") != "2" {
+		t.Fatalf("DequeueFilter = %v, %v; want seq 2", msg, err)
+	}
+	msg.Ack()
+
+	msgs, err := q.SubscribeFilter(ctx, "s", bunnymq.MustParseFilter(`kind == click && n != "1"`), 4)
+	if err != nil {
+		t.Fatalf("SubscribeFilter: %v", err)
+	}
+	if msg := receive(t, msgs); msg.Seq() != 3 || msg.Data().Message != "click" {
+		t.Fatalf("SubscribeFilter delivered seq %d, want 3", msg.Seq())
+	}
+	expectNothing(t, msgs)
+	q.EnqueueWithHeaders(ctx, testStruct{Message: "click"}, bunnymq.Headers{"kind": "click"})
+	msg = receive(t, msgs)
+	if msg.Seq() != 5 {
+		t.Fatalf("SubscribeFilter delivered seq %d, want 5", msg.Seq())
+	}
+	q.Enqueue(testStruct{Message: "no headers"})
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	// 确认之后，后面被过滤掉的消息也算消费了，不再挡着清理
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		consumers, _ := db.Consumers("events")
+		if len(consumers) == 2 && consumers[1].ID == "s" && consumers[1].Progress == 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consumers = %+v, want s at progress 6", consumers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscribeFlowControl(t *testing.T) {
+	db := openDB(t)
+	_, addr := startServer(t, db, "")
+	c := dial(t, addr)
+	q := Open[testStruct](c, "jobs", &bunnymq.JsonCoder[testStruct]{})
+	for _, m := range []string{"1", "2", "3", "4"} {
+		q.Enqueue(testStruct{Message: m})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs, err := q.Subscribe(ctx, "worker", 2)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	first, second := receive(t, msgs), receive(t, msgs)
+	if first.Data().Message != "1" || second.Data().Message != "2" {
+		t.Fatalf("got %q and %q, want 1 and 2", first.Data().Message, second.Data().Message)
+	}
+	// 窗口满了，确认一条才放一条
+	expectNothing(t, msgs)
+	if err := first.Ack(); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if msg := receive(t, msgs); msg.Data().Message != "3" {
+		t.Fatalf("after Ack got %q, want 3", msg.Data().Message)
+	}
+	expectNothing(t, msgs)
+
+	// 拒绝 2 会把 2 和之后发出的消息重发一遍
+	if err := second.NAck(); err != nil {
+		t.Fatalf("NAck: %v", err)
+	}
+	again := receive(t, msgs)
+	if again.Data().Message != "2" {
+		t.Fatalf("after NAck got %q, want 2 again", again.Data().Message)
+	}
+	if msg := receive(t, msgs); msg.Data().Message != "3" {
+		t.Fatalf("after NAck got %q, want 3 again", msg.Data().Message)
+	}
+	again.Ack()
+	if msg := receive(t, msgs); msg.Data().Message != "4" {
+		t.Fatalf("got %q, want 4", msg.Data().Message)
+	}
+
+	q.Enqueue(testStruct{Message: "5"})
+	expectNothing(t, msgs)
+	cancel()
+	for range msgs {
+	}
+}
+
+func TestNAckWithFullWindow(t *testing.T) {
+	db := openDB(t)
+	_, addr := startServer(t, db, "")
+	c := dial(t, addr)
+	q := Open[testStruct](c, "jobs", &bunnymq.JsonCoder[testStruct]{})
+	for i := 0; i < 20; i++ {
+		q.Enqueue(testStruct{Message: "m"})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs, err := q.Subscribe(ctx, "worker", 8)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	first := receive(t, msgs)
+	// 等窗口里的消息都到客户端，重发的消息比窗口还多
+	time.Sleep(200 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- first.NAck() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("NAck: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("NAck did not return within 5s")
+	}
+	// 连接上的其他请求也不能被这个订阅卡住
+	enqueueCtx, enqueueCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer enqueueCancel()
+	if err := q.EnqueueContext(enqueueCtx, testStruct{Message: "late"}); err != nil {
+		t.Fatalf("Enqueue after NAck: %v", err)
+	}
+	for i := 0; ; i++ {
+		if i == 20 {
+			t.Fatalf("message %d was not pushed again", first.Seq())
+		}
+		if msg := receive(t, msgs); msg.Seq() == first.Seq() {
+			break
+		}
+	}
+	cancel()
+	for range msgs {
+	}
+}
+
+func TestSubscribeReconnects(t *testing.T) {
+	db := openDB(t)
+	srv, addr := startServer(t, db, "")
+	c := dial(t, addr, WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+	q := Open[testStruct](c, "events", &bunnymq.JsonCoder[testStruct]{})
+	q.Enqueue(testStruct{Message: "before"})
+	msgs, err := q.Subscribe(context.Background(), "c", 4)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer q.Close()
+	msg := receive(t, msgs)
+	if msg.Data().Message != "before" {
+		t.Fatalf("got %q, want before", msg.Data().Message)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	srv.Close()
+	if err := q.Enqueue(testStruct{}); err == nil {
+		t.Fatalf("Enqueue succeeded with the server down")
+	}
+	local, err := bunnymq.OpenQueue[testStruct](db, "events", &bunnymq.JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("OpenQueue: %v", err)
+	}
+	defer local.Close()
+	local.Enqueue(testStruct{Message: "while down"})
+	startServer(t, db, addr)
+
+	if msg := receive(t, msgs); msg.Data().Message != "while down" {
+		t.Fatalf("after reconnecting got %q, want while down", msg.Data().Message)
+	}
+	if err := q.Enqueue(testStruct{Message: "after"}); err != nil {
+		t.Fatalf("Enqueue after the server came back: %v", err)
+	}
+	if msg := receive(t, msgs); msg.Data().Message != "after" {
+		t.Fatalf("got %q, want after", msg.Data().Message)
+	}
+
+	q.Close()
+	select {
+	case _, ok := <-msgs:
+		if ok {
+			t.Fatalf("message delivered after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("subscription not ended by Close")
+	}
+}
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+	"gitlab.cnns/luoying/bunnymq/internal/wire"
+)
+
+// RemoteQueue is a queue on a bunnymq server. Like bunnymq.Queue it is a
+// bunnymq.ProducerConsumer, so code written against those interfaces works
+// with either.
+type RemoteQueue[T any] struct {
+	c     *Client
+	name  string
+	coder bunnymq.Coder[T]
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var _ bunnymq.ProducerConsumer[struct{}] = (*RemoteQueue[struct{}])(nil)
+
+// Open returns the queue called name on the server c is connected to. The
+// queue is created on the server when first used.
+func Open[T any](c *Client, name string, coder bunnymq.Coder[T]) *RemoteQueue[T] {
+	return &RemoteQueue[T]{c: c, name: name, coder: coder, done: make(chan struct{})}
+}
+
+// Name returns the name of the queue.
+func (q *RemoteQueue[T]) Name() string {
+	return q.name
+}
+
+// Close ends the subscriptions of the queue. It does not close the Client.
+func (q *RemoteQueue[T]) Close() error {
+	q.closeOnce.Do(func() { close(q.done) })
+	return nil
+}
+
+func (q *RemoteQueue[T]) checkOpen() error {
+	select {
+	case <-q.done:
+		return bunnymq.ErrDatabaseClosed
+	default:
+		return nil
+	}
+}
+
+// Enqueue adds a new item to the queue.
+func (q *RemoteQueue[T]) Enqueue(data T) error {
+	return q.EnqueueContext(context.Background(), data)
+}
+
+// EnqueueContext adds a new item to the queue, giving up when ctx is done.
+// An item whose response did not arrive may still have been enqueued.
+func (q *RemoteQueue[T]) EnqueueContext(ctx context.Context, data T) error {
+	return q.EnqueueWithHeaders(ctx, data, nil)
+}
+
+// EnqueueWithHeaders is like EnqueueContext but stores headers with the
+// message, as Queue.EnqueueWithHeaders does.
+func (q *RemoteQueue[T]) EnqueueWithHeaders(ctx context.Context, data T, headers bunnymq.Headers) error {
+	if err := q.checkOpen(); err != nil {
+		return err
+	}
+	body, err := q.coder.Encode(data)
+	if err != nil {
+		return err
+	}
+	_, err = q.c.roundTrip(ctx, wire.TypePublish, wire.Publish{Queue: q.name, Body: body, Headers: headers}.Append(nil))
+	return err
+}
+
+// Dequeue returns the next message of consumerID, like Queue.Dequeue. It
+// returns bunnymq.ErrKeyNotFound if there is none.
+func (q *RemoteQueue[T]) Dequeue(consumerID string) (bunnymq.Msg[T], error) {
+	return q.DequeueWait(context.Background(), consumerID, 0)
+}
+
+// DequeueWait is like Dequeue but waits up to wait for a message to be
+// enqueued. The server may cap wait.
+func (q *RemoteQueue[T]) DequeueWait(ctx context.Context, consumerID string, wait time.Duration) (bunnymq.Msg[T], error) {
+	return q.DequeueFilter(ctx, consumerID, nil, wait)
+}
+
+// DequeueFilter is like DequeueWait but skips the messages whose headers do
+// not pass filter, as Queue.DequeueFilter does. The filter is evaluated by the
+// server, so skipped messages are not sent.
+func (q *RemoteQueue[T]) DequeueFilter(ctx context.Context, consumerID string, filter *bunnymq.Filter, wait time.Duration) (bunnymq.Msg[T], error) {
+	if err := q.checkOpen(); err != nil {
+		return nil, err
+	}
+	req := wire.Fetch{Queue: q.name, Consumer: consumerID, Wait: wait, Filter: filter.String()}
+	f, err := q.c.roundTrip(ctx, wire.TypeFetch, req.Append(nil))
+	if err != nil {
+		return nil, err
+	}
+	if f.Type == wire.TypeEmpty {
+		return nil, bunnymq.ErrKeyNotFound
+	}
+	return q.decode(consumerID, f.Body)
+}
+
+func (q *RemoteQueue[T]) decode(consumerID string, body []byte) (*remoteMsg[T], error) {
+	var m wire.Message
+	if err := m.Decode(body); err != nil {
+		return nil, err
+	}
+	data, err := q.coder.Decode(m.Body)
+	if err != nil {
+		return nil, bunnymq.NewDBError(bunnymq.CodeFailedToDeserialize, err, q.name)
+	}
+	return &remoteMsg[T]{q: q, consumerID: consumerID, seq: m.Seq, headers: m.Headers, data: data}, nil
+}
+
+// Subscribe streams the messages of consumerID on the returned channel,
+// starting after the last acknowledged one. At most maxInFlight messages are
+// delivered without being acknowledged or rejected; acknowledge them in
+// order, since acknowledging a message acknowledges every earlier one.
+// Rejecting a message redelivers it and every message delivered after it.
+//
+// If the connection breaks, the subscription reconnects and starts again
+// after the last acknowledged message, so unacknowledged messages are
+// delivered again. A message that cannot be decoded is logged and skipped; it
+// keeps its in-flight slot until the subscription reconnects. The channel is
+// closed when ctx is done or the queue or client is closed.
+func (q *RemoteQueue[T]) Subscribe(ctx context.Context, consumerID string, maxInFlight int) (<-chan bunnymq.Msg[T], error) {
+	return q.SubscribeFilter(ctx, consumerID, nil, maxInFlight)
+}
+
+// SubscribeFilter is like Subscribe but only delivers the messages whose
+// headers pass filter. The others count as consumed by consumerID.
+func (q *RemoteQueue[T]) SubscribeFilter(ctx context.Context, consumerID string, filter *bunnymq.Filter, maxInFlight int) (<-chan bunnymq.Msg[T], error) {
+	if maxInFlight <= 0 {
+		return nil, bunnymq.NewDBError(bunnymq.CodeInvalidOption, errors.New("max in-flight must be positive"), "Subscribe")
+	}
+	if err := q.checkOpen(); err != nil {
+		return nil, err
+	}
+	req := wire.Subscribe{Queue: q.name, Consumer: consumerID, MaxInFlight: uint64(maxInFlight), Filter: filter.String()}
+	st, err := q.subscribe(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-q.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	out := make(chan bunnymq.Msg[T])
+	go func() {
+		defer cancel()
+		q.run(ctx, req, st, out)
+	}()
+	return out, nil
+}
+
+// stream is a subscription on one connection.
+type stream struct {
+	cn     *conn
+	id     uint64
+	frames *inbox
+}
+
+// subscribe sends a Subscribe request and waits for the server to accept it.
+func (q *RemoteQueue[T]) subscribe(req wire.Subscribe) (*stream, error) {
+	cn, err := q.c.connection()
+	if err != nil {
+		return nil, err
+	}
+	st := &stream{cn: cn, id: q.c.nextID.Add(1)}
+	st.frames = cn.openStream(st.id)
+	if err := cn.write(wire.Frame{Type: wire.TypeSubscribe, ID: st.id, Body: req.Append(nil)}); err != nil {
+		cn.forget(st.id)
+		return nil, err
+	}
+	f, ok := st.frames.take()
+	for !ok {
+		select {
+		case <-st.frames.ready:
+			f, ok = st.frames.take()
+		case <-cn.done:
+			cn.forget(st.id)
+			return nil, cn.broken()
+		}
+	}
+	if f.Type == wire.TypeError {
+		cn.forget(st.id)
+		return nil, remoteError(f.Body)
+	}
+	return st, nil
+}
+
+// run delivers the messages of st to out, subscribing again whenever the
+// connection breaks, until ctx is done.
+func (q *RemoteQueue[T]) run(ctx context.Context, req wire.Subscribe, st *stream, out chan<- bunnymq.Msg[T]) {
+	defer close(out)
+	consumerID := req.Consumer
+	var delay time.Duration
+	for {
+		if st != nil {
+			delay = 0
+			err := q.pump(ctx, consumerID, st, out)
+			st.cn.forget(st.id)
+			if err == nil {
+				// 尽力通知服务端，连接断了也无所谓
+				st.cn.write(wire.Frame{Type: wire.TypeUnsubscribe, ID: st.id})
+				return
+			}
+			q.c.warn("bunnymq client: subscription interrupted", "queue", q.name, "consumer", consumerID, "err", err)
+			st = nil
+		}
+		var ok bool
+		if delay, ok = q.c.backoff(ctx, delay); !ok {
+			return
+		}
+		var err error
+		if st, err = q.subscribe(req); err != nil {
+			q.c.warn("bunnymq client: resubscribe failed", "queue", q.name, "consumer", consumerID, "err", err)
+			continue
+		}
+		q.c.info("bunnymq client: resubscribed", "queue", q.name, "consumer", consumerID)
+	}
+}
+
+// pump forwards the messages of st to out. It returns nil when ctx is done
+// and the reason otherwise.
+func (q *RemoteQueue[T]) pump(ctx context.Context, consumerID string, st *stream, out chan<- bunnymq.Msg[T]) error {
+	for {
+		f, ok := st.frames.take()
+		if !ok {
+			select {
+			case <-st.frames.ready:
+				continue
+			case <-st.cn.done:
+				return st.cn.broken()
+			case <-ctx.Done():
+				return nil
+			case <-q.c.done:
+				return nil
+			}
+		}
+		if f.Type == wire.TypeError {
+			return remoteError(f.Body)
+		}
+		if f.Type != wire.TypeMessage {
+			continue
+		}
+		msg, err := q.decode(consumerID, f.Body)
+		if err != nil {
+			q.c.warn("bunnymq client: skipping message", "queue", q.name, "consumer", consumerID, "err", err)
+			continue
+		}
+		select {
+		case out <- msg:
+		case <-ctx.Done():
+			return nil
+		case <-q.c.done:
+			return nil
+		}
+	}
+}
+
+// remoteMsg is a message received from the server. Ack and NAck are sent to
+// the server right away.
+type remoteMsg[T any] struct {
+	q          *RemoteQueue[T]
+	consumerID string
+	seq        uint64
+	headers    bunnymq.Headers
+	data       T
+}
+
+func (m *remoteMsg[T]) Ack() error {
+	return m.settle(wire.TypeAck)
+}
+
+func (m *remoteMsg[T]) NAck() error {
+	return m.settle(wire.TypeNack)
+}
+
+func (m *remoteMsg[T]) settle(typ wire.Type) error {
+	req := wire.Settle{Queue: m.q.name, Consumer: m.consumerID, Seq: m.seq}
+	_, err := m.q.c.roundTrip(context.Background(), typ, req.Append(nil))
+	return err
+}
+
+func (m *remoteMsg[T]) Data() T {
+	return m.data
+}
+
+func (m *remoteMsg[T]) Seq() uint64 {
+	return m.seq
+}
+
+func (m *remoteMsg[T]) Headers() bunnymq.Headers {
+	return m.headers
+}
+
+// Context returns context.Background: trace context is not extracted on the
+// client side.
+func (m *remoteMsg[T]) Context() context.Context {
+	return context.Background()
+}
+
+func (c *Client) warn(msg string, args ...any) {
+	if c.logger != nil {
+		c.logger.Warn(msg, args...)
+	}
+}
+
+func (c *Client) info(msg string, args ...any) {
+	if c.logger != nil {
+		c.logger.Info(msg, args...)
+	}
+}
@@ -0,0 +1,428 @@
+// Command bunnymqctl inspects and repairs bunnymq databases.
+//
+// Usage:
+//
+//	bunnymqctl [-db ggb.db] [-segment-log] [-readonly] <command> [arguments]
+//
+// Commands:
+//
+//	queues                                  list the queues
+//	stats <queue>                           message counts and sequence numbers
+//	consumers <queue>                       progress and delivery counts of the consumers
+//	peek <queue> [-from seq] [-n N]         show messages without consuming them
+//	seek [-queue q] <consumer> <seq>        make seq the consumer's next message
+//	purge <queue>                           remove every message of the queue
+//	compact                                 remove consumed messages and reclaim space
+//	dlq replay <queue> [-n N]               move dead letters back to the queue
+//	export <queue> [-o file]                dump the queue as JSON Lines
+//	import <queue> [file]                   load a dump into the queue, from stdin without file
+//	check [-repair]                         look for inconsistencies, and fix what can be fixed
+//
+// The database must not be open in another process. To inspect a database
+// that is in use, run against a copy of it with -readonly.
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"gitlab.cnns/luoying/bunnymq"
+)
+
+// errUsage is returned for a malformed command line; the usage has been
+// printed already.
+var errUsage = errors.New("usage")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "bunnymqctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("bunnymqctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		dbPath     = fs.String("db", "ggb.db", "database file, or directory with -segment-log")
+		segmentLog = fs.Bool("segment-log", false, "the database is a segment log directory")
+		readOnly   = fs.Bool("readonly", false, "open the database read-only")
+	)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: bunnymqctl [flags] queues|stats|consumers|peek|seek|purge|compact|dlq replay|export|import|check ...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	opts := []bunnymq.Option{bunnymq.WithOpenTimeout(time.Second)}
+	if *segmentLog {
+		opts = append(opts, bunnymq.WithSegmentLog())
+	}
+	if *readOnly {
+		opts = append(opts, bunnymq.WithReadOnly())
+	}
+	// 打开前确认文件存在，避免把拼错的路径建成一个空库
+	if _, err := os.Stat(*dbPath); err != nil {
+		return err
+	}
+	db, err := bunnymq.Open(*dbPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	c := &command{db: db, in: stdin, out: stdout, errOut: stderr}
+	name, rest := fs.Arg(0), fs.Args()[1:]
+	switch name {
+	case "queues":
+		return c.queues(rest)
+	case "stats":
+		return c.stats(rest)
+	case "consumers":
+		return c.consumers(rest)
+	case "peek":
+		return c.peek(rest)
+	case "seek":
+		return c.seek(rest)
+	case "purge":
+		return c.purge(rest)
+	case "compact":
+		return c.compact(rest)
+	case "dlq":
+		if len(rest) > 0 && rest[0] == "replay" {
+			return c.replay(rest[1:])
+		}
+	case "export":
+		return c.export(rest)
+	case "import":
+		return c.importDump(rest)
+	case "check":
+		return c.check(rest)
+	}
+	fs.Usage()
+	return errUsage
+}
+
+type command struct {
+	db     *bunnymq.DB
+	in     io.Reader
+	out    io.Writer
+	errOut io.Writer
+}
+
+// parse parses the flags of a command, which may come before or after its
+// arguments, and checks the number of arguments unless nargs is negative.
+func (c *command) parse(fs *flag.FlagSet, args []string, usage string, nargs int) ([]string, error) {
+	fs.SetOutput(c.errOut)
+	fs.Usage = func() {
+		fmt.Fprintln(c.errOut, "usage: bunnymqctl", usage)
+		fs.PrintDefaults()
+	}
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if nargs >= 0 && len(positional) != nargs {
+		fs.Usage()
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+func (c *command) queues(args []string) error {
+	if _, err := c.parse(flag.NewFlagSet("queues", flag.ContinueOnError), args, "queues", 0); err != nil {
+		return err
+	}
+	names, err := c.db.ListQueues()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintln(c.out, name)
+	}
+	return nil
+}
+
+func (c *command) stats(args []string) error {
+	pos, err := c.parse(flag.NewFlagSet("stats", flag.ContinueOnError), args, "stats <queue>", 1)
+	if err != nil {
+		return err
+	}
+	stats, err := c.db.Stats()
+	if err != nil {
+		return err
+	}
+	qs, ok := stats.Queues[pos[0]]
+	if !ok {
+		return fmt.Errorf("queue %q: %w", pos[0], bunnymq.ErrBucketNotFound)
+	}
+	fmt.Fprintf(c.out, "messages\t%d\nfirst seq\t%d\nlast seq\t%d\n", qs.Count, qs.FirstSeq, qs.LastSeq)
+	return nil
+}
+
+func (c *command) consumers(args []string) error {
+	pos, err := c.parse(flag.NewFlagSet("consumers", flag.ContinueOnError), args, "consumers <queue>", 1)
+	if err != nil {
+		return err
+	}
+	consumers, err := c.db.Consumers(pos[0])
+	if err != nil {
+		return err
+	}
+	var last uint64
+	if stats, err := c.db.Stats(); err == nil {
+		last = stats.Queues[pos[0]].LastSeq
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONSUMER\tPROGRESS\tLAG\tDELIVERING\tDELIVERIES")
+	for _, cs := range consumers {
+		lag := uint64(0)
+		if last > cs.Progress {
+			lag = last - cs.Progress
+		}
+		delivering := "-"
+		if cs.LeaseSeq > 0 {
+			delivering = strconv.FormatUint(cs.LeaseSeq, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\n", cs.ID, cs.Progress, lag, delivering, cs.Deliveries)
+	}
+	return tw.Flush()
+}
+
+func (c *command) peek(args []string) error {
+	fs := flag.NewFlagSet("peek", flag.ContinueOnError)
+	from := fs.Uint64("from", 1, "first sequence number to show")
+	n := fs.Int("n", 10, "number of messages to show")
+	pos, err := c.parse(fs, args, "peek <queue> [-from seq] [-n N]", 1)
+	if err != nil {
+		return err
+	}
+	msgs, err := c.db.Peek(pos[0], *from, *n)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		fmt.Fprintf(c.out, "seq %d", msg.Seq)
+		if !msg.Time.IsZero() {
+			fmt.Fprintf(c.out, "  %s", msg.Time.Format(time.RFC3339Nano))
+		}
+		fmt.Fprintln(c.out)
+		for _, k := range msg.Headers.Keys() {
+			fmt.Fprintf(c.out, "  %s: %s\n", k, msg.Headers.Get(k))
+		}
+		fmt.Fprintf(c.out, "  %s\n", printable(msg.Payload))
+	}
+	return nil
+}
+
+// printable returns the payload as text, or base64 if it is not UTF-8.
+func printable(payload []byte) string {
+	if utf8.Valid(payload) {
+		return strings.ReplaceAll(string(payload), "\n", "\n  ")
+	}
+	return "base64:" + base64.StdEncoding.EncodeToString(payload)
+}
+
+func (c *command) seek(args []string) error {
+	fs := flag.NewFlagSet("seek", flag.ContinueOnError)
+	queue := fs.String("queue", "", "queue of the consumer; may be omitted if the consumer reads only one queue")
+	pos, err := c.parse(fs, args, "seek [-queue q] <consumer> <seq>", 2)
+	if err != nil {
+		return err
+	}
+	consumer := pos[0]
+	seq, err := strconv.ParseUint(pos[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sequence number %q", pos[1])
+	}
+	if *queue == "" {
+		if *queue, err = c.queueOf(consumer); err != nil {
+			return err
+		}
+	}
+	if err := c.db.Seek(*queue, consumer, seq); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "%s on %s will resume at seq %d\n", consumer, *queue, seq)
+	return nil
+}
+
+// queueOf returns the only queue consumer has state on.
+func (c *command) queueOf(consumer string) (string, error) {
+	names, err := c.db.ListQueues()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, name := range names {
+		consumers, err := c.db.Consumers(name)
+		if err != nil {
+			return "", err
+		}
+		for _, cs := range consumers {
+			if cs.ID == consumer {
+				found = append(found, name)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("consumer %q has no progress on any queue; pass -queue", consumer)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("consumer %q reads %s; pass -queue", consumer, strings.Join(found, ", "))
+}
+
+func (c *command) purge(args []string) error {
+	pos, err := c.parse(flag.NewFlagSet("purge", flag.ContinueOnError), args, "purge <queue>", 1)
+	if err != nil {
+		return err
+	}
+	n, err := c.db.Purge(pos[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "removed %d messages from %s\n", n, pos[0])
+	return nil
+}
+
+func (c *command) compact(args []string) error {
+	if _, err := c.parse(flag.NewFlagSet("compact", flag.ContinueOnError), args, "compact", 0); err != nil {
+		return err
+	}
+	return c.db.Clean()
+}
+
+func (c *command) replay(args []string) error {
+	fs := flag.NewFlagSet("dlq replay", flag.ContinueOnError)
+	n := fs.Int("n", 0, "number of messages to replay, 0 for all")
+	pos, err := c.parse(fs, args, "dlq replay <queue> [-n N]", 1)
+	if err != nil {
+		return err
+	}
+	moved, err := c.db.ReplayDeadLetters(pos[0], *n)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "replayed %d messages from %s to %s\n", moved, bunnymq.DeadLetterQueueName(pos[0]), pos[0])
+	return nil
+}
+
+func (c *command) export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "", "write the dump to this file instead of stdout")
+	pos, err := c.parse(fs, args, "export <queue> [-o file]", 1)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return c.db.Export(pos[0], c.out)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := c.db.Export(pos[0], f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *command) importDump(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	pos, err := c.parse(fs, args, "import <queue> [file]", -1)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 && len(pos) != 2 {
+		fs.Usage()
+		return errUsage
+	}
+	in := c.in
+	if len(pos) == 2 && pos[1] != "-" {
+		f, err := os.Open(pos[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	before, err := c.lastSeq(pos[0])
+	if err != nil {
+		return err
+	}
+	if err := c.db.Import(pos[0], in); err != nil {
+		return err
+	}
+	after, err := c.lastSeq(pos[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "imported into %s, last seq %d -> %d\n", pos[0], before, after)
+	return nil
+}
+
+// lastSeq returns the sequence counter of the queue, 0 if it does not exist.
+func (c *command) lastSeq(queue string) (uint64, error) {
+	stats, err := c.db.Stats()
+	if err != nil {
+		return 0, err
+	}
+	return stats.Queues[queue].LastSeq, nil
+}
+
+func (c *command) check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "fix the problems that can be fixed safely")
+	if _, err := c.parse(fs, args, "check [-repair]", 0); err != nil {
+		return err
+	}
+	report, err := c.db.Check()
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintln(c.out, p)
+	}
+	fmt.Fprintf(c.out, "checked %d queues, %d messages: %d problems\n", report.Queues, report.Messages, len(report.Problems))
+	if *repair && !report.OK() {
+		fixed, err := c.db.Repair(report)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "repaired %d problems\n", fixed)
+		if report, err = c.db.Check(); err != nil {
+			return err
+		}
+	}
+	if !report.OK() {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.cnns/luoying/bunnymq"
+)
+
+func ctl(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	return ctlStdin(t, "", args...)
+}
+
+func ctlStdin(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	err := run(args, strings.NewReader(stdin), &out, &errOut)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "ctl.db")
+	queue, err := bunnymq.NewQueue[string]("orders", dbPath, &bunnymq.JsonCoder[string]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	for _, m := range []string{"a", "b", "c"} {
+		queue.Enqueue(m)
+	}
+	msg, _ := queue.Dequeue("worker")
+	msg.Ack()
+	queue.Close()
+
+	if out, err := ctl(t, "-db", dbPath, "queues"); err != nil || out != "orders\n" {
+		t.Fatalf("queues = %q, %v", out, err)
+	}
+	if out, err := ctl(t, "-db", dbPath, "-readonly", "stats", "orders"); err != nil || !strings.Contains(out, "messages\t3") {
+		t.Fatalf("stats = %q, %v", out, err)
+	}
+	if out, err := ctl(t, "-db", dbPath, "consumers", "orders"); err != nil || !strings.Contains(out, "worker    1         2") {
+		t.Fatalf("consumers = %q, %v", out, err)
+	}
+	out, err := ctl(t, "-db", dbPath, "peek", "orders", "-from", "2", "-n", "1")
+	if err != nil || !strings.HasPrefix(out, "seq 2") || !strings.Contains(out, `"b"`) || strings.Contains(out, `"c"`) {
+		t.Fatalf("peek = %q, %v", out, err)
+	}
+
+	// 没有 -queue 时按消费者所在的唯一队列处理
+	if out, err := ctl(t, "-db", dbPath, "seek", "worker", "3"); err != nil || !strings.Contains(out, "on orders") {
+		t.Fatalf("seek = %q, %v", out, err)
+	}
+	if _, err := ctl(t, "-db", dbPath, "seek", "nobody", "3"); err == nil {
+		t.Errorf("seek of an unknown consumer without -queue succeeded")
+	}
+	if _, err := ctl(t, "-db", dbPath, "-readonly", "purge", "orders"); !errors.Is(err, bunnymq.ErrReadOnly) {
+		t.Errorf("purge -readonly: got %v, want ErrReadOnly", err)
+	}
+	if out, err := ctl(t, "-db", dbPath, "purge", "orders"); err != nil || out != "removed 3 messages from orders\n" {
+		t.Fatalf("purge = %q, %v", out, err)
+	}
+	if _, err := ctl(t, "-db", dbPath, "compact"); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if _, err := ctl(t, "-db", dbPath, "dlq", "replay", "orders"); !errors.Is(err, bunnymq.ErrBucketNotFound) {
+		t.Errorf("dlq replay without a dead-letter queue: got %v, want ErrBucketNotFound", err)
+	}
+
+	for _, args := range [][]string{{"-db", dbPath}, {"-db", dbPath, "stats"}, {"-db", dbPath, "dlq"}, {"-db", dbPath, "frobnicate"}} {
+		if _, err := ctl(t, args...); !errors.Is(err, errUsage) {
+			t.Errorf("%v: got %v, want a usage error", args, err)
+		}
+	}
+	if _, err := ctl(t, "-db", filepath.Join(t.TempDir(), "typo.db"), "queues"); err == nil {
+		t.Errorf("opening a missing database succeeded")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.db"), filepath.Join(dir, "dst.db")
+	queue, err := bunnymq.NewQueue[string]("orders", src, &bunnymq.JsonCoder[string]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	queue.Enqueue("a")
+	queue.Enqueue("b")
+	msg, _ := queue.Dequeue("worker")
+	msg.Ack()
+	queue.Close()
+
+	dump, err := ctl(t, "-db", src, "export", "orders")
+	if err != nil || !strings.Contains(dump, `"payload":"b"`) {
+		t.Fatalf("export = %q, %v", dump, err)
+	}
+	if _, err := ctl(t, "-db", src, "export", "orders", "-o", filepath.Join(dir, "orders.jsonl")); err != nil {
+		t.Fatalf("export -o: %v", err)
+	}
+
+	// 目标库要先存在
+	empty, _ := bunnymq.Open(dst)
+	empty.Close()
+	if out, err := ctlStdin(t, dump, "-db", dst, "import", "orders"); err != nil || out != "imported into orders, last seq 0 -> 2\n" {
+		t.Fatalf("import = %q, %v", out, err)
+	}
+	if out, err := ctl(t, "-db", dst, "import", "orders", filepath.Join(dir, "orders.jsonl")); err != nil || out != "imported into orders, last seq 2 -> 4\n" {
+		t.Fatalf("import of a file = %q, %v", out, err)
+	}
+	if out, err := ctl(t, "-db", dst, "consumers", "orders"); err != nil || !strings.Contains(out, "worker    3") {
+		t.Fatalf("consumers after import = %q, %v", out, err)
+	}
+	if _, err := ctl(t, "-db", dst, "import"); !errors.Is(err, errUsage) {
+		t.Errorf("import without a queue: got %v, want a usage error", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "check.db")
+	queue, err := bunnymq.NewQueue[string]("orders", dbPath, &bunnymq.JsonCoder[string]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	queue.Enqueue("a")
+	queue.Close()
+	if out, err := ctl(t, "-db", dbPath, "check"); err != nil || out != "checked 1 queues, 1 messages: 0 problems\n" {
+		t.Fatalf("check = %q, %v", out, err)
+	}
+
+	// 把进度设到队列末尾之后
+	if _, err := ctl(t, "-db", dbPath, "seek", "-queue", "orders", "worker", "10"); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	if out, err := ctl(t, "-db", dbPath, "check"); err == nil || !strings.Contains(out, "progress ahead of queue") {
+		t.Fatalf("check = %q, %v; want a problem", out, err)
+	}
+	if out, err := ctl(t, "-db", dbPath, "check", "-repair"); err != nil || !strings.Contains(out, "repaired 1 problems") {
+		t.Fatalf("check -repair = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,101 @@
+// Command bunnymqd serves a bunnymq database over HTTP and, with -wire, over
+// the binary protocol of package client. See package server for the API.
+//
+// Usage:
+//
+//	bunnymqd -db queues.db -addr :7070 -wire unix:/run/bunnymq.sock
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+	"gitlab.cnns/luoying/bunnymq/server"
+)
+
+func main() {
+	var (
+		addr       = flag.String("addr", ":7070", "address to listen on")
+		dbPath     = flag.String("db", "bunnymq.db", "database file, or directory with -segment-log")
+		segmentLog = flag.Bool("segment-log", false, "store queues in a segment log directory instead of a bbolt file")
+		durability = flag.String("durability", "strict", "strict, batched or none")
+		maxWait    = flag.Duration("max-wait", server.DefaultMaxWait, "longest long-poll a client may request")
+		maxSize    = flag.Int64("max-message-size", server.DefaultMaxMessageSize, "largest message accepted, in bytes")
+		wireAddr   = flag.String("wire", "", "also serve the binary protocol on host:port or unix:/path")
+	)
+	flag.Parse()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	if err := run(logger, *addr, *wireAddr, *dbPath, *segmentLog, *durability, *maxWait, *maxSize); err != nil {
+		logger.Error("bunnymqd: exiting", "err", err)
+		os.Exit(1)
+	}
+}
+
+func run(logger *slog.Logger, addr, wireAddr, dbPath string, segmentLog bool, durability string, maxWait time.Duration, maxSize int64) error {
+	mode, err := bunnymq.ParseDurability(durability)
+	if err != nil {
+		return err
+	}
+	opts := []bunnymq.Option{bunnymq.WithDurability(mode), bunnymq.WithLogger(logger)}
+	if segmentLog {
+		opts = append(opts, bunnymq.WithSegmentLog())
+	}
+	db, err := bunnymq.Open(dbPath, opts...)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	handler := server.New(db, server.WithMaxWait(maxWait), server.WithMaxMessageSize(maxSize), server.WithLogger(logger))
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wireLn net.Listener
+	if wireAddr != "" {
+		network, address := "tcp", wireAddr
+		if path, ok := strings.CutPrefix(wireAddr, "unix:"); ok {
+			network, address = "unix", path
+		}
+		if wireLn, err = net.Listen(network, address); err != nil {
+			return err
+		}
+	}
+	errc := make(chan error, 2)
+	go func() {
+		logger.Info("bunnymqd: listening", "addr", addr, "db", dbPath)
+		errc <- srv.ListenAndServe()
+	}()
+	if wireLn != nil {
+		go func() {
+			logger.Info("bunnymqd: serving the wire protocol", "addr", wireAddr)
+			errc <- handler.ServeWire(wireLn)
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		handler.Close()
+		return err
+	case <-ctx.Done():
+	}
+	logger.Info("bunnymqd: shutting down")
+	// 先结束长轮询，否则 Shutdown 要等它们超时
+	handler.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -1,9 +1,18 @@
 package bunnymq
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 )
 
+// Coder encodes messages of type T for storage. Decode is given a copy of the
+// stored bytes that the caller does not reuse, so it may keep or return them
+// without copying.
 type Coder[T any] interface {
 	Encode(T) ([]byte, error)
 	Decode(encodedData []byte) (T, error)
@@ -22,3 +31,167 @@ func (c *JsonCoder[T]) Decode(encodedData []byte) (T, error) {
 	err := json.Unmarshal(encodedData, &data)
 	return data, err
 }
+
+func (JsonCoder[T]) CoderName() string { return "json" }
+
+// RawCoder stores []byte payloads unchanged, for queues whose messages are
+// already encoded or opaque. It can read a queue written with any coder, so
+// it is not recorded in the queue metadata and never mismatches; use
+// BytesCoder for a queue that should only ever hold raw bytes.
+type RawCoder struct{}
+
+func (RawCoder) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (RawCoder) Decode(encodedData []byte) ([]byte, error) {
+	return encodedData, nil
+}
+
+// GobCoder encodes messages with encoding/gob. Every message carries its own
+// type information, so it is larger than the value it holds but can be
+// decoded on its own.
+type GobCoder[T any] struct{}
+
+func (GobCoder[T]) Encode(data T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCoder[T]) Decode(encodedData []byte) (T, error) {
+	var data T
+	err := gob.NewDecoder(bytes.NewReader(encodedData)).Decode(&data)
+	return data, err
+}
+
+func (GobCoder[T]) CoderName() string { return "gob" }
+
+// BytesCoder stores []byte payloads unchanged, like RawCoder, but is recorded
+// in the queue metadata like any other coder.
+type BytesCoder struct{}
+
+func (BytesCoder) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (BytesCoder) Decode(encodedData []byte) ([]byte, error) {
+	return encodedData, nil
+}
+
+func (BytesCoder) CoderName() string { return "bytes" }
+
+// StringCoder stores strings as their bytes.
+type StringCoder struct{}
+
+func (StringCoder) Encode(data string) ([]byte, error) {
+	return []byte(data), nil
+}
+
+func (StringCoder) Decode(encodedData []byte) (string, error) {
+	return string(encodedData), nil
+}
+
+func (StringCoder) CoderName() string { return "string" }
+
+// ProtoMessage is implemented by types that marshal themselves to a binary
+// form, such as the messages generated by gogo/protobuf or vtprotobuf.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// ProtoCoder encodes messages with their own Marshal and Unmarshal methods.
+// T is normally a pointer type, as in ProtoCoder[*pb.Order]; Decode allocates
+// the value it unmarshals into.
+type ProtoCoder[T ProtoMessage] struct{}
+
+func (ProtoCoder[T]) Encode(data T) ([]byte, error) {
+	return data.Marshal()
+}
+
+func (ProtoCoder[T]) Decode(encodedData []byte) (T, error) {
+	var data T
+	if t := reflect.TypeFor[T](); t.Kind() == reflect.Pointer {
+		data = reflect.New(t.Elem()).Interface().(T)
+	}
+	err := data.Unmarshal(encodedData)
+	return data, err
+}
+
+func (ProtoCoder[T]) CoderName() string { return "proto" }
+
+// NamedCoder is implemented by coders that name their encoding. The name is
+// recorded in the metadata of the queues they are used with, and opening such
+// a queue with a coder of another name fails with ErrCoderMismatch. Coders of
+// the same encoding for different types, such as JsonCoder[A] and
+// JsonCoder[B], share a name.
+type NamedCoder interface {
+	CoderName() string
+}
+
+var (
+	coderNamesMu sync.RWMutex
+	coderNames   = map[reflect.Type]string{} // registered coder type -> name
+)
+
+// RegisterCoder names the type of coder, for coders that do not implement
+// NamedCoder. Call it from an init function, before any queue is opened with
+// the coder. It panics if name is empty, or if the name or the type is
+// already registered, or the name is that of a built-in coder.
+func RegisterCoder(name string, coder any) {
+	switch name {
+	case "":
+		panic("bunnymq: RegisterCoder with an empty name")
+	case "json", "gob", "bytes", "string", "proto":
+		panic(fmt.Sprintf("bunnymq: coder name %q is reserved", name))
+	}
+	t := reflect.TypeOf(coder)
+	if t == nil {
+		panic("bunnymq: RegisterCoder of a nil coder")
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	coderNamesMu.Lock()
+	defer coderNamesMu.Unlock()
+	if old, ok := coderNames[t]; ok {
+		panic(fmt.Sprintf("bunnymq: coder %v already registered as %q", t, old))
+	}
+	for other, old := range coderNames {
+		if old == name {
+			panic(fmt.Sprintf("bunnymq: coder name %q already registered for %v", name, other))
+		}
+	}
+	coderNames[t] = name
+}
+
+// CoderName returns the name under which coder is recorded in the queue
+// metadata: its CoderName if it implements NamedCoder, else the name it was
+// registered with, else its type without type arguments, such as
+// "mypkg.MyCoder". It returns "" for RawCoder, which is never recorded.
+func CoderName(coder any) string {
+	switch c := coder.(type) {
+	case RawCoder, *RawCoder:
+		return ""
+	case NamedCoder:
+		return c.CoderName()
+	}
+	t := reflect.TypeOf(coder)
+	if t == nil {
+		return ""
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	coderNamesMu.RLock()
+	name, ok := coderNames[t]
+	coderNamesMu.RUnlock()
+	if ok {
+		return name
+	}
+	name, _, _ = strings.Cut(t.String(), "[")
+	return name
+}
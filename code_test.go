@@ -0,0 +1,171 @@
+package bunnymq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// point marshals itself like a generated protobuf message would.
+type point struct{ X, Y int32 }
+
+func (p *point) Marshal() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(p.X)), uint32(p.Y)), nil
+}
+
+func (p *point) Unmarshal(data []byte) error {
+	if len(data) != 8 {
+		return fmt.Errorf("point: %d bytes", len(data))
+	}
+	p.X, p.Y = int32(binary.BigEndian.Uint32(data)), int32(binary.BigEndian.Uint32(data[4:]))
+	return nil
+}
+
+// csvCoder is registered by name rather than implementing NamedCoder.
+type csvCoder struct{}
+
+func (csvCoder) Encode(v testStruct) ([]byte, error) { return []byte(v.Message), nil }
+
+func (csvCoder) Decode(data []byte) (testStruct, error) {
+	return testStruct{Message: string(data)}, nil
+}
+
+func init() {
+	RegisterCoder("csv", csvCoder{})
+}
+
+func roundTrip[T any](t *testing.T, coder Coder[T], v T) {
+	t.Helper()
+	data, err := coder.Encode(v)
+	if err != nil {
+		t.Fatalf("%s Encode: %v", CoderName(coder), err)
+	}
+	got, err := coder.Decode(data)
+	if err != nil || !reflect.DeepEqual(got, v) {
+		t.Fatalf("%s round trip = %v, %v; want %v", CoderName(coder), got, err, v)
+	}
+}
+
+func TestCoders(t *testing.T) {
+	roundTrip[testStruct](t, GobCoder[testStruct]{}, testStruct{Message: "gob"})
+	roundTrip[[]byte](t, BytesCoder{}, []byte{0, 1, 2})
+	roundTrip[[]byte](t, RawCoder{}, []byte{3, 4})
+	roundTrip[string](t, StringCoder{}, "héllo")
+	roundTrip[*point](t, ProtoCoder[*point]{}, &point{X: -1, Y: 2})
+
+	for _, tt := range []struct {
+		coder any
+		want  string
+	}{
+		{&JsonCoder[testStruct]{}, "json"},
+		{GobCoder[int]{}, "gob"},
+		{BytesCoder{}, "bytes"},
+		{&StringCoder{}, "string"},
+		{ProtoCoder[*point]{}, "proto"},
+		{RawCoder{}, ""},
+		{csvCoder{}, "csv"},
+		{&csvCoder{}, "csv"},
+		{upperCoder{}, "bunnymq.upperCoder"},
+	} {
+		if got := CoderName(tt.coder); got != tt.want {
+			t.Errorf("CoderName(%T) = %q, want %q", tt.coder, got, tt.want)
+		}
+	}
+
+	for _, name := range []string{"", "json", "bytes", "csv"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterCoder(%q) did not panic", name)
+				}
+			}()
+			RegisterCoder(name, struct{}{})
+		}()
+	}
+}
+
+func TestRawCoderPayloadOutlivesTx(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		queue, err := NewQueue[[]byte]("raw", dbPath, RawCoder{}, opts...)
+		if err != nil {
+			t.Fatalf("NewQueue: %v", err)
+		}
+		defer queue.Close()
+		queue.Enqueue([]byte("first"))
+		msg, err := queue.Dequeue("c")
+		if err != nil {
+			t.Fatalf("Dequeue: %v", err)
+		}
+		// RawCoder 原样返回，事务结束后的写入不能改到它
+		for i := 0; i < 100; i++ {
+			queue.Enqueue([]byte("overwrite"))
+		}
+		msg.Ack()
+		if got := string(msg.Data()); got != "first" {
+			t.Errorf("payload after later writes = %q, want first", got)
+		}
+	})
+}
+
+func TestCoderMismatch(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "coders.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	points, err := OpenQueue[*point](db, "points", ProtoCoder[*point]{})
+	if err != nil {
+		t.Fatalf("OpenQueue: %v", err)
+	}
+	points.Enqueue(&point{X: 3, Y: 4})
+	if msg, err := points.Dequeue("c"); err != nil || *msg.Data() != (point{X: 3, Y: 4}) {
+		t.Fatalf("Dequeue = %v, %v", msg, err)
+	}
+	if _, err := OpenQueue[*point](db, "points", GobCoder[*point]{}); !errors.Is(err, ErrCoderMismatch) {
+		t.Fatalf("OpenQueue with GobCoder: got %v, want ErrCoderMismatch", err)
+	}
+	if _, err := OpenQueue[[]byte](db, "points", BytesCoder{}); !errors.Is(err, ErrCoderMismatch) {
+		t.Fatalf("OpenQueue with BytesCoder: got %v, want ErrCoderMismatch", err)
+	}
+	if _, err := OpenQueue[[]byte](db, "points", RawCoder{}); err != nil {
+		t.Fatalf("OpenQueue with RawCoder: %v", err)
+	}
+	if _, err := OpenQueue[testStruct](db, "lines", csvCoder{}); err != nil {
+		t.Fatalf("OpenQueue with a registered coder: %v", err)
+	}
+	if info, _ := db.QueueInfo("lines"); info.Coder != "csv" {
+		t.Errorf("registered coder recorded as %q, want csv", info.Coder)
+	}
+}
+
+func TestMigrateCoderNames(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "names.db")
+	// 格式 2 记的是 JsonCoder 的类型名
+	writeRawBolt(t, dbPath, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(formatKey), []byte("2")); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("orders"), []byte(`{"created":"2026-01-02T03:04:05Z","coder":"bunnymq.JsonCoder","limits":{"max_length":5,"overflow":"block"}}`))
+	})
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	info, err := db.QueueInfo("orders")
+	if err != nil || info.Coder != "json" || info.Created.Year() != 2026 || info.Limits.MaxLength != 5 || info.Limits.Overflow != OverflowBlock {
+		t.Fatalf("QueueInfo after migration = %+v, %v", info, err)
+	}
+	if _, err := OpenQueue[testStruct](db, "orders", &JsonCoder[testStruct]{}); err != nil {
+		t.Fatalf("OpenQueue with JsonCoder after migration: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 type consumerProgressManager struct {
@@ -11,7 +12,6 @@ type consumerProgressManager struct {
 }
 
 func newConsumerProgressManager(dbClient *dbClient) *consumerProgressManager {
-	dbClient.ensureBucketExists(consumerProgressBucket)
 	return &consumerProgressManager{
 		dbClient: dbClient,
 	}
@@ -40,6 +40,28 @@ func (cpm *consumerProgressManager) getProgress(consumerID, queueName string) (i
 	return progress, nil
 }
 
+// ack moves the consumer's progress forward to newProgress and, if a lease is
+// being tracked for the consumer, releases it in the same transaction. Progress
+// never moves back, so acknowledging a message after a later one is a no-op.
+func (cpm *consumerProgressManager) ack(consumerID, queueName string, newProgress int64, releaseLease bool) error {
+	key := cpm.buildProgressKey(consumerID, queueName)
+	return cpm.dbClient.update(func(tx Tx) error {
+		current, err := tx.Get(consumerProgressBucket, key)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		if p, err := strconv.ParseInt(string(current), 10, 64); err != nil || p < newProgress {
+			if err := tx.Put(consumerProgressBucket, key, []byte(strconv.FormatInt(newProgress, 10))); err != nil {
+				return err
+			}
+		}
+		if !releaseLease {
+			return nil
+		}
+		return tx.Delete(consumerLeaseBucket, key)
+	})
+}
+
 // UpdateProgress updates the progress of a consumer for a specific queue.
 func (cpm *consumerProgressManager) updateProgress(consumerID, queueName string, newProgress int64) error {
 	key := cpm.buildProgressKey(consumerID, queueName)
@@ -48,5 +70,22 @@ func (cpm *consumerProgressManager) updateProgress(consumerID, queueName string,
 
 // buildProgressKey constructs a unique key for storing consumer progress.
 func (cpm *consumerProgressManager) buildProgressKey(consumerID, queueName string) string {
-	return fmt.Sprintf("%s:%s", consumerID, queueName)
+	return progressKey(consumerID, queueName)
+}
+
+// progressKey is the key of a consumer's progress and lease on a queue. Queue
+// names cannot contain ':' (see checkQueueName), so the queue is whatever
+// follows the last colon and consumer IDs may contain colons.
+func progressKey(consumerID, queueName string) string {
+	return consumerID + ":" + queueName
+}
+
+// splitProgressKey splits a key built by progressKey; ok is false if key has
+// no colon.
+func splitProgressKey(key string) (consumerID, queueName string, ok bool) {
+	i := strings.LastIndexByte(key, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return key[:i], key[i+1:], true
 }
@@ -0,0 +1,304 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DB is a handle to an open database. Every handle on the same path in this
+// process shares one underlying store, which is closed when the last handle
+// is closed. Queues opened from a DB with OpenQueue stop working when the DB
+// is closed.
+//
+// Besides opening queues, a DB lists, renames and deletes the queues stored
+// in it. Queue names starting with an underscore, and the names of the
+// buckets that hold consumer progress, are reserved.
+type DB struct {
+	path   string
+	opts   Options
+	client *dbClient
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Open opens the database at path, or takes another reference to it if it is
+// already open in this process. File-level options (OpenTimeout, FileMode,
+// Durability, the store) only apply when the path is opened for the first
+// time; the others become the defaults of queues opened from the DB.
+func Open(path string, opts ...Option) (*DB, error) {
+	options := defaultOptions("")
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	client, err := newDBClient(path, options)
+	if err != nil {
+		return nil, err
+	}
+	if _, isDefault := options.Logger.(nopLogger); !isDefault {
+		client.setLogger(options.Logger)
+	}
+	if options.Hooks.OnCleanup != nil {
+		client.setCleanupHook(options.Hooks.OnCleanup)
+	}
+	return &DB{path: path, opts: options, client: client}, nil
+}
+
+// OpenQueue opens the named queue in db. opts are applied on top of the
+// options db was opened with. The queue shares db's reference to the file:
+// closing the queue leaves db open, and closing db makes the queue return
+// ErrDatabaseClosed.
+func OpenQueue[T any](db *DB, queueName string, coder Coder[T], opts ...Option) (*Queue[T], error) {
+	if err := checkQueueName(queueName); err != nil {
+		return nil, err
+	}
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	options := db.opts
+	options.Queue = queueName
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	return newQueue(db, coder, options)
+}
+
+// DBStats describes the queues in a database.
+type DBStats struct {
+	Queues   map[string]QueueStats // by queue name
+	Messages int                   // messages stored across all queues
+}
+
+// checkQueueName rejects names that cannot be used for a queue.
+func checkQueueName(name string) error {
+	switch {
+	case name == "":
+		return invalidOption("queue", "queue name must not be empty")
+	case strings.HasPrefix(name, "_") || isInternalBucket(name):
+		return NewDBError(CodeReservedQueueName, fmt.Errorf("queue name %q is reserved", name), name)
+	case strings.ContainsRune(name, ':'):
+		// 消费者进度的 key 是 "消费者:队列"，队列名带冒号就分不清了
+		return invalidOption("queue", fmt.Sprintf("queue name %q must not contain ':'", name))
+	}
+	return nil
+}
+
+// ListQueues returns the names of the queues in the database, sorted.
+// Dead-letter queues are listed like any other queue.
+func (db *DB) ListQueues() ([]string, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	var names []string
+	err := db.client.view(func(tx Tx) error {
+		var err error
+		names, err = tx.Queues()
+		return err
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// QueueExists reports whether a queue with the given name has been created,
+// that is, whether a message was ever enqueued to it since it was last deleted.
+func (db *DB) QueueExists(name string) (bool, error) {
+	if db.isClosed() {
+		return false, ErrDatabaseClosed
+	}
+	err := db.client.view(func(tx Tx) error {
+		_, err := tx.Stats(name)
+		return err
+	})
+	if errors.Is(err, ErrBucketNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteQueue deletes a queue together with its messages, its metadata and the
+// progress of its consumers. Its dead-letter queue is a separate queue and is kept. It
+// returns ErrBucketNotFound if the queue does not exist; a queue that was opened
+// but never written to exists only in its metadata.
+func (db *DB) DeleteQueue(name string) error {
+	if err := checkQueueName(name); err != nil {
+		return err
+	}
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	err := db.client.update(func(tx Tx) error {
+		err := tx.DeleteQueue(name)
+		if errors.Is(err, ErrBucketNotFound) {
+			// 打开过但还没写过消息的队列只有元数据
+			if _, merr := tx.Get(metaBucket, name); merr == nil {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := moveQueueMeta(tx, name, ""); err != nil {
+			return err
+		}
+		return moveConsumerState(tx, name, "")
+	})
+	if err != nil {
+		return err
+	}
+	db.client.setRetention(name, 0)
+	db.client.notifyFreed(name)
+	db.client.logger.Info("bunnymq: deleted queue", "path", db.path, "queue", name)
+	return nil
+}
+
+// RenameQueue renames a queue, keeping its messages, sequence numbers, limits
+// and the progress of its consumers. It returns ErrBucketNotFound if from does not
+// exist and ErrQueueExists if to does. Queues already opened under the old
+// name keep using it, so reopen them after the rename.
+func (db *DB) RenameQueue(from, to string) error {
+	if err := checkQueueName(from); err != nil {
+		return err
+	}
+	if err := checkQueueName(to); err != nil {
+		return err
+	}
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	if from == to {
+		return ErrQueueExists
+	}
+	err := db.client.update(func(tx Tx) error {
+		if err := tx.RenameQueue(from, to); err != nil {
+			return err
+		}
+		if err := moveQueueMeta(tx, from, to); err != nil {
+			return err
+		}
+		return moveConsumerState(tx, from, to)
+	})
+	if err != nil {
+		return err
+	}
+	db.client.logger.Info("bunnymq: renamed queue", "path", db.path, "from", from, "to", to)
+	return nil
+}
+
+// Stats returns the stats of every queue in the database.
+func (db *DB) Stats() (DBStats, error) {
+	if db.isClosed() {
+		return DBStats{}, ErrDatabaseClosed
+	}
+	stats := DBStats{Queues: make(map[string]QueueStats)}
+	err := db.client.view(func(tx Tx) error {
+		names, err := tx.Queues()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			qs, err := tx.Stats(name)
+			if err != nil {
+				return err
+			}
+			stats.Queues[name] = qs
+			stats.Messages += qs.Count
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// moveConsumerState moves the progress and lease records of the consumers of
+// queue from to queue to, or deletes them if to is empty.
+func moveConsumerState(tx Tx, from, to string) error {
+	for _, bucket := range []string{consumerProgressBucket, consumerLeaseBucket} {
+		var keys []string
+		var values [][]byte
+		err := tx.ForEach(bucket, func(key string, value []byte) error {
+			if _, queue, ok := splitProgressKey(key); ok && queue == from {
+				keys = append(keys, key)
+				values = append(values, append([]byte(nil), value...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// 遍历结束后再改，避免边遍历边写
+		for i, key := range keys {
+			if err := tx.Delete(bucket, key); err != nil {
+				return err
+			}
+			if to == "" {
+				continue
+			}
+			consumerID, _, _ := splitProgressKey(key)
+			if err := tx.Put(bucket, progressKey(consumerID, to), values[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Enqueued returns a channel that is closed the next time a message is
+// enqueued to the named queue in this process, through any handle on db's
+// path. Take the channel before looking at the queue, so that a message
+// enqueued in between is not missed:
+//
+//	ready := db.Enqueued("orders")
+//	msg, err := queue.Dequeue("worker")
+//	if errors.Is(err, bunnymq.ErrKeyNotFound) {
+//		<-ready
+//	}
+//
+// Writes from other processes are not seen.
+func (db *DB) Enqueued(queue string) <-chan struct{} {
+	return db.client.enqueued(queue)
+}
+
+// Path returns the path db was opened with.
+func (db *DB) Path() string {
+	return db.path
+}
+
+// Clean removes consumed messages from every queue in the database; see
+// CleanDB.
+func (db *DB) Clean() error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	return db.client.cleanupAllConsumed()
+}
+
+// Close releases the handle. The store is closed once no handle on the path is
+// left. Closing a DB twice is a no-op.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mu.Unlock()
+	return db.client.release()
+}
+
+func (db *DB) isClosed() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.closed
+}
@@ -3,15 +3,29 @@ package bunnymq
 import (
 	"errors"
 	"fmt"
-	bolt "go.etcd.io/bbolt"
 	"strconv"
 	"sync"
 	"time"
+
+	"gitlab.cnns/luoying/bunnymq/metrics"
 )
 
 type dbClient struct {
-	db     *bolt.DB
+	store  Store
 	dbPath string
+	refs   int // open DB handles on dbPath, guarded by cacheMutex
+	// readOnly is set when the path was opened with WithReadOnly.
+	readOnly bool
+
+	stateMu    sync.Mutex // guards the fields below
+	registry   *metrics.Registry
+	txDuration *metrics.Histogram
+	sizeGauges map[*metrics.Registry]func() // registry -> unregisters the file size gauge
+	logger     Logger
+	hooks      Hooks
+	retention  map[string]time.Duration // queue name -> retention configured by NewQueue
+	waiters    map[string]chan struct{} // queue name -> closed on the next enqueue
+	freed      map[string]chan struct{} // queue name -> closed when messages are next removed
 }
 
 var (
@@ -20,49 +34,131 @@ var (
 	ErrTxTimeout  = errors.New("transaction timed out")
 )
 
-// newDBClient creates a new database client with an increased timeout for write transactions
-func newDBClient(dbPath string) (*dbClient, error) {
+// newDBClient returns the client for dbPath, opening its store on first use,
+// and takes a reference to it that must be dropped with release. The
+// file-level settings in opts are only used when the path is not open yet.
+func newDBClient(dbPath string, opts Options) (*dbClient, error) {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
 	// 检查缓存中是否已经存在该 dbClient
 	if client, exists := dbClientCache[dbPath]; exists {
+		if client.readOnly != opts.ReadOnly {
+			return nil, invalidOption("read only", fmt.Sprintf("%s is already open with read only %v in this process", dbPath, client.readOnly))
+		}
+		client.refs++
 		return client, nil
 	}
 
 	// 如果不存在，则创建新的 dbClient
-	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	openStore := opts.openStore
+	if openStore == nil {
+		openStore = openBoltStore
+	}
+	store, err := openStore(dbPath, &opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
+	}
+	if err := migrate(store, dbPath, opts.ReadOnly, opts.Logger); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if opts.ReadOnly {
+		store = readOnlyStore{store}
 	}
 
-	client := &dbClient{db: db, dbPath: dbPath}
+	client := &dbClient{
+		store:      store,
+		dbPath:     dbPath,
+		refs:       1,
+		readOnly:   opts.ReadOnly,
+		logger:     opts.Logger,
+		retention:  make(map[string]time.Duration),
+		waiters:    make(map[string]chan struct{}),
+		freed:      make(map[string]chan struct{}),
+		sizeGauges: make(map[*metrics.Registry]func()),
+	}
+	client.logger.Info("bunnymq: opened database", "path", dbPath, "durability", opts.Durability)
 	dbClientCache[dbPath] = client
 	return client, nil
 }
 
-// Put stores a key-value pair in a specified bucket with a retry mechanism
-func (client *dbClient) put(bucketName, key string, value []byte) error {
-	return client.update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		if err != nil {
-			return err
+func (client *dbClient) setRetention(queueName string, d time.Duration) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	if d > 0 {
+		client.retention[queueName] = d
+	} else {
+		delete(client.retention, queueName)
+	}
+}
+
+func (client *dbClient) retentionFor(queueName string) time.Duration {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	return client.retention[queueName]
+}
+
+// enqueued returns a channel that is closed the next time a message is
+// enqueued to the queue.
+func (client *dbClient) enqueued(queueName string) <-chan struct{} {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	ch, ok := client.waiters[queueName]
+	if !ok {
+		ch = make(chan struct{})
+		client.waiters[queueName] = ch
+	}
+	return ch
+}
+
+func (client *dbClient) notifyEnqueued(queueName string) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	if ch, ok := client.waiters[queueName]; ok {
+		close(ch)
+		delete(client.waiters, queueName)
+	}
+}
+
+// roomFreed returns a channel that is closed the next time messages are
+// removed from the queue or its limits change, for producers waiting under
+// OverflowBlock.
+func (client *dbClient) roomFreed(queueName string) <-chan struct{} {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	ch, ok := client.freed[queueName]
+	if !ok {
+		ch = make(chan struct{})
+		client.freed[queueName] = ch
+	}
+	return ch
+}
+
+func (client *dbClient) notifyFreed(queueNames ...string) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	for _, name := range queueNames {
+		if ch, ok := client.freed[name]; ok {
+			close(ch)
+			delete(client.freed, name)
 		}
+	}
+}
 
-		return bucket.Put([]byte(key), value)
+// Put stores a key-value pair in a specified bucket with a retry mechanism
+func (client *dbClient) put(bucketName, key string, value []byte) error {
+	return client.update(func(tx Tx) error {
+		return tx.Put(bucketName, key, value)
 	})
 }
 
 // GetAll retrieves all key-value pairs from a specified bucket
 func (client *dbClient) getAll(bucketName string) ([]*keyValue, error) {
 	var results []*keyValue
-	err := client.view(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		if err != nil {
-			return err
-		}
-		return bucket.ForEach(func(k, v []byte) error {
-			results = append(results, &keyValue{key: string(k), value: v})
+	err := client.view(func(tx Tx) error {
+		return tx.ForEach(bucketName, func(k string, v []byte) error {
+			results = append(results, &keyValue{key: k, value: append([]byte(nil), v...)})
 			return nil
 		})
 	})
@@ -71,109 +167,103 @@ func (client *dbClient) getAll(bucketName string) ([]*keyValue, error) {
 
 func (client *dbClient) get(bucketName, key string) ([]byte, error) {
 	var value []byte
-	err := client.view(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
-		if bucket == nil {
-			return ErrBucketNotFound
-		}
-		value = bucket.Get([]byte(key))
-		if value == nil {
-			return ErrKeyNotFound
+	err := client.view(func(tx Tx) error {
+		v, err := tx.Get(bucketName, key)
+		if err != nil {
+			return err
 		}
+		// 值只在事务内有效，需要拷贝出来
+		value = append([]byte(nil), v...)
 		return nil
 	})
 	return value, err
 }
 
-// PutWithAutoIncrementKey stores a value with an auto-incremented key in a specified bucket with retry mechanism
-func (client *dbClient) putWithAutoIncrementKey(bucketName string, value []byte) error {
+// PutWithAutoIncrementKey stores a value with an auto-incremented key in a specified bucket with retry mechanism.
+// It returns the sequence number used as the key and how many of the oldest messages were dropped to
+// make room. The limits stored for the queue are applied first, see makeRoom.
+func (client *dbClient) putWithAutoIncrementKey(bucketName string, value []byte) (uint64, int, error) {
 	var lastErr error
+	var seq uint64
+	var dropped int
 	for i := 0; i < 3; i++ { // Retry mechanism for up to 3 attempts
-		lastErr = client.update(func(tx *bolt.Tx) error {
-			bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-			if err != nil {
-				return err
-			}
-			seq, err := bucket.NextSequence()
-			if err != nil {
-				return ErrFailedToCreate
-			}
-			key := strconv.FormatUint(seq, 10)
-			return bucket.Put([]byte(key), value)
+		lastErr = client.update(func(tx Tx) (err error) {
+			seq, dropped, err = appendMessage(tx, bucketName, value)
+			return err
 		})
 		if lastErr == nil || !errors.Is(lastErr, ErrTxTimeout) {
 			break
 		}
+		client.log().Warn("bunnymq: retrying write", "path", client.dbPath, "bucket", bucketName, "attempt", i+1, "err", lastErr)
 		time.Sleep(100 * time.Millisecond) // Small delay before retrying
 	}
-	return lastErr
+	if lastErr != nil {
+		return 0, 0, lastErr
+	}
+	return seq, dropped, nil
+}
+
+// appendMessage appends value to queue after applying the queue's limits,
+// and returns its sequence number and the number of messages dropped to make
+// room for it. Every message written to a queue goes through it.
+func appendMessage(tx Tx, queue string, value []byte) (uint64, int, error) {
+	dropped, err := makeRoom(tx, queue, len(value))
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := tx.Append(queue, value)
+	return seq, dropped, err
 }
 
-// GetNext retrieves the next key-value pair based on the progress in a specified bucket
+// GetNext retrieves the message stored under progress in a specified bucket,
+// or the next one after it if that message has been removed.
 func (client *dbClient) getNext(bucketName, progress string) (*keyValue, error) {
+	from, err := strconv.ParseUint(progress, 10, 64)
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
 	var result *keyValue
-	err := client.view(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
-		if bucket == nil {
-			return ErrBucketNotFound
-		}
-		// 使用 progress 作为键直接获取对应的值
-		value := bucket.Get([]byte(progress))
-		if value == nil {
-			return ErrKeyNotFound
+	err = client.view(func(tx Tx) error {
+		seq, value, err := tx.Seek(bucketName, from)
+		if err != nil {
+			return err
 		}
-
-		result = &keyValue{key: progress, value: value}
+		result = &keyValue{key: strconv.FormatUint(seq, 10), value: append([]byte(nil), value...)}
 		return nil
 	})
 	return result, err
 }
 
-// Close closes the database connection
-func (client *dbClient) close() error {
-	return client.db.Close()
-}
-
-func (client *dbClient) view(fn func(*bolt.Tx) error) error {
-	return client.db.View(fn)
-}
-
-func (client *dbClient) update(fn func(*bolt.Tx) error) error {
-	tx, err := client.db.Begin(true)
-	if err != nil {
-		return err
-	}
-	// 如果在fn(tx)执行时出现错误，事务会回滚
-	if err := fn(tx); err != nil {
-		tx.Rollback() // 手动回滚
-		return err
+// release drops a reference taken by newDBClient. The last release removes
+// the client from the cache and closes its store, so the next newDBClient on
+// the path opens it again.
+func (client *dbClient) release() error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	client.refs--
+	if client.refs > 0 {
+		return nil
 	}
-
-	// 如果提交时出现错误，事务也会回滚
-	if err := tx.Commit(); err != nil {
-		tx.Rollback() // 手动回滚
-		return err
+	if dbClientCache[client.dbPath] == client {
+		delete(dbClientCache, client.dbPath)
 	}
+	client.unregisterMetrics()
+	return client.store.Close()
+}
 
-	return nil
+func (client *dbClient) view(fn func(Tx) error) error {
+	return client.store.View(fn)
 }
 
-func (client *dbClient) delete(bucketName, key string) error {
-	return client.update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
-		if bucket == nil {
-			return ErrBucketNotFound
-		}
-		return bucket.Delete([]byte(key))
+func (client *dbClient) update(fn func(Tx) error) error {
+	defer client.observeTx(time.Now())
+	return client.store.Update(func(tx Tx) error {
+		return fn(newSizeCounter(tx))
 	})
 }
 
-func (client *dbClient) ensureBucketExists(bucketName string) error {
-	return client.update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-		if err != nil {
-			return fmt.Errorf("failed to create or access bucket: %v", err)
-		}
-		return nil
+func (client *dbClient) delete(bucketName, key string) error {
+	return client.update(func(tx Tx) error {
+		return tx.Delete(bucketName, key)
 	})
 }
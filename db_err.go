@@ -20,6 +20,16 @@ const (
 	CodeClosingDatabase
 	CodeDeletingBackupFile
 	CodeFailToStore
+	CodeInvalidOption
+	CodeQueueFull
+	CodeDatabaseClosed
+	CodeQueueExists
+	CodeReservedQueueName
+	CodeDatabaseLocked
+	CodeReadOnly
+	CodeCorrupt
+	CodeCoderMismatch
+	CodeUnsupportedFormat
 )
 
 // DBError is a custom error type for database-related errors.
@@ -38,6 +48,13 @@ func (e *DBError) Unwrap() error {
 	return e.Err
 }
 
+// Is reports whether target is a *DBError with the same code, so that errors
+// carrying extra context still match the predefined errors below.
+func (e *DBError) Is(target error) bool {
+	t, ok := target.(*DBError)
+	return ok && t.Code != CodeUnknown && t.Code == e.Code
+}
+
 func NewDBError(code DBErrorCode, err error, context string) *DBError {
 	return &DBError{
 		Code:    code,
@@ -59,6 +76,16 @@ var (
 	ErrOpeningBackupDatabase = NewDBError(CodeOpeningBackupDatabase, fmt.Errorf("failed to open backup database"), "")
 	ErrFailedToDelete        = NewDBError(CodeFailedToDelete, fmt.Errorf("failed to delete key"), "")
 	ErrDeDeletingBackupFile  = NewDBError(CodeDeletingBackupFile, fmt.Errorf("deleting existing backup file"), "")
-	ErrClosingDatabase       = NewDBError(CodeDeletingBackupFile, fmt.Errorf("dclosing databas"), "")
+	ErrClosingDatabase       = NewDBError(CodeClosingDatabase, fmt.Errorf("dclosing databas"), "")
 	ErrFailToStore           = NewDBError(CodeFailToStore, fmt.Errorf("failed to store data"), "")
+	ErrInvalidOption         = NewDBError(CodeInvalidOption, fmt.Errorf("invalid option"), "")
+	ErrQueueFull             = NewDBError(CodeQueueFull, fmt.Errorf("queue is full"), "")
+	ErrDatabaseClosed        = NewDBError(CodeDatabaseClosed, fmt.Errorf("database is closed"), "")
+	ErrQueueExists           = NewDBError(CodeQueueExists, fmt.Errorf("queue already exists"), "")
+	ErrReservedQueueName     = NewDBError(CodeReservedQueueName, fmt.Errorf("queue name is reserved"), "")
+	ErrDatabaseLocked        = NewDBError(CodeDatabaseLocked, fmt.Errorf("database is locked by another process"), "")
+	ErrReadOnly              = NewDBError(CodeReadOnly, fmt.Errorf("database is open read-only"), "")
+	ErrCorrupt               = NewDBError(CodeCorrupt, fmt.Errorf("database is corrupt"), "")
+	ErrCoderMismatch         = NewDBError(CodeCoderMismatch, fmt.Errorf("queue was written with a different coder"), "")
+	ErrUnsupportedFormat     = NewDBError(CodeUnsupportedFormat, fmt.Errorf("database format is newer than this version supports"), "")
 )
@@ -0,0 +1,31 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Errors built with NewDBError carry their own message and context but must
+// still match the predefined error with the same code, e.g. the validation
+// errors of NewQueue and ErrInvalidOption.
+func TestDBErrorIs(t *testing.T) {
+	err := invalidOption("WithMaxLength", "max length must not be negative")
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("%v should match ErrInvalidOption", err)
+	}
+	if errors.Is(err, ErrQueueFull) {
+		t.Errorf("%v should not match ErrQueueFull", err)
+	}
+	if wrapped := fmt.Errorf("opening queue: %w", err); !errors.Is(wrapped, ErrInvalidOption) {
+		t.Errorf("%v should match ErrInvalidOption through wrapping", wrapped)
+	}
+	// CodeUnknown 不代表任何具体错误，不能互相匹配
+	unknown := NewDBError(CodeUnknown, errors.New("a"), "")
+	if errors.Is(unknown, NewDBError(CodeUnknown, errors.New("b"), "")) {
+		t.Errorf("errors with CodeUnknown should not match each other")
+	}
+	if errors.Is(ErrClosingDatabase, ErrDeDeletingBackupFile) {
+		t.Errorf("ErrClosingDatabase should have its own code")
+	}
+}
@@ -0,0 +1,238 @@
+package bunnymq
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func cachedClient(path string) *dbClient {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	return dbClientCache[path]
+}
+
+func TestCloseOnlyReleasesOwnPath(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewQueue[testStruct]("q", filepath.Join(dir, "a.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	b, err := NewQueue[testStruct]("q", filepath.Join(dir, "b.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer b.Close()
+	// 关闭 a.db 的队列不能影响 b.db
+	if err := a.Close(); err != nil {
+		t.Fatalf("Error closing queue: %v", err)
+	}
+	if err := b.Enqueue(testStruct{Message: "still open"}); err != nil {
+		t.Fatalf("Enqueue on b.db after closing a.db: %v", err)
+	}
+	if cachedClient(filepath.Join(dir, "a.db")) != nil {
+		t.Errorf("a.db is still cached after its last queue was closed")
+	}
+}
+
+func TestDBReopenAfterLastClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reopen.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	first, err := OpenQueue[testStruct](db, "q", &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("OpenQueue: %v", err)
+	}
+	second, err := NewQueue[testStruct]("q", path, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	if first.db != second.db {
+		t.Fatalf("queues on the same path do not share a client")
+	}
+	if err := first.Enqueue(testStruct{Message: "kept"}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// db 已关闭，但 second 仍持有引用
+	if _, err := first.Dequeue("c"); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Dequeue from a closed DB: got %v, want ErrDatabaseClosed", err)
+	}
+	if err := db.Clean(); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Clean on a closed DB: got %v, want ErrDatabaseClosed", err)
+	}
+	if _, err := OpenQueue[testStruct](db, "q", &JsonCoder[testStruct]{}); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("OpenQueue on a closed DB: got %v, want ErrDatabaseClosed", err)
+	}
+	if cachedClient(path) == nil {
+		t.Fatalf("client dropped while a queue still uses it")
+	}
+	if err := second.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := second.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if err := second.Enqueue(testStruct{}); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Enqueue after Close: got %v, want ErrDatabaseClosed", err)
+	}
+	if cachedClient(path) != nil {
+		t.Fatalf("client still cached after the last close")
+	}
+
+	queue, err := NewQueue[testStruct]("q", path, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("NewQueue after reopen: %v", err)
+	}
+	defer queue.Close()
+	msg, err := queue.Dequeue("c")
+	if err != nil {
+		t.Fatalf("Dequeue after reopen: %v", err)
+	}
+	if msg.Data().Message != "kept" {
+		t.Errorf("got %q after reopen, want kept", msg.Data().Message)
+	}
+}
+
+func TestDBQueueManagement(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		orders, err := OpenQueue[testStruct](db, "orders", &JsonCoder[testStruct]{})
+		if err != nil {
+			t.Fatalf("OpenQueue: %v", err)
+		}
+		for _, m := range []string{"a", "b", "c"} {
+			if err := orders.Enqueue(testStruct{Message: m}); err != nil {
+				t.Fatalf("Enqueue: %v", err)
+			}
+		}
+		msg, err := orders.Dequeue("c1")
+		if err != nil {
+			t.Fatalf("Dequeue: %v", err)
+		}
+		if err := msg.Ack(); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+		other, _ := OpenQueue[testStruct](db, "other", &JsonCoder[testStruct]{})
+		if err := other.Enqueue(testStruct{Message: "x"}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+
+		if names, err := db.ListQueues(); err != nil || len(names) != 2 || names[0] != "orders" || names[1] != "other" {
+			t.Fatalf("ListQueues = %v, %v", names, err)
+		}
+		if err := db.RenameQueue("orders", "other"); !errors.Is(err, ErrQueueExists) {
+			t.Errorf("RenameQueue onto an existing queue: got %v, want ErrQueueExists", err)
+		}
+		if err := db.RenameQueue("missing", "new"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("RenameQueue of a missing queue: got %v, want ErrBucketNotFound", err)
+		}
+		if err := db.RenameQueue("orders", "invoices"); err != nil {
+			t.Fatalf("RenameQueue: %v", err)
+		}
+		if ok, err := db.QueueExists("orders"); err != nil || ok {
+			t.Errorf("QueueExists(orders) after rename = %v, %v", ok, err)
+		}
+
+		// 改名后消费进度跟着走，序号不变
+		invoices, _ := OpenQueue[testStruct](db, "invoices", &JsonCoder[testStruct]{})
+		msg, err = invoices.Dequeue("c1")
+		if err != nil || msg.Data().Message != "b" {
+			t.Fatalf("Dequeue after rename = %v, %v; want b", msg, err)
+		}
+		if err := invoices.Enqueue(testStruct{Message: "d"}); err != nil {
+			t.Fatalf("Enqueue after rename: %v", err)
+		}
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatalf("Stats: %v", err)
+		}
+		if got := stats.Queues["invoices"]; got != (QueueStats{Count: 4, FirstSeq: 1, LastSeq: 4}) {
+			t.Errorf("Stats(invoices) = %+v", got)
+		}
+		if stats.Messages != 5 {
+			t.Errorf("Stats.Messages = %d, want 5", stats.Messages)
+		}
+
+		if err := db.DeleteQueue("invoices"); err != nil {
+			t.Fatalf("DeleteQueue: %v", err)
+		}
+		if err := db.DeleteQueue("invoices"); !errors.Is(err, ErrBucketNotFound) {
+			t.Errorf("second DeleteQueue: got %v, want ErrBucketNotFound", err)
+		}
+		if err := invoices.Enqueue(testStruct{Message: "fresh"}); err != nil {
+			t.Fatalf("Enqueue after delete: %v", err)
+		}
+		msg, err = invoices.Dequeue("c1")
+		if err != nil || msg.Data().Message != "fresh" {
+			t.Errorf("Dequeue after delete = %v, %v; want fresh from a new queue", msg, err)
+		}
+	})
+}
+
+func TestReservedQueueNames(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "reserved.db")
+	for _, name := range []string{consumerProgressBucket, consumerLeaseBucket, "_meta"} {
+		if q, err := NewQueue[testStruct](name, dbPath, &JsonCoder[testStruct]{}); !errors.Is(err, ErrReservedQueueName) {
+			if q != nil {
+				q.Close()
+			}
+			t.Errorf("NewQueue(%q): got %v, want ErrReservedQueueName", name, err)
+		}
+	}
+	if cachedClient(dbPath) != nil {
+		t.Errorf("rejected NewQueue left the database open")
+	}
+}
+
+func TestQueueNamesWithColons(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "colons.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if _, err := OpenQueue[testStruct](db, "a:b", &JsonCoder[testStruct]{}); !errors.Is(err, ErrInvalidOption) {
+		t.Fatalf("OpenQueue(a:b): got %v, want ErrInvalidOption", err)
+	}
+
+	// 消费者 "x:a" 在队列 b 上的进度 key 是 "x:a:b"，不能算到队列 a 或别的队列头上
+	b, _ := OpenQueue[testStruct](db, "b", &JsonCoder[testStruct]{})
+	a, _ := OpenQueue[testStruct](db, "a", &JsonCoder[testStruct]{})
+	for i := 0; i < 5; i++ {
+		b.Enqueue(testStruct{})
+		a.Enqueue(testStruct{})
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := b.Dequeue("x:a")
+		if err != nil {
+			t.Fatalf("Dequeue: %v", err)
+		}
+		msg.Ack()
+	}
+	if consumers, _ := db.Consumers("b"); len(consumers) != 1 || consumers[0].ID != "x:a" || consumers[0].Progress != 3 {
+		t.Fatalf("Consumers(b) = %+v, want x:a at 3", consumers)
+	}
+	if consumers, _ := db.Consumers("a"); len(consumers) != 0 {
+		t.Fatalf("Consumers(a) = %+v, want none", consumers)
+	}
+	if err := db.Clean(); err != nil {
+		t.Fatalf("Clean: %v", err)
+	}
+	if stats, _ := db.Stats(); stats.Queues["a"].Count != 5 || stats.Queues["b"].Count != 2 {
+		t.Fatalf("stats after Clean = %+v, want a untouched and b cleaned up to 3", stats.Queues)
+	}
+	if err := db.DeleteQueue("a"); err != nil {
+		t.Fatalf("DeleteQueue(a): %v", err)
+	}
+	if msg, err := b.Dequeue("x:a"); err != nil || msg.Seq() != 4 {
+		t.Fatalf("Dequeue(x:a) on b after deleting a = %v, %v; want seq 4", msg, err)
+	}
+}
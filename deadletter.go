@@ -0,0 +1,117 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// deadLetterSuffix is appended to a queue name to form its dead-letter queue.
+const deadLetterSuffix = ".dlq"
+
+// Headers added to a message when it is moved to a dead-letter queue.
+const (
+	DeadLetterQueueHeader    = "x-dead-letter-queue"
+	DeadLetterConsumerHeader = "x-dead-letter-consumer"
+	DeadLetterSeqHeader      = "x-dead-letter-seq"
+	DeadLetterAttemptsHeader = "x-dead-letter-attempts"
+)
+
+// DeadLetterQueueName returns the name of the queue that receives messages
+// dead-lettered from queueName. It is an ordinary queue and can be opened with
+// NewQueue to inspect or replay its messages.
+func DeadLetterQueueName(queueName string) string {
+	return queueName + deadLetterSuffix
+}
+
+// deadLetterIfExhausted records that seq is being delivered to the consumer
+// and, once the message has already been delivered MaxDeliveries times, moves
+// it to the dead-letter queue instead and reports true. This is what fires
+// Hooks.OnDeadLetter and the dead-lettered counter; without MaxDeliveries
+// nothing is recorded.
+func (q *Queue[T]) deadLetterIfExhausted(consumerID string, seq int64, env envelope) (bool, error) {
+	if q.opts.MaxDeliveries <= 0 {
+		return false, nil
+	}
+	attempts, err := q.progressManager.recordDelivery(consumerID, q.queueName, seq)
+	if err != nil {
+		return false, err
+	}
+	if attempts <= q.opts.MaxDeliveries {
+		return false, nil
+	}
+	return true, q.moveToDeadLetter(consumerID, seq, env, attempts-1)
+}
+
+// moveToDeadLetter appends the message to the dead-letter queue, advances the
+// consumer past it and drops the consumer's lease, all in one transaction.
+func (q *Queue[T]) moveToDeadLetter(consumerID string, seq int64, env envelope, attempts int) error {
+	headers := Headers{}
+	for k, v := range env.headers {
+		headers[k] = v
+	}
+	headers.Set(DeadLetterQueueHeader, q.queueName)
+	headers.Set(DeadLetterConsumerHeader, consumerID)
+	headers.Set(DeadLetterSeqHeader, strconv.FormatInt(seq, 10))
+	headers.Set(DeadLetterAttemptsHeader, strconv.Itoa(attempts))
+	value := encodeEnvelope(envelope{headers: headers, timestamp: env.timestamp, payload: env.payload})
+
+	key := q.progressManager.buildProgressKey(consumerID, q.queueName)
+	err := q.db.update(func(tx Tx) error {
+		if _, err := tx.Append(DeadLetterQueueName(q.queueName), value); err != nil {
+			return err
+		}
+		if err := tx.Put(consumerProgressBucket, key, []byte(strconv.FormatInt(seq, 10))); err != nil {
+			return err
+		}
+		return tx.Delete(consumerLeaseBucket, key)
+	})
+	if err != nil {
+		q.logger.Error("bunnymq: dead-lettering failed", "queue", q.queueName, "consumer", consumerID, "seq", seq, "err", err)
+		return err
+	}
+	q.metrics.deadLettered.Inc()
+	q.db.notifyEnqueued(DeadLetterQueueName(q.queueName))
+	q.logger.Warn("bunnymq: message dead-lettered", "queue", q.queueName, "consumer", consumerID, "seq", seq, "attempts", attempts)
+	return nil
+}
+
+// recordDelivery notes that seq is being delivered to the consumer and returns
+// how many times it has been delivered so far, including this time. The count
+// lives in the consumer_leases bucket so that it survives restarts.
+func (cpm *consumerProgressManager) recordDelivery(consumerID, queueName string, seq int64) (int, error) {
+	key := cpm.buildProgressKey(consumerID, queueName)
+	attempts := 1
+	err := cpm.dbClient.update(func(tx Tx) error {
+		lease, err := tx.Get(consumerLeaseBucket, key)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		if leaseSeq, n, ok := parseLease(lease); ok && leaseSeq == seq {
+			attempts = n + 1
+		}
+		return tx.Put(consumerLeaseBucket, key, formatLease(seq, attempts))
+	})
+	return attempts, err
+}
+
+func formatLease(seq int64, attempts int) []byte {
+	return []byte(fmt.Sprintf("%d:%d", seq, attempts))
+}
+
+func parseLease(value []byte) (seq int64, attempts int, ok bool) {
+	s, n, found := strings.Cut(string(value), ":")
+	if !found {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	attempts, err = strconv.Atoi(n)
+	if err != nil {
+		return 0, 0, false
+	}
+	return seq, attempts, true
+}
@@ -0,0 +1,86 @@
+package bunnymq
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaxDeliveriesDeadLetter(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "dlq.db")
+	var deadLettered []Event
+	queue, err := NewQueue[testStruct]("jobs", dbPath, &JsonCoder[testStruct]{},
+		WithMaxDeliveries(2),
+		WithHooks(Hooks{OnDeadLetter: func(e Event) { deadLettered = append(deadLettered, e) }}))
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	for _, m := range []string{"poison", "good"} {
+		if err := queue.Enqueue(testStruct{Message: m}); err != nil {
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := queue.Dequeue("worker")
+		if err != nil {
+			t.Fatalf("Error dequeuing message: %v", err)
+		}
+		if msg.Data().Message != "poison" {
+			t.Fatalf("delivery %d: got %q", i+1, msg.Data().Message)
+		}
+		if err := msg.NAck(); err != nil {
+			t.Fatalf("Error calling NAck: %v", err)
+		}
+	}
+
+	msg, err := queue.Dequeue("worker")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if msg.Data().Message != "good" {
+		t.Fatalf("expected poison message to be dead-lettered, got %q", msg.Data().Message)
+	}
+	if len(deadLettered) != 1 || deadLettered[0].Seq != 1 || deadLettered[0].ConsumerID != "worker" {
+		t.Errorf("unexpected dead-letter events %+v", deadLettered)
+	}
+
+	dlq, err := NewQueue[testStruct](DeadLetterQueueName("jobs"), dbPath, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error opening dead-letter queue: %v", err)
+	}
+	defer dlq.Close()
+	dead, err := dlq.Dequeue("inspector")
+	if err != nil {
+		t.Fatalf("Error dequeuing dead letter: %v", err)
+	}
+	if dead.Data().Message != "poison" || dead.Headers().Get(DeadLetterAttemptsHeader) != "2" || dead.Headers().Get(DeadLetterQueueHeader) != "jobs" {
+		t.Errorf("unexpected dead letter %+v headers %v", dead.Data(), dead.Headers())
+	}
+}
+
+func TestNoDeadLetterWithoutMaxDeliveries(t *testing.T) {
+	queue, err := NewQueue[testStruct]("jobs", filepath.Join(t.TempDir(), "nodlq.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	if err := queue.Enqueue(testStruct{Message: "poison"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		msg, err := queue.Dequeue("worker")
+		if err != nil || msg.Data().Message != "poison" {
+			t.Fatalf("delivery %d: got %v, %v", i+1, msg, err)
+		}
+		if err := msg.NAck(); err != nil {
+			t.Fatalf("Error calling NAck: %v", err)
+		}
+	}
+	// 不设 MaxDeliveries 时不记录投递次数
+	if _, err := queue.db.get(consumerLeaseBucket, progressKey("worker", "jobs")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected no lease, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package bunnymq
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Durability selects when committed writes are flushed to stable storage.
+//
+// Crash-loss bounds per mode:
+//
+//   - DurabilityStrict: every commit is fsynced before Enqueue or Ack return.
+//     Nothing that returned successfully is lost, whether the process is killed
+//     or the machine loses power.
+//   - DurabilityBatched: commits are written to the file but fsynced by a
+//     background goroutine every SyncInterval. Killing the process loses
+//     nothing, since the writes are already in the OS page cache. A power loss
+//     or kernel crash can lose up to one SyncInterval of acknowledged writes.
+//   - DurabilityNone: the library never fsyncs. Killing the process loses
+//     nothing; after a power loss or kernel crash everything written since the
+//     OS last flushed its cache may be gone. Use it for ephemeral queues whose
+//     file can be discarded.
+//
+// In the batched and none modes bbolt cannot order page writes against its
+// meta page, so after a power loss the file may also fail bbolt's consistency
+// check and need to be restored from a backup.
+type Durability int
+
+const (
+	DurabilityStrict Durability = iota
+	DurabilityBatched
+	DurabilityNone
+)
+
+// DefaultSyncInterval is the fsync period used by DurabilityBatched.
+const DefaultSyncInterval = 100 * time.Millisecond
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityStrict:
+		return "strict"
+	case DurabilityBatched:
+		return "batched"
+	case DurabilityNone:
+		return "none"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// ParseDurability returns the mode named by s, as printed by String.
+func ParseDurability(s string) (Durability, error) {
+	for _, d := range []Durability{DurabilityStrict, DurabilityBatched, DurabilityNone} {
+		if s == d.String() {
+			return d, nil
+		}
+	}
+	return 0, invalidOption("durability", fmt.Sprintf("unknown mode %q", s))
+}
+
+// WithDurability selects the durability mode of the database file.
+func WithDurability(d Durability) Option {
+	return func(o *Options) error {
+		if d < DurabilityStrict || d > DurabilityNone {
+			return invalidOption("durability", fmt.Sprintf("unknown mode %v", d))
+		}
+		o.Durability = d
+		o.Durable = d == DurabilityStrict
+		return nil
+	}
+}
+
+// WithSyncInterval sets how often DurabilityBatched fsyncs the file.
+func WithSyncInterval(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return invalidOption("sync interval", "must be positive")
+		}
+		o.SyncInterval = d
+		return nil
+	}
+}
+
+// boltOptions translates the file-level settings into bbolt options.
+func (o *Options) boltOptions() *bolt.Options {
+	opts := &bolt.Options{Timeout: o.OpenTimeout, ReadOnly: o.ReadOnly}
+	switch o.Durability {
+	case DurabilityBatched:
+		opts.NoSync = true
+	case DurabilityNone:
+		opts.NoSync = true
+		opts.NoGrowSync = true
+		opts.NoFreelistSync = true
+	}
+	return opts
+}
+
+// syncTarget is a store whose commits are not fsynced as they happen.
+type syncTarget interface {
+	sync() error
+	log() Logger
+}
+
+// syncer fsyncs a store periodically when it has unsynced commits.
+type syncer struct {
+	store syncTarget
+	path  string
+	dirty atomic.Bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func startSyncer(store syncTarget, path string, interval time.Duration) *syncer {
+	s := &syncer{store: store, path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.run(interval)
+	return s
+}
+
+func (s *syncer) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// markDirty records that a commit has not been fsynced yet.
+func (s *syncer) markDirty() {
+	if s != nil {
+		s.dirty.Store(true)
+	}
+}
+
+func (s *syncer) flush() {
+	if !s.dirty.Swap(false) {
+		return
+	}
+	if err := s.store.sync(); err != nil {
+		s.dirty.Store(true)
+		s.store.log().Warn("bunnymq: periodic sync failed", "path", s.path, "err", err)
+	}
+}
+
+// close stops the goroutine and flushes any pending commits.
+func (s *syncer) close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.flush()
+}
@@ -0,0 +1,145 @@
+package bunnymq
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const crashHelperEnv = "BUNNYMQ_CRASH_HELPER"
+
+// TestCrashHelperProcess is not a real test: it is the child process started by
+// TestCrashDuringWrites. It enqueues messages forever and prints the sequence
+// number of every Enqueue that returned successfully.
+func TestCrashHelperProcess(t *testing.T) {
+	if os.Getenv(crashHelperEnv) != "1" {
+		t.Skip("helper process for TestCrashDuringWrites")
+	}
+	mode, _ := strconv.Atoi(os.Getenv("BUNNYMQ_CRASH_MODE"))
+	queue, err := NewQueue[testStruct]("crash", os.Getenv("BUNNYMQ_CRASH_DB"), &JsonCoder[testStruct]{},
+		WithDurability(Durability(mode)), WithSyncInterval(5*time.Millisecond))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	for i := 1; ; i++ {
+		if err := queue.Enqueue(testStruct{Message: strconv.Itoa(i)}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+		fmt.Fprintln(out, i)
+		out.Flush()
+	}
+}
+
+// TestCrashDuringWrites kills a writer process with SIGKILL in the middle of a
+// stream of Enqueues and checks that the file is consistent and that every
+// Enqueue the child saw succeed is present. A killed process never loses
+// committed writes in any mode because they are already in the page cache;
+// power-loss bounds cannot be simulated here.
+func TestCrashDuringWrites(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns child processes")
+	}
+	for _, mode := range []Durability{DurabilityStrict, DurabilityBatched, DurabilityNone} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "crash.db")
+			cmd := exec.Command(os.Args[0], "-test.run=^TestCrashHelperProcess$")
+			cmd.Env = append(os.Environ(),
+				crashHelperEnv+"=1",
+				"BUNNYMQ_CRASH_DB="+dbPath,
+				"BUNNYMQ_CRASH_MODE="+strconv.Itoa(int(mode)))
+			cmd.Stderr = os.Stderr
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			acked := 0
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				if acked, err = strconv.Atoi(scanner.Text()); err != nil {
+					t.Fatalf("unexpected helper output %q", scanner.Text())
+				}
+				if acked >= 200 {
+					break
+				}
+			}
+			if err := cmd.Process.Kill(); err != nil {
+				t.Fatal(err)
+			}
+			_ = cmd.Wait()
+			if acked < 200 {
+				t.Fatalf("helper exited after %d writes", acked)
+			}
+
+			db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+			if err != nil {
+				t.Fatalf("reopening after crash: %v", err)
+			}
+			defer db.Close()
+			err = db.View(func(tx *bolt.Tx) error {
+				for err := range tx.Check() {
+					return err
+				}
+				bucket := tx.Bucket(queueBucket("crash"))
+				if bucket == nil {
+					return fmt.Errorf("queue bucket missing")
+				}
+				for seq := 1; seq <= acked; seq++ {
+					if bucket.Get(seqKey(uint64(seq), false)) == nil {
+						return fmt.Errorf("acknowledged message %d lost", seq)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestBatchedDurabilitySyncs(t *testing.T) {
+	queue, err := NewQueue[testStruct]("batched", filepath.Join(t.TempDir(), "batched.db"), &JsonCoder[testStruct]{},
+		WithDurability(DurabilityBatched), WithSyncInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+	store := queue.db.store.(*boltStore)
+	if store.syncer == nil || !store.db.NoSync {
+		t.Fatalf("batched mode should open with NoSync and a background syncer")
+	}
+	if err := queue.Enqueue(testStruct{Message: "m"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for store.syncer.dirty.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("background sync did not run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDurabilityOptionValidation(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "invalid.db")
+	if _, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}, WithDurability(Durability(7))); err == nil {
+		t.Errorf("expected unknown durability to be rejected")
+	}
+	if _, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}, WithSyncInterval(0)); err == nil {
+		t.Errorf("expected zero sync interval to be rejected")
+	}
+}
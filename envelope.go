@@ -0,0 +1,145 @@
+package bunnymq
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Headers are string key/value pairs stored alongside a message payload.
+// Headers implements HeaderCarrier so it can be handed to a Propagator.
+type Headers map[string]string
+
+// Get returns the value for key, or "" if it is not set.
+func (h Headers) Get(key string) string { return h[key] }
+
+// Set sets key to value.
+func (h Headers) Set(key, value string) { h[key] = value }
+
+// Keys returns the header keys in sorted order.
+func (h Headers) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 消息在数据库中的存储格式：
+//
+//	magic(1) version(1) timestamp(varint) headerCount(uvarint)
+//	{keyLen(uvarint) key valueLen(uvarint) value}...
+//	payload
+//
+// 旧版本直接存储编码后的 payload，没有 magic 前缀，读取时按无 header 处理。
+const (
+	envelopeMagic   byte = 0xB5
+	envelopeVersion byte = 1
+)
+
+type envelope struct {
+	headers   Headers
+	timestamp time.Time
+	payload   []byte
+}
+
+func encodeEnvelope(e envelope) []byte {
+	size := 2 + binary.MaxVarintLen64*2 + len(e.payload)
+	for k, v := range e.headers {
+		size += 2*binary.MaxVarintLen64 + len(k) + len(v)
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, envelopeMagic, envelopeVersion)
+	buf = binary.AppendVarint(buf, e.timestamp.UnixNano())
+	buf = binary.AppendUvarint(buf, uint64(len(e.headers)))
+	for _, k := range e.headers.Keys() {
+		v := e.headers[k]
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+	return append(buf, e.payload...)
+}
+
+func decodeEnvelope(data []byte) (envelope, error) {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		// 旧格式：整个值就是 payload
+		return envelope{payload: data}, nil
+	}
+	if len(data) < 2 || data[1] != envelopeVersion {
+		return envelope{}, fmt.Errorf("%w: unsupported envelope version", ErrFailedToDeserialize)
+	}
+	r := envelopeReader{buf: data[2:]}
+	ts := r.varint()
+	n := r.uvarint()
+	var headers Headers
+	if n > 0 && r.err == nil {
+		if n > uint64(len(r.buf)) {
+			return envelope{}, fmt.Errorf("%w: header count out of range", ErrFailedToDeserialize)
+		}
+		headers = make(Headers, n)
+		for i := uint64(0); i < n && r.err == nil; i++ {
+			k := r.bytes()
+			v := r.bytes()
+			headers[string(k)] = string(v)
+		}
+	}
+	if r.err != nil {
+		return envelope{}, r.err
+	}
+	return envelope{headers: headers, timestamp: time.Unix(0, ts), payload: r.buf}, nil
+}
+
+type envelopeReader struct {
+	buf []byte
+	err error
+}
+
+func (r *envelopeReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: truncated envelope", ErrFailedToDeserialize)
+	}
+}
+
+func (r *envelopeReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *envelopeReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *envelopeReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
@@ -0,0 +1,310 @@
+package bunnymq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// exportVersion is the version of the dump format written by Export.
+const exportVersion = 1
+
+// exportRecord is one line of a dump. Type says which of the other fields are
+// set: "queue" for the header, "message" for a stored message and "consumer"
+// for the progress of a consumer.
+type exportRecord struct {
+	Type string `json:"type"`
+
+	// queue
+	Version int    `json:"version,omitempty"`
+	Name    string `json:"name,omitempty"`
+	LastSeq uint64 `json:"last_seq,omitempty"`
+
+	// message
+	Seq           uint64          `json:"seq,omitempty"`
+	Time          *time.Time      `json:"time,omitempty"`
+	Headers       Headers         `json:"headers,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	PayloadBase64 []byte          `json:"payload_base64,omitempty"`
+
+	// consumer
+	ID       string `json:"id,omitempty"`
+	Progress uint64 `json:"progress,omitempty"`
+}
+
+// Export writes the queue to w as JSON Lines: a header with the queue name and
+// its sequence counter, then every stored message in order, then the progress
+// of every consumer:
+//
+//	{"type":"queue","version":1,"name":"orders","last_seq":7}
+//	{"type":"message","seq":6,"time":"2024-05-01T10:00:00Z","headers":{"k":"v"},"payload":{"id":1}}
+//	{"type":"consumer","id":"billing","progress":5}
+//
+// The payload is written as JSON when the queue uses a coder named "json",
+// such as JsonCoder, and base64 encoded in payload_base64 otherwise.
+// Deliveries in progress and their delivery counts are not exported. The dump
+// is a consistent snapshot.
+func (q *Queue[T]) Export(w io.Writer) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkOpen(); err != nil {
+		return err
+	}
+	return q.db.exportQueue(q.queueName, w, CoderName(q.coder) == "json")
+}
+
+// Import reads a dump written by Export, possibly of another queue or
+// database, into the queue in a single transaction.
+//
+// If every message of the dump has a sequence number above the queue's
+// counter, as it does when importing into a new or purged queue, the messages
+// keep their sequence numbers and the counter is raised to the dump's, so the
+// queue continues where the exported one stopped. Otherwise the messages are
+// appended after the existing ones with new sequence numbers, and the progress
+// of each consumer is moved to the new number of the last message it had
+// consumed. Imported progress never moves a consumer back. Since progress is
+// cumulative, a consumer that had consumed part of the dump also skips the
+// messages that were in the queue before the import.
+func (q *Queue[T]) Import(r io.Reader) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkOpen(); err != nil {
+		return err
+	}
+	return q.db.importQueue(q.queueName, r)
+}
+
+// Export writes the queue to w like Queue.Export, without needing its coder:
+// payloads that are JSON are written as JSON, others in base64.
+func (db *DB) Export(queue string, w io.Writer) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	return db.client.exportQueue(queue, w, true)
+}
+
+// Import reads a dump into the queue like Queue.Import, creating the queue if
+// it does not exist.
+func (db *DB) Import(queue string, r io.Reader) error {
+	if err := checkQueueName(queue); err != nil {
+		return err
+	}
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	return db.client.importQueue(queue, r)
+}
+
+// exportQueue writes the dump of the queue. Payloads are written as JSON only
+// if jsonPayload is set and they come back byte for byte when decoded.
+func (client *dbClient) exportQueue(queue string, w io.Writer, jsonPayload bool) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	var compacted bytes.Buffer
+	err := client.view(func(tx Tx) error {
+		var last uint64
+		if stats, err := tx.Stats(queue); err == nil {
+			last = stats.LastSeq
+		} else if !errors.Is(err, ErrBucketNotFound) {
+			return err
+		}
+		if err := enc.Encode(exportRecord{Type: "queue", Version: exportVersion, Name: queue, LastSeq: last}); err != nil {
+			return err
+		}
+		var writeErr error
+		err := tx.Scan(queue, 1, func(seq uint64, value []byte) bool {
+			env, err := decodeEnvelope(value)
+			if err != nil {
+				writeErr = NewDBError(CodeFailedToDeserialize, err, queue+"/"+strconv.FormatUint(seq, 10))
+				return false
+			}
+			rec := exportRecord{Type: "message", Seq: seq, Headers: env.headers}
+			if !env.timestamp.IsZero() {
+				rec.Time = &env.timestamp
+			}
+			// 编码时会被压缩，只有压缩后不变的才能原样写成 JSON
+			compacted.Reset()
+			if jsonPayload && json.Compact(&compacted, env.payload) == nil && bytes.Equal(compacted.Bytes(), env.payload) {
+				rec.Payload = env.payload
+			} else {
+				rec.PayloadBase64 = env.payload
+			}
+			writeErr = enc.Encode(rec)
+			return writeErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+		err = tx.ForEach(consumerProgressBucket, func(key string, value []byte) error {
+			id, q, ok := splitProgressKey(key)
+			if !ok || q != queue {
+				return nil
+			}
+			progress, err := strconv.ParseUint(string(value), 10, 64)
+			if err != nil {
+				return NewDBError(CodeInvalidProgress, err, key)
+			}
+			return enc.Encode(exportRecord{Type: "consumer", ID: id, Progress: progress})
+		})
+		if errors.Is(err, ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// importQueue applies a dump to the queue in one transaction.
+func (client *dbClient) importQueue(queue string, r io.Reader) error {
+	var imported int
+	err := client.update(func(tx Tx) error {
+		imp := &importer{tx: tx, queue: queue, progress: make(map[string]uint64)}
+		if stats, err := tx.Stats(queue); err == nil {
+			imp.counter = stats.LastSeq
+		} else if !errors.Is(err, ErrBucketNotFound) {
+			return err
+		}
+		dec := json.NewDecoder(r)
+		for line := 1; ; line++ {
+			var rec exportRecord
+			if err := dec.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				return NewDBError(CodeFailedToDeserialize, err, fmt.Sprintf("import record %d", line))
+			}
+			if err := imp.add(&rec); err != nil {
+				return NewDBError(CodeFailedToDeserialize, err, fmt.Sprintf("import record %d", line))
+			}
+		}
+		imported = len(imp.seqs)
+		return imp.finish()
+	})
+	if err != nil {
+		return err
+	}
+	if imported > 0 {
+		client.notifyEnqueued(queue)
+	}
+	client.logger.Info("bunnymq: imported queue", "path", client.dbPath, "queue", queue, "messages", imported)
+	return nil
+}
+
+// importer applies the records of a dump to a queue.
+type importer struct {
+	tx      Tx
+	queue   string
+	counter uint64 // the queue's sequence counter before the import
+
+	decided  bool
+	remap    bool
+	lastSeq  uint64            // from the header
+	prevSeq  uint64            // sequence number in the dump of the last message
+	seqs     [][2]uint64       // sequence numbers in the dump and in the queue
+	progress map[string]uint64 // consumer -> progress in the dump
+}
+
+func (imp *importer) add(rec *exportRecord) error {
+	switch rec.Type {
+	case "queue":
+		if rec.Version != exportVersion {
+			return fmt.Errorf("unsupported dump version %d", rec.Version)
+		}
+		if imp.decided {
+			return errors.New("header after messages")
+		}
+		imp.lastSeq = rec.LastSeq
+	case "message":
+		if rec.Seq == 0 || rec.Seq <= imp.prevSeq {
+			return fmt.Errorf("message seq %d out of order", rec.Seq)
+		}
+		if rec.Payload != nil && rec.PayloadBase64 != nil {
+			return errors.New("message has both payload and payload_base64")
+		}
+		imp.prevSeq = rec.Seq
+		if !imp.decided {
+			imp.decided, imp.remap = true, rec.Seq <= imp.counter
+		}
+		env := envelope{headers: rec.Headers, payload: rec.PayloadBase64}
+		if rec.Payload != nil {
+			env.payload = rec.Payload
+		}
+		if rec.Time != nil {
+			env.timestamp = *rec.Time
+		} else {
+			env.timestamp = time.Now()
+		}
+		if !imp.remap {
+			// 先把计数器挪到 seq-1，追加得到的就是原来的序号
+			if err := imp.tx.SetSequence(imp.queue, rec.Seq-1); err != nil {
+				return err
+			}
+		}
+		seq, err := imp.tx.Append(imp.queue, encodeEnvelope(env))
+		if err != nil {
+			return err
+		}
+		imp.seqs = append(imp.seqs, [2]uint64{rec.Seq, seq})
+	case "consumer":
+		if rec.ID == "" {
+			return errors.New("consumer without id")
+		}
+		imp.progress[rec.ID] = rec.Progress
+	default:
+		return fmt.Errorf("unknown record type %q", rec.Type)
+	}
+	return nil
+}
+
+// finish raises the sequence counter and the progress of the consumers.
+func (imp *importer) finish() error {
+	if !imp.decided {
+		imp.remap = imp.lastSeq < imp.counter
+	}
+	if !imp.remap {
+		if err := imp.tx.SetSequence(imp.queue, max(imp.lastSeq, imp.prevSeq)); err != nil {
+			return err
+		}
+	}
+	ids := make([]string, 0, len(imp.progress))
+	for id := range imp.progress {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		progress := imp.progress[id]
+		if progress == 0 {
+			continue
+		}
+		if imp.remap {
+			// 换算成它消费过的最后一条消息的新序号
+			i := sort.Search(len(imp.seqs), func(i int) bool { return imp.seqs[i][0] > progress })
+			if i == 0 {
+				continue
+			}
+			progress = imp.seqs[i-1][1]
+		}
+		key := progressKey(id, imp.queue)
+		if old, err := imp.tx.Get(consumerProgressBucket, key); err == nil {
+			if n, err := strconv.ParseUint(string(old), 10, 64); err == nil && n >= progress {
+				continue
+			}
+		}
+		if err := imp.tx.Put(consumerProgressBucket, key, []byte(strconv.FormatUint(progress, 10))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
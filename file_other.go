@@ -0,0 +1,28 @@
+//go:build !unix
+
+package bunnymq
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile is a no-op on platforms without flock; callers must not open the
+// same directory from two processes.
+func lockFile(f *os.File, timeout time.Duration) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
+
+// syncDir is a no-op where directories cannot be opened for fsync.
+func syncDir(dir string) error {
+	return nil
+}
+
+// processAlive cannot tell on these platforms and assumes the process exists.
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,310 @@
+package bunnymq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filter selects messages by their headers. It is parsed from an expression
+// such as
+//
+//	type == "order" && (region == eu || region == "us-east") && !test
+//
+// A header name on its own is true when the message has that header; == and
+// != compare its value, a missing header comparing as "". Conditions combine
+// with && and ||, negate with ! and group with parentheses; && binds tighter
+// than ||. Header names and values are either bare words of letters, digits
+// and _ - . : / or quoted strings, with Go escapes between double quotes and
+// none between single quotes.
+//
+// A nil *Filter matches every message.
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// ParseFilter parses a filter expression. It returns an error with
+// CodeInvalidOption if expr is not valid.
+func ParseFilter(expr string) (*Filter, error) {
+	p := filterParser{src: expr}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokEOF {
+		return nil, p.errorf("empty expression")
+	}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// MustParseFilter is like ParseFilter but panics if expr is not valid.
+func MustParseFilter(expr string) *Filter {
+	f, err := ParseFilter(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Match reports whether a message with headers h passes the filter.
+func (f *Filter) Match(h Headers) bool {
+	if f == nil {
+		return true
+	}
+	return f.root.match(h)
+}
+
+// String returns the expression the filter was parsed from.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+type filterNode interface {
+	match(Headers) bool
+}
+
+type (
+	filterOr  []filterNode
+	filterAnd []filterNode
+	filterNot struct{ n filterNode }
+	filterHas struct{ key string }
+	filterEq  struct {
+		key, value string
+		negate     bool
+	}
+)
+
+func (n filterOr) match(h Headers) bool {
+	for _, c := range n {
+		if c.match(h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n filterAnd) match(h Headers) bool {
+	for _, c := range n {
+		if !c.match(h) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n filterNot) match(h Headers) bool { return !n.n.match(h) }
+
+func (n filterHas) match(h Headers) bool {
+	_, ok := h[n.key]
+	return ok
+}
+
+func (n filterEq) match(h Headers) bool { return (h[n.key] == n.value) != n.negate }
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokAnd
+	tokOr
+	tokNot
+	tokEq
+	tokNe
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string // the word, or the unquoted string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokWord:
+		return fmt.Sprintf("%q", t.text)
+	case tokString:
+		return fmt.Sprintf("string %q", t.text)
+	}
+	return fmt.Sprintf("%q", [...]string{tokAnd: "&&", tokOr: "||", tokNot: "!", tokEq: "==", tokNe: "!=", tokLParen: "(", tokRParen: ")"}[t.kind])
+}
+
+// filterParser is a recursive descent parser over the grammar
+//
+//	or    = and { "||" and }
+//	and   = unary { "&&" unary }
+//	unary = "!" unary | "(" or ")" | name [ ( "==" | "!=" ) value ]
+type filterParser struct {
+	src string
+	pos int
+	tok token
+}
+
+func (p *filterParser) errorf(format string, args ...any) error {
+	return invalidOption("filter", fmt.Sprintf("filter %q: %s at offset %d", p.src, fmt.Sprintf(format, args...), p.tok.pos))
+}
+
+func (p *filterParser) or() (filterNode, error) {
+	n, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	nodes := filterOr{n}
+	for p.tok.kind == tokOr {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if n, err = p.and(); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *filterParser) and() (filterNode, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	nodes := filterAnd{n}
+	for p.tok.kind == tokAnd {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if n, err = p.unary(); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *filterParser) unary() (filterNode, error) {
+	switch p.tok.kind {
+	case tokNot:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{n}, nil
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected \")\", found %s", p.tok)
+		}
+		return n, p.next()
+	case tokWord, tokString:
+		key := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokEq && p.tok.kind != tokNe {
+			return filterHas{key}, nil
+		}
+		negate := p.tok.kind == tokNe
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokWord && p.tok.kind != tokString {
+			return nil, p.errorf("expected a value, found %s", p.tok)
+		}
+		value := p.tok.text
+		return filterEq{key: key, value: value, negate: negate}, p.next()
+	}
+	return nil, p.errorf("expected a header name, found %s", p.tok)
+}
+
+// next reads the next token into p.tok.
+func (p *filterParser) next() error {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\n' || p.src[p.pos] == '\r') {
+		p.pos++
+	}
+	start := p.pos
+	p.tok = token{pos: start}
+	if p.pos == len(p.src) {
+		return nil
+	}
+	rest := p.src[p.pos:]
+	for _, op := range []struct {
+		text string
+		kind tokenKind
+	}{{"&&", tokAnd}, {"||", tokOr}, {"==", tokEq}, {"!=", tokNe}, {"!", tokNot}, {"(", tokLParen}, {")", tokRParen}} {
+		if strings.HasPrefix(rest, op.text) {
+			p.pos += len(op.text)
+			p.tok.kind = op.kind
+			return nil
+		}
+	}
+	switch c := rest[0]; {
+	case c == '"':
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return p.errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			return p.errorf("invalid string %s", rest[:end+1])
+		}
+		p.pos += end + 1
+		p.tok.kind, p.tok.text = tokString, s
+	case c == '\'':
+		end := strings.IndexByte(rest[1:], '\'')
+		if end < 0 {
+			return p.errorf("unterminated string")
+		}
+		p.pos += end + 2
+		p.tok.kind, p.tok.text = tokString, rest[1:end+1]
+	case isFilterWordByte(c):
+		end := 1
+		for end < len(rest) && isFilterWordByte(rest[end]) {
+			end++
+		}
+		p.pos += end
+		p.tok.kind, p.tok.text = tokWord, rest[:end]
+	default:
+		return p.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+func isFilterWordByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == ':' || c == '/'
+}
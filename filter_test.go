@@ -0,0 +1,132 @@
+package bunnymq
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	h := Headers{"type": "order", "region": "eu", "note": "a \"quoted\" value"}
+	for _, tt := range []struct {
+		expr string
+		want bool
+	}{
+		{`type == order`, true},
+		{`type != "order"`, false},
+		{`region`, true},
+		{`!missing`, true},
+		{`missing == ""`, true},
+		{`type == order && region == us`, false},
+		{`type == order && (region == us || region == 'eu')`, true},
+		{`region == us || type == order && !region`, false},
+		{`!(type == order) || region`, true},
+		{`note == "a \"quoted\" value"`, true},
+		{`note == 'a "quoted" value'`, true},
+	} {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%s): %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match(h); got != tt.want {
+			t.Errorf("%s matched %v, want %v", tt.expr, got, tt.want)
+		}
+		if f.String() != tt.expr {
+			t.Errorf("String() = %q, want %q", f.String(), tt.expr)
+		}
+	}
+	for _, expr := range []string{"", "type ==", "(type", "type == a b", "a && || b", `"open`, "type = a", "a)"} {
+		if _, err := ParseFilter(expr); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("ParseFilter(%q): got %v, want ErrInvalidOption", expr, err)
+		}
+	}
+	var none *Filter
+	if !none.Match(nil) {
+		t.Error("a nil filter should match everything")
+	}
+}
+
+func TestDequeueFilter(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		queue, _ := OpenQueue[testStruct](db, "mixed", &JsonCoder[testStruct]{})
+		for i := 1; i <= 6; i++ {
+			kind := "a"
+			if i%3 != 0 {
+				kind = "b"
+			}
+			queue.EnqueueWithHeaders(context.Background(), testStruct{Message: strconv.Itoa(i)}, Headers{"kind": kind})
+		}
+		queue.Enqueue(testStruct{Message: "plain"})
+
+		onlyA := MustParseFilter("kind == a")
+		for _, want := range []uint64{3, 6} {
+			msg, err := queue.DequeueFilter("w", onlyA)
+			if err != nil || msg.Seq() != want || msg.Headers().Get("kind") != "a" {
+				t.Fatalf("DequeueFilter = %v, %v; want seq %d", msg, err, want)
+			}
+			msg.Ack()
+		}
+		// 最后一条不匹配，也要算作已消费，否则清理不掉
+		if _, err := queue.DequeueFilter("w", onlyA); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("DequeueFilter with nothing left: got %v, want ErrKeyNotFound", err)
+		}
+		consumers, _ := db.Consumers("mixed")
+		if len(consumers) != 1 || consumers[0].Progress != 7 {
+			t.Fatalf("consumers after filtering = %+v, want progress 7", consumers)
+		}
+
+		msg, err := queue.DequeueWhere("v", func(h Headers, data testStruct) bool {
+			return h.Get("kind") == "" || data.Message == "5"
+		})
+		if err != nil || msg.Seq() != 5 {
+			t.Fatalf("DequeueWhere = %v, %v; want seq 5", msg, err)
+		}
+		// 没确认之前再取还是同一条
+		if again, err := queue.DequeueWhere("v", func(Headers, testStruct) bool { return true }); err != nil || again.Seq() != 5 {
+			t.Fatalf("DequeueWhere before Ack = %v, %v; want seq 5 again", again, err)
+		}
+	})
+}
+
+func TestFetchFilter(t *testing.T) {
+	queue, err := NewQueue[testStruct]("fetch_filter", t.TempDir()+"/fetch.db", &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	defer queue.Close()
+	for i, kind := range []string{"b", "b", "a", "b", "a", "b"} {
+		queue.EnqueueWithHeaders(context.Background(), testStruct{Message: strconv.Itoa(i + 1)}, Headers{"kind": kind})
+	}
+	onlyA := MustParseFilter("kind == a")
+
+	msgs, err := queue.FetchFilter("w", 0, 1, onlyA)
+	if err != nil || len(msgs) != 1 || msgs[0].Seq() != 3 {
+		t.Fatalf("FetchFilter = %v, %v; want seq 3", msgs, err)
+	}
+	// 前面两条不匹配，直接算作已消费
+	if msgs, _ := queue.Fetch("w", 0, 1); len(msgs) != 1 || msgs[0].Seq() != 3 {
+		t.Fatalf("progress after skipping: next message is %v, want seq 3", msgs)
+	}
+	// 3 还没确认，跳过 4 不能动进度
+	msgs, err = queue.FetchFilter("w", 3, 10, onlyA)
+	if err != nil || len(msgs) != 1 || msgs[0].Seq() != 5 {
+		t.Fatalf("FetchFilter after 3 = %v, %v; want seq 5", msgs, err)
+	}
+	if msgs, _ := queue.Fetch("w", 0, 1); msgs[0].Seq() != 3 {
+		t.Fatalf("FetchFilter past an unacknowledged message moved progress to %d", msgs[0].Seq()-1)
+	}
+	msgs[0].Ack()
+	if msgs, err := queue.FetchFilter("w", 0, 10, onlyA); err != nil || len(msgs) != 0 {
+		t.Fatalf("FetchFilter after Ack of everything = %v, %v; want nothing", msgs, err)
+	}
+	if msgs, _ := queue.Fetch("w", 0, 10); len(msgs) != 0 {
+		t.Errorf("trailing filtered messages left unacknowledged: %v", msgs)
+	}
+}
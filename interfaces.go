@@ -0,0 +1,35 @@
+package bunnymq
+
+import "context"
+
+// Producer is the sending side of a queue. It is implemented by *Queue, by
+// the RemoteQueue of package client and by the fake in package bunnymqtest,
+// so code that only enqueues can be given any of them.
+type Producer[T any] interface {
+	// Enqueue adds a new item to the queue.
+	Enqueue(data T) error
+	// EnqueueContext adds a new item to the queue; ctx carries trace context
+	// and, for remote queues, bounds the request.
+	EnqueueContext(ctx context.Context, data T) error
+	// Close releases the queue.
+	Close() error
+}
+
+// Consumer is the receiving side of a queue. Messages are acknowledged or
+// rejected through the Msg returned by Dequeue.
+type Consumer[T any] interface {
+	// Dequeue returns the next message of consumerID that has not been
+	// acknowledged. It returns ErrKeyNotFound if there is none, or
+	// ErrBucketNotFound if nothing was ever enqueued.
+	Dequeue(consumerID string) (Msg[T], error)
+	// Close releases the queue.
+	Close() error
+}
+
+// ProducerConsumer is a queue used for both sending and receiving.
+type ProducerConsumer[T any] interface {
+	Producer[T]
+	Consumer[T]
+}
+
+var _ ProducerConsumer[struct{}] = (*Queue[struct{}])(nil)
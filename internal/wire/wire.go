@@ -0,0 +1,337 @@
+// Package wire implements the binary protocol spoken between package server
+// and package client.
+//
+// Every frame is
+//
+//	length(4, big-endian) type(1) id(8, big-endian) body
+//
+// where length counts the type, id and body. Requests carry an id chosen by
+// the client and every response to a request carries the same id; the
+// messages of a subscription carry the id of the Subscribe request. Inside
+// bodies, integers are uvarints and strings and byte slices are prefixed with
+// their length as a uvarint.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Type identifies the kind of a frame.
+type Type uint8
+
+const (
+	TypePublish     Type = iota + 1 // Publish, answered by OK
+	TypeFetch                       // Fetch, answered by Message or Empty
+	TypeAck                         // Settle, answered by OK
+	TypeNack                        // Settle, answered by OK
+	TypeSubscribe                   // Subscribe, answered by OK and then a Message per delivery
+	TypeUnsubscribe                 // no body; id is the id of the Subscribe request
+	TypeOK                          // no body
+	TypeError                       // Error
+	TypeMessage                     // Message
+	TypeEmpty                       // no body; the queue had nothing to fetch
+)
+
+// headerSize is the size of the type and id that follow the length prefix.
+const headerSize = 1 + 8
+
+// DefaultMaxFrameSize is the largest frame ReadFrame accepts when given a
+// limit of 0.
+const DefaultMaxFrameSize = 16 << 20
+
+// ErrFrameTooLarge is returned by ReadFrame for frames over the limit. The
+// stream cannot be read any further.
+var ErrFrameTooLarge = errors.New("wire: frame too large")
+
+// ErrMalformed is returned when a frame body cannot be decoded.
+var ErrMalformed = errors.New("wire: malformed frame")
+
+// Frame is a frame as read from or written to a connection.
+type Frame struct {
+	Type Type
+	ID   uint64
+	Body []byte
+}
+
+// WriteFrame writes f to w in a single Write call.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, 4+headerSize, 4+headerSize+len(f.Body))
+	binary.BigEndian.PutUint32(buf, uint32(headerSize+len(f.Body)))
+	buf[4] = byte(f.Type)
+	binary.BigEndian.PutUint64(buf[5:], f.ID)
+	_, err := w.Write(append(buf, f.Body...))
+	return err
+}
+
+// ReadFrame reads the next frame from r, rejecting bodies larger than max
+// bytes, or DefaultMaxFrameSize if max is 0.
+func ReadFrame(r io.Reader, max int) (Frame, error) {
+	if max <= 0 {
+		max = DefaultMaxFrameSize
+	}
+	var head [4 + headerSize]byte
+	if _, err := io.ReadFull(r, head[:4]); err != nil {
+		return Frame{}, err
+	}
+	n := binary.BigEndian.Uint32(head[:4])
+	if n < headerSize {
+		return Frame{}, fmt.Errorf("%w: length %d", ErrMalformed, n)
+	}
+	if int64(n)-headerSize > int64(max) {
+		return Frame{}, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, n-headerSize)
+	}
+	if _, err := io.ReadFull(r, head[4:]); err != nil {
+		return Frame{}, unexpectedEOF(err)
+	}
+	f := Frame{Type: Type(head[4]), ID: binary.BigEndian.Uint64(head[5:])}
+	if body := int(n) - headerSize; body > 0 {
+		f.Body = make([]byte, body)
+		if _, err := io.ReadFull(r, f.Body); err != nil {
+			return Frame{}, unexpectedEOF(err)
+		}
+	}
+	return f, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Publish asks the server to enqueue Body on Queue, with Headers stored
+// alongside it.
+type Publish struct {
+	Queue   string
+	Body    []byte
+	Headers map[string]string // optional, omitted from the body when empty
+}
+
+// Fetch asks for the next message of Consumer on Queue, waiting up to Wait
+// for one to be enqueued. A non-empty Filter is a bunnymq.Filter expression;
+// the messages it rejects are skipped.
+type Fetch struct {
+	Queue    string
+	Consumer string
+	Wait     time.Duration // sent in milliseconds
+	Filter   string        // optional, omitted from the body when empty
+}
+
+// Settle acknowledges or rejects the message Seq of Consumer on Queue.
+// Acknowledgements are cumulative: acknowledging a message acknowledges every
+// earlier message of the queue for that consumer.
+type Settle struct {
+	Queue    string
+	Consumer string
+	Seq      uint64
+}
+
+// Subscribe asks the server to push the messages of Consumer on Queue,
+// keeping at most MaxInFlight of them unacknowledged. A non-empty Filter
+// restricts them as in Fetch.
+type Subscribe struct {
+	Queue       string
+	Consumer    string
+	MaxInFlight uint64
+	Filter      string // optional, omitted from the body when empty
+}
+
+// Error reports a failed request. Code is a bunnymq.DBErrorCode.
+type Error struct {
+	Code    uint64
+	Message string
+}
+
+// Message is a message delivered by Fetch or a subscription.
+type Message struct {
+	Seq     uint64
+	Headers map[string]string
+	Body    []byte
+}
+
+func (m Publish) Append(b []byte) []byte {
+	b = appendBytes(appendString(b, m.Queue), m.Body)
+	if len(m.Headers) == 0 {
+		return b
+	}
+	return appendHeaders(b, m.Headers)
+}
+
+func (m *Publish) Decode(body []byte) error {
+	d := decoder{buf: body}
+	m.Queue, m.Body = d.string(), d.bytes()
+	m.Headers = nil
+	if d.err == nil && len(d.buf) > 0 {
+		// Append leaves out an empty header section, so a trailing count of
+		// zero is as malformed as any other leftover byte
+		if m.Headers = d.headers(); m.Headers == nil && d.err == nil {
+			d.err = ErrMalformed
+		}
+	}
+	return d.finish()
+}
+
+func (m Fetch) Append(b []byte) []byte {
+	b = appendString(appendString(b, m.Queue), m.Consumer)
+	b = binary.AppendUvarint(b, uint64(m.Wait/time.Millisecond))
+	return appendOptional(b, m.Filter)
+}
+
+func (m *Fetch) Decode(body []byte) error {
+	d := decoder{buf: body}
+	m.Queue, m.Consumer = d.string(), d.string()
+	m.Wait = time.Duration(d.uvarint()) * time.Millisecond
+	m.Filter = d.optional()
+	return d.finish()
+}
+
+func (m Settle) Append(b []byte) []byte {
+	b = appendString(appendString(b, m.Queue), m.Consumer)
+	return binary.AppendUvarint(b, m.Seq)
+}
+
+func (m *Settle) Decode(body []byte) error {
+	d := decoder{buf: body}
+	m.Queue, m.Consumer, m.Seq = d.string(), d.string(), d.uvarint()
+	return d.finish()
+}
+
+func (m Subscribe) Append(b []byte) []byte {
+	b = appendString(appendString(b, m.Queue), m.Consumer)
+	b = binary.AppendUvarint(b, m.MaxInFlight)
+	return appendOptional(b, m.Filter)
+}
+
+func (m *Subscribe) Decode(body []byte) error {
+	d := decoder{buf: body}
+	m.Queue, m.Consumer, m.MaxInFlight = d.string(), d.string(), d.uvarint()
+	m.Filter = d.optional()
+	return d.finish()
+}
+
+func (m Error) Append(b []byte) []byte {
+	return appendString(binary.AppendUvarint(b, m.Code), m.Message)
+}
+
+func (m *Error) Decode(body []byte) error {
+	d := decoder{buf: body}
+	m.Code, m.Message = d.uvarint(), d.string()
+	return d.finish()
+}
+
+func (m Message) Append(b []byte) []byte {
+	b = binary.AppendUvarint(b, m.Seq)
+	b = appendHeaders(b, m.Headers)
+	return appendBytes(b, m.Body)
+}
+
+func (m *Message) Decode(body []byte) error {
+	d := decoder{buf: body}
+	m.Seq = d.uvarint()
+	m.Headers = d.headers()
+	m.Body = d.bytes()
+	return d.finish()
+}
+
+func appendHeaders(b []byte, h map[string]string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(h)))
+	for k, v := range h {
+		b = appendString(appendString(b, k), v)
+	}
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendOptional appends s as a trailing string field, or nothing if s is
+// empty, so that bodies without it stay readable by older peers.
+func appendOptional(b []byte, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendString(b, s)
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decoder reads the fields of a body, remembering the first error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrMalformed
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = ErrMalformed
+		return nil
+	}
+	v := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// headers reads a map written by appendHeaders, nil if it is empty.
+func (d *decoder) headers() map[string]string {
+	n := d.uvarint()
+	if n == 0 || d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = ErrMalformed
+		return nil
+	}
+	h := make(map[string]string, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		k := d.string()
+		h[k] = d.string()
+	}
+	return h
+}
+
+// optional reads a trailing field written by appendOptional.
+func (d *decoder) optional() string {
+	if d.err != nil || len(d.buf) == 0 {
+		return ""
+	}
+	return d.string()
+}
+
+// finish reports the first error, or ErrMalformed if bytes are left over.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = ErrMalformed
+	}
+	return d.err
+}
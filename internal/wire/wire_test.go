@@ -0,0 +1,96 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []Frame{
+		{Type: TypePublish, ID: 1, Body: Publish{Queue: "orders", Body: []byte(`{"id":1}`)}.Append(nil)},
+		{Type: TypeOK, ID: 1},
+		{Type: TypeMessage, ID: 1 << 40, Body: Message{Seq: 7, Headers: map[string]string{"traceparent": "00-ab"}, Body: []byte("x")}.Append(nil)},
+	}
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatalf("WriteFrame: %v", err)
+		}
+	}
+	for _, want := range frames {
+		got, err := ReadFrame(&buf, 0)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ReadFrame = %+v, want %+v", got, want)
+		}
+	}
+	if _, err := ReadFrame(&buf, 0); err != io.EOF {
+		t.Errorf("ReadFrame at end: got %v, want io.EOF", err)
+	}
+
+	WriteFrame(&buf, Frame{Type: TypePublish, Body: make([]byte, 100)})
+	if _, err := ReadFrame(&buf, 99); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("ReadFrame over the limit: got %v, want ErrFrameTooLarge", err)
+	}
+	WriteFrame(&buf, Frame{Type: TypeOK})
+	buf.Truncate(buf.Len() - 1)
+	if _, err := ReadFrame(&buf, 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadFrame of a truncated frame: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestBodies(t *testing.T) {
+	fetch := Fetch{Queue: "q", Consumer: "c", Wait: 1500 * time.Millisecond}
+	var gotFetch Fetch
+	if err := gotFetch.Decode(fetch.Append(nil)); err != nil || gotFetch != fetch {
+		t.Errorf("Fetch = %+v, %v", gotFetch, err)
+	}
+	settle := Settle{Queue: "q", Consumer: "c", Seq: 1<<63 + 1}
+	var gotSettle Settle
+	if err := gotSettle.Decode(settle.Append(nil)); err != nil || gotSettle != settle {
+		t.Errorf("Settle = %+v, %v", gotSettle, err)
+	}
+	sub := Subscribe{Queue: "q", Consumer: "c", MaxInFlight: 16}
+	var gotSub Subscribe
+	if err := gotSub.Decode(sub.Append(nil)); err != nil || gotSub != sub {
+		t.Errorf("Subscribe = %+v, %v", gotSub, err)
+	}
+	sub.Filter = `type == "order"`
+	if err := gotSub.Decode(sub.Append(nil)); err != nil || gotSub != sub {
+		t.Errorf("Subscribe with a filter = %+v, %v", gotSub, err)
+	}
+	fetch.Filter = "urgent"
+	if err := gotFetch.Decode(fetch.Append(nil)); err != nil || gotFetch != fetch {
+		t.Errorf("Fetch with a filter = %+v, %v", gotFetch, err)
+	}
+	pub := Publish{Queue: "q", Body: []byte("x"), Headers: map[string]string{"type": "order"}}
+	var gotPub Publish
+	if err := gotPub.Decode(pub.Append(nil)); err != nil || !reflect.DeepEqual(gotPub, pub) {
+		t.Errorf("Publish with headers = %+v, %v", gotPub, err)
+	}
+	e := Error{Code: 15, Message: "queue is full"}
+	var gotErr Error
+	if err := gotErr.Decode(e.Append(nil)); err != nil || gotErr != e {
+		t.Errorf("Error = %+v, %v", gotErr, err)
+	}
+
+	// 截断或多出字节都算格式错误
+	body := Publish{Queue: "q", Body: []byte("payload")}.Append(nil)
+	var p Publish
+	if err := p.Decode(body[:len(body)-1]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("truncated Publish: got %v, want ErrMalformed", err)
+	}
+	if err := p.Decode(append(body, 0)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Publish with trailing bytes: got %v, want ErrMalformed", err)
+	}
+	var m Message
+	if err := m.Decode([]byte{1, 200, 1}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Message with a bogus header count: got %v, want ErrMalformed", err)
+	}
+}
@@ -0,0 +1,58 @@
+package bunnymq
+
+import (
+	"context"
+	"errors"
+	"iter"
+)
+
+// All returns an iterator over the messages of consumerID, for use in a range
+// loop:
+//
+//	for msg, err := range queue.All(ctx, "worker") {
+//		if err != nil {
+//			return err
+//		}
+//		handle(msg.Data())
+//		msg.Ack()
+//	}
+//
+// Each step is a Dequeue. When the queue is empty All waits for the next
+// message enqueued in this process. The sequence ends when ctx is done or the
+// loop breaks; after an error other than an empty queue, such as
+// ErrDatabaseClosed, it yields the error once and ends. As with Dequeue, a
+// message that is neither acknowledged nor rejected is delivered again by the
+// next step.
+func (q *Queue[T]) All(ctx context.Context, consumerID string) iter.Seq2[Msg[T], error] {
+	return func(yield func(Msg[T], error) bool) {
+		for ctx.Err() == nil {
+			// 先拿通知通道再读，读和等之间入队的消息不会漏掉
+			ready := q.db.enqueued(q.queueName)
+			msg, err := q.Dequeue(consumerID)
+			if err == nil {
+				if !yield(msg, nil) {
+					return
+				}
+				continue
+			}
+			if !errors.Is(err, ErrKeyNotFound) && !errors.Is(err, ErrBucketNotFound) {
+				yield(nil, err)
+				return
+			}
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Messages returns an iterator over the stored messages and their sequence
+// numbers, oldest first, that consumes nothing; see Range. It stops early if a
+// message cannot be read. Use Range to see the error.
+func (q *Queue[T]) Messages() iter.Seq2[uint64, T] {
+	return func(yield func(uint64, T) bool) {
+		q.Range(1, yield)
+	}
+}
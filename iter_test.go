@@ -0,0 +1,91 @@
+package bunnymq
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAll(t *testing.T) {
+	queue, err := NewQueue[testStruct]("iter", filepath.Join(t.TempDir(), "iter.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	defer queue.Close()
+	queue.Enqueue(testStruct{Message: "a"})
+	queue.Enqueue(testStruct{Message: "b"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan string)
+	done := make(chan error)
+	go func() {
+		for msg, err := range queue.All(ctx, "w") {
+			if err != nil {
+				done <- err
+				return
+			}
+			msg.Ack()
+			got <- msg.Data().Message
+		}
+		done <- nil
+	}()
+	for _, want := range []string{"a", "b"} {
+		if m := <-got; m != want {
+			t.Fatalf("got %q, want %q", m, want)
+		}
+	}
+	// 队列空了，等下一条入队
+	time.Sleep(20 * time.Millisecond)
+	queue.Enqueue(testStruct{Message: "c"})
+	select {
+	case m := <-got:
+		if m != "c" {
+			t.Fatalf("got %q, want c", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("All did not wake up for a new message")
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("All ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("All did not end after cancel")
+	}
+
+	queue.Close()
+	for _, err := range queue.All(context.Background(), "w") {
+		if !errors.Is(err, ErrDatabaseClosed) {
+			t.Errorf("All on a closed queue yielded %v, want ErrDatabaseClosed", err)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	queue, err := NewQueue[testStruct]("iter", filepath.Join(t.TempDir(), "iter.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	defer queue.Close()
+	for _, m := range []string{"a", "b", "c"} {
+		queue.Enqueue(testStruct{Message: m})
+	}
+	var seen []string
+	for seq, data := range queue.Messages() {
+		seen = append(seen, data.Message)
+		if seq == 2 {
+			break
+		}
+	}
+	if len(seen) != 2 || seen[1] != "b" {
+		t.Fatalf("Messages = %v, want [a b]", seen)
+	}
+	if msg, err := queue.Dequeue("w"); err != nil || msg.Seq() != 1 {
+		t.Errorf("Dequeue after browsing = %v, %v; want seq 1", msg, err)
+	}
+}
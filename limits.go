@@ -0,0 +1,418 @@
+package bunnymq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// OverflowPolicy decides what Enqueue does when a message would take a queue
+// past its MaxLength or MaxBytes.
+type OverflowPolicy int
+
+const (
+	// OverflowReject makes Enqueue return ErrQueueFull. It is the default.
+	OverflowReject OverflowPolicy = iota
+	// OverflowDropOldest deletes the oldest messages to make room, whether
+	// or not they have been consumed. Consumers that had not reached them
+	// continue with the oldest message left.
+	OverflowDropOldest
+	// OverflowBlock makes Enqueue wait for cleanup to make room, for up to
+	// the queue's BlockTimeout or until its context is done, and then return
+	// ErrQueueFull. Only cleanup, purges and limit changes made in this
+	// process wake a waiting Enqueue early; room made by other processes is
+	// noticed within a second.
+	OverflowBlock
+)
+
+var overflowNames = [...]string{OverflowReject: "reject", OverflowDropOldest: "drop-oldest", OverflowBlock: "block"}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowNames) {
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+	return overflowNames[p]
+}
+
+// MarshalText encodes the policy by name, as it is stored in the metadata.
+func (p OverflowPolicy) MarshalText() ([]byte, error) {
+	if p < 0 || int(p) >= len(overflowNames) {
+		return nil, fmt.Errorf("unknown overflow policy %d", int(p))
+	}
+	return []byte(overflowNames[p]), nil
+}
+
+// UnmarshalText decodes a policy written by MarshalText.
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	for i, name := range overflowNames {
+		if string(text) == name {
+			*p = OverflowPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q", text)
+}
+
+// QueueLimits bound the size of a queue. They are stored with the queue in
+// the database, so they apply to every producer that opens the queue, in any
+// process, whether or not it was given the corresponding options.
+type QueueLimits struct {
+	MaxLength    int            `json:"max_length,omitempty"`    // stored messages; 0 means unbounded
+	MaxBytes     int64          `json:"max_bytes,omitempty"`     // stored bytes, headers included; 0 means unbounded
+	Overflow     OverflowPolicy `json:"overflow"`                // what Enqueue does when a limit is reached
+	BlockTimeout time.Duration  `json:"block_timeout,omitempty"` // how long OverflowBlock waits; 0 waits until the context is done
+}
+
+func (l QueueLimits) bounded() bool {
+	return l.MaxLength > 0 || l.MaxBytes > 0
+}
+
+func (l QueueLimits) validate() error {
+	switch {
+	case l.MaxLength < 0:
+		return invalidOption("max length", "must not be negative")
+	case l.MaxBytes < 0:
+		return invalidOption("max bytes", "must not be negative")
+	case l.Overflow < OverflowReject || l.Overflow > OverflowBlock:
+		return invalidOption("overflow", fmt.Sprintf("unknown overflow policy %d", int(l.Overflow)))
+	case l.BlockTimeout < 0:
+		return invalidOption("block timeout", "must not be negative")
+	}
+	return nil
+}
+
+// limits returns the limits set by the options, and whether any was set.
+func (o *Options) limits() (QueueLimits, bool) {
+	l := QueueLimits{MaxLength: o.MaxLength, MaxBytes: o.MaxBytes, Overflow: o.Overflow, BlockTimeout: o.BlockTimeout}
+	return l, l != QueueLimits{}
+}
+
+// QueueLimits returns the limits stored for queue, zero if it has none.
+func (db *DB) QueueLimits(queue string) (QueueLimits, error) {
+	if err := checkQueueName(queue); err != nil {
+		return QueueLimits{}, err
+	}
+	if db.isClosed() {
+		return QueueLimits{}, ErrDatabaseClosed
+	}
+	var limits QueueLimits
+	err := db.client.view(func(tx Tx) error {
+		meta, err := readQueueMeta(tx, queue)
+		if meta.Limits != nil {
+			limits = *meta.Limits
+		}
+		return err
+	})
+	return limits, err
+}
+
+// SetQueueLimits stores limits for queue, replacing those it had; zero limits
+// remove them. Messages already stored are left alone even if they exceed the
+// new limits: the limits are applied when the next message is enqueued.
+func (db *DB) SetQueueLimits(queue string, limits QueueLimits) error {
+	if err := checkQueueName(queue); err != nil {
+		return err
+	}
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	if err := db.client.setLimits(queue, limits); err != nil {
+		return err
+	}
+	db.client.logger.Info("bunnymq: set queue limits", "path", db.path, "queue", queue,
+		"max_length", limits.MaxLength, "max_bytes", limits.MaxBytes, "overflow", limits.Overflow)
+	return nil
+}
+
+func (client *dbClient) setLimits(queue string, limits QueueLimits) error {
+	err := client.update(func(tx Tx) error {
+		meta, err := readQueueMeta(tx, queue)
+		if err != nil {
+			return err
+		}
+		meta.Limits = nil
+		if limits != (QueueLimits{}) {
+			meta.Limits = &limits
+		}
+		if _, err := meta.trackSize(tx, queue); err != nil {
+			return err
+		}
+		return writeQueueMeta(tx, queue, meta)
+	})
+	if err == nil {
+		// 限制放宽了，等着的生产者可以再试
+		client.notifyFreed(queue)
+	}
+	return err
+}
+
+// queueSize is how many messages, and how many bytes of them, a queue stores.
+type queueSize struct {
+	count, bytes int64
+}
+
+// storedSize adds up the messages of queue from from to to.
+func storedSize(tx Tx, queue string, from, to uint64) (queueSize, error) {
+	var size queueSize
+	err := tx.Scan(queue, from, func(seq uint64, value []byte) bool {
+		if seq > to {
+			return false
+		}
+		size.count++
+		size.bytes += int64(len(value))
+		return true
+	})
+	if errors.Is(err, ErrBucketNotFound) {
+		return queueSize{}, nil
+	}
+	return size, err
+}
+
+// trackSize makes the running totals in meta match its limits: a message
+// count while it has MaxLength and a byte total while it has MaxBytes. A
+// total that is missing, because the limit is new or was set by an older
+// version, is counted from the queue. It reports whether meta changed.
+func (meta *queueMeta) trackSize(tx Tx, queue string) (bool, error) {
+	var l QueueLimits
+	if meta.Limits != nil {
+		l = *meta.Limits
+	}
+	changed := false
+	if l.MaxLength == 0 && meta.Count != nil {
+		meta.Count, changed = nil, true
+	}
+	if l.MaxBytes == 0 && meta.Bytes != nil {
+		meta.Bytes, changed = nil, true
+	}
+	if (l.MaxLength > 0 && meta.Count == nil) || (l.MaxBytes > 0 && meta.Bytes == nil) {
+		size, err := storedSize(tx, queue, 0, math.MaxUint64)
+		if err != nil {
+			return false, err
+		}
+		if l.MaxLength > 0 && meta.Count == nil {
+			meta.Count = &size.count
+		}
+		if l.MaxBytes > 0 && meta.Bytes == nil {
+			meta.Bytes = &size.bytes
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// makeRoom applies the stored limits of queue before a message of size bytes
+// is appended to it, in the same transaction. It returns the number of
+// messages dropped by OverflowDropOldest, or ErrQueueFull if the message does
+// not fit. The size of the queue comes from the running totals in its
+// metadata, so only the messages dropped are read.
+func makeRoom(tx Tx, queue string, size int) (int, error) {
+	meta, err := readQueueMeta(tx, queue)
+	if err != nil || meta.Limits == nil || !meta.Limits.bounded() {
+		return 0, err
+	}
+	l := *meta.Limits
+	if l.MaxBytes > 0 && int64(size) > l.MaxBytes {
+		return 0, NewDBError(CodeQueueFull, fmt.Errorf("message of %d bytes exceeds max bytes %d", size, l.MaxBytes), queue)
+	}
+	changed, err := meta.trackSize(tx, queue)
+	if err != nil {
+		return 0, err
+	}
+	if changed {
+		if err := writeQueueMeta(tx, queue, meta); err != nil {
+			return 0, err
+		}
+	}
+
+	drop := 0
+	if l.MaxLength > 0 && *meta.Count >= int64(l.MaxLength) {
+		drop = int(*meta.Count) - l.MaxLength + 1
+	}
+	var bytes int64
+	if l.MaxBytes > 0 {
+		bytes = *meta.Bytes
+	}
+	over := l.MaxBytes > 0 && bytes+int64(size) > l.MaxBytes
+	if drop == 0 && !over {
+		return 0, nil
+	}
+	if l.Overflow != OverflowDropOldest {
+		return 0, NewDBError(CodeQueueFull, fmt.Errorf("queue is full (%s)", l.describe()), queue)
+	}
+
+	// 从最旧的消息开始删，直到条数和字节数都放得下
+	var (
+		first, last uint64
+		n           int
+		freed       int64
+	)
+	err = tx.Scan(queue, 0, func(seq uint64, value []byte) bool {
+		if n >= drop && (l.MaxBytes == 0 || bytes-freed+int64(size) <= l.MaxBytes) {
+			return false
+		}
+		if n == 0 {
+			first = seq
+		}
+		last = seq
+		freed += int64(len(value))
+		n++
+		return true
+	})
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return n, tx.DeleteRange(queue, first, last)
+}
+
+// sizeCounter is the Tx handed out by dbClient.update. It keeps the running
+// totals in the metadata of bounded queues up to date as messages are
+// appended and deleted, whatever deletes them: cleanup, retention,
+// OverflowDropOldest, Purge or Repair. The totals are written as it goes, so
+// that makeRoom sees the messages appended earlier in the same transaction.
+type sizeCounter struct {
+	Tx
+	tracked map[string]bool // queue -> whether its metadata holds a running total
+}
+
+func newSizeCounter(tx Tx) *sizeCounter {
+	return &sizeCounter{Tx: tx, tracked: make(map[string]bool)}
+}
+
+func (t *sizeCounter) isTracked(queue string) (bool, error) {
+	if tracked, ok := t.tracked[queue]; ok {
+		return tracked, nil
+	}
+	meta, err := readQueueMeta(t.Tx, queue)
+	if err != nil {
+		return false, err
+	}
+	tracked := meta.Count != nil || meta.Bytes != nil
+	t.tracked[queue] = tracked
+	return tracked, nil
+}
+
+// add adds delta to the running totals of queue.
+func (t *sizeCounter) add(queue string, delta queueSize) error {
+	meta, err := readQueueMeta(t.Tx, queue)
+	if err != nil {
+		return err
+	}
+	if meta.Count != nil {
+		*meta.Count += delta.count
+	}
+	if meta.Bytes != nil {
+		*meta.Bytes += delta.bytes
+	}
+	return writeQueueMeta(t.Tx, queue, meta)
+}
+
+func (t *sizeCounter) Append(queue string, value []byte) (uint64, error) {
+	seq, err := t.Tx.Append(queue, value)
+	if err != nil {
+		return seq, err
+	}
+	tracked, err := t.isTracked(queue)
+	if tracked {
+		err = t.add(queue, queueSize{count: 1, bytes: int64(len(value))})
+	}
+	return seq, err
+}
+
+func (t *sizeCounter) DeleteRange(queue string, from, to uint64) error {
+	tracked, err := t.isTracked(queue)
+	if err != nil {
+		return err
+	}
+	if !tracked {
+		return t.Tx.DeleteRange(queue, from, to)
+	}
+	freed, err := storedSize(t.Tx, queue, from, to)
+	if err != nil {
+		return err
+	}
+	if err := t.Tx.DeleteRange(queue, from, to); err != nil {
+		return err
+	}
+	return t.add(queue, queueSize{count: -freed.count, bytes: -freed.bytes})
+}
+
+// Put and Delete forget what they may have changed about a queue's metadata,
+// so that a running total set up in this transaction is picked up.
+func (t *sizeCounter) Put(bucket, key string, value []byte) error {
+	if bucket == metaBucket {
+		delete(t.tracked, key)
+	}
+	return t.Tx.Put(bucket, key, value)
+}
+
+func (t *sizeCounter) Delete(bucket, key string) error {
+	if bucket == metaBucket {
+		delete(t.tracked, key)
+	}
+	return t.Tx.Delete(bucket, key)
+}
+
+func (t *sizeCounter) DeleteQueue(queue string) error {
+	delete(t.tracked, queue)
+	return t.Tx.DeleteQueue(queue)
+}
+
+// RenameQueue forgets both names; the metadata moves with the queue.
+func (t *sizeCounter) RenameQueue(from, to string) error {
+	delete(t.tracked, from)
+	delete(t.tracked, to)
+	return t.Tx.RenameQueue(from, to)
+}
+
+func (l QueueLimits) describe() string {
+	switch {
+	case l.MaxLength > 0 && l.MaxBytes > 0:
+		return fmt.Sprintf("max length %d, max bytes %d", l.MaxLength, l.MaxBytes)
+	case l.MaxLength > 0:
+		return fmt.Sprintf("max length %d", l.MaxLength)
+	}
+	return fmt.Sprintf("max bytes %d", l.MaxBytes)
+}
+
+// freedPoll is how often a blocked Enqueue looks for room made by other
+// processes, which do not wake it.
+const freedPoll = time.Second
+
+// waitForRoom waits until ready is closed, the block timeout of the queue's
+// limits has passed since start, or ctx is done. It reports whether it is
+// worth trying again.
+func (client *dbClient) waitForRoom(ctx context.Context, queue string, start time.Time, ready <-chan struct{}) bool {
+	var limits QueueLimits
+	err := client.view(func(tx Tx) error {
+		meta, err := readQueueMeta(tx, queue)
+		if meta.Limits != nil {
+			limits = *meta.Limits
+		}
+		return err
+	})
+	if err != nil || limits.Overflow != OverflowBlock {
+		return false
+	}
+	wait := freedPoll
+	if limits.BlockTimeout > 0 {
+		left := limits.BlockTimeout - time.Since(start)
+		if left <= 0 {
+			return false
+		}
+		wait = min(wait, left)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
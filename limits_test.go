@@ -0,0 +1,234 @@
+package bunnymq
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueueLimits(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		// 每条消息 envelope 之后的大小都一样
+		payload, _ := (&JsonCoder[testStruct]{}).Encode(testStruct{Message: "m1"})
+		size := int64(len(encodeEnvelope(envelope{timestamp: time.Now(), payload: payload})))
+		bounded, err := OpenQueue[testStruct](db, "bounded", &JsonCoder[testStruct]{}, WithMaxBytes(2*size+size/2))
+		if err != nil {
+			t.Fatalf("OpenQueue: %v", err)
+		}
+		for i := 1; i <= 2; i++ {
+			if err := bounded.Enqueue(testStruct{Message: "m" + strconv.Itoa(i)}); err != nil {
+				t.Fatalf("Enqueue %d: %v", i, err)
+			}
+		}
+		if err := bounded.Enqueue(testStruct{Message: "m3"}); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("Enqueue past max bytes: got %v, want ErrQueueFull", err)
+		}
+
+		// 不带选项打开同一个队列，照样受存下来的限制约束
+		again, _ := OpenQueue[testStruct](db, "bounded", &JsonCoder[testStruct]{})
+		if err := again.Enqueue(testStruct{Message: "m3"}); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("Enqueue through a queue opened without limits: got %v, want ErrQueueFull", err)
+		}
+		if err := db.SetQueueLimits("bounded", QueueLimits{MaxLength: 3, Overflow: OverflowDropOldest}); err != nil {
+			t.Fatalf("SetQueueLimits: %v", err)
+		}
+		for i := 3; i <= 5; i++ {
+			if err := again.Enqueue(testStruct{Message: "m" + strconv.Itoa(i)}); err != nil {
+				t.Fatalf("Enqueue %d under drop-oldest: %v", i, err)
+			}
+		}
+		msgs, _ := db.Peek("bounded", 1, 10)
+		if len(msgs) != 3 || msgs[0].Seq != 3 {
+			t.Fatalf("messages after dropping = %+v, want seqs 3-5", msgs)
+		}
+		if msg, err := again.Dequeue("late"); err != nil || msg.Data().Message != "m3" {
+			t.Fatalf("Dequeue after dropping = %v, %v; want m3", msg, err)
+		}
+
+		if err := db.RenameQueue("bounded", "renamed"); err != nil {
+			t.Fatalf("RenameQueue: %v", err)
+		}
+		if limits, err := db.QueueLimits("renamed"); err != nil || limits.MaxLength != 3 || limits.Overflow != OverflowDropOldest {
+			t.Fatalf("limits after rename = %+v, %v", limits, err)
+		}
+		if limits, _ := db.QueueLimits("bounded"); limits != (QueueLimits{}) {
+			t.Errorf("limits left under the old name: %+v", limits)
+		}
+		db.SetQueueLimits("renamed", QueueLimits{})
+		renamed, _ := OpenQueue[testStruct](db, "renamed", &JsonCoder[testStruct]{})
+		for i := 0; i < 5; i++ {
+			if err := renamed.Enqueue(testStruct{}); err != nil {
+				t.Fatalf("Enqueue after removing the limits: %v", err)
+			}
+		}
+
+		if _, err := OpenQueue[testStruct](db, "x", &JsonCoder[testStruct]{}, WithOverflow(OverflowPolicy(9))); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("unknown overflow policy: got %v, want ErrInvalidOption", err)
+		}
+		if err := db.SetQueueLimits("x", QueueLimits{MaxBytes: -1}); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("negative max bytes: got %v, want ErrInvalidOption", err)
+		}
+	})
+}
+
+func TestOverflowBlock(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "block.db")
+	queue, err := NewQueue[testStruct]("block", dbPath, &JsonCoder[testStruct]{},
+		WithMaxLength(1), WithOverflow(OverflowBlock), WithBlockTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	defer queue.Close()
+	queue.Enqueue(testStruct{Message: "first"})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		msg, _ := queue.Dequeue("c")
+		msg.Ack()
+		CleanDB(dbPath)
+	}()
+	start := time.Now()
+	if err := queue.Enqueue(testStruct{Message: "second"}); err != nil {
+		t.Fatalf("blocked Enqueue: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 4*time.Second {
+		t.Errorf("blocked Enqueue returned after %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := queue.EnqueueContext(ctx, testStruct{}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Enqueue blocked until the context ended: got %v, want ErrQueueFull", err)
+	}
+	db, _ := Open(dbPath)
+	defer db.Close()
+	db.SetQueueLimits("block", QueueLimits{MaxLength: 1, Overflow: OverflowBlock, BlockTimeout: 30 * time.Millisecond})
+	start = time.Now()
+	if err := queue.Enqueue(testStruct{}); !errors.Is(err, ErrQueueFull) || time.Since(start) < 30*time.Millisecond {
+		t.Fatalf("Enqueue past the block timeout: got %v after %v", err, time.Since(start))
+	}
+}
+
+// 限字节数的队列在元数据里记总字节数，入队、丢弃、清理和 Purge 都要跟着改，
+// 取消字节限制后不再记
+func TestQueueRunningTotals(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		check := func(when string) {
+			t.Helper()
+			err := db.client.view(func(tx Tx) error {
+				meta, err := readQueueMeta(tx, "sized")
+				if err != nil {
+					return err
+				}
+				want, err := storedSize(tx, "sized", 0, math.MaxUint64)
+				if err != nil {
+					return err
+				}
+				switch {
+				case meta.Count == nil:
+					t.Errorf("%s: no message count, want %d", when, want.count)
+				case *meta.Count != want.count || want.count > 20:
+					t.Errorf("%s: message count = %d, want %d (at most 20)", when, *meta.Count, want.count)
+				}
+				switch {
+				case meta.Bytes == nil:
+					t.Errorf("%s: no byte total, want %d", when, want.bytes)
+				case *meta.Bytes != want.bytes || want.bytes > 1000:
+					t.Errorf("%s: byte total = %d, want %d (at most 1000)", when, *meta.Bytes, want.bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", when, err)
+			}
+		}
+
+		queue, err := OpenQueue[testStruct](db, "sized", &JsonCoder[testStruct]{})
+		if err != nil {
+			t.Fatalf("OpenQueue: %v", err)
+		}
+		// 设限制之前已有的消息也要算进去
+		for i := 0; i < 3; i++ {
+			if err := queue.Enqueue(testStruct{Message: strconv.Itoa(i)}); err != nil {
+				t.Fatalf("Enqueue: %v", err)
+			}
+		}
+		if err := db.SetQueueLimits("sized", QueueLimits{MaxLength: 20, MaxBytes: 1000, Overflow: OverflowDropOldest}); err != nil {
+			t.Fatalf("SetQueueLimits: %v", err)
+		}
+		check("after setting limits")
+		for i := 3; i < 40; i++ {
+			if err := queue.Enqueue(testStruct{Message: strconv.Itoa(i)}); err != nil {
+				t.Fatalf("Enqueue %d: %v", i, err)
+			}
+		}
+		check("after dropping the oldest")
+		for i := 0; i < 4; i++ {
+			msg, err := queue.Dequeue("c")
+			if err != nil {
+				t.Fatalf("Dequeue: %v", err)
+			}
+			msg.Ack()
+		}
+		if err := db.Clean(); err != nil {
+			t.Fatalf("Clean: %v", err)
+		}
+		check("after cleanup")
+		if _, err := db.Purge("sized"); err != nil {
+			t.Fatalf("Purge: %v", err)
+		}
+		check("after purge")
+
+		if err := db.SetQueueLimits("sized", QueueLimits{}); err != nil {
+			t.Fatalf("SetQueueLimits: %v", err)
+		}
+		db.client.view(func(tx Tx) error {
+			if meta, _ := readQueueMeta(tx, "sized"); meta.Count != nil || meta.Bytes != nil {
+				t.Errorf("running totals kept without limits")
+			}
+			return nil
+		})
+	})
+}
+
+func TestLimitsWithinOneTransaction(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		if err := db.SetQueueLimits("batch", QueueLimits{MaxLength: 2}); err != nil {
+			t.Fatalf("SetQueueLimits: %v", err)
+		}
+		// 同一个事务里后面的检查要看到前面追加的消息
+		err = db.client.update(func(tx Tx) error {
+			for i := 0; i < 3; i++ {
+				if _, err := makeRoom(tx, "batch", 1); err != nil {
+					return err
+				}
+				if _, err := tx.Append("batch", []byte("m")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("third append in one transaction: got %v, want ErrQueueFull", err)
+		}
+	})
+}
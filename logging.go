@@ -0,0 +1,119 @@
+package bunnymq
+
+import "time"
+
+// Logger is the logging interface used by queues and database clients. It is
+// method-compatible with *slog.Logger, so slog.Default() or any handler-backed
+// slog logger can be passed directly. The default logger discards everything.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// Event describes a single message operation reported to Hooks.
+type Event struct {
+	Queue      string
+	ConsumerID string // empty for OnEnqueue
+	Seq        uint64 // sequence number of the message in its queue
+	Time       time.Time
+}
+
+// CleanupEvent describes a CleanDB run on a database file.
+type CleanupEvent struct {
+	Path     string
+	Duration time.Duration
+	Err      error
+}
+
+// Hooks are optional callbacks for audit events. Each hook runs synchronously
+// after the operation has been committed, outside the queue lock, so it may
+// call back into the queue. Nil hooks are skipped.
+type Hooks struct {
+	OnEnqueue    func(Event)
+	OnAck        func(Event)
+	OnNAck       func(Event)
+	OnDeadLetter func(Event)
+	OnCleanup    func(CleanupEvent)
+}
+
+func (h *Hooks) enqueue(e Event) {
+	if h.OnEnqueue != nil {
+		h.OnEnqueue(e)
+	}
+}
+
+func (h *Hooks) ack(e Event) {
+	if h.OnAck != nil {
+		h.OnAck(e)
+	}
+}
+
+func (h *Hooks) nack(e Event) {
+	if h.OnNAck != nil {
+		h.OnNAck(e)
+	}
+}
+
+func (h *Hooks) deadLetter(e Event) {
+	if h.OnDeadLetter != nil {
+		h.OnDeadLetter(e)
+	}
+}
+
+func (h *Hooks) cleanup(e CleanupEvent) {
+	if h.OnCleanup != nil {
+		h.OnCleanup(e)
+	}
+}
+
+// SetLogger sets the logger used by the queue and, because database clients
+// are shared per path, by the database client behind it. A nil logger restores
+// the silent default.
+func (q *Queue[T]) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	q.mu.Lock()
+	q.logger = logger
+	q.mu.Unlock()
+	q.db.setLogger(logger)
+}
+
+// SetHooks replaces the queue's hooks. OnCleanup is registered on the database
+// client and fires for CleanDB runs on the queue's path.
+func (q *Queue[T]) SetHooks(hooks Hooks) {
+	q.mu.Lock()
+	q.hooks = hooks
+	q.mu.Unlock()
+	q.db.setCleanupHook(hooks.OnCleanup)
+}
+
+func (client *dbClient) setLogger(logger Logger) {
+	client.stateMu.Lock()
+	client.logger = logger
+	client.stateMu.Unlock()
+	if s, ok := client.store.(interface{ setLogger(Logger) }); ok {
+		s.setLogger(logger)
+	}
+}
+
+func (client *dbClient) setCleanupHook(fn func(CleanupEvent)) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	client.hooks.OnCleanup = fn
+}
+
+func (client *dbClient) log() Logger {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	return client.logger
+}
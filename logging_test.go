@@ -0,0 +1,58 @@
+package bunnymq
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQueueHooksAndLogger(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "hooks.db")
+	queue, err := NewQueue[testStruct]("hooks_queue", dbPath, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	var buf bytes.Buffer
+	queue.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	var events []string
+	var cleanups []CleanupEvent
+	queue.SetHooks(Hooks{
+		OnEnqueue: func(e Event) { events = append(events, "enqueue:"+e.Queue) },
+		OnAck:     func(e Event) { events = append(events, "ack:"+e.ConsumerID) },
+		OnNAck:    func(e Event) { events = append(events, "nack:"+e.ConsumerID) },
+		OnCleanup: func(e CleanupEvent) { cleanups = append(cleanups, e) },
+	})
+
+	if err := queue.Enqueue(testStruct{Message: "hello"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+	msg, err := queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if err := msg.NAck(); err != nil {
+		t.Fatalf("Error calling NAck: %v", err)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Error acknowledging message: %v", err)
+	}
+	if err := CleanDB(dbPath); err != nil {
+		t.Fatalf("Error cleaning database: %v", err)
+	}
+
+	want := []string{"enqueue:hooks_queue", "nack:c1", "ack:c1"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected events %v, want %v", events, want)
+	}
+	if len(cleanups) != 1 || cleanups[0].Path != dbPath || cleanups[0].Err != nil {
+		t.Errorf("unexpected cleanup events %+v", cleanups)
+	}
+	if !strings.Contains(buf.String(), "bunnymq: enqueued") || !strings.Contains(buf.String(), "bunnymq: cleanup finished") {
+		t.Errorf("expected debug and cleanup log lines, got:\n%s", buf.String())
+	}
+}
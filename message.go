@@ -2,6 +2,8 @@ package bunnymq
 
 import (
 	"errors"
+	"strconv"
+	"time"
 )
 
 type MessageStore[V any] struct {
@@ -14,47 +16,79 @@ func NewMessageStore[V any](dbClient *dbClient, coder Coder[V]) (*MessageStore[V
 }
 
 func (ms *MessageStore[V]) Write(bucketName string, value V) error {
+	_, _, err := ms.write(bucketName, value, nil)
+	return err
+}
+
+// write encodes value together with its headers and stores it, returning the
+// sequence number it was stored under and how many old messages the queue's
+// overflow policy dropped to make room.
+func (ms *MessageStore[V]) write(bucketName string, value V, headers Headers) (uint64, int, error) {
 	// Encode the value using the coder
-	data, err := ms.coder.Encode(value)
+	payload, err := ms.coder.Encode(value)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
+	data := encodeEnvelope(envelope{headers: headers, timestamp: time.Now(), payload: payload})
 
-	err = ms.StoreByte(bucketName, data)
+	seq, dropped, err := ms.dbClient.putWithAutoIncrementKey(bucketName, data)
 	if err != nil {
 		if errors.Is(err, ErrBucketNotFound) {
 
-			err = ms.StoreByte(bucketName, data)
+			seq, dropped, err = ms.dbClient.putWithAutoIncrementKey(bucketName, data)
 			if err != nil {
-				return err
+				return 0, 0, err
 			}
 		} else {
-			return err
+			return 0, 0, err
 		}
 	}
-	return nil
+	return seq, dropped, nil
 }
 
 func (ms *MessageStore[V]) Read(bucketName, progress string) (V, error) {
+	value, _, _, err := ms.read(bucketName, progress)
+	return value, err
+}
 
+// read returns the decoded value stored under progress, or under the next
+// existing key if that message has been removed, along with its envelope and
+// the sequence number it was found at.
+func (ms *MessageStore[V]) read(bucketName, progress string) (V, envelope, int64, error) {
+	var zero V
+	env, seq, err := ms.readEnvelope(bucketName, progress)
+	if err != nil {
+		return zero, envelope{}, 0, err
+	}
+	// Decode the data using the coder
+	value, err := ms.coder.Decode(env.payload)
+	if err != nil {
+		return zero, envelope{}, 0, err
+	}
+	return value, env, seq, nil
+}
+
+// readEnvelope is like read but leaves the payload undecoded.
+func (ms *MessageStore[V]) readEnvelope(bucketName, progress string) (envelope, int64, error) {
 	keyValue, err := ms.dbClient.getNext(bucketName, progress)
 	if err != nil {
-		var zero V
-		return zero, err
+		return envelope{}, 0, err
 	}
 	if keyValue == nil {
-		var zero V
-		return zero, ErrKeyNotFound
+		return envelope{}, 0, ErrKeyNotFound
 	}
-	// Decode the data using the coder
-	value, err := ms.coder.Decode(keyValue.value)
+	seq, err := strconv.ParseInt(keyValue.key, 10, 64)
+	if err != nil {
+		return envelope{}, 0, ErrFailedToDeserialize
+	}
+	env, err := decodeEnvelope(keyValue.value)
 	if err != nil {
-		var zero V
-		return zero, err
+		return envelope{}, 0, err
 	}
-	return value, nil
+	return env, seq, nil
 }
 
 func (ms *MessageStore[V]) StoreByte(bucketName string, message []byte) error {
-	return ms.dbClient.putWithAutoIncrementKey(bucketName, message)
+	_, _, err := ms.dbClient.putWithAutoIncrementKey(bucketName, message)
+	return err
 }
@@ -0,0 +1,141 @@
+package bunnymq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 队列的配置，按队列名存
+const metaBucket = "_meta"
+
+// queueMeta is what the database records about a queue in metaBucket, as
+// JSON. Every field is optional so that records written by older versions
+// still decode.
+type queueMeta struct {
+	Created time.Time    `json:"created"`
+	Coder   string       `json:"coder,omitempty"`
+	Limits  *QueueLimits `json:"limits,omitempty"`
+	Count   *int64       `json:"count,omitempty"` // stored messages, kept only while Limits has MaxLength
+	Bytes   *int64       `json:"bytes,omitempty"` // stored bytes, kept only while Limits has MaxBytes
+}
+
+// readQueueMeta returns the metadata of queue, zero if none is stored.
+func readQueueMeta(tx Tx, queue string) (queueMeta, error) {
+	var meta queueMeta
+	value, err := tx.Get(metaBucket, queue)
+	if errors.Is(err, ErrKeyNotFound) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(value, &meta); err != nil {
+		return meta, NewDBError(CodeFailedToDeserialize, fmt.Errorf("metadata of queue %q: %w", queue, err), queue)
+	}
+	return meta, nil
+}
+
+// writeQueueMeta stores the metadata of queue.
+func writeQueueMeta(tx Tx, queue string, meta queueMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return tx.Put(metaBucket, queue, value)
+}
+
+// moveQueueMeta moves the metadata of queue from to queue to, or deletes it if
+// to is empty.
+func moveQueueMeta(tx Tx, from, to string) error {
+	value, err := tx.Get(metaBucket, from)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// 删除之后原来的值就不能再用了
+	value = append([]byte(nil), value...)
+	if err := tx.Delete(metaBucket, from); err != nil {
+		return err
+	}
+	if to == "" {
+		return nil
+	}
+	return tx.Put(metaBucket, to, value)
+}
+
+// QueueInfo is what the database records about a queue.
+type QueueInfo struct {
+	Created time.Time   // when the queue was first opened; zero if it predates the record
+	Coder   string      // the coder its messages are encoded with; empty if not recorded
+	Limits  QueueLimits // see SetQueueLimits
+}
+
+// QueueInfo returns what the database records about queue. A queue it knows
+// nothing about has a zero QueueInfo.
+func (db *DB) QueueInfo(queue string) (QueueInfo, error) {
+	if err := checkQueueName(queue); err != nil {
+		return QueueInfo{}, err
+	}
+	if db.isClosed() {
+		return QueueInfo{}, ErrDatabaseClosed
+	}
+	var info QueueInfo
+	err := db.client.view(func(tx Tx) error {
+		meta, err := readQueueMeta(tx, queue)
+		info.Created, info.Coder = meta.Created, meta.Coder
+		if meta.Limits != nil {
+			info.Limits = *meta.Limits
+		}
+		return err
+	})
+	return info, err
+}
+
+// recordQueue checks coder against the coder recorded for queue and, on first
+// use, records it along with the creation time of a new queue. A read-only
+// database is only checked.
+func (client *dbClient) recordQueue(queue, coder string) error {
+	// check 返回要写的元数据，不用写时返回 nil
+	check := func(tx Tx) (*queueMeta, error) {
+		meta, err := readQueueMeta(tx, queue)
+		if err != nil {
+			return nil, err
+		}
+		if coder != "" && meta.Coder != "" && meta.Coder != coder {
+			return nil, NewDBError(CodeCoderMismatch, fmt.Errorf("queue %q was written with %s, not %s", queue, meta.Coder, coder), queue)
+		}
+		changed := false
+		if coder != "" && meta.Coder == "" {
+			meta.Coder, changed = coder, true
+		}
+		if meta.Created.IsZero() {
+			// 已有消息的老队列不知道是什么时候建的，留空
+			if _, err := tx.Stats(queue); errors.Is(err, ErrBucketNotFound) {
+				meta.Created, changed = time.Now().UTC(), true
+			}
+		}
+		if !changed {
+			return nil, nil
+		}
+		return &meta, nil
+	}
+	var pending *queueMeta
+	err := client.view(func(tx Tx) (err error) {
+		pending, err = check(tx)
+		return err
+	})
+	if err != nil || pending == nil || client.readOnly {
+		return err
+	}
+	return client.update(func(tx Tx) error {
+		meta, err := check(tx)
+		if err != nil || meta == nil {
+			return err
+		}
+		return writeQueueMeta(tx, queue, *meta)
+	})
+}
@@ -0,0 +1,162 @@
+package bunnymq
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq/metrics"
+)
+
+// queueMetrics holds the instruments a Queue reports to. The zero value, used
+// until metrics are enabled, records nothing because metrics instruments are
+// nil-safe.
+type queueMetrics struct {
+	registry     *metrics.Registry
+	enqueued     *metrics.Counter
+	dequeued     *metrics.Counter
+	acked        *metrics.Counter
+	nacked       *metrics.Counter
+	redelivered  *metrics.Counter
+	deadLettered *metrics.Counter
+	filtered     *metrics.Counter
+	dropped      *metrics.Counter
+	unregister   []func() // removes the gauges read from the database
+}
+
+func newQueueMetrics(reg *metrics.Registry, queueName string) *queueMetrics {
+	labels := metrics.Labels{"queue": queueName}
+	return &queueMetrics{
+		registry:     reg,
+		enqueued:     reg.Counter("bunnymq_messages_enqueued_total", "Messages written to the queue.", labels),
+		dequeued:     reg.Counter("bunnymq_messages_dequeued_total", "Messages handed to consumers.", labels),
+		acked:        reg.Counter("bunnymq_messages_acked_total", "Messages acknowledged by consumers.", labels),
+		nacked:       reg.Counter("bunnymq_messages_nacked_total", "Messages rejected by consumers.", labels),
+		redelivered:  reg.Counter("bunnymq_messages_redelivered_total", "Messages handed to the same consumer more than once.", labels),
+		deadLettered: reg.Counter("bunnymq_messages_dead_lettered_total", "Messages moved to the dead-letter queue.", labels),
+		filtered:     reg.Counter("bunnymq_messages_filtered_total", "Messages skipped by a consumer's filter.", labels),
+		dropped:      reg.Counter("bunnymq_messages_dropped_total", "Messages deleted by the drop-oldest overflow policy.", labels),
+	}
+}
+
+// EnableMetrics registers the queue's counters and gauges with reg. Queue depth
+// and consumer lag are read from the database at scrape time; the database file
+// gets a transaction latency histogram and a file size gauge, shared by all
+// queues on the same path.
+func (q *Queue[T]) EnableMetrics(reg *metrics.Registry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.metrics.registry == reg {
+		return
+	}
+	q.metrics.unregisterGauges()
+	m := newQueueMetrics(reg, q.queueName)
+	labels := metrics.Labels{"queue": q.queueName}
+	m.unregister = []func(){
+		reg.GaugeFunc("bunnymq_queue_depth", "Messages currently stored in the queue.", labels, q.db.depthCollector(q.queueName)),
+		reg.GaugeFunc("bunnymq_consumer_lag", "Messages not yet acknowledged by a consumer.", labels, q.db.lagCollector(q.queueName)),
+	}
+	q.metrics = m
+	q.db.instrument(reg)
+}
+
+// unregisterGauges removes the queue's gauges from their registry, when the
+// queue is closed or switches registries. Its counters stay, so that they
+// carry on if the queue is opened again.
+func (m *queueMetrics) unregisterGauges() {
+	for _, unregister := range m.unregister {
+		unregister()
+	}
+	m.unregister = nil
+}
+
+// instrument attaches the per-file instruments once per registry.
+func (client *dbClient) instrument(reg *metrics.Registry) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	if client.registry == reg {
+		return
+	}
+	client.registry = reg
+	labels := metrics.Labels{"path": client.dbPath}
+	client.txDuration = reg.Histogram("bunnymq_tx_duration_seconds", "Latency of write transactions, including commit.", nil, labels)
+	if _, ok := client.sizeGauges[reg]; ok {
+		return
+	}
+	client.sizeGauges[reg] = reg.GaugeFunc("bunnymq_db_file_size_bytes", "Size of the database file.", labels, func() []metrics.Sample {
+		info, err := os.Stat(client.dbPath)
+		if err != nil {
+			return nil
+		}
+		return []metrics.Sample{{Labels: labels, Value: float64(info.Size())}}
+	})
+}
+
+// unregisterMetrics removes the file size gauges once the file is closed.
+func (client *dbClient) unregisterMetrics() {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+	for reg, unregister := range client.sizeGauges {
+		unregister()
+		delete(client.sizeGauges, reg)
+	}
+}
+
+func (client *dbClient) observeTx(start time.Time) {
+	client.stateMu.Lock()
+	h := client.txDuration
+	client.stateMu.Unlock()
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (client *dbClient) depthCollector(queueName string) metrics.CollectFunc {
+	return func() []metrics.Sample {
+		var depth int
+		err := client.view(func(tx Tx) error {
+			stats, err := tx.Stats(queueName)
+			if err != nil && !errors.Is(err, ErrBucketNotFound) {
+				return err
+			}
+			depth = stats.Count
+			return nil
+		})
+		if err != nil {
+			return nil
+		}
+		return []metrics.Sample{{Labels: metrics.Labels{"queue": queueName}, Value: float64(depth)}}
+	}
+}
+
+func (client *dbClient) lagCollector(queueName string) metrics.CollectFunc {
+	return func() []metrics.Sample {
+		var samples []metrics.Sample
+		_ = client.view(func(tx Tx) error {
+			stats, err := tx.Stats(queueName)
+			if err != nil && !errors.Is(err, ErrBucketNotFound) {
+				return err
+			}
+			last := stats.LastSeq
+			return tx.ForEach(consumerProgressBucket, func(key string, v []byte) error {
+				consumer, queue, ok := splitProgressKey(key)
+				if !ok || queue != queueName {
+					return nil
+				}
+				progress, err := strconv.ParseUint(string(v), 10, 64)
+				if err != nil {
+					return nil
+				}
+				lag := float64(0)
+				if last > progress {
+					lag = float64(last - progress)
+				}
+				samples = append(samples, metrics.Sample{
+					Labels: metrics.Labels{"queue": queueName, "consumer": consumer},
+					Value:  lag,
+				})
+				return nil
+			})
+		})
+		return samples
+	}
+}
@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ServeHTTP writes the registry in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	_, _ = r.WriteTo(w)
+}
+
+// WriteTo writes all families to w, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw, r)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (f *family) write(w *countingWriter, r *Registry) {
+	// 快照当前的序列，collector 在锁外执行，避免在抓取时阻塞写入方
+	r.mu.Lock()
+	sigs := make([]string, 0, len(f.series))
+	for sig := range f.series {
+		sigs = append(sigs, sig)
+	}
+	sort.Strings(sigs)
+	series := make([]any, len(sigs))
+	for i, sig := range sigs {
+		series[i] = f.series[sig]
+	}
+	collectSigs := make([]string, 0, len(f.collects))
+	for sig := range f.collects {
+		collectSigs = append(collectSigs, sig)
+	}
+	sort.Strings(collectSigs)
+	collects := make([]CollectFunc, len(collectSigs))
+	for i, sig := range collectSigs {
+		collects[i] = f.collects[sig].fn
+	}
+	r.mu.Unlock()
+
+	var samples []Sample
+	for _, fn := range collects {
+		samples = append(samples, fn()...)
+	}
+	if len(series) == 0 && len(samples) == 0 {
+		return
+	}
+
+	w.put("# HELP ", f.name, " ", escapeHelp(f.help), "\n")
+	w.put("# TYPE ", f.name, " ", string(f.typ), "\n")
+	for _, s := range series {
+		switch m := s.(type) {
+		case *Counter:
+			w.put(f.name, formatLabels(m.labels, "", ""), " ", strconv.FormatUint(m.Value(), 10), "\n")
+		case *Gauge:
+			w.put(f.name, formatLabels(m.labels, "", ""), " ", formatFloat(m.Value()), "\n")
+		case *Histogram:
+			writeHistogram(w, f.name, m)
+		}
+	}
+	for _, s := range samples {
+		w.put(f.name, formatLabels(s.Labels, "", ""), " ", formatFloat(s.Value), "\n")
+	}
+}
+
+func writeHistogram(w *countingWriter, name string, h *Histogram) {
+	var cumulative uint64
+	for i, ub := range h.upper {
+		cumulative += h.buckets[i].Load()
+		w.put(name, "_bucket", formatLabels(h.labels, "le", formatFloat(ub)), " ", strconv.FormatUint(cumulative, 10), "\n")
+	}
+	count := h.count.Load()
+	w.put(name, "_bucket", formatLabels(h.labels, "le", "+Inf"), " ", strconv.FormatUint(count, 10), "\n")
+	h.mu.Lock()
+	sum := h.sum
+	h.mu.Unlock()
+	w.put(name, "_sum", formatLabels(h.labels, "", ""), " ", formatFloat(sum), "\n")
+	w.put(name, "_count", formatLabels(h.labels, "", ""), " ", strconv.FormatUint(count, 10), "\n")
+}
+
+// formatLabels renders labels in sorted order, optionally appending one extra pair.
+func formatLabels(labels Labels, extraName, extraValue string) string {
+	if len(labels) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	first := true
+	add := func(k, v string) {
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(v))
+		b.WriteByte('"')
+	}
+	for _, k := range sortedKeys(labels) {
+		add(k, labels[k])
+	}
+	if extraName != "" {
+		add(extraName, extraValue)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string       { return helpEscaper.Replace(s) }
+func escapeLabelValue(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) put(parts ...string) {
+	for _, p := range parts {
+		if cw.err != nil {
+			return
+		}
+		n, err := cw.w.WriteString(p)
+		cw.n += int64(n)
+		cw.err = err
+	}
+}
@@ -0,0 +1,297 @@
+// Package metrics is a small, dependency-free registry of counters, gauges
+// and histograms that renders in the Prometheus text exposition format.
+//
+// A *Registry is an http.Handler, so it can be mounted directly on a mux:
+//
+//	reg := metrics.NewRegistry()
+//	queue.EnableMetrics(reg)
+//	http.Handle("/metrics", reg)
+//
+// All instrument methods are safe to call on a nil receiver, which lets
+// instrumented code record unconditionally whether or not metrics are enabled.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Labels is a set of label name/value pairs attached to a series.
+type Labels map[string]string
+
+// Sample is a single value reported by a collector function.
+type Sample struct {
+	Labels Labels
+	Value  float64
+}
+
+// CollectFunc produces samples at scrape time. It is used for values that are
+// cheaper to compute on demand than to keep up to date, such as queue depth.
+type CollectFunc func() []Sample
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// DefBuckets are the default histogram buckets, in seconds.
+var DefBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+type family struct {
+	name     string
+	help     string
+	typ      metricType
+	series   map[string]any        // label signature -> *Counter | *Gauge | *Histogram
+	collects map[string]*collector // label signature -> collector
+}
+
+// collector is a registered CollectFunc. It is compared by pointer, so that
+// unregistering a function that has been replaced leaves its replacement.
+type collector struct {
+	fn CollectFunc
+}
+
+// Registry holds metric families keyed by name.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) family(name, help string, typ metricType) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, series: make(map[string]any), collects: make(map[string]*collector)}
+		r.families[name] = f
+	}
+	if f.typ != typ {
+		panic("metrics: " + name + " registered as " + string(f.typ) + ", not " + string(typ))
+	}
+	return f
+}
+
+// Counter returns the counter with the given name and labels, creating it on
+// first use. Repeated calls with the same name and labels return the same counter.
+func (r *Registry) Counter(name, help string, labels Labels) *Counter {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, help, typeCounter)
+	sig := signature(labels)
+	if c, ok := f.series[sig]; ok {
+		return c.(*Counter)
+	}
+	c := &Counter{labels: copyLabels(labels)}
+	f.series[sig] = c
+	return c
+}
+
+// Gauge returns the gauge with the given name and labels, creating it on first use.
+func (r *Registry) Gauge(name, help string, labels Labels) *Gauge {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, help, typeGauge)
+	sig := signature(labels)
+	if g, ok := f.series[sig]; ok {
+		return g.(*Gauge)
+	}
+	g := &Gauge{labels: copyLabels(labels)}
+	f.series[sig] = g
+	return g
+}
+
+// Histogram returns the histogram with the given name and labels, creating it
+// on first use. buckets must be sorted ascending; nil selects DefBuckets.
+// Buckets are fixed by the first call for a given series.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels Labels) *Histogram {
+	if r == nil {
+		return nil
+	}
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, help, typeHistogram)
+	sig := signature(labels)
+	if h, ok := f.series[sig]; ok {
+		return h.(*Histogram)
+	}
+	h := &Histogram{
+		labels:  copyLabels(labels),
+		upper:   append([]float64(nil), buckets...),
+		buckets: make([]atomic.Uint64, len(buckets)),
+	}
+	f.series[sig] = h
+	return h
+}
+
+// GaugeFunc registers fn to be called on every scrape; each returned sample is
+// rendered as a gauge series of the named family. labels identify fn within
+// the family, e.g. the queue it reports on: registering another function under
+// the same name and labels replaces it, so that the same series is never
+// reported twice. The returned function unregisters fn, unless it has been
+// replaced since.
+func (r *Registry) GaugeFunc(name, help string, labels Labels, fn CollectFunc) (unregister func()) {
+	if r == nil {
+		return func() {}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, help, typeGauge)
+	sig := signature(labels)
+	c := &collector{fn: fn}
+	f.collects[sig] = c
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if f.collects[sig] == c {
+			delete(f.collects, sig)
+		}
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	labels Labels
+	v      atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	c.v.Add(n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.v.Load()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	labels Labels
+	bits   atomic.Uint64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	if g == nil {
+		return
+	}
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add adds delta (which may be negative) to the gauge.
+func (g *Gauge) Add(delta float64) {
+	if g == nil {
+		return
+	}
+	for {
+		old := g.bits.Load()
+		nv := math.Float64bits(math.Float64frombits(old) + delta)
+		if g.bits.CompareAndSwap(old, nv) {
+			return
+		}
+	}
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	labels  Labels
+	upper   []float64
+	buckets []atomic.Uint64
+	count   atomic.Uint64
+	mu      sync.Mutex
+	sum     float64
+}
+
+// Observe records a single observation.
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	for i, ub := range h.upper {
+		if v <= ub {
+			h.buckets[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.mu.Lock()
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	return h.count.Load()
+}
+
+func signature(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, k := range sortedKeys(labels) {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func sortedKeys(labels Labels) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func copyLabels(labels Labels) Labels {
+	if len(labels) == 0 {
+		return nil
+	}
+	out := make(Labels, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
+}
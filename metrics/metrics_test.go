@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("jobs_total", "Jobs processed.", Labels{"queue": "a"})
+	c.Add(3)
+	reg.Counter("jobs_total", "Jobs processed.", Labels{"queue": `b"x`}).Inc()
+	reg.Gauge("temperature", "Current temperature.", nil).Set(21.5)
+	h := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1}, nil)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+	reg.GaugeFunc("depth", "Depth.", Labels{"queue": "a"}, func() []Sample {
+		return []Sample{{Labels: Labels{"queue": "a"}, Value: 7}}
+	})
+
+	if got := reg.Counter("jobs_total", "Jobs processed.", Labels{"queue": "a"}); got != c {
+		t.Fatalf("Counter did not return the existing series")
+	}
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	want := `# HELP depth Depth.
+# TYPE depth gauge
+depth{queue="a"} 7
+# HELP jobs_total Jobs processed.
+# TYPE jobs_total counter
+jobs_total{queue="a"} 3
+jobs_total{queue="b\"x"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.55
+latency_seconds_count 3
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature 21.5
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeFuncReplaceAndUnregister(t *testing.T) {
+	reg := NewRegistry()
+	gauge := func(v float64) CollectFunc {
+		return func() []Sample { return []Sample{{Labels: Labels{"queue": "a"}, Value: v}} }
+	}
+	scrape := func() string {
+		t.Helper()
+		var b strings.Builder
+		if _, err := reg.WriteTo(&b); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		return b.String()
+	}
+	unregisterOld := reg.GaugeFunc("depth", "Depth.", Labels{"queue": "a"}, gauge(1))
+	// 同名同标签再注册一次是替换，不会输出两遍
+	unregisterNew := reg.GaugeFunc("depth", "Depth.", Labels{"queue": "a"}, gauge(2))
+	want := "# HELP depth Depth.\n# TYPE depth gauge\ndepth{queue=\"a\"} 2\n"
+	if got := scrape(); got != want {
+		t.Fatalf("after registering twice:\n%s\nwant:\n%s", got, want)
+	}
+	// 已被替换的注销函数不影响新的
+	unregisterOld()
+	if got := scrape(); got != want {
+		t.Fatalf("after unregistering the replaced function:\n%s\nwant:\n%s", got, want)
+	}
+	unregisterNew()
+	if got := scrape(); got != "" {
+		t.Fatalf("after unregistering:\n%s\nwant nothing", got)
+	}
+	var nilReg *Registry
+	nilReg.GaugeFunc("depth", "", nil, gauge(1))()
+}
+
+func TestNilInstrumentsAreNoops(t *testing.T) {
+	var reg *Registry
+	c := reg.Counter("x", "", nil)
+	c.Inc()
+	reg.Gauge("y", "", nil).Set(1)
+	reg.Histogram("z", "", nil, nil).Observe(1)
+	if c.Value() != 0 {
+		t.Fatalf("nil counter reported a value")
+	}
+}
+
+func TestTypeConflictPanics(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("x", "", nil)
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "counter") {
+			t.Fatalf("expected type conflict panic, got %v", r)
+		}
+	}()
+	reg.Gauge("x", "", nil)
+}
@@ -0,0 +1,154 @@
+package bunnymq
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq/metrics"
+)
+
+func TestQueueMetrics(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "metrics.db")
+	queue, err := NewQueue[testStruct]("metrics_queue", dbPath, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	reg := metrics.NewRegistry()
+	queue.EnableMetrics(reg)
+
+	for i := 0; i < 3; i++ {
+		if err := queue.Enqueue(testStruct{Message: "m", Time: time.Now()}); err != nil {
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+	}
+	msg, err := queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if err := msg.NAck(); err != nil {
+		t.Fatalf("Error calling NAck: %v", err)
+	}
+	msg, err = queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message again: %v", err)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Error acknowledging message: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := reg.WriteTo(&buf); err != nil {
+		t.Fatalf("Error writing metrics: %v", err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`bunnymq_messages_enqueued_total{queue="metrics_queue"} 3`,
+		`bunnymq_messages_dequeued_total{queue="metrics_queue"} 2`,
+		`bunnymq_messages_acked_total{queue="metrics_queue"} 1`,
+		`bunnymq_messages_nacked_total{queue="metrics_queue"} 1`,
+		`bunnymq_messages_redelivered_total{queue="metrics_queue"} 1`,
+		`bunnymq_queue_depth{queue="metrics_queue"} 3`,
+		`bunnymq_consumer_lag{consumer="c1",queue="metrics_queue"} 2`,
+		`bunnymq_tx_duration_seconds_count{path="` + dbPath + `"}`,
+		`bunnymq_db_file_size_bytes{path="` + dbPath + `"}`,
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("metrics output missing %q\n%s", line, out)
+		}
+	}
+}
+
+// EnableMetrics may run while other goroutines enqueue; go test -race catches
+// the enqueue path reading q.metrics outside q.mu.
+func TestEnableMetricsWhileEnqueuing(t *testing.T) {
+	queue, err := NewQueue[testStruct]("metrics_race", filepath.Join(t.TempDir(), "race.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := queue.Enqueue(testStruct{Message: "m", Time: time.Now()}); err != nil {
+				t.Errorf("Error enqueuing message: %v", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			queue.EnableMetrics(metrics.NewRegistry())
+		}
+	}
+}
+
+func TestMetricsAcrossReopen(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "reopen.db")
+	reg := metrics.NewRegistry()
+	scrape := func() string {
+		t.Helper()
+		var buf bytes.Buffer
+		if _, err := reg.WriteTo(&buf); err != nil {
+			t.Fatalf("Error writing metrics: %v", err)
+		}
+		return buf.String()
+	}
+	series := []string{
+		`bunnymq_queue_depth{queue="reopened"}`,
+		`bunnymq_consumer_lag{consumer="c1",queue="reopened"}`,
+		`bunnymq_db_file_size_bytes{path="` + dbPath + `"}`,
+	}
+	open := func() *Queue[testStruct] {
+		t.Helper()
+		queue, err := NewQueue[testStruct]("reopened", dbPath, &JsonCoder[testStruct]{}, WithMetrics(reg))
+		if err != nil {
+			t.Fatalf("Error creating queue: %v", err)
+		}
+		return queue
+	}
+
+	queue := open()
+	queue.Enqueue(testStruct{Message: "m"})
+	msg, err := queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	msg.Ack()
+	// 同一个队列在同一个注册表里再打开一次
+	again, err := OpenQueue[testStruct](queue.handle, "reopened", &JsonCoder[testStruct]{}, WithMetrics(reg))
+	if err != nil {
+		t.Fatalf("Error opening queue again: %v", err)
+	}
+	again.Close()
+	queue.Close()
+	out := scrape()
+	for _, s := range series {
+		if strings.Contains(out, s) {
+			t.Errorf("closed queue still reports %s\n%s", s, out)
+		}
+	}
+
+	queue = open()
+	defer queue.Close()
+	again, err = OpenQueue[testStruct](queue.handle, "reopened", &JsonCoder[testStruct]{}, WithMetrics(reg))
+	if err != nil {
+		t.Fatalf("Error opening queue again: %v", err)
+	}
+	defer again.Close()
+	out = scrape()
+	for _, s := range series {
+		if n := strings.Count(out, s); n != 1 {
+			t.Errorf("%s reported %d times, want once\n%s", s, n, out)
+		}
+	}
+}
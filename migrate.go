@@ -0,0 +1,179 @@
+package bunnymq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// formatKey is the key in metaBucket holding the format version of the
+// database. Queue names cannot start with "_", so it cannot clash with the
+// metadata of a queue.
+const formatKey = "_format"
+
+// formatVersion is the layout this version of bunnymq writes:
+//
+//	0  nothing recorded: queue buckets in bbolt files may lack their prefix
+//	1  queue buckets in bbolt files are named queueBucketPrefix plus the queue
+//	2  message keys in bbolt files are big-endian sequence numbers
+//	3  built-in coders are recorded by their CoderName
+//
+// Opening a database for writing migrates it to formatVersion. A database
+// written by a newer version is refused with ErrUnsupportedFormat.
+const formatVersion = 3
+
+// migration upgrades a database to version from the version before it. It
+// runs in the same transaction as the migrations after it and the update of
+// the recorded version, so a database is never left half migrated.
+type migration struct {
+	version int
+	name    string
+	run     func(tx Tx) error
+}
+
+// migrations must be in version order. Stores whose layout a migration does
+// not concern treat it as a no-op.
+var migrations = []migration{
+	{1, "prefixed queue buckets", upgradeQueueBuckets},
+	{2, "big-endian message keys", upgradeMessageKeys},
+	{3, "coder names", renameCoders},
+}
+
+// readFormatVersion returns the format version recorded in the database, 0 if
+// none is.
+func readFormatVersion(tx Tx) (int, error) {
+	value, err := tx.Get(metaBucket, formatKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(string(value))
+	if err != nil || version < 0 {
+		return 0, NewDBError(CodeCorrupt, fmt.Errorf("malformed format version %q", value), formatKey)
+	}
+	return version, nil
+}
+
+// migrate checks the format version of the database opened at path and, unless
+// it is read-only, runs the migrations it is missing. A read-only database is
+// read in its own format.
+func migrate(store Store, path string, readOnly bool, logger Logger) error {
+	var version int
+	err := store.View(func(tx Tx) (err error) {
+		version, err = readFormatVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if version > formatVersion {
+		return NewDBError(CodeUnsupportedFormat, fmt.Errorf("format version %d is newer than %d, the newest this version supports", version, formatVersion), path)
+	}
+	if version == formatVersion || readOnly {
+		return nil
+	}
+
+	var applied []string
+	fresh := false
+	err = store.Update(func(tx Tx) error {
+		// 别的进程可能刚迁移过
+		from, err := readFormatVersion(tx)
+		if err != nil || from >= formatVersion {
+			return err
+		}
+		for _, m := range migrations {
+			if m.version <= from {
+				continue
+			}
+			if err := m.run(tx); err != nil {
+				return fmt.Errorf("migrating to format %d (%s): %w", m.version, m.name, err)
+			}
+			applied = append(applied, m.name)
+		}
+		// 没加前缀的旧队列要等第一个迁移挪过来才看得见
+		queues, err := tx.Queues()
+		if err != nil {
+			return err
+		}
+		fresh = from == 0 && len(queues) == 0
+		return tx.Put(metaBucket, formatKey, []byte(strconv.Itoa(formatVersion)))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+	// 新建的空库没什么可迁移的，不必记日志
+	if len(applied) > 0 && !fresh {
+		logger.Info("bunnymq: migrated database", "path", path, "from", version, "to", formatVersion, "migrations", applied)
+	}
+	return nil
+}
+
+// FormatVersion returns the format version of the database. A database opened
+// for writing is always at the version this package writes; one opened with
+// WithReadOnly may be older.
+func (db *DB) FormatVersion() (int, error) {
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	var version int
+	err := db.client.view(func(tx Tx) (err error) {
+		version, err = readFormatVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// bucketUpgrader is implemented by transactions of stores whose layout
+// changed in format versions 1 and 2: bbolt files kept queues in unprefixed
+// buckets and message keys as decimal strings.
+type bucketUpgrader interface {
+	upgradeQueueBuckets() error
+	upgradeMessageKeys() error
+}
+
+func upgradeQueueBuckets(tx Tx) error {
+	if u, ok := tx.(bucketUpgrader); ok {
+		return u.upgradeQueueBuckets()
+	}
+	return nil
+}
+
+func upgradeMessageKeys(tx Tx) error {
+	if u, ok := tx.(bucketUpgrader); ok {
+		return u.upgradeMessageKeys()
+	}
+	return nil
+}
+
+// renameCoders replaces the type names recorded for built-in coders before
+// they had a CoderName.
+func renameCoders(tx Tx) error {
+	renamed := map[string]queueMeta{}
+	err := tx.ForEach(metaBucket, func(key string, value []byte) error {
+		if key == formatKey {
+			return nil
+		}
+		var meta queueMeta
+		if err := json.Unmarshal(value, &meta); err != nil {
+			// 坏掉的记录留给读它的地方报错
+			return nil
+		}
+		if meta.Coder == "bunnymq.JsonCoder" {
+			meta.Coder = "json"
+			renamed[key] = meta
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for queue, meta := range renamed {
+		if err := writeQueueMeta(tx, queue, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
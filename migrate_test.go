@@ -0,0 +1,207 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeRawBolt creates a bbolt file at path and fills it with fn, as an older
+// version or a newer one would have left it.
+func writeRawBolt(t *testing.T, path string, fn func(tx *bolt.Tx) error) {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(fn)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateDecimalKeys(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "decimal.db")
+	writeRawBolt(t, dbPath, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(queueBucket("legacy"))
+		if err != nil {
+			return err
+		}
+		// 超过 9 条，十进制字符串的顺序和数值顺序就不一样了
+		for i := 1; i <= 12; i++ {
+			seq, _ := bucket.NextSequence()
+			if err := bucket.Put([]byte(strconv.FormatUint(seq, 10)), []byte(fmt.Sprintf(`{"message":"m%d"}`, i))); err != nil {
+				return err
+			}
+		}
+		progress, err := tx.CreateBucket([]byte(consumerProgressBucket))
+		if err != nil {
+			return err
+		}
+		return progress.Put([]byte("c:legacy"), []byte("9"))
+	})
+	checkOrder := func(db *DB) {
+		t.Helper()
+		msgs, err := db.Peek("legacy", 8, 10)
+		if err != nil || len(msgs) != 5 {
+			t.Fatalf("Peek = %v, %v; want 5 messages", msgs, err)
+		}
+		for i, msg := range msgs {
+			if want := uint64(8 + i); msg.Seq != want || string(msg.Payload) != fmt.Sprintf(`{"message":"m%d"}`, want) {
+				t.Fatalf("message %d = %d %s, want %d", i, msg.Seq, msg.Payload, want)
+			}
+		}
+	}
+
+	// 只读打开不迁移，按旧格式读
+	ro, err := Open(dbPath, WithReadOnly())
+	if err != nil {
+		t.Fatalf("Open read-only: %v", err)
+	}
+	if version, err := ro.FormatVersion(); err != nil || version != 0 {
+		t.Errorf("FormatVersion read-only = %d, %v; want 0", version, err)
+	}
+	checkOrder(ro)
+	ro.Close()
+
+	db, err := Open(dbPath)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if version, err := db.FormatVersion(); err != nil || version != formatVersion {
+		t.Errorf("FormatVersion after migration = %d, %v; want %d", version, err, formatVersion)
+	}
+	checkOrder(db)
+	err = db.client.store.(*boltStore).db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket("legacy")).ForEach(func(k, _ []byte) error {
+			if len(k) != 8 {
+				return fmt.Errorf("key %q left after migration", k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := OpenQueue[testStruct](db, "legacy", &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("OpenQueue: %v", err)
+	}
+	if msg, err := queue.Dequeue("c"); err != nil || msg.Seq() != 10 {
+		t.Fatalf("Dequeue after migration = %v, %v; want seq 10", msg, err)
+	}
+	if err := queue.Enqueue(testStruct{Message: "m13"}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if msgs, _ := db.Peek("legacy", 13, 1); len(msgs) != 1 || msgs[0].Seq != 13 {
+		t.Fatalf("Peek of the new message = %v", msgs)
+	}
+}
+
+func TestRestoreLegacySnapshot(t *testing.T) {
+	dir := t.TempDir()
+	snap := filepath.Join(dir, "legacy.db")
+	// 加前缀之前的快照，队列名直接作 bucket 名
+	writeRawBolt(t, snap, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("legacy"))
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= 2; i++ {
+			seq, _ := bucket.NextSequence()
+			if err := bucket.Put([]byte(strconv.FormatUint(seq, 10)), []byte(fmt.Sprintf(`{"message":"m%d"}`, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db, err := Open(filepath.Join(dir, "live.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if err := db.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if version, err := db.FormatVersion(); err != nil || version != formatVersion {
+		t.Errorf("FormatVersion after Restore = %d, %v; want %d", version, err, formatVersion)
+	}
+	if msgs, err := db.Peek("legacy", 1, 2); err != nil || len(msgs) != 2 || msgs[1].Seq != 2 {
+		t.Fatalf("Peek after Restore = %v, %v; want messages 1 and 2", msgs, err)
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "future.db")
+	writeRawBolt(t, dbPath, func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(formatKey), []byte(strconv.Itoa(formatVersion+1)))
+	})
+	if _, err := Open(dbPath); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("Open of a newer format: got %v, want ErrUnsupportedFormat", err)
+	}
+	if _, err := Open(dbPath, WithReadOnly()); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("read-only Open of a newer format: got %v, want ErrUnsupportedFormat", err)
+	}
+	// 打开失败不能留下锁
+	if _, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("NewQueue of a newer format: got %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+// upperCoder is a Coder other than JsonCoder, to open a queue with the wrong one.
+type upperCoder struct{}
+
+func (upperCoder) Encode(v testStruct) ([]byte, error) { return []byte(v.Message), nil }
+
+func (upperCoder) Decode(data []byte) (testStruct, error) {
+	return testStruct{Message: string(data)}, nil
+}
+
+func TestQueueCoderRecorded(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		db, err := Open(dbPath, opts...)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		defer db.Close()
+		if _, err := OpenQueue[testStruct](db, "typed", &JsonCoder[testStruct]{}); err != nil {
+			t.Fatalf("OpenQueue: %v", err)
+		}
+		info, err := db.QueueInfo("typed")
+		if err != nil || info.Coder != "json" || info.Created.IsZero() {
+			t.Fatalf("QueueInfo = %+v, %v", info, err)
+		}
+
+		if _, err := OpenQueue[testStruct](db, "typed", upperCoder{}); !errors.Is(err, ErrCoderMismatch) {
+			t.Fatalf("OpenQueue with another coder: got %v, want ErrCoderMismatch", err)
+		}
+		// RawCoder 什么都能读，类型参数不同的 JsonCoder 编码相同
+		if _, err := OpenQueue[[]byte](db, "typed", RawCoder{}); err != nil {
+			t.Errorf("OpenQueue with RawCoder: %v", err)
+		}
+		if _, err := OpenQueue[map[string]any](db, "typed", &JsonCoder[map[string]any]{}); err != nil {
+			t.Errorf("OpenQueue with JsonCoder of another type: %v", err)
+		}
+
+		// 队列删掉之后可以换编码
+		if err := db.DeleteQueue("typed"); err != nil {
+			t.Fatalf("DeleteQueue: %v", err)
+		}
+		if _, err := OpenQueue[testStruct](db, "typed", upperCoder{}); err != nil {
+			t.Fatalf("OpenQueue with another coder after DeleteQueue: %v", err)
+		}
+		if info, _ := db.QueueInfo("typed"); info.Coder != "bunnymq.upperCoder" {
+			t.Errorf("coder recorded after DeleteQueue = %q", info.Coder)
+		}
+	})
+}
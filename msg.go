@@ -1,36 +1,62 @@
 package bunnymq
 
+import (
+	"context"
+	"time"
+)
+
+// Msg is a message returned by Consumer.Dequeue. Together with Producer and
+// Consumer it is all code needs to use a queue, local or remote.
 type Msg[T any] interface {
+	// Ack acknowledges the message, so the consumer moves past it and past
+	// any messages before it that were removed while it was queued.
 	Ack() error
+	// NAck rejects the message; it is delivered again by the next Dequeue.
 	NAck() error
+	// Data returns the decoded payload.
 	Data() T
+	// Seq returns the sequence number of the message within its queue.
+	Seq() uint64
+	// Headers returns the headers stored with the message, or nil if it has none.
+	Headers() Headers
+	// Context returns a context carrying the trace context extracted from the
+	// message headers by the queue's Propagator. It is never nil.
+	Context() context.Context
 }
 
 type MsgImpl[T any] struct {
 	data            T
+	headers         Headers
+	ctx             context.Context
 	queueName       string
 	acked           bool
 	consumerID      string
+	seq             uint64
 	progressManager *consumerProgressManager
+	trackLease      bool // the queue records deliveries for dead-lettering
+	metrics         *queueMetrics
+	logger          Logger
+	hooks           Hooks
 	processed       bool
 }
 
 func (m *MsgImpl[T]) Ack() error {
+	if m.acked {
+		return nil
+	}
 	consumerID := m.consumerID
 	queueName := m.queueName
 
-	// 获取当前进度
-	progress, err := m.progressManager.getProgress(consumerID, queueName)
-	if err != nil {
-		return err
-	}
-
-	// 更新进度
-	newProgress := progress + 1
-	err = m.progressManager.updateProgress(consumerID, queueName, newProgress)
+	// 更新进度到这条消息，前面被保留策略删除的消息一并跳过
+	newProgress := int64(m.seq)
+	err := m.progressManager.ack(consumerID, queueName, newProgress, m.trackLease)
 	if err != nil {
+		m.logger.Error("bunnymq: ack failed", "queue", queueName, "consumer", consumerID, "err", err)
 		return err
 	}
+	m.acked = true
+	m.metrics.acked.Inc()
+	m.hooks.ack(Event{Queue: queueName, ConsumerID: consumerID, Seq: uint64(newProgress), Time: time.Now()})
 
 	return nil
 
@@ -38,9 +64,26 @@ func (m *MsgImpl[T]) Ack() error {
 
 func (m *MsgImpl[T]) NAck() error {
 	// Message is not acknowledged, do nothing
+	m.metrics.nacked.Inc()
+	m.hooks.nack(Event{Queue: m.queueName, ConsumerID: m.consumerID, Seq: m.seq, Time: time.Now()})
 	return nil
 }
 
 func (m *MsgImpl[T]) Data() T {
 	return m.data
 }
+
+func (m *MsgImpl[T]) Headers() Headers {
+	return m.headers
+}
+
+func (m *MsgImpl[T]) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+func (m *MsgImpl[T]) Seq() uint64 {
+	return m.seq
+}
@@ -0,0 +1,248 @@
+package bunnymq
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq/metrics"
+)
+
+// Options is the resolved configuration of a queue. It is filled from the
+// defaults and the Option values passed to NewQueue.
+//
+// OpenTimeout, FileMode, Durability, SyncInterval and ReadOnly apply to the
+// database file and only take effect when NewQueue is the first to open that
+// path in this process; later queues on the same path share the already open
+// file.
+type Options struct {
+	Queue   string
+	Durable bool // true when Durability is DurabilityStrict
+	AutoAck bool // Dequeue acknowledges the message before returning it
+
+	Durability    Durability     // see Durability for the crash-loss bounds
+	SyncInterval  time.Duration  // fsync period for DurabilityBatched
+	OpenTimeout   time.Duration  // how long to wait for the file lock
+	ReadOnly      bool           // open the file read-only; see WithReadOnly
+	FileMode      os.FileMode    // permissions used when creating the file
+	MaxLength     int            // maximum stored messages; 0 means unbounded
+	MaxBytes      int64          // maximum stored bytes; 0 means unbounded
+	Overflow      OverflowPolicy // what Enqueue does at MaxLength or MaxBytes
+	BlockTimeout  time.Duration  // how long OverflowBlock waits; 0 waits for the context
+	Retention     time.Duration  // CleanDB removes older messages; 0 keeps them
+	MaxDeliveries int            // dead-letter after this many deliveries; 0 disables
+	SegmentSize   int64          // segment file size for WithSegmentLog
+
+	Logger     Logger
+	Hooks      Hooks
+	Propagator Propagator
+	Metrics    *metrics.Registry
+
+	openStore func(path string, o *Options) (Store, error) // set by WithStore; nil opens a bbolt file
+}
+
+// Option configures a queue created by NewQueue.
+type Option func(*Options) error
+
+func defaultOptions(queueName string) Options {
+	return Options{
+		Queue:        queueName,
+		Durable:      true,
+		Durability:   DurabilityStrict,
+		SyncInterval: DefaultSyncInterval,
+		OpenTimeout:  1 * time.Second,
+		FileMode:     0600,
+		SegmentSize:  DefaultSegmentSize,
+		Logger:       nopLogger{},
+	}
+}
+
+func (o *Options) validate() error {
+	if o.FileMode&^os.ModePerm != 0 || o.FileMode&0600 != 0600 {
+		return invalidOption("file mode", fmt.Sprintf("%v must be a permission mode readable and writable by the owner", o.FileMode))
+	}
+	return nil
+}
+
+func invalidOption(context, msg string) error {
+	return NewDBError(CodeInvalidOption, fmt.Errorf("%s", msg), context)
+}
+
+// WithOpenTimeout sets how long NewQueue waits for the database file lock. Zero
+// waits indefinitely, as bbolt does.
+func WithOpenTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return invalidOption("open timeout", "must not be negative")
+		}
+		o.OpenTimeout = d
+		return nil
+	}
+}
+
+// WithReadOnly opens the database read-only, for processes that inspect a
+// queue file without changing it. With the default bbolt store several
+// read-only processes can have the file open at once, but not while a process
+// has it open for writing: bbolt allows one writer or many readers. To look at
+// a queue while its owner is running, go through that process instead.
+//
+// Enqueue, Ack, CleanDB and the other writes fail with ErrReadOnly. Dequeue
+// still returns the next message of a consumer, which makes it a way to peek
+// at its backlog. The segment log does not support read-only access.
+func WithReadOnly() Option {
+	return func(o *Options) error {
+		o.ReadOnly = true
+		return nil
+	}
+}
+
+// WithFileMode sets the permissions of a newly created database file.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *Options) error {
+		o.FileMode = mode
+		return nil
+	}
+}
+
+// WithDurable selects DurabilityStrict (the default) or, when false,
+// DurabilityNone.
+func WithDurable(durable bool) Option {
+	if durable {
+		return WithDurability(DurabilityStrict)
+	}
+	return WithDurability(DurabilityNone)
+}
+
+// WithNoSync is the inverse of WithDurable, named after the bbolt option.
+func WithNoSync(noSync bool) Option {
+	return WithDurable(!noSync)
+}
+
+// WithAutoAck makes Dequeue acknowledge messages before returning them.
+func WithAutoAck(autoAck bool) Option {
+	return func(o *Options) error {
+		o.AutoAck = autoAck
+		return nil
+	}
+}
+
+// WithMaxLength caps the number of stored messages; once the queue holds n
+// messages, Enqueue applies the overflow policy, by default returning
+// ErrQueueFull. Zero means unbounded.
+//
+// The limits set by WithMaxLength, WithMaxBytes, WithOverflow and
+// WithBlockTimeout are stored with the queue when it is opened, replacing
+// those it had, and apply to every producer of the queue. A queue opened
+// without any of them keeps its stored limits; see DB.SetQueueLimits to
+// change or remove them.
+func WithMaxLength(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return invalidOption("max length", "must not be negative")
+		}
+		o.MaxLength = n
+		return nil
+	}
+}
+
+// WithMaxBytes caps the size of the stored messages, headers included, like
+// WithMaxLength caps their number. A single message larger than n is always
+// rejected with ErrQueueFull.
+func WithMaxBytes(n int64) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return invalidOption("max bytes", "must not be negative")
+		}
+		o.MaxBytes = n
+		return nil
+	}
+}
+
+// WithOverflow sets what Enqueue does when the queue is at its MaxLength or
+// MaxBytes; see OverflowPolicy.
+func WithOverflow(p OverflowPolicy) Option {
+	return func(o *Options) error {
+		if p < OverflowReject || p > OverflowBlock {
+			return invalidOption("overflow", fmt.Sprintf("unknown overflow policy %d", int(p)))
+		}
+		o.Overflow = p
+		return nil
+	}
+}
+
+// WithBlockTimeout sets how long Enqueue waits for room under OverflowBlock
+// before returning ErrQueueFull. Zero waits until the context is done.
+func WithBlockTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return invalidOption("block timeout", "must not be negative")
+		}
+		o.BlockTimeout = d
+		return nil
+	}
+}
+
+// WithRetention makes CleanDB delete messages older than d even if some
+// consumer has not acknowledged them yet. Zero keeps messages until consumed.
+func WithRetention(d time.Duration) Option {
+	return func(o *Options) error {
+		if d < 0 {
+			return invalidOption("retention", "must not be negative")
+		}
+		o.Retention = d
+		return nil
+	}
+}
+
+// WithMaxDeliveries moves a message to the queue's dead-letter queue (see
+// DeadLetterQueueName) when a consumer is about to receive it for the n+1th
+// time without having acknowledged it. Zero disables dead-lettering.
+func WithMaxDeliveries(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return invalidOption("max deliveries", "must not be negative")
+		}
+		o.MaxDeliveries = n
+		return nil
+	}
+}
+
+// WithLogger sets the queue's logger; see SetLogger.
+func WithLogger(logger Logger) Option {
+	return func(o *Options) error {
+		if logger == nil {
+			return invalidOption("logger", "must not be nil")
+		}
+		o.Logger = logger
+		return nil
+	}
+}
+
+// WithHooks sets the queue's audit hooks; see SetHooks.
+func WithHooks(hooks Hooks) Option {
+	return func(o *Options) error {
+		o.Hooks = hooks
+		return nil
+	}
+}
+
+// WithPropagator sets the trace context propagator; see SetPropagator.
+func WithPropagator(p Propagator) Option {
+	return func(o *Options) error {
+		o.Propagator = p
+		return nil
+	}
+}
+
+// WithMetrics registers the queue with reg; see EnableMetrics.
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(o *Options) error {
+		o.Metrics = reg
+		return nil
+	}
+}
+
+// Options returns the configuration the queue was created with.
+func (q *Queue[T]) Options() Options {
+	return q.opts
+}
@@ -0,0 +1,155 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewQueueOptionValidation(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "options.db")
+	for name, opt := range map[string]Option{
+		"negative timeout":       WithOpenTimeout(-time.Second),
+		"negative max length":    WithMaxLength(-1),
+		"negative retention":     WithRetention(-time.Minute),
+		"negative deliveries":    WithMaxDeliveries(-2),
+		"nil logger":             WithLogger(nil),
+		"unreadable file mode":   WithFileMode(0200),
+		"non-permission mode":    WithFileMode(os.ModeDir | 0700),
+		"file mode without user": WithFileMode(0066),
+	} {
+		if _, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}, opt); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%s: expected ErrInvalidOption, got %v", name, err)
+		}
+	}
+	if _, err := NewQueue[testStruct]("", dbPath, &JsonCoder[testStruct]{}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("empty queue name: expected ErrInvalidOption, got %v", err)
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Errorf("invalid options should not create the database file, stat: %v", err)
+	}
+}
+
+func TestNewQueueFileOptions(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "mode.db")
+	queue, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{},
+		WithFileMode(0640), WithNoSync(true), WithOpenTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("file mode = %v, want 0640", info.Mode().Perm())
+	}
+	if !queue.db.store.(*boltStore).db.NoSync {
+		t.Errorf("expected NoSync to be set on the database")
+	}
+	if opts := queue.Options(); opts.Durable || opts.Queue != "q" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+}
+
+func TestAutoAck(t *testing.T) {
+	queue, err := NewQueue[testStruct]("auto_ack", filepath.Join(t.TempDir(), "ack.db"), &JsonCoder[testStruct]{}, WithAutoAck(true))
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	for i := 1; i <= 2; i++ {
+		if err := queue.Enqueue(testStruct{Message: fmt.Sprintf("Message %d", i)}); err != nil {
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		msg, err := queue.Dequeue("c1")
+		if err != nil {
+			t.Fatalf("Error dequeuing message: %v", err)
+		}
+		if want := fmt.Sprintf("Message %d", i); msg.Data().Message != want {
+			t.Errorf("got %q, want %q", msg.Data().Message, want)
+		}
+		// Ack on an auto-acked message must not skip the next one
+		if err := msg.Ack(); err != nil {
+			t.Fatalf("Error acknowledging message: %v", err)
+		}
+	}
+	if _, err := queue.Dequeue("c1"); err == nil {
+		t.Errorf("expected no more messages")
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	queue, err := NewQueue[testStruct]("bounded", filepath.Join(t.TempDir(), "bounded.db"), &JsonCoder[testStruct]{}, WithMaxLength(2))
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := queue.Enqueue(testStruct{Message: "m"}); err != nil {
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+	}
+	if err := queue.Enqueue(testStruct{Message: "overflow"}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "retention.db")
+	queue, err := NewQueue[testStruct]("retained", dbPath, &JsonCoder[testStruct]{}, WithRetention(time.Hour))
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	// 先让消费者确认一条消息，CleanDB 才不会把整个队列当作已消费
+	if err := queue.Enqueue(testStruct{Message: "m0"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+	msg, err := queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Error acknowledging message: %v", err)
+	}
+
+	// 两条过期消息，一条新消息
+	for i, ts := range []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-90 * time.Minute), time.Now()} {
+		value := encodeEnvelope(envelope{timestamp: ts, payload: []byte(fmt.Sprintf(`{"Message":"m%d"}`, i+1))})
+		if _, _, err := queue.db.putWithAutoIncrementKey("retained", value); err != nil {
+			t.Fatalf("Error writing message: %v", err)
+		}
+	}
+	if err := CleanDB(dbPath); err != nil {
+		t.Fatalf("Error cleaning database: %v", err)
+	}
+
+	msg, err = queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if msg.Data().Message != "m3" {
+		t.Fatalf("expected expired messages to be skipped, got %q", msg.Data().Message)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Error acknowledging message: %v", err)
+	}
+	if err := queue.Enqueue(testStruct{Message: "m4"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+	msg, err = queue.Dequeue("c1")
+	if err != nil || msg.Data().Message != "m4" {
+		t.Fatalf("expected m4 after ack, got %v %v", msg, err)
+	}
+}
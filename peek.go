@@ -0,0 +1,118 @@
+package bunnymq
+
+import (
+	"time"
+)
+
+// rangeBatch is how many messages Range reads per read transaction.
+const rangeBatch = 256
+
+// StoredMessage is a decoded message read without consuming it.
+type StoredMessage[T any] struct {
+	Seq     uint64
+	Time    time.Time // when it was enqueued, zero for messages from before headers
+	Headers Headers
+	Data    T
+}
+
+// Peek returns up to n of the oldest messages stored in the queue, whether or
+// not they have been consumed, without affecting any consumer. Messages that
+// cleanup has removed are not returned.
+func (q *Queue[T]) Peek(n int) ([]StoredMessage[T], error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkOpen(); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	msgs, _, err := q.readStored(1, n)
+	return msgs, err
+}
+
+// PeekAt returns the message with sequence number seq without affecting any
+// consumer, or ErrKeyNotFound if it is not stored.
+func (q *Queue[T]) PeekAt(seq uint64) (StoredMessage[T], error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkOpen(); err != nil {
+		return StoredMessage[T]{}, err
+	}
+	msgs, _, err := q.readStored(seq, 1)
+	if err != nil {
+		return StoredMessage[T]{}, err
+	}
+	if len(msgs) == 0 || msgs[0].Seq != seq {
+		return StoredMessage[T]{}, ErrKeyNotFound
+	}
+	return msgs[0], nil
+}
+
+// Range calls fn for the stored messages with sequence numbers of at least
+// fromSeq, in order, until fn returns false, without affecting any consumer.
+// Messages are read in batches, each in its own read transaction, and fn is
+// called outside of them, so it may use the queue; messages enqueued or
+// removed while Range runs may or may not be seen.
+func (q *Queue[T]) Range(fromSeq uint64, fn func(seq uint64, data T) bool) error {
+	for {
+		q.mu.Lock()
+		err := q.checkOpen()
+		var (
+			msgs []StoredMessage[T]
+			more bool
+		)
+		if err == nil {
+			msgs, more, err = q.readStored(fromSeq, rangeBatch)
+		}
+		q.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		for _, msg := range msgs {
+			if !fn(msg.Seq, msg.Data) {
+				return nil
+			}
+		}
+		if !more {
+			return nil
+		}
+		fromSeq = msgs[len(msgs)-1].Seq + 1
+	}
+}
+
+// readStored decodes up to max messages starting at from. more reports
+// whether the read stopped at max. Callers hold q.mu.
+func (q *Queue[T]) readStored(from uint64, max int) (msgs []StoredMessage[T], more bool, err error) {
+	type stored struct {
+		seq   uint64
+		value []byte
+	}
+	var raw []stored
+	err = q.db.view(func(tx Tx) error {
+		return tx.Scan(q.queueName, from, func(seq uint64, value []byte) bool {
+			if len(raw) == max {
+				more = true
+				return false
+			}
+			raw = append(raw, stored{seq: seq, value: append([]byte(nil), value...)})
+			return true
+		})
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	msgs = make([]StoredMessage[T], 0, len(raw))
+	for _, r := range raw {
+		env, err := decodeEnvelope(r.value)
+		if err != nil {
+			return nil, false, err
+		}
+		data, err := q.coder.Decode(env.payload)
+		if err != nil {
+			return nil, false, err
+		}
+		msgs = append(msgs, StoredMessage[T]{Seq: r.seq, Time: env.timestamp, Headers: env.headers, Data: data})
+	}
+	return msgs, more, nil
+}
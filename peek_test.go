@@ -0,0 +1,58 @@
+package bunnymq
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestPeekAndRange(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		queue, err := NewQueue[testStruct]("browse", dbPath, &JsonCoder[testStruct]{}, opts...)
+		if err != nil {
+			t.Fatalf("NewQueue: %v", err)
+		}
+		defer queue.Close()
+		for i := 1; i <= 300; i++ {
+			queue.Enqueue(testStruct{Message: strconv.Itoa(i)})
+		}
+		msg, _ := queue.Dequeue("w")
+		msg.Ack()
+
+		// 已确认的消息还在库里，照样能看到；看过之后消费者的位置不变
+		peeked, err := queue.Peek(2)
+		if err != nil || len(peeked) != 2 || peeked[0].Seq != 1 || peeked[1].Data.Message != "2" || peeked[0].Time.IsZero() {
+			t.Fatalf("Peek(2) = %+v, %v", peeked, err)
+		}
+		if m, err := queue.PeekAt(42); err != nil || m.Seq != 42 || m.Data.Message != "42" {
+			t.Fatalf("PeekAt(42) = %+v, %v", m, err)
+		}
+		if _, err := queue.PeekAt(301); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("PeekAt past the end: got %v, want ErrKeyNotFound", err)
+		}
+
+		var seqs []uint64
+		err = queue.Range(250, func(seq uint64, data testStruct) bool {
+			seqs = append(seqs, seq)
+			return seq < 260
+		})
+		if err != nil || len(seqs) != 11 || seqs[0] != 250 || seqs[10] != 260 {
+			t.Fatalf("Range(250) stopped at %v, %v", seqs, err)
+		}
+		count := 0
+		err = queue.Range(0, func(seq uint64, data testStruct) bool {
+			count++
+			if seq == 1 {
+				// 回调里可以继续用这个队列
+				queue.Enqueue(testStruct{Message: "late"})
+			}
+			return data.Message == strconv.FormatUint(seq, 10) || data.Message == "late"
+		})
+		if err != nil || count < 300 {
+			t.Fatalf("Range over the whole queue saw %d messages, %v", count, err)
+		}
+		if msg, err := queue.Dequeue("w"); err != nil || msg.Seq() != 2 {
+			t.Errorf("Dequeue after browsing = %v, %v; want seq 2", msg, err)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package bunnymq
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pidFileSuffix names the file next to a bbolt database that records which
+// process has it open for writing.
+const pidFileSuffix = ".pid"
+
+// writePID records the current process in f, replacing its contents.
+func writePID(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
+
+// writePIDFile records the current process as the writer of the database at
+// path.
+func writePIDFile(path string, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writePID(f)
+}
+
+// lockHolder returns the PID recorded in path, if that process is still
+// running. The file may be stale after a crash, or name a writer while the
+// lock is actually held by a read-only process.
+func lockHolder(path string) (int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || !processAlive(pid) {
+		return 0, false
+	}
+	return pid, true
+}
+
+// lockedError describes a lock on path that could not be taken in time,
+// naming the process recorded in pidPath if there is one.
+func lockedError(path, pidPath string) error {
+	if pid, ok := lockHolder(pidPath); ok {
+		return NewDBError(CodeDatabaseLocked, fmt.Errorf("database is locked by process %d", pid), path)
+	}
+	return NewDBError(CodeDatabaseLocked, fmt.Errorf("database is locked by another process"), path)
+}
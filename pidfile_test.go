@@ -0,0 +1,76 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockedErrorNamesHolder(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "locked.db")
+	opts := defaultOptions("q")
+	store, err := openBoltStore(dbPath, &opts)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	// flock 按打开的文件区分，同一进程再打开一次也会等锁
+	opts.OpenTimeout = 50 * time.Millisecond
+	other, err := openBoltStore(dbPath, &opts)
+	if err == nil {
+		other.Close()
+		t.Fatalf("second open of a locked file succeeded")
+	}
+	if !errors.Is(err, ErrDatabaseLocked) || !strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())) {
+		t.Errorf("second open: got %v, want ErrDatabaseLocked naming this process", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := os.Stat(dbPath + pidFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("pid file left behind after close: %v", err)
+	}
+}
+
+func TestReadOnlyQueue(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "readonly.db")
+	writer, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	for _, m := range []string{"a", "b"} {
+		if err := writer.Enqueue(testStruct{Message: m}); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	// 同一进程里读写和只读不能混用
+	if _, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}, WithReadOnly()); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("read-only open of a path open for writing: got %v, want ErrInvalidOption", err)
+	}
+	writer.Close()
+
+	reader, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}, WithReadOnly())
+	if err != nil {
+		t.Fatalf("Error opening read-only queue: %v", err)
+	}
+	defer reader.Close()
+	msg, err := reader.Dequeue("c")
+	if err != nil || msg.Data().Message != "a" {
+		t.Fatalf("Dequeue = %v, %v; want a", msg, err)
+	}
+	if err := msg.Ack(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Ack: got %v, want ErrReadOnly", err)
+	}
+	if err := reader.Enqueue(testStruct{Message: "c"}); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Enqueue: got %v, want ErrReadOnly", err)
+	}
+	if err := CleanDB(dbPath, WithReadOnly()); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("CleanDB: got %v, want ErrReadOnly", err)
+	}
+	if _, err := os.Stat(dbPath + pidFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("read-only open wrote a pid file: %v", err)
+	}
+}
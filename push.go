@@ -7,6 +7,14 @@ import (
 // 处理消费者
 const consumerProgressBucket = "consumer_progress"
 
+// 记录投递次数，用于死信
+const consumerLeaseBucket = "consumer_leases"
+
+// isInternalBucket reports whether a top-level bucket holds bookkeeping rather than messages.
+func isInternalBucket(name string) bool {
+	return name == consumerProgressBucket || name == consumerLeaseBucket || name == metaBucket
+}
+
 type keyValue struct {
 	key   string
 	value []byte
@@ -16,8 +24,3 @@ func (kv keyValue) String() string {
 	return fmt.Sprintf("key: %s, Value: %s", kv.key, string(kv.value))
 }
 
-type Options struct {
-	Queue   string
-	Durable bool
-	AutoAck bool
-}
@@ -15,65 +15,45 @@ type testStruct struct {
 
 // 验证 多个队列推送 并且只有一个消费者
 func TestMultiQueue1(t *testing.T) {
-	queueNames := []string{"queue1", "queue2", "queue3"}
-
-	var queues []*Queue[testStruct]
-	for _, queueName := range queueNames {
-		queue, err := NewQueue[testStruct](queueName, "mes1.db", &JsonCoder[testStruct]{})
-		if err != nil {
-			t.Fatalf("Error creating queue %s: %v", queueName, err)
-		}
-		queues = append(queues, queue)
-		defer queue.Close()
-
-	}
-	defer cleanDatabase("mes1.db")
-	// Push 30 messages to each queue
-	for i, queue := range queues {
-		num := 0
-		for j := 1; j <= 30; j++ {
-			msg := testStruct{
-				sid:     fmt.Sprintf("Queue%d", i+1),
-				Message: fmt.Sprintf("Message %d", j),
-				Time:    time.Now(),
-			}
-			err := queue.Enqueue(msg)
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		queueNames := []string{"queue1", "queue2", "queue3"}
 
+		var queues []*Queue[testStruct]
+		for _, queueName := range queueNames {
+			queue, err := NewQueue[testStruct](queueName, dbPath, &JsonCoder[testStruct]{}, opts...)
 			if err != nil {
-				t.Fatalf("Error enqueuing message to %s: %v", queueNames[i], err)
+				t.Fatalf("Error creating queue %s: %v", queueName, err)
 			}
-			num = 1 + num
-		}
-		t.Logf("%s 推送 %d 信息", queue.queueName, num)
-
-	}
+			queues = append(queues, queue)
+			defer queue.Close()
 
-	// Consume messages only from the first queue
-	consumerID := "consumer2"
-	receivedMessages := 0
-	for {
-		msg, err := queues[0].Dequeue(consumerID)
-		if err != nil {
-			break
 		}
-		receivedMessages++
-		if err := msg.Ack(); err != nil {
-			t.Errorf("Error acknowledging message: %v", err)
-		}
-	}
+		defer cleanDatabase(dbPath, opts...)
+		// Push 30 messages to each queue
+		for i, queue := range queues {
+			num := 0
+			for j := 1; j <= 30; j++ {
+				msg := testStruct{
+					sid:     fmt.Sprintf("Queue%d", i+1),
+					Message: fmt.Sprintf("Message %d", j),
+					Time:    time.Now(),
+				}
+				err := queue.Enqueue(msg)
 
-	t.Logf("%s %s 消费了 %d  ", queues[0].queueName, consumerID, receivedMessages)
+				if err != nil {
+					t.Fatalf("Error enqueuing message to %s: %v", queueNames[i], err)
+				}
+				num = 1 + num
+			}
+			t.Logf("%s 推送 %d 信息", queue.queueName, num)
 
-	if receivedMessages != 30 {
-		t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[0], receivedMessages)
-	}
+		}
 
-	// Validate that other queues have all their messages (should be 30 each)
-	for i, queue := range queues[1:] {
-		consumerID := fmt.Sprintf("consumer%d", i+2)
+		// Consume messages only from the first queue
+		consumerID := "consumer2"
 		receivedMessages := 0
 		for {
-			msg, err := queue.Dequeue(consumerID)
+			msg, err := queues[0].Dequeue(consumerID)
 			if err != nil {
 				break
 			}
@@ -83,9 +63,31 @@ func TestMultiQueue1(t *testing.T) {
 			}
 		}
 
+		t.Logf("%s %s 消费了 %d  ", queues[0].queueName, consumerID, receivedMessages)
+
 		if receivedMessages != 30 {
-			t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[i+1], receivedMessages)
+			t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[0], receivedMessages)
+		}
+
+		// Validate that other queues have all their messages (should be 30 each)
+		for i, queue := range queues[1:] {
+			consumerID := fmt.Sprintf("consumer%d", i+2)
+			receivedMessages := 0
+			for {
+				msg, err := queue.Dequeue(consumerID)
+				if err != nil {
+					break
+				}
+				receivedMessages++
+				if err := msg.Ack(); err != nil {
+					t.Errorf("Error acknowledging message: %v", err)
+				}
+			}
+
+			if receivedMessages != 30 {
+				t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[i+1], receivedMessages)
+			}
 		}
-	}
 
+	})
 }
@@ -1,103 +1,441 @@
 package bunnymq
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"strconv"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 const dbName = "ggb.db"
 
-var (
-	clientRefCount int32
-	clientMutex    sync.Mutex
-)
-
 // Queue encapsulates the operations to enqueue and dequeue messages in a queue.
 type Queue[T any] struct {
 	queueName       string
 	dbPath          string
 	db              *dbClient
+	handle          *DB  // the DB the queue was opened from
+	ownsHandle      bool // set by NewQueue, whose handle Close releases
+	closed          bool
 	coder           Coder[T]
+	opts            Options
 	msgManager      *MessageStore[T]
 	progressManager *consumerProgressManager
-	mu              sync.Mutex // To ensure thread-safe operations
+	metrics         *queueMetrics
+	logger          Logger
+	hooks           Hooks
+	propagator      Propagator
+	delivered       map[string]int64 // consumerID -> last delivered progress, for redelivery accounting
+	mu              sync.Mutex       // To ensure thread-safe operations
 }
 
 // NewQueue creates a new queue with the given database client, queue name, and coder.
-func NewQueue[T any](queueName, dbPath string, coder Coder[T]) (*Queue[T], error) {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
-	db, err := newDBClient(dbPath)
+// Options are applied in order on top of the defaults (durable, 1s open timeout,
+// file mode 0600); an invalid option makes NewQueue fail with ErrInvalidOption.
+//
+// NewQueue is shorthand for Open followed by OpenQueue: the queue holds its own
+// reference to dbPath, which Close releases.
+func NewQueue[T any](queueName, dbPath string, coder Coder[T], opts ...Option) (*Queue[T], error) {
+	if err := checkQueueName(queueName); err != nil {
+		return nil, err
+	}
+	db, err := Open(dbPath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	q, err := OpenQueue(db, queueName, coder)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	atomic.AddInt32(&clientRefCount, 1)
+	q.ownsHandle = true
+	return q, nil
+}
 
+func newQueue[T any](db *DB, coder Coder[T], options Options) (*Queue[T], error) {
+	client := db.client
 	// Initialize MessageStore and ConsumerProgressManager
-	msgManager, err := NewMessageStore[T](db, coder)
+	msgManager, err := NewMessageStore[T](client, coder)
 	if err != nil {
 		return nil, err
 	}
-	progressManager := newConsumerProgressManager(db)
-	return &Queue[T]{
-		queueName:       queueName,
-		db:              db,
+	if err := client.recordQueue(options.Queue, CoderName(coder)); err != nil {
+		return nil, err
+	}
+	if limits, ok := options.limits(); ok && !options.ReadOnly {
+		if err := limits.validate(); err != nil {
+			return nil, err
+		}
+		if err := client.setLimits(options.Queue, limits); err != nil {
+			return nil, err
+		}
+	}
+	progressManager := newConsumerProgressManager(client)
+	client.setRetention(options.Queue, options.Retention)
+	q := &Queue[T]{
+		queueName:       options.Queue,
+		dbPath:          db.path,
+		db:              client,
+		handle:          db,
 		coder:           coder,
+		opts:            options,
 		msgManager:      msgManager,
 		progressManager: progressManager,
-	}, nil
+		metrics:         &queueMetrics{},
+		logger:          options.Logger,
+		hooks:           options.Hooks,
+		propagator:      options.Propagator,
+		delivered:       make(map[string]int64),
+	}
+	if options.Metrics != nil {
+		q.EnableMetrics(options.Metrics)
+	}
+	return q, nil
+}
+
+// checkOpen returns ErrDatabaseClosed once the queue or its DB is closed.
+// Callers hold q.mu.
+func (q *Queue[T]) checkOpen() error {
+	if q.closed || q.handle.isClosed() {
+		return ErrDatabaseClosed
+	}
+	return nil
 }
 
 // Enqueue adds a new item to the queue.
 func (q *Queue[T]) Enqueue(data T) error {
+	return q.EnqueueContext(context.Background(), data)
+}
+
+// EnqueueContext adds a new item to the queue. If a Propagator is set, the trace
+// context carried by ctx is injected into the message headers.
+func (q *Queue[T]) EnqueueContext(ctx context.Context, data T) error {
+	return q.EnqueueWithHeaders(ctx, data, nil)
+}
+
+// EnqueueWithHeaders is like EnqueueContext but stores headers with the
+// message, for consumers to read or filter on. headers is not modified; trace
+// context injected by the Propagator takes precedence over its keys.
+//
+// When the queue is full, what happens depends on its OverflowPolicy: under
+// OverflowBlock, EnqueueWithHeaders waits for room, giving up when ctx is
+// done.
+func (q *Queue[T]) EnqueueWithHeaders(ctx context.Context, data T, headers Headers) error {
+	start := time.Now()
+	for {
+		// 先拿通知通道再写，写失败和开始等待之间腾出的空间不会漏掉
+		ready := q.db.roomFreed(q.queueName)
+		err := q.enqueueOnce(ctx, data, headers)
+		if errors.Is(err, ErrQueueFull) && q.db.waitForRoom(ctx, q.queueName, start, ready) {
+			continue
+		}
+		return err
+	}
+}
+
+func (q *Queue[T]) enqueueOnce(ctx context.Context, data T, headers Headers) error {
 	q.mu.Lock()
-	defer q.mu.Unlock()
-	return q.msgManager.Write(q.queueName, data)
+	if err := q.checkOpen(); err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	if len(headers) > 0 || q.propagator != nil {
+		h := make(Headers, len(headers))
+		for k, v := range headers {
+			h[k] = v
+		}
+		if q.propagator != nil {
+			q.propagator.Inject(ctx, h)
+		}
+		headers = h
+	}
+	seq, dropped, err := q.msgManager.write(q.queueName, data, headers)
+	// EnableMetrics 会在锁内替换 q.metrics，解锁前取出
+	hooks, logger, metrics := q.hooks, q.logger, q.metrics
+	q.mu.Unlock()
+	if err != nil {
+		if !errors.Is(err, ErrQueueFull) {
+			logger.Error("bunnymq: enqueue failed", "queue", q.queueName, "err", err)
+		}
+		return err
+	}
+	if dropped > 0 {
+		metrics.dropped.Add(uint64(dropped))
+		logger.Warn("bunnymq: dropped oldest messages to make room", "queue", q.queueName, "count", dropped)
+	}
+	metrics.enqueued.Inc()
+	q.db.notifyEnqueued(q.queueName)
+	logger.Debug("bunnymq: enqueued", "queue", q.queueName, "seq", seq)
+	hooks.enqueue(Event{Queue: q.queueName, Seq: seq, Time: time.Now()})
+	return nil
 }
 
 // Dequeue retrieves and removes the first item from the queue.
+//
+// With MaxDeliveries set, a message about to be delivered to the same consumer
+// more than MaxDeliveries times is moved to the dead-letter queue instead and
+// the next message is tried. With AutoAck set, the message is acknowledged
+// before it is returned.
 func (q *Queue[T]) Dequeue(consumerID string) (Msg[T], error) {
+	return q.dequeue(consumerID, nil, nil)
+}
+
+// DequeueWhere is like Dequeue but skips the messages for which pred returns
+// false. Skipped messages count as consumed by consumerID: its progress moves
+// past them, so they are never delivered to it and do not hold up cleanup.
+// pred is called with the queue locked and must not use the queue.
+func (q *Queue[T]) DequeueWhere(consumerID string, pred func(h Headers, data T) bool) (Msg[T], error) {
+	return q.dequeue(consumerID, nil, pred)
+}
+
+// DequeueFilter is like DequeueWhere with a header filter. The payloads of
+// the messages it skips are not decoded.
+func (q *Queue[T]) DequeueFilter(consumerID string, f *Filter) (Msg[T], error) {
+	return q.dequeue(consumerID, f, nil)
+}
+
+func (q *Queue[T]) dequeue(consumerID string, f *Filter, pred func(Headers, T) bool) (Msg[T], error) {
+	q.mu.Lock()
+	msg, deadLettered, err := q.dequeueLocked(consumerID, f, pred)
+	hooks := q.hooks
+	q.mu.Unlock()
+
+	for _, seq := range deadLettered {
+		hooks.deadLetter(Event{Queue: q.queueName, ConsumerID: consumerID, Seq: uint64(seq), Time: time.Now()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if q.opts.AutoAck {
+		if err := msg.Ack(); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// dequeueLocked reads the consumer's next message that passes f and pred,
+// acknowledging the messages that do not and dead-lettering messages that
+// exceeded MaxDeliveries on the way. It returns the sequences it dead-lettered.
+func (q *Queue[T]) dequeueLocked(consumerID string, f *Filter, pred func(Headers, T) bool) (*MsgImpl[T], []int64, error) {
+	if err := q.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	var (
+		deadLettered []int64
+		skipped      int64 // 跳过但还没确认的最后一条，连续跳过的消息只写一次进度
+	)
+	for {
+		// 获取当前消费者的进度
+		progress := skipped
+		if skipped == 0 {
+			var err error
+			if progress, err = q.progressManager.getProgress(consumerID, q.queueName); err != nil {
+				return nil, deadLettered, err
+			}
+		}
+
+		// 根据进度读取消息，先只看消息头，过滤掉的消息不用解码
+		var (
+			data    T
+			matched bool
+		)
+		env, seq, err := q.msgManager.readEnvelope(q.queueName, strconv.FormatInt(progress+1, 10))
+		if err == nil && f.Match(env.headers) {
+			if data, err = q.coder.Decode(env.payload); err == nil {
+				matched = pred == nil || pred(env.headers, data)
+			}
+		}
+		if skipped > 0 && (err != nil || matched) {
+			if ackErr := q.progressManager.ack(consumerID, q.queueName, skipped, q.opts.MaxDeliveries > 0); ackErr != nil {
+				return nil, deadLettered, ackErr
+			}
+			skipped = 0
+		}
+		if err != nil {
+			return nil, deadLettered, err
+		}
+		if !matched {
+			skipped = seq
+			q.metrics.filtered.Inc()
+			continue
+		}
+
+		exhausted, err := q.deadLetterIfExhausted(consumerID, seq, env)
+		if err != nil {
+			return nil, deadLettered, err
+		}
+		if exhausted {
+			deadLettered = append(deadLettered, seq)
+			continue
+		}
+
+		ctx := context.Background()
+		if q.propagator != nil && env.headers != nil {
+			ctx = q.propagator.Extract(ctx, env.headers)
+		}
+
+		q.metrics.dequeued.Inc()
+		if last, ok := q.delivered[consumerID]; ok && last == progress {
+			q.metrics.redelivered.Inc()
+		}
+		q.delivered[consumerID] = progress
+
+		// 返回消息，但不更新进度，进度更新在 Ack 时进行
+		return &MsgImpl[T]{
+			data:            data,
+			headers:         env.headers,
+			ctx:             ctx,
+			queueName:       q.queueName,
+			consumerID:      consumerID,
+			seq:             uint64(seq),
+			progressManager: q.progressManager,
+			trackLease:      q.opts.MaxDeliveries > 0,
+			metrics:         q.metrics,
+			logger:          q.logger,
+			hooks:           q.hooks,
+		}, deadLettered, nil
+	}
+}
+
+// Fetch returns up to max messages that consumerID has not acknowledged and
+// whose sequence numbers are greater than after, oldest first, without
+// waiting. It is meant for consumers that keep several messages in flight:
+// acknowledging a message acknowledges every earlier message of the queue as
+// well, so acknowledge them in order. Pass 0 for after to start at the
+// consumer's next message.
+//
+// Fetch does not count deliveries, so MaxDeliveries and AutoAck do not apply
+// to it. It returns an empty slice when there is nothing to fetch, and
+// ErrInvalidOption if max is not positive.
+func (q *Queue[T]) Fetch(consumerID string, after uint64, max int) ([]Msg[T], error) {
+	return q.FetchFilter(consumerID, after, max, nil)
+}
+
+// FetchFilter is like Fetch but only returns messages that pass f, without
+// decoding the payloads of the others. Messages that do not pass are
+// acknowledged for consumerID when nothing before them is left unacknowledged,
+// that is when after is not past the consumer's progress, so that they do not
+// hold up cleanup; otherwise a later FetchFilter or acknowledgement takes care
+// of them.
+func (q *Queue[T]) FetchFilter(consumerID string, after uint64, max int, f *Filter) ([]Msg[T], error) {
+	if max <= 0 {
+		return nil, invalidOption("max", "must be positive")
+	}
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	// 获取当前消费者的进度
+	if err := q.checkOpen(); err != nil {
+		return nil, err
+	}
 	progress, err := q.progressManager.getProgress(consumerID, q.queueName)
 	if err != nil {
 		return nil, err
 	}
-
-	// 根据进度读取消息
-	data, err := q.msgManager.Read(q.queueName, fmt.Sprintf("%d", progress+1))
+	from := after
+	if progress > 0 && uint64(progress) > from {
+		from = uint64(progress)
+	}
+	var (
+		raw      []keyValue
+		skipped  uint64 // 紧接在进度之后、被过滤掉的最后一条
+		nskipped uint64
+	)
+	contiguous := progress >= 0 && from == uint64(progress)
+	err = q.db.view(func(tx Tx) error {
+		return tx.Scan(q.queueName, from+1, func(seq uint64, value []byte) bool {
+			if f != nil {
+				env, err := decodeEnvelope(value)
+				if err == nil && !f.Match(env.headers) {
+					if contiguous && len(raw) == 0 {
+						skipped = seq
+						nskipped++
+					}
+					return true
+				}
+			}
+			raw = append(raw, keyValue{key: strconv.FormatUint(seq, 10), value: append([]byte(nil), value...)})
+			return len(raw) < max
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
+	if skipped > 0 {
+		if err := q.progressManager.ack(consumerID, q.queueName, int64(skipped), false); err != nil {
+			return nil, err
+		}
+		q.metrics.filtered.Add(nskipped)
+	}
+	msgs := make([]Msg[T], 0, len(raw))
+	for _, kv := range raw {
+		env, err := decodeEnvelope(kv.value)
+		if err != nil {
+			return nil, err
+		}
+		data, err := q.coder.Decode(env.payload)
+		if err != nil {
+			return nil, err
+		}
+		seq, _ := strconv.ParseUint(kv.key, 10, 64)
+		ctx := context.Background()
+		if q.propagator != nil && env.headers != nil {
+			ctx = q.propagator.Extract(ctx, env.headers)
+		}
+		msgs = append(msgs, &MsgImpl[T]{
+			data:            data,
+			headers:         env.headers,
+			ctx:             ctx,
+			queueName:       q.queueName,
+			consumerID:      consumerID,
+			seq:             seq,
+			progressManager: q.progressManager,
+			metrics:         q.metrics,
+			logger:          q.logger,
+			hooks:           q.hooks,
+		})
+	}
+	q.metrics.dequeued.Add(uint64(len(msgs)))
+	return msgs, nil
+}
 
-	// 返回消息，但不更新进度，进度更新在 Ack 时进行
-	return &MsgImpl[T]{
-		data:            data,
-		queueName:       q.queueName,
-		consumerID:      consumerID,
-		progressManager: q.progressManager,
-	}, nil
+// SetPropagator sets the propagator used to carry trace context from producers
+// to consumers through message headers. A nil propagator disables propagation.
+func (q *Queue[T]) SetPropagator(p Propagator) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.propagator = p
 }
 
-// CleanDB cleans up consumed messages.
-func CleanDB(dbPath string) error {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
-	db, err := newDBClient(dbPath)
+// CleanDB cleans up consumed messages. opts are only used when dbPath is not
+// already open in this process, e.g. to select the store it was written with.
+func CleanDB(dbPath string, opts ...Option) error {
+	db, err := Open(dbPath, opts...)
 	if err != nil {
 		return err
 	}
-
-	return db.cleanupAllConsumed()
+	err = db.Clean()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
+// Close closes the queue. A queue created by NewQueue also releases its
+// reference to the database file, closing it if no other queue or DB uses
+// it. Operations on a closed queue return ErrDatabaseClosed; closing it again
+// is a no-op.
 func (q *Queue[T]) Close() error {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
-	if atomic.AddInt32(&clientRefCount, -1) == 0 {
-		return q.db.close()
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.metrics.unregisterGauges()
+	q.mu.Unlock()
+	if q.ownsHandle {
+		return q.handle.Close()
 	}
 	return nil
 }
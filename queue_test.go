@@ -1,6 +1,7 @@
 package bunnymq
 
 import (
+	"errors"
 	"fmt"
 
 	"sync"
@@ -10,188 +11,168 @@ import (
 
 // 测试nack
 func TestQueueWithNack(t *testing.T) {
-	// 创建队列
-	dbPath := "test.db"
-	queue, err := NewQueue[testStruct]("test_queue_nack", dbPath, &JsonCoder[testStruct]{})
-	t.Log("create")
-	if err != nil {
-		t.Fatalf("Error creating queue: %v", err)
-	}
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		// 创建队列
+		queue, err := NewQueue[testStruct]("test_queue_nack", dbPath, &JsonCoder[testStruct]{}, opts...)
+		t.Log("create")
+		if err != nil {
+			t.Fatalf("Error creating queue: %v", err)
+		}
 
-	// 推送消息到队列
-	message := testStruct{
-		sid:     t.Name(),
-		Message: "Message to be Nack",
-		Time:    time.Now(),
-	}
-	t.Log(message)
-	if err := queue.Enqueue(message); err != nil {
+		// 推送消息到队列
+		message := testStruct{
+			sid:     t.Name(),
+			Message: "Message to be Nack",
+			Time:    time.Now(),
+		}
+		t.Log(message)
+		if err := queue.Enqueue(message); err != nil {
 
-		t.Fatalf("Error enqueuing message: %v", err)
-	}
-	t.Log(message)
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+		t.Log(message)
 
-	consumerID := "consumer_nack"
-	msg, err := queue.Dequeue(consumerID)
-	if err != nil {
-		t.Fatalf("Error dequeuing message: %v", err)
-	}
-	t.Log("consumer_nack")
-	// Simulate processing failure and call Nack
-	if err := msg.NAck(); err != nil {
-		t.Errorf("Error calling Nack: %v", err)
-	}
+		consumerID := "consumer_nack"
+		msg, err := queue.Dequeue(consumerID)
+		if err != nil {
+			t.Fatalf("Error dequeuing message: %v", err)
+		}
+		t.Log("consumer_nack")
+		// Simulate processing failure and call Nack
+		if err := msg.NAck(); err != nil {
+			t.Errorf("Error calling Nack: %v", err)
+		}
 
-	// Dequeue the message again, it should be the same message
-	msgAgain, err := queue.Dequeue(consumerID)
-	if err != nil {
-		t.Fatalf("Error dequeuing message again: %v", err)
-	}
-	t.Log(message.Message, message.Time)
-	t.Log(msgAgain.Data().Message, message.Time)
-	if msgAgain.Data().Message != message.Message {
+		// Dequeue the message again, it should be the same message
+		msgAgain, err := queue.Dequeue(consumerID)
+		if err != nil {
+			t.Fatalf("Error dequeuing message again: %v", err)
+		}
+		t.Log(message.Message, message.Time)
+		t.Log(msgAgain.Data().Message, message.Time)
+		if msgAgain.Data().Message != message.Message {
 
-		t.Errorf("Expected message: %s, got: %s", message.Message, msgAgain.Data().Message)
-	}
+			t.Errorf("Expected message: %s, got: %s", message.Message, msgAgain.Data().Message)
+		}
+	})
 }
 
 // 一个队列不同消费者同时消费
 func TestQueueMultipleConsumers(t *testing.T) {
-	// 创建队列
-	dbPath := "test2=2.db"
-	queue, err := NewQueue[testStruct]("test_queue", dbPath, &JsonCoder[testStruct]{})
-	if err != nil {
-		t.Fatalf("Error creating queue: %v", err)
-	}
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		// 创建队列
+		queue, err := NewQueue[testStruct]("test_queue", dbPath, &JsonCoder[testStruct]{}, opts...)
+		if err != nil {
+			t.Fatalf("Error creating queue: %v", err)
+		}
 
-	// 推送消息到队列
-	var messages []testStruct
-	for i := 1; i <= 30; i++ {
-		messages = append(messages, testStruct{
-			sid:     t.Name(),
-			Message: fmt.Sprintf("Message %d", i),
-			Time:    time.Now(),
-		})
-	}
+		// 推送消息到队列
+		var messages []testStruct
+		for i := 1; i <= 30; i++ {
+			messages = append(messages, testStruct{
+				sid:     t.Name(),
+				Message: fmt.Sprintf("Message %d", i),
+				Time:    time.Now(),
+			})
+		}
 
-	for _, msg := range messages {
-		if err := queue.Enqueue(msg); err != nil {
-			t.Fatalf("Error enqueuing message: %v", err)
+		for _, msg := range messages {
+			if err := queue.Enqueue(msg); err != nil {
+				t.Fatalf("Error enqueuing message: %v", err)
+			}
 		}
-	}
 
-	// 设置消费者数量
-	consumerIDs := []string{"consumer1", "consumer2", "consumer3"}
-	expectedMessages := len(messages)
+		// 设置消费者数量
+		consumerIDs := []string{"consumer1", "consumer2", "consumer3"}
+		expectedMessages := len(messages)
 
-	// 并发测试
-	var wg sync.WaitGroup
-	for _, consumerID := range consumerIDs {
-		wg.Add(1)
-		go func(consumerID string) {
-			defer wg.Done()
-			receivedMessages := 0
-			for {
-				msg, err := queue.Dequeue(consumerID)
-				if err != nil {
-					break
-				}
+		// 并发测试
+		var wg sync.WaitGroup
+		for _, consumerID := range consumerIDs {
+			wg.Add(1)
+			go func(consumerID string) {
+				defer wg.Done()
+				receivedMessages := 0
+				for {
+					msg, err := queue.Dequeue(consumerID)
+					if err != nil {
+						break
+					}
 
-				// 不删除消息，只记录进度
-				if err := msg.Ack(); err != nil {
-					t.Errorf("Error acknowledging message: %v", err)
+					// 不删除消息，只记录进度
+					if err := msg.Ack(); err != nil {
+						t.Errorf("Error acknowledging message: %v", err)
+					}
+					receivedMessages++
 				}
-				receivedMessages++
-			}
 
-			t.Logf("Consumer %s received %d messages.", consumerID, receivedMessages)
+				t.Logf("Consumer %s received %d messages.", consumerID, receivedMessages)
 
-			if receivedMessages != expectedMessages {
-				t.Errorf("Consumer %s did not receive all messages, received: %d expected: %d", consumerID, receivedMessages, expectedMessages)
-			}
-		}(consumerID)
-	}
+				if receivedMessages != expectedMessages {
+					t.Errorf("Consumer %s did not receive all messages, received: %d expected: %d", consumerID, receivedMessages, expectedMessages)
+				}
+			}(consumerID)
+		}
 
-	wg.Wait()
+		wg.Wait()
+	})
 }
 
 // 不同队列，只有一个消费者消费了一条队列
 // Cleanup the database before running the test
-func cleanDatabase(path string) {
-	err := CleanDB(path)
+func cleanDatabase(path string, opts ...Option) {
+	err := CleanDB(path, opts...)
 	if err != nil {
 		fmt.Printf("Error cleaning database: %v\n", err)
 	}
 }
 
 func TestMultiQueue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
 
-	// Define queue names
-	queueNames := []string{"queue1", "queue2", "queue3"}
-	path := "1.db"
-	defer cleanDatabase(path, )
-	// Create queues
-	var queues []*Queue[testStruct]
-	for _, queueName := range queueNames {
-		queue, err := NewQueue[testStruct](queueName, path, &JsonCoder[testStruct]{})
-		if err != nil {
-			t.Fatalf("Error creating queue %s: %v", queueName, err)
-		}
-		queues = append(queues, queue)
-		defer queue.Close()
-	}
-
-	// Push messages to different queues
-	var wg sync.WaitGroup
-	for i, queue := range queues {
-		wg.Add(1)
-		go func(queue *Queue[testStruct], idx int) {
-			defer wg.Done()
-			for j := 1; j <= 30; j++ {
-				msg := testStruct{
-					sid:     fmt.Sprintf("Queue%d", idx+1),
-					Message: fmt.Sprintf("Message %d", j),
-					Time:    time.Now(),
-				}
-				if err := queue.Enqueue(msg); err != nil {
-					t.Fatalf("Error enqueuing message to %s: %v", queueNames[idx], err)
-				}
-
+		// Define queue names
+		queueNames := []string{"queue1", "queue2", "queue3"}
+		defer cleanDatabase(dbPath, opts...)
+		// Create queues
+		var queues []*Queue[testStruct]
+		for _, queueName := range queueNames {
+			queue, err := NewQueue[testStruct](queueName, dbPath, &JsonCoder[testStruct]{}, opts...)
+			if err != nil {
+				t.Fatalf("Error creating queue %s: %v", queueName, err)
 			}
-		}(queue, i)
-	}
-	wg.Wait()
+			queues = append(queues, queue)
+			defer queue.Close()
+		}
 
-	// Consume messages only from the first queue
-	consumerID := "consumer1"
-	queueToConsume := queues[0]
-	receivedMessages := 0
+		// Push messages to different queues
+		var wg sync.WaitGroup
+		for i, queue := range queues {
+			wg.Add(1)
+			go func(queue *Queue[testStruct], idx int) {
+				defer wg.Done()
+				for j := 1; j <= 30; j++ {
+					msg := testStruct{
+						sid:     fmt.Sprintf("Queue%d", idx+1),
+						Message: fmt.Sprintf("Message %d", j),
+						Time:    time.Now(),
+					}
+					if err := queue.Enqueue(msg); err != nil {
+						t.Errorf("Error enqueuing message to %s: %v", queueNames[idx], err)
+						return
+					}
 
-	for {
-		msg, err := queueToConsume.Dequeue(consumerID)
-		if err != nil {
-			break
-		}
-		receivedMessages++
-		if err := msg.Ack(); err != nil {
-			t.Errorf("Error acknowledging message: %v", err)
+				}
+			}(queue, i)
 		}
-	}
-
-	// Check if all messages were consumed from queue1
-	if receivedMessages != 30 {
-		t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[0], receivedMessages)
-	} else {
-		t.Logf("Consumer %s successfully received all 30 messages from %s.", consumerID, queueNames[0])
-	}
+		wg.Wait()
 
-	// Validate that other queues have all their messages (30 each)
-	for i, queue := range queues[1:] {
-		consumerID := fmt.Sprintf("consumer%d", i+2)
+		// Consume messages only from the first queue
+		consumerID := "consumer1"
+		queueToConsume := queues[0]
 		receivedMessages := 0
 
 		for {
-			msg, err := queue.Dequeue(consumerID)
+			msg, err := queueToConsume.Dequeue(consumerID)
 			if err != nil {
 				break
 			}
@@ -201,10 +182,151 @@ func TestMultiQueue(t *testing.T) {
 			}
 		}
 
+		// Check if all messages were consumed from queue1
 		if receivedMessages != 30 {
-			t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[i+1], receivedMessages)
+			t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[0], receivedMessages)
 		} else {
-			t.Logf("Consumer %s successfully received all 30 messages from %s.", consumerID, queueNames[i+1])
+			t.Logf("Consumer %s successfully received all 30 messages from %s.", consumerID, queueNames[0])
 		}
-	}
+
+		// Validate that other queues have all their messages (30 each)
+		for i, queue := range queues[1:] {
+			consumerID := fmt.Sprintf("consumer%d", i+2)
+			receivedMessages := 0
+
+			for {
+				msg, err := queue.Dequeue(consumerID)
+				if err != nil {
+					break
+				}
+				receivedMessages++
+				if err := msg.Ack(); err != nil {
+					t.Errorf("Error acknowledging message: %v", err)
+				}
+			}
+
+			if receivedMessages != 30 {
+				t.Errorf("Consumer %s did not receive all messages from %s, received: %d", consumerID, queueNames[i+1], receivedMessages)
+			} else {
+				t.Logf("Consumer %s successfully received all 30 messages from %s.", consumerID, queueNames[i+1])
+			}
+		}
+	})
+}
+
+func TestFetch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		queue, err := NewQueue[testStruct]("fetch", dbPath, &JsonCoder[testStruct]{}, opts...)
+		if err != nil {
+			t.Fatalf("Error creating queue: %v", err)
+		}
+		defer queue.Close()
+		for _, m := range []string{"a", "b", "c", "d"} {
+			queue.Enqueue(testStruct{Message: m})
+		}
+		msgs, err := queue.Fetch("c", 0, 2)
+		if err != nil || len(msgs) != 2 || msgs[0].Seq() != 1 || msgs[1].Data().Message != "b" {
+			t.Fatalf("Fetch = %v, %v; want a and b", msgs, err)
+		}
+		msgs, err = queue.Fetch("c", 2, 10)
+		if err != nil || len(msgs) != 2 || msgs[0].Data().Message != "c" {
+			t.Fatalf("Fetch after 2 = %v, %v; want c and d", msgs, err)
+		}
+
+		// 确认是累积的，先确认后面的再确认前面的不会让进度倒退
+		if err := msgs[1].Ack(); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+		if err := msgs[0].Ack(); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+		if msgs, _ := queue.Fetch("c", 0, 10); len(msgs) != 0 {
+			t.Errorf("Fetch after acking d = %v; want nothing", msgs)
+		}
+		if msg, err := queue.Dequeue("c"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Dequeue after acking d = %v, %v; want ErrKeyNotFound", msg, err)
+		}
+		for _, max := range []int{0, -1} {
+			if msgs, err := queue.Fetch("c", 0, max); !errors.Is(err, ErrInvalidOption) {
+				t.Errorf("Fetch with max %d = %v, %v; want ErrInvalidOption", max, msgs, err)
+			}
+		}
+	})
+}
+
+// 保留策略、丢弃最旧消息和 Purge 会在消费者进度之后删出空洞，Dequeue 要跳过空洞，
+// Ack 把进度直接移到取到的那条消息
+func TestDequeueSkipsRemovedMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		queue, err := NewQueue[testStruct]("gaps", dbPath, &JsonCoder[testStruct]{}, opts...)
+		if err != nil {
+			t.Fatalf("Error creating queue: %v", err)
+		}
+		defer queue.Close()
+		for _, m := range []string{"a", "b", "c", "d"} {
+			if err := queue.Enqueue(testStruct{Message: m}); err != nil {
+				t.Fatalf("Error enqueuing message: %v", err)
+			}
+		}
+		err = queue.db.update(func(tx Tx) error {
+			return tx.DeleteRange("gaps", 2, 3)
+		})
+		if err != nil {
+			t.Fatalf("Error deleting messages: %v", err)
+		}
+
+		for _, want := range []struct {
+			seq uint64
+			msg string
+		}{{1, "a"}, {4, "d"}} {
+			msg, err := queue.Dequeue("c")
+			if err != nil || msg.Seq() != want.seq || msg.Data().Message != want.msg {
+				t.Fatalf("Dequeue = %v, %v; want %d %s", msg, err, want.seq, want.msg)
+			}
+			if err := msg.Ack(); err != nil {
+				t.Fatalf("Ack: %v", err)
+			}
+			if progress, _ := queue.progressManager.getProgress("c", "gaps"); progress != int64(want.seq) {
+				t.Errorf("progress after acking %d = %d", want.seq, progress)
+			}
+		}
+		if msg, err := queue.Dequeue("c"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Dequeue at the end = %v, %v; want ErrKeyNotFound", msg, err)
+		}
+	})
+}
+
+// 清理删掉全部已消费的消息（bbolt 还会重建文件）后，序号要接着原来的编，
+// 否则新消息的序号不大于消费者进度，永远取不到
+func TestCleanKeepsSequence(t *testing.T) {
+	forEachStore(t, func(t *testing.T, dbPath string, opts ...Option) {
+		queue, err := NewQueue[testStruct]("cleaned", dbPath, &JsonCoder[testStruct]{}, opts...)
+		if err != nil {
+			t.Fatalf("Error creating queue: %v", err)
+		}
+		defer queue.Close()
+		for _, m := range []string{"a", "b", "c"} {
+			if err := queue.Enqueue(testStruct{Message: m}); err != nil {
+				t.Fatalf("Error enqueuing message: %v", err)
+			}
+			msg, err := queue.Dequeue("c")
+			if err != nil {
+				t.Fatalf("Error dequeuing message: %v", err)
+			}
+			if err := msg.Ack(); err != nil {
+				t.Fatalf("Ack: %v", err)
+			}
+		}
+		if err := CleanDB(dbPath, opts...); err != nil {
+			t.Fatalf("Error cleaning database: %v", err)
+		}
+
+		if err := queue.Enqueue(testStruct{Message: "d"}); err != nil {
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+		msg, err := queue.Dequeue("c")
+		if err != nil || msg.Seq() != 4 || msg.Data().Message != "d" {
+			t.Fatalf("Dequeue after Clean = %v, %v; want 4 d", msg, err)
+		}
+	})
 }
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gitlab.cnns/luoying/bunnymq"
+)
+
+// DefaultEventsInFlight is the max_in_flight of event streams that do not set
+// it.
+const DefaultEventsInFlight = 16
+
+// errClientGone is returned by an event stream's send once the client has
+// disconnected.
+var errClientGone = errors.New("client disconnected")
+
+// events streams the messages of a consumer as Server-Sent Events.
+//
+// With ack=send every message is acknowledged as soon as it has been written
+// to the stream. With ack=explicit, the default, messages are acknowledged
+// through the ack route, in order, and at most max_in_flight are sent ahead
+// of the acknowledgements. The id of each event is the message's sequence
+// number; a client reconnecting with Last-Event-ID, or the last_event_id
+// parameter, resumes after that message, or after the consumer's progress if
+// that is further. With filter set, only the messages passing that
+// bunnymq.Filter expression are sent; the others are acknowledged as they are
+// passed over.
+func (s *Server) events(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	consumer := query.Get("consumer")
+	if consumer == "" {
+		s.writeError(w, http.StatusBadRequest, errors.New("consumer is required"))
+		return
+	}
+	var ackOnSend bool
+	switch query.Get("ack") {
+	case "", "explicit":
+	case "send":
+		ackOnSend = true
+	default:
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ack mode %q, want send or explicit", query.Get("ack")))
+		return
+	}
+	inFlight := uint64(DefaultEventsInFlight)
+	if v := query.Get("max_in_flight"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || n == 0 {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid max_in_flight %q", v))
+			return
+		}
+		inFlight = n
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = query.Get("last_event_id")
+	}
+	var after uint64
+	if lastID != "" {
+		var err error
+		if after, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid last event id %q", lastID))
+			return
+		}
+	}
+	filter, err := parseFilter(query.Get("filter"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported by the connection"))
+		return
+	}
+	q, err := s.queue(name)
+	if err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := newSubscription(name, consumer, inFlight, filter)
+	sub.cursor = after
+	s.addSub(sub)
+	defer s.removeSub(sub)
+	stop := context.AfterFunc(r.Context(), func() { close(sub.stop) })
+	defer stop()
+
+	err = s.push(q, sub, func(msg bunnymq.Msg[[]byte]) error {
+		if err := writeEvent(w, "message", strconv.FormatUint(msg.Seq(), 10), msg.Data()); err != nil {
+			return errClientGone
+		}
+		flusher.Flush()
+		if ackOnSend {
+			if err := msg.Ack(); err != nil {
+				return err
+			}
+			s.notifySettled(name, consumer, msg.Seq(), true)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errClientGone) {
+		if statusFor(err) >= 500 && s.logger != nil {
+			s.logger.Error("bunnymq server: event stream failed", "queue", name, "err", err)
+		}
+		writeEvent(w, "error", "", []byte(err.Error()))
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes one event. Each line of data becomes a data field, so
+// newlines in the payload survive the round trip.
+func writeEvent(w http.ResponseWriter, event, id string, data []byte) error {
+	var buf bytes.Buffer
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(bytes.TrimSuffix(line, []byte("\r")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type event struct {
+	id, name, data string
+}
+
+// openEvents starts an event stream and returns a function reading its next
+// event.
+func openEvents(t *testing.T, url, lastID string) (next func() event, stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	expectStatus(t, resp, http.StatusOK)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	events := make(chan event)
+	go func() {
+		defer close(events)
+		r := bufio.NewReader(resp.Body)
+		var ev event
+		var data []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "":
+				ev.data = strings.Join(data, "\n")
+				events <- ev
+				ev, data = event{}, nil
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.name = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, line[6:])
+			}
+		}
+	}()
+	stop = func() {
+		cancel()
+		resp.Body.Close()
+	}
+	t.Cleanup(stop)
+	next = func() event {
+		t.Helper()
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				t.Fatalf("event stream ended")
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event within 5s")
+		}
+		return event{}
+	}
+	return next, stop
+}
+
+func TestEventsAckOnSend(t *testing.T) {
+	ts := newTestServer(t)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/tail/messages", "first\nline two"), http.StatusNoContent)
+	next, stop := openEvents(t, ts.URL+"/queues/tail/events?consumer=dash&ack=send", "")
+	if ev := next(); ev != (event{id: "1", name: "message", data: "first\nline two"}) {
+		t.Fatalf("first event = %+v", ev)
+	}
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/tail/messages", "second"), http.StatusNoContent)
+	if ev := next(); ev.id != "2" || ev.data != "second" {
+		t.Fatalf("second event = %+v", ev)
+	}
+	stop()
+
+	// 发送即确认，进度很快会走到 2
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := do(t, "GET", ts.URL+"/queues/tail/messages?consumer=dash", "")
+		if resp.StatusCode == http.StatusNoContent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("messages still pending after ack-on-send: status %d", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventsExplicitAckAndResume(t *testing.T) {
+	ts := newTestServer(t)
+	for _, m := range []string{"a", "b", "c", "d"} {
+		expectStatus(t, do(t, "POST", ts.URL+"/queues/jobs/messages", m), http.StatusNoContent)
+	}
+	next, stop := openEvents(t, ts.URL+"/queues/jobs/events?consumer=w&max_in_flight=2", "")
+	if a, b := next(), next(); a.data != "a" || b.data != "b" {
+		t.Fatalf("events = %+v, %+v; want a and b", a, b)
+	}
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/jobs/messages/1/ack?consumer=w", ""), http.StatusNoContent)
+	if ev := next(); ev.id != "3" {
+		t.Fatalf("event after ack = %+v, want 3", ev)
+	}
+	stop()
+
+	// 只确认了 1；带 Last-Event-ID 重连从 3 之后继续，不带则从进度之后继续
+	next, _ = openEvents(t, ts.URL+"/queues/jobs/events?consumer=w", "3")
+	if ev := next(); ev.id != "4" {
+		t.Fatalf("resumed event = %+v, want 4", ev)
+	}
+	next, _ = openEvents(t, ts.URL+"/queues/jobs/events?consumer=w", "")
+	if ev := next(); ev.id != "2" {
+		t.Fatalf("event without Last-Event-ID = %+v, want 2", ev)
+	}
+
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/jobs/events", ""), http.StatusBadRequest)
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/jobs/events?consumer=w&ack=later", ""), http.StatusBadRequest)
+	resp := do(t, "GET", ts.URL+"/queues/jobs/events?consumer=w&last_event_id=x", "")
+	expectStatus(t, resp, http.StatusBadRequest)
+	io.Copy(io.Discard, resp.Body)
+}
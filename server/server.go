@@ -0,0 +1,583 @@
+// Package server serves the queues of a bunnymq database over HTTP and, with
+// ServeWire, over the binary protocol used by package client.
+//
+// Routes, where {name} is a queue name escaped as a single path segment:
+//
+//	GET    /queues                              list the queues
+//	GET    /stats                               stats of every queue
+//	POST   /clean                               remove consumed messages, like CleanDB
+//	GET    /queues/{name}                       stats of one queue
+//	DELETE /queues/{name}                       delete the queue
+//	POST   /queues/{name}/rename?to={new}       rename the queue
+//	POST   /queues/{name}/messages              enqueue the request body
+//	GET    /queues/{name}/messages?consumer={id}&wait={duration}&filter={expr}
+//	                                            the consumer's next message
+//	POST   /queues/{name}/messages/{seq}/ack?consumer={id}&filter={expr}
+//	POST   /queues/{name}/messages/{seq}/nack?consumer={id}&filter={expr}
+//	GET    /queues/{name}/events?consumer={id}&ack={send|explicit}&max_in_flight={n}&filter={expr}
+//	                                            the consumer's messages as Server-Sent Events
+//
+// Message bodies are opaque: they are stored as sent, through
+// bunnymq.RawCoder, and returned as stored, so JSON payloads pass through
+// unchanged. A message is returned with its sequence number in the
+// Bunnymq-Seq header and each of its headers as Bunnymq-Header-{key}.
+// Headers sent the same way on enqueue are stored with the message, their keys
+// lowercased since HTTP does not preserve case.
+//
+// GET .../messages long-polls: with wait set, it returns as soon as a message
+// is available or 204 No Content once wait has passed. wait is a Go duration
+// or a number of seconds and is capped by WithMaxWait.
+//
+// GET .../events streams the consumer's messages as Server-Sent Events as they
+// are enqueued, each with its sequence number as the event id. With ack=send a
+// message is acknowledged once written; with ack=explicit, the default, the
+// client acknowledges through the ack route, in order, and at most
+// max_in_flight messages are sent ahead. A client reconnecting with
+// Last-Event-ID resumes after that message.
+//
+// filter, where accepted, is a bunnymq.Filter expression over the message
+// headers: messages it rejects are skipped and count as consumed by the
+// consumer. Pass the same filter when acknowledging, so that the message can
+// be found again after a restart.
+//
+// Other responses are JSON. Errors are objects with an "error" field and a
+// status derived from the bunnymq error: 404 for a missing queue, 409 for a
+// rename onto an existing queue, 507 for a full queue, and so on.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+)
+
+// Defaults for the corresponding options.
+const (
+	DefaultMaxWait        = 30 * time.Second
+	DefaultMaxMessageSize = 1 << 20
+)
+
+// Headers of a dequeued message. MessageHeaderPrefix also sets message
+// headers on enqueue.
+const (
+	SeqHeader           = "Bunnymq-Seq"
+	MessageHeaderPrefix = "Bunnymq-Header-"
+)
+
+// Server is an http.Handler serving the queues of a bunnymq.DB. Queues are
+// opened on first use and stay open until Close.
+type Server struct {
+	db        *bunnymq.DB
+	maxWait   time.Duration
+	maxSize   int64
+	queueOpts []bunnymq.Option
+	logger    bunnymq.Logger
+
+	mu      sync.Mutex
+	queues  map[string]*bunnymq.Queue[[]byte]
+	pending map[delivery]bunnymq.Msg[[]byte] // last message handed to each consumer
+	done    chan struct{}
+	closed  bool
+
+	listeners map[net.Listener]struct{} // listeners passed to ServeWire
+	conns     map[*wireConn]struct{}
+	subs      map[*subscription]struct{} // wire and event-stream subscriptions
+}
+
+type delivery struct {
+	queue, consumer string
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithMaxWait caps the wait parameter of long-polling requests.
+func WithMaxWait(d time.Duration) Option {
+	return func(s *Server) { s.maxWait = d }
+}
+
+// WithMaxMessageSize sets the largest request body accepted by enqueue; larger
+// bodies are rejected with 413.
+func WithMaxMessageSize(n int64) Option {
+	return func(s *Server) { s.maxSize = n }
+}
+
+// WithQueueOptions sets the options queues are opened with, on top of those
+// the DB was opened with.
+func WithQueueOptions(opts ...bunnymq.Option) Option {
+	return func(s *Server) { s.queueOpts = opts }
+}
+
+// WithLogger sets the logger that receives internal server errors.
+func WithLogger(logger bunnymq.Logger) Option {
+	return func(s *Server) { s.logger = logger }
+}
+
+// New returns a Server for the queues in db. The caller keeps ownership of db
+// and closes it after closing the Server.
+func New(db *bunnymq.DB, opts ...Option) *Server {
+	s := &Server{
+		db:        db,
+		maxWait:   DefaultMaxWait,
+		maxSize:   DefaultMaxMessageSize,
+		queues:    make(map[string]*bunnymq.Queue[[]byte]),
+		pending:   make(map[delivery]bunnymq.Msg[[]byte]),
+		done:      make(chan struct{}),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*wireConn]struct{}),
+		subs:      make(map[*subscription]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Close ends pending long-polls, closes the listeners and connections of
+// ServeWire and closes the queues the server opened. HTTP requests arriving
+// afterwards fail with 503.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	var firstErr error
+	for name, q := range s.queues {
+		if err := q.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.queues, name)
+	}
+	return firstErr
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts, err := splitPath(r.URL.EscapedPath())
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "queues":
+		if allow(w, r, http.MethodGet) {
+			s.listQueues(w)
+		}
+	case len(parts) == 1 && parts[0] == "stats":
+		if allow(w, r, http.MethodGet) {
+			s.stats(w)
+		}
+	case len(parts) == 1 && parts[0] == "clean":
+		if allow(w, r, http.MethodPost) {
+			s.clean(w)
+		}
+	case len(parts) == 2 && parts[0] == "queues":
+		if allow(w, r, http.MethodGet, http.MethodDelete) {
+			if r.Method == http.MethodGet {
+				s.queueStats(w, parts[1])
+			} else {
+				s.deleteQueue(w, parts[1])
+			}
+		}
+	case len(parts) == 3 && parts[0] == "queues" && parts[2] == "rename":
+		if allow(w, r, http.MethodPost) {
+			s.renameQueue(w, parts[1], r.URL.Query().Get("to"))
+		}
+	case len(parts) == 3 && parts[0] == "queues" && parts[2] == "messages":
+		if allow(w, r, http.MethodGet, http.MethodPost) {
+			if r.Method == http.MethodGet {
+				s.dequeue(w, r, parts[1])
+			} else {
+				s.enqueue(w, r, parts[1])
+			}
+		}
+	case len(parts) == 3 && parts[0] == "queues" && parts[2] == "events":
+		if allow(w, r, http.MethodGet) {
+			s.events(w, r, parts[1])
+		}
+	case len(parts) == 5 && parts[0] == "queues" && parts[2] == "messages" && (parts[4] == "ack" || parts[4] == "nack"):
+		if allow(w, r, http.MethodPost) {
+			s.settle(w, r, parts[1], parts[3], parts[4] == "ack")
+		}
+	default:
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+	}
+}
+
+// splitPath splits an escaped URL path into unescaped segments.
+func splitPath(escaped string) ([]string, error) {
+	parts := strings.Split(strings.Trim(escaped, "/"), "/")
+	for i, p := range parts {
+		unescaped, err := url.PathUnescape(p)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = unescaped
+	}
+	return parts, nil
+}
+
+// allow reports whether r uses one of methods, answering 405 if not.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, errorBody{Error: "method not allowed"})
+	return false
+}
+
+// queue returns the open queue called name, opening it on first use.
+func (s *Server) queue(name string) (*bunnymq.Queue[[]byte], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, bunnymq.ErrDatabaseClosed
+	}
+	if q, ok := s.queues[name]; ok {
+		return q, nil
+	}
+	q, err := bunnymq.OpenQueue[[]byte](s.db, name, bunnymq.RawCoder{}, s.queueOpts...)
+	if err != nil {
+		return nil, err
+	}
+	s.queues[name] = q
+	return q, nil
+}
+
+// forget closes the server's handle on a queue that was renamed or deleted.
+func (s *Server) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[name]; ok {
+		q.Close()
+		delete(s.queues, name)
+	}
+	for d := range s.pending {
+		if d.queue == name {
+			delete(s.pending, d)
+		}
+	}
+}
+
+func (s *Server) enqueue(w http.ResponseWriter, r *http.Request, name string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.writeError(w, http.StatusRequestEntityTooLarge, err)
+		} else {
+			s.writeError(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+	q, err := s.queue(name)
+	if err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	var headers bunnymq.Headers
+	for k, v := range r.Header {
+		if key, ok := strings.CutPrefix(k, MessageHeaderPrefix); ok && key != "" && len(v) > 0 {
+			if headers == nil {
+				headers = bunnymq.Headers{}
+			}
+			headers.Set(strings.ToLower(key), v[0])
+		}
+	}
+	if err := q.EnqueueWithHeaders(r.Context(), body, headers); err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) dequeue(w http.ResponseWriter, r *http.Request, name string) {
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		s.writeError(w, http.StatusBadRequest, errors.New("consumer is required"))
+		return
+	}
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	wait = min(wait, s.maxWait)
+	filter, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	q, err := s.queue(name)
+	if err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		// 先拿通知通道再读，读和等之间入队的消息不会漏掉
+		ready := s.db.Enqueued(name)
+		msg, err := q.DequeueFilter(consumer, filter)
+		if err == nil {
+			s.mu.Lock()
+			s.pending[delivery{name, consumer}] = msg
+			s.mu.Unlock()
+			writeMessage(w, msg)
+			return
+		}
+		if !isEmpty(err) {
+			s.writeError(w, statusFor(err), err)
+			return
+		}
+		select {
+		case <-ready:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-s.done:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// settle acknowledges or rejects the message a consumer last received.
+func (s *Server) settle(w http.ResponseWriter, r *http.Request, name, seqParam string, ack bool) {
+	consumer := r.URL.Query().Get("consumer")
+	if consumer == "" {
+		s.writeError(w, http.StatusBadRequest, errors.New("consumer is required"))
+		return
+	}
+	seq, err := strconv.ParseUint(seqParam, 10, 64)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid sequence number %q", seqParam))
+		return
+	}
+	key := delivery{name, consumer}
+	s.mu.Lock()
+	msg := s.pending[key]
+	s.mu.Unlock()
+	if msg == nil || msg.Seq() != seq {
+		// 服务重启过或者消息是别的连接取走的，重新取一次当前消息
+		q, err := s.queue(name)
+		if err != nil {
+			s.writeError(w, statusFor(err), err)
+			return
+		}
+		filter, err := parseFilter(r.URL.Query().Get("filter"))
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		msg, err = q.DequeueFilter(consumer, filter)
+		if err != nil && !isEmpty(err) {
+			s.writeError(w, statusFor(err), err)
+			return
+		}
+		if msg == nil || msg.Seq() != seq {
+			s.writeError(w, http.StatusConflict, fmt.Errorf("message %d is not the next message of consumer %q", seq, consumer))
+			return
+		}
+	}
+	if ack {
+		err = msg.Ack()
+	} else {
+		err = msg.NAck()
+	}
+	if err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	s.mu.Lock()
+	if s.pending[key] == msg {
+		delete(s.pending, key)
+	}
+	s.mu.Unlock()
+	s.notifySettled(name, consumer, seq, ack)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listQueues(w http.ResponseWriter) {
+	names, err := s.db.ListQueues()
+	if err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Queues []string `json:"queues"`
+	}{names})
+}
+
+// queueStats is the JSON form of bunnymq.QueueStats.
+type queueStats struct {
+	Messages int    `json:"messages"`
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+}
+
+func toQueueStats(qs bunnymq.QueueStats) queueStats {
+	return queueStats{Messages: qs.Count, FirstSeq: qs.FirstSeq, LastSeq: qs.LastSeq}
+}
+
+func (s *Server) stats(w http.ResponseWriter) {
+	stats, err := s.db.Stats()
+	if err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	queues := make(map[string]queueStats, len(stats.Queues))
+	for name, qs := range stats.Queues {
+		queues[name] = toQueueStats(qs)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Messages int                   `json:"messages"`
+		Queues   map[string]queueStats `json:"queues"`
+	}{stats.Messages, queues})
+}
+
+func (s *Server) queueStats(w http.ResponseWriter, name string) {
+	stats, err := s.db.Stats()
+	if err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	qs, ok := stats.Queues[name]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, fmt.Errorf("queue %q not found", name))
+		return
+	}
+	writeJSON(w, http.StatusOK, toQueueStats(qs))
+}
+
+func (s *Server) deleteQueue(w http.ResponseWriter, name string) {
+	if err := s.db.DeleteQueue(name); err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	s.forget(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) renameQueue(w http.ResponseWriter, name, to string) {
+	if to == "" {
+		s.writeError(w, http.StatusBadRequest, errors.New("to is required"))
+		return
+	}
+	if err := s.db.RenameQueue(name, to); err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	s.forget(name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clean(w http.ResponseWriter) {
+	if err := s.db.Clean(); err != nil {
+		s.writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseWait accepts a Go duration or a number of seconds.
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		v = strconv.Itoa(n) + "s"
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid wait %q", v)
+	}
+	return d, nil
+}
+
+// parseFilter parses the optional filter of a request. An empty expression
+// is a nil filter, which passes every message.
+func parseFilter(expr string) (*bunnymq.Filter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return bunnymq.ParseFilter(expr)
+}
+
+// isEmpty reports whether a Dequeue error means there is no message yet.
+func isEmpty(err error) bool {
+	return errors.Is(err, bunnymq.ErrKeyNotFound) || errors.Is(err, bunnymq.ErrBucketNotFound)
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, bunnymq.ErrBucketNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, bunnymq.ErrQueueExists):
+		return http.StatusConflict
+	case errors.Is(err, bunnymq.ErrReservedQueueName), errors.Is(err, bunnymq.ErrInvalidOption):
+		return http.StatusBadRequest
+	case errors.Is(err, bunnymq.ErrQueueFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, bunnymq.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, bunnymq.ErrDatabaseClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeMessage(w http.ResponseWriter, msg bunnymq.Msg[[]byte]) {
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set(SeqHeader, strconv.FormatUint(msg.Seq(), 10))
+	for _, k := range msg.Headers().Keys() {
+		h.Set(MessageHeaderPrefix+k, msg.Headers().Get(k))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(msg.Data())
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, err error) {
+	if status >= 500 && s.logger != nil {
+		s.logger.Error("bunnymq server: request failed", "status", status, "err", err)
+	}
+	writeJSON(w, status, errorBody{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+)
+
+func newTestServer(t *testing.T, opts ...Option) *httptest.Server {
+	t.Helper()
+	db, err := bunnymq.Open(filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	handler := New(db, opts...)
+	ts := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		ts.Close()
+		handler.Close()
+		db.Close()
+	})
+	return ts
+}
+
+func do(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func expectStatus(t *testing.T, resp *http.Response, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: status %d, want %d: %s", resp.Request.Method, resp.Request.URL, resp.StatusCode, want, body)
+	}
+}
+
+func TestEnqueueDequeueAck(t *testing.T) {
+	ts := newTestServer(t)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/orders/messages", `{"id":1}`), http.StatusNoContent)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/orders/messages", `{"id":2}`), http.StatusNoContent)
+
+	resp := do(t, "GET", ts.URL+"/queues/orders/messages?consumer=c", "")
+	expectStatus(t, resp, http.StatusOK)
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != `{"id":1}` || resp.Header.Get(SeqHeader) != "1" {
+		t.Fatalf("first message = %s (seq %s)", body, resp.Header.Get(SeqHeader))
+	}
+
+	// 未确认之前一直返回同一条；序号不对的确认被拒绝
+	resp = do(t, "GET", ts.URL+"/queues/orders/messages?consumer=c", "")
+	expectStatus(t, resp, http.StatusOK)
+	if resp.Header.Get(SeqHeader) != "1" {
+		t.Fatalf("redelivered seq %s, want 1", resp.Header.Get(SeqHeader))
+	}
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/orders/messages/2/ack?consumer=c", ""), http.StatusConflict)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/orders/messages/1/nack?consumer=c", ""), http.StatusNoContent)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/orders/messages/1/ack?consumer=c", ""), http.StatusNoContent)
+
+	resp = do(t, "GET", ts.URL+"/queues/orders/messages?consumer=c", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body, _ := io.ReadAll(resp.Body); string(body) != `{"id":2}` {
+		t.Fatalf("second message = %s", body)
+	}
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/orders/messages/2/ack?consumer=c", ""), http.StatusNoContent)
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/orders/messages?consumer=c", ""), http.StatusNoContent)
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/orders/messages", ""), http.StatusBadRequest)
+}
+
+func TestDequeueFilter(t *testing.T) {
+	ts := newTestServer(t)
+	for _, kind := range []string{"view", "click", "view"} {
+		req, _ := http.NewRequest("POST", ts.URL+"/queues/events/messages", strings.NewReader(kind))
+		req.Header.Set(MessageHeaderPrefix+"Kind", kind)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		expectStatus(t, resp, http.StatusNoContent)
+	}
+
+	clicks := "?consumer=c&filter=" + url.QueryEscape(`kind == "click"`)
+	resp := do(t, "GET", ts.URL+"/queues/events/messages"+clicks, "")
+	expectStatus(t, resp, http.StatusOK)
+	if resp.Header.Get(SeqHeader) != "2" || resp.Header.Get(MessageHeaderPrefix+"Kind") != "click" {
+		t.Fatalf("filtered message: seq %s, kind %s", resp.Header.Get(SeqHeader), resp.Header.Get(MessageHeaderPrefix+"Kind"))
+	}
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/events/messages/2/ack"+clicks, ""), http.StatusNoContent)
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/events/messages"+clicks, ""), http.StatusNoContent)
+	// 其他消费者不受影响
+	resp = do(t, "GET", ts.URL+"/queues/events/messages?consumer=other", "")
+	expectStatus(t, resp, http.StatusOK)
+	if resp.Header.Get(SeqHeader) != "1" {
+		t.Fatalf("unfiltered consumer got seq %s, want 1", resp.Header.Get(SeqHeader))
+	}
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/events/messages?consumer=c&filter=kind+%3D%3D", ""), http.StatusBadRequest)
+}
+
+func TestLongPoll(t *testing.T) {
+	ts := newTestServer(t)
+	start := time.Now()
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/jobs/messages?consumer=c&wait=100ms", ""), http.StatusNoContent)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("empty long-poll returned after %v", elapsed)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		req, _ := http.NewRequest("POST", ts.URL+"/queues/jobs/messages", strings.NewReader("wake"))
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	start = time.Now()
+	resp := do(t, "GET", ts.URL+"/queues/jobs/messages?consumer=c&wait=10", "")
+	expectStatus(t, resp, http.StatusOK)
+	if body, _ := io.ReadAll(resp.Body); string(body) != "wake" {
+		t.Errorf("long-poll returned %q", body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("long-poll was not woken by the enqueue, took %v", elapsed)
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	ts := newTestServer(t, WithMaxMessageSize(8))
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/a/messages", "1"), http.StatusNoContent)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/a/messages", "123456789"), http.StatusRequestEntityTooLarge)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/b/messages", "2"), http.StatusNoContent)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/_meta/messages", "x"), http.StatusBadRequest)
+
+	resp := do(t, "GET", ts.URL+"/queues", "")
+	expectStatus(t, resp, http.StatusOK)
+	var list struct{ Queues []string }
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil || strings.Join(list.Queues, ",") != "a,b" {
+		t.Fatalf("queues = %v, %v", list.Queues, err)
+	}
+
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/a/rename?to=b", ""), http.StatusConflict)
+	expectStatus(t, do(t, "POST", ts.URL+"/queues/a/rename?to=c", ""), http.StatusNoContent)
+	resp = do(t, "GET", ts.URL+"/queues/c", "")
+	expectStatus(t, resp, http.StatusOK)
+	var stats queueStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil || stats != (queueStats{Messages: 1, FirstSeq: 1, LastSeq: 1}) {
+		t.Fatalf("stats of c = %+v, %v", stats, err)
+	}
+	expectStatus(t, do(t, "GET", ts.URL+"/queues/a", ""), http.StatusNotFound)
+
+	expectStatus(t, do(t, "DELETE", ts.URL+"/queues/b", ""), http.StatusNoContent)
+	expectStatus(t, do(t, "DELETE", ts.URL+"/queues/b", ""), http.StatusNotFound)
+	resp = do(t, "GET", ts.URL+"/stats", "")
+	expectStatus(t, resp, http.StatusOK)
+	var all struct {
+		Messages int
+		Queues   map[string]queueStats
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&all); err != nil || all.Messages != 1 || len(all.Queues) != 1 {
+		t.Fatalf("stats = %+v, %v", all, err)
+	}
+	expectStatus(t, do(t, "POST", ts.URL+"/clean", ""), http.StatusNoContent)
+	expectStatus(t, do(t, "PUT", ts.URL+"/queues", ""), http.StatusMethodNotAllowed)
+	expectStatus(t, do(t, "GET", ts.URL+"/nowhere", ""), http.StatusNotFound)
+}
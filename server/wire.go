@@ -0,0 +1,469 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+	"gitlab.cnns/luoying/bunnymq/internal/wire"
+)
+
+// DefaultMaxInFlight caps the MaxInFlight a subscriber may ask for.
+const DefaultMaxInFlight = 1024
+
+// frameOverhead is the room left in a frame for the fields around a message.
+const frameOverhead = 64 << 10
+
+// ServeWire accepts connections on ln, which may be a TCP or a Unix socket
+// listener, and serves the binary protocol used by package client on them. It
+// blocks until ln fails and returns nil once the server has been closed.
+//
+// The protocol offers publish, fetch, ack and nack with the same meaning as
+// the HTTP routes, plus subscriptions that push messages to the client as
+// they are enqueued. A subscriber has at most MaxInFlight unacknowledged
+// messages at a time; acknowledging one lets the next one through.
+// Acknowledgements are cumulative: acknowledging a message also acknowledges
+// every earlier message of the queue for that consumer.
+func (s *Server) ServeWire(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return nil
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// 与 net/http 一样，临时错误退避后重试
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		c := &wireConn{s: s, conn: conn, subs: make(map[uint64]*subscription)}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go c.serve()
+	}
+}
+
+// wireConn is a connection served by ServeWire. Requests are handled
+// concurrently; responses are written under wmu.
+type wireConn struct {
+	s      *Server
+	conn   net.Conn
+	wmu    sync.Mutex
+	ctx    context.Context // done once the connection ends, for publishes blocked on a full queue
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	subs map[uint64]*subscription // by the id of the Subscribe request
+}
+
+func (c *wireConn) serve() {
+	defer func() {
+		c.cancel()
+		c.conn.Close()
+		c.mu.Lock()
+		for id, sub := range c.subs {
+			close(sub.stop)
+			c.s.removeSub(sub)
+			delete(c.subs, id)
+		}
+		c.mu.Unlock()
+		c.s.mu.Lock()
+		delete(c.s.conns, c)
+		c.s.mu.Unlock()
+	}()
+	for {
+		f, err := wire.ReadFrame(c.conn, int(c.s.maxSize)+frameOverhead)
+		if err != nil {
+			return
+		}
+		switch f.Type {
+		case wire.TypePublish:
+			go c.publish(f)
+		case wire.TypeFetch:
+			go c.fetch(f)
+		case wire.TypeAck, wire.TypeNack:
+			go c.settle(f)
+		case wire.TypeSubscribe:
+			c.subscribe(f)
+		case wire.TypeUnsubscribe:
+			c.mu.Lock()
+			if sub, ok := c.subs[f.ID]; ok {
+				close(sub.stop)
+				c.s.removeSub(sub)
+				delete(c.subs, f.ID)
+			}
+			c.mu.Unlock()
+		default:
+			c.writeError(f.ID, bunnymq.NewDBError(bunnymq.CodeUnknown, fmt.Errorf("unknown frame type %d", f.Type), "wire"))
+		}
+	}
+}
+
+func (c *wireConn) write(f wire.Frame) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// 写失败说明连接已断，读循环会发现并清理
+	c.conn.SetWriteDeadline(time.Now().Add(time.Minute))
+	wire.WriteFrame(c.conn, f)
+}
+
+func (c *wireConn) writeError(id uint64, err error) {
+	e := wire.Error{Code: uint64(bunnymq.CodeUnknown), Message: err.Error()}
+	var dbErr *bunnymq.DBError
+	if errors.As(err, &dbErr) {
+		e.Code = uint64(dbErr.Code)
+		if dbErr.Err != nil {
+			e.Message = dbErr.Err.Error()
+		}
+	}
+	if statusFor(err) >= 500 && c.s.logger != nil {
+		c.s.logger.Error("bunnymq server: wire request failed", "err", err)
+	}
+	c.write(wire.Frame{Type: wire.TypeError, ID: id, Body: e.Append(nil)})
+}
+
+func (c *wireConn) writeMessage(id uint64, msg bunnymq.Msg[[]byte]) {
+	m := wire.Message{Seq: msg.Seq(), Headers: msg.Headers(), Body: msg.Data()}
+	c.write(wire.Frame{Type: wire.TypeMessage, ID: id, Body: m.Append(nil)})
+}
+
+func malformed(err error) error {
+	return bunnymq.NewDBError(bunnymq.CodeInvalidOption, err, "wire")
+}
+
+func (c *wireConn) publish(f wire.Frame) {
+	var req wire.Publish
+	if err := req.Decode(f.Body); err != nil {
+		c.writeError(f.ID, malformed(err))
+		return
+	}
+	if int64(len(req.Body)) > c.s.maxSize {
+		c.writeError(f.ID, bunnymq.NewDBError(bunnymq.CodeInvalidOption,
+			fmt.Errorf("message of %d bytes exceeds the limit of %d", len(req.Body), c.s.maxSize), "wire"))
+		return
+	}
+	q, err := c.s.queue(req.Queue)
+	if err == nil {
+		err = q.EnqueueWithHeaders(c.ctx, req.Body, req.Headers)
+	}
+	if err != nil {
+		c.writeError(f.ID, err)
+		return
+	}
+	c.write(wire.Frame{Type: wire.TypeOK, ID: f.ID})
+}
+
+func (c *wireConn) fetch(f wire.Frame) {
+	var req wire.Fetch
+	if err := req.Decode(f.Body); err != nil {
+		c.writeError(f.ID, malformed(err))
+		return
+	}
+	filter, err := parseFilter(req.Filter)
+	if err != nil {
+		c.writeError(f.ID, err)
+		return
+	}
+	q, err := c.s.queue(req.Queue)
+	if err != nil {
+		c.writeError(f.ID, err)
+		return
+	}
+	timer := time.NewTimer(min(req.Wait, c.s.maxWait))
+	defer timer.Stop()
+	for {
+		ready := c.s.db.Enqueued(req.Queue)
+		msg, err := q.DequeueFilter(req.Consumer, filter)
+		if err == nil {
+			c.s.mu.Lock()
+			c.s.pending[delivery{req.Queue, req.Consumer}] = msg
+			c.s.mu.Unlock()
+			c.writeMessage(f.ID, msg)
+			return
+		}
+		if !isEmpty(err) {
+			c.writeError(f.ID, err)
+			return
+		}
+		select {
+		case <-ready:
+		case <-timer.C:
+			c.write(wire.Frame{Type: wire.TypeEmpty, ID: f.ID})
+			return
+		case <-c.s.done:
+			c.write(wire.Frame{Type: wire.TypeEmpty, ID: f.ID})
+			return
+		}
+	}
+}
+
+// settle acknowledges or rejects a message. Settling a message that was
+// already acknowledged, through a later one, is a no-op; settling one that is
+// not stored fails with ErrKeyNotFound.
+func (c *wireConn) settle(f wire.Frame) {
+	var req wire.Settle
+	if err := req.Decode(f.Body); err != nil || req.Seq == 0 {
+		if err == nil {
+			err = errors.New("sequence number must be positive")
+		}
+		c.writeError(f.ID, malformed(err))
+		return
+	}
+	ack := f.Type == wire.TypeAck
+	if err := c.s.settleSeq(req.Queue, req.Consumer, req.Seq, ack); err != nil {
+		c.writeError(f.ID, err)
+		return
+	}
+	// 先回 OK，重发的消息排在它后面
+	c.write(wire.Frame{Type: wire.TypeOK, ID: f.ID})
+	c.s.notifySettled(req.Queue, req.Consumer, req.Seq, ack)
+}
+
+// settleSeq acknowledges or rejects message seq of consumer. The message last
+// handed out by a fetch is used when it matches, so that its delivery is
+// recorded as settled.
+func (s *Server) settleSeq(name, consumer string, seq uint64, ack bool) error {
+	key := delivery{name, consumer}
+	s.mu.Lock()
+	msg := s.pending[key]
+	s.mu.Unlock()
+	if msg == nil || msg.Seq() != seq {
+		q, err := s.queue(name)
+		if err != nil {
+			return err
+		}
+		msgs, err := q.Fetch(consumer, seq-1, 1)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 || msgs[0].Seq() != seq {
+			// 还存着但没取到，说明已经确认过了
+			if _, err := q.PeekAt(seq); err != nil {
+				return err
+			}
+			return nil
+		}
+		msg = msgs[0]
+	}
+	var err error
+	if ack {
+		err = msg.Ack()
+	} else {
+		err = msg.NAck()
+	}
+	if err != nil {
+		return err
+	}
+	if ack {
+		s.mu.Lock()
+		if p := s.pending[key]; p != nil && p.Seq() <= seq {
+			delete(s.pending, key)
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// notifySettled tells the subscriptions of consumer on the queue, over any
+// transport, that seq was settled.
+func (s *Server) notifySettled(name, consumer string, seq uint64, ack bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs {
+		if sub.queue == name && sub.consumer == consumer {
+			sub.settled(seq, ack)
+		}
+	}
+}
+
+func (s *Server) addSub(sub *subscription) {
+	s.mu.Lock()
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *Server) removeSub(sub *subscription) {
+	s.mu.Lock()
+	delete(s.subs, sub)
+	s.mu.Unlock()
+}
+
+// subscription pushes the messages of a consumer that pass filter to a
+// client, keeping at most maxInFlight of them unacknowledged.
+type subscription struct {
+	queue, consumer string
+	maxInFlight     int
+	filter          *bunnymq.Filter
+	stop            chan struct{} // closed on unsubscribe or when the connection ends
+	wake            chan struct{}
+
+	mu       sync.Mutex
+	cursor   uint64   // last sequence number pushed
+	inFlight []uint64 // pushed and not yet settled, ascending
+}
+
+func newSubscription(queue, consumer string, maxInFlight uint64, filter *bunnymq.Filter) *subscription {
+	return &subscription{
+		queue:       queue,
+		consumer:    consumer,
+		maxInFlight: int(min(maxInFlight, DefaultMaxInFlight)),
+		filter:      filter,
+		stop:        make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// settled drops the settled messages from the in-flight window. A rejected
+// message and everything pushed after it are pushed again.
+func (sub *subscription) settled(seq uint64, ack bool) {
+	sub.mu.Lock()
+	i := 0
+	if ack {
+		for i < len(sub.inFlight) && sub.inFlight[i] <= seq {
+			i++
+		}
+		sub.inFlight = sub.inFlight[i:]
+	} else {
+		for i < len(sub.inFlight) && sub.inFlight[i] < seq {
+			i++
+		}
+		if i < len(sub.inFlight) {
+			sub.inFlight = sub.inFlight[:i]
+			sub.cursor = seq - 1
+		}
+	}
+	sub.mu.Unlock()
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wireConn) subscribe(f wire.Frame) {
+	var req wire.Subscribe
+	if err := req.Decode(f.Body); err != nil || req.MaxInFlight == 0 {
+		if err == nil {
+			err = errors.New("max in-flight must be positive")
+		}
+		c.writeError(f.ID, malformed(err))
+		return
+	}
+	filter, err := parseFilter(req.Filter)
+	if err != nil {
+		c.writeError(f.ID, err)
+		return
+	}
+	q, err := c.s.queue(req.Queue)
+	if err != nil {
+		c.writeError(f.ID, err)
+		return
+	}
+	sub := newSubscription(req.Queue, req.Consumer, req.MaxInFlight, filter)
+	c.mu.Lock()
+	if _, ok := c.subs[f.ID]; ok {
+		c.mu.Unlock()
+		c.writeError(f.ID, malformed(fmt.Errorf("subscription %d already exists", f.ID)))
+		return
+	}
+	c.subs[f.ID] = sub
+	c.mu.Unlock()
+	c.s.addSub(sub)
+	// OK 要在第一条消息之前发出，所以在读循环里写
+	c.write(wire.Frame{Type: wire.TypeOK, ID: f.ID})
+	go func() {
+		err := c.s.push(q, sub, func(msg bunnymq.Msg[[]byte]) error {
+			c.writeMessage(f.ID, msg)
+			return nil
+		})
+		if err != nil {
+			c.writeError(f.ID, err)
+			c.mu.Lock()
+			if c.subs[f.ID] == sub {
+				delete(c.subs, f.ID)
+				c.s.removeSub(sub)
+			}
+			c.mu.Unlock()
+		}
+	}()
+}
+
+// push sends the messages of sub's consumer to send as they are enqueued,
+// keeping at most sub.maxInFlight unsettled, until sub.stop is closed or the
+// server is closed. It returns the first error of send or of reading the
+// queue.
+func (s *Server) push(q *bunnymq.Queue[[]byte], sub *subscription, send func(bunnymq.Msg[[]byte]) error) error {
+	for {
+		ready := s.db.Enqueued(sub.queue)
+		sub.mu.Lock()
+		room, cursor := sub.maxInFlight-len(sub.inFlight), sub.cursor
+		sub.mu.Unlock()
+		if room > 0 {
+			msgs, err := q.FetchFilter(sub.consumer, cursor, room, sub.filter)
+			if err != nil && !isEmpty(err) {
+				return err
+			}
+			sub.mu.Lock()
+			// 取消息期间有 nack 把游标拨回去了，这批作废重取
+			stale := sub.cursor != cursor
+			if !stale {
+				for _, msg := range msgs {
+					sub.inFlight = append(sub.inFlight, msg.Seq())
+					sub.cursor = msg.Seq()
+				}
+			}
+			sub.mu.Unlock()
+			if stale {
+				continue
+			}
+			for _, msg := range msgs {
+				if err := send(msg); err != nil {
+					return err
+				}
+			}
+			if len(msgs) == room {
+				continue
+			}
+		}
+		select {
+		case <-ready:
+		case <-sub.wake:
+		case <-sub.stop:
+			return nil
+		case <-s.done:
+			return nil
+		}
+	}
+}
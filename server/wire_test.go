@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.cnns/luoying/bunnymq"
+	"gitlab.cnns/luoying/bunnymq/internal/wire"
+)
+
+func TestServeWire(t *testing.T) {
+	dir := t.TempDir()
+	db, err := bunnymq.Open(filepath.Join(dir, "wire.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	ln, err := net.Listen("unix", filepath.Join(dir, "wire.sock"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := New(db, WithMaxMessageSize(8))
+	served := make(chan error, 1)
+	go func() { served <- s.ServeWire(ln) }()
+
+	conn, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	roundTrip := func(typ wire.Type, body []byte) wire.Frame {
+		t.Helper()
+		if err := wire.WriteFrame(conn, wire.Frame{Type: typ, ID: 42, Body: body}); err != nil {
+			t.Fatalf("WriteFrame: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		f, err := wire.ReadFrame(conn, 0)
+		if err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		}
+		if f.ID != 42 {
+			t.Fatalf("response id %d, want 42", f.ID)
+		}
+		return f
+	}
+	expectError := func(f wire.Frame, code bunnymq.DBErrorCode) {
+		t.Helper()
+		var e wire.Error
+		if f.Type != wire.TypeError || e.Decode(f.Body) != nil || e.Code != uint64(code) {
+			t.Fatalf("got frame %d %+v, want error code %d", f.Type, e, code)
+		}
+	}
+
+	if f := roundTrip(wire.TypePublish, wire.Publish{Queue: "q", Body: []byte("hello")}.Append(nil)); f.Type != wire.TypeOK {
+		t.Fatalf("publish: got frame type %d", f.Type)
+	}
+	expectError(roundTrip(wire.TypePublish, wire.Publish{Queue: "q", Body: []byte("too long!")}.Append(nil)), bunnymq.CodeInvalidOption)
+	expectError(roundTrip(wire.TypePublish, []byte{0xff}), bunnymq.CodeInvalidOption)
+	expectError(roundTrip(wire.Type(200), nil), bunnymq.CodeUnknown)
+
+	f := roundTrip(wire.TypeFetch, wire.Fetch{Queue: "q", Consumer: "c"}.Append(nil))
+	var m wire.Message
+	if f.Type != wire.TypeMessage || m.Decode(f.Body) != nil || m.Seq != 1 || string(m.Body) != "hello" {
+		t.Fatalf("fetch: got frame %d %+v", f.Type, m)
+	}
+	// 确认过的消息再确认一次没有影响
+	for i := 0; i < 2; i++ {
+		if f := roundTrip(wire.TypeAck, wire.Settle{Queue: "q", Consumer: "c", Seq: 1}.Append(nil)); f.Type != wire.TypeOK {
+			t.Fatalf("ack: got frame type %d", f.Type)
+		}
+	}
+	// 不存在的消息不能当作确认成功
+	expectError(roundTrip(wire.TypeAck, wire.Settle{Queue: "q", Consumer: "c", Seq: 2}.Append(nil)), bunnymq.CodeKeyNotFound)
+	expectError(roundTrip(wire.TypeNack, wire.Settle{Queue: "q", Consumer: "c", Seq: 99}.Append(nil)), bunnymq.CodeKeyNotFound)
+	if f := roundTrip(wire.TypeFetch, wire.Fetch{Queue: "q", Consumer: "c", Wait: 10 * time.Millisecond}.Append(nil)); f.Type != wire.TypeEmpty {
+		t.Fatalf("fetch after ack: got frame type %d", f.Type)
+	}
+
+	s.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeWire after Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ServeWire did not return after Close")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := wire.ReadFrame(conn, 0); err == nil {
+		t.Errorf("connection still open after Close")
+	}
+}
@@ -0,0 +1,140 @@
+package bunnymq
+
+import (
+	"errors"
+	"io"
+)
+
+// Store is the persistence layer behind queues. The default store is a bbolt
+// file; NewMemoryStore keeps everything in memory. A Store holds two kinds of
+// data: queues, which are append-only logs of messages keyed by a sequence
+// number starting at 1, and buckets, which are small string-keyed maps used for
+// bookkeeping such as consumer progress.
+//
+// Byte slices passed to or returned from a Tx are only valid until the
+// transaction ends and must not be modified.
+type Store interface {
+	// Update runs fn in a read-write transaction. If fn returns an error the
+	// transaction is rolled back and the error is returned.
+	Update(fn func(tx Tx) error) error
+	// View runs fn in a read-only transaction.
+	View(fn func(tx Tx) error) error
+	// Close releases the store. Later transactions fail with ErrDatabaseClosed.
+	Close() error
+}
+
+// Tx is a transaction on a Store. Write methods fail in a read-only transaction.
+type Tx interface {
+	// Get returns the value stored under key, or ErrKeyNotFound.
+	Get(bucket, key string) ([]byte, error)
+	// Put stores value under key, creating the bucket if needed.
+	Put(bucket, key string, value []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(bucket, key string) error
+	// ForEach calls fn for every key in the bucket, in key order.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+
+	// Append adds value to the queue, creating it if needed, and returns the
+	// sequence number assigned to it.
+	Append(queue string, value []byte) (uint64, error)
+	// Seek returns the first message whose sequence number is at least from. It
+	// returns ErrBucketNotFound if the queue does not exist and ErrKeyNotFound
+	// if there is no such message.
+	Seek(queue string, from uint64) (uint64, []byte, error)
+	// Scan calls fn for messages with sequence numbers of at least from, in
+	// ascending order, until fn returns false.
+	Scan(queue string, from uint64, fn func(seq uint64, value []byte) bool) error
+	// DeleteRange removes messages with sequence numbers in [from, to]. The
+	// queue's sequence counter is not reset.
+	DeleteRange(queue string, from, to uint64) error
+	// Stats describes the queue, or returns ErrBucketNotFound.
+	Stats(queue string) (QueueStats, error)
+	// Queues lists the queues in the store.
+	Queues() ([]string, error)
+	// DeleteQueue removes the queue and its sequence counter.
+	DeleteQueue(queue string) error
+	// RenameQueue moves the queue, its messages and its sequence counter to
+	// a new name. It returns ErrBucketNotFound if from does not exist and
+	// ErrQueueExists if to does.
+	RenameQueue(from, to string) error
+	// SetSequence raises the queue's sequence counter to seq, creating the
+	// queue if needed, so that the next Append returns seq+1. A counter that
+	// is already at or past seq is left alone.
+	SetSequence(queue string, seq uint64) error
+}
+
+// QueueStats describes the messages stored in a queue.
+type QueueStats struct {
+	Count    int    // messages currently stored
+	FirstSeq uint64 // sequence of the oldest stored message, 0 if empty
+	LastSeq  uint64 // last sequence number handed out, even if since deleted
+}
+
+// compacter is implemented by stores that can reclaim space after cleanup.
+type compacter interface {
+	compact() error
+}
+
+// backuper is implemented by stores that can copy themselves while in use and
+// be replaced by such a copy.
+type backuper interface {
+	backup(w io.Writer) (int64, error)
+	restore(path string) error
+}
+
+// WithStore makes NewQueue use store for dbPath instead of opening a bbolt
+// file there. Like the other file-level options it only applies when dbPath
+// is first opened; later queues on the same path share the same store.
+func WithStore(store Store) Option {
+	return func(o *Options) error {
+		if store == nil {
+			return invalidOption("store", "must not be nil")
+		}
+		o.openStore = func(string, *Options) (Store, error) { return store, nil }
+		return nil
+	}
+}
+
+// WithMemoryStore keeps the queue in a new in-memory store registered under
+// dbPath, so queues opened with the same path share it until the last one is
+// closed. Nothing is written to disk.
+func WithMemoryStore() Option {
+	return func(o *Options) error {
+		o.openStore = func(string, *Options) (Store, error) { return NewMemoryStore(), nil }
+		return nil
+	}
+}
+
+// readOnlyStore wraps the store of a database opened with WithReadOnly so that
+// every store rejects writes the same way.
+type readOnlyStore struct {
+	Store
+}
+
+func (readOnlyStore) Update(func(Tx) error) error {
+	return ErrReadOnly
+}
+
+func (s readOnlyStore) backup(w io.Writer) (int64, error) {
+	if b, ok := s.Store.(backuper); ok {
+		return b.backup(w)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (readOnlyStore) restore(string) error {
+	return ErrReadOnly
+}
+
+func (s readOnlyStore) checkLayout(include func(string) bool) ([]Problem, error) {
+	if lc, ok := s.Store.(layoutChecker); ok {
+		return lc.checkLayout(include)
+	}
+	return nil, nil
+}
+
+func (s readOnlyStore) setLogger(logger Logger) {
+	if l, ok := s.Store.(interface{ setLogger(Logger) }); ok {
+		l.setLogger(logger)
+	}
+}
@@ -0,0 +1,482 @@
+package bunnymq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore is the default Store, a bbolt file. Every queue and bucket is a
+// top-level bbolt bucket; queue buckets are named queueBucketPrefix plus the
+// queue name so that they cannot collide with bookkeeping buckets. Message
+// keys are big-endian sequence numbers, so that bbolt keeps them in order;
+// files older than format version 2 use decimal strings until migrated.
+const queueBucketPrefix = "queue/"
+
+func queueBucket(name string) []byte {
+	return []byte(queueBucketPrefix + name)
+}
+
+type boltStore struct {
+	mu       sync.RWMutex // guards db, which compaction replaces
+	db       *bolt.DB
+	path     string
+	fileMode os.FileMode
+	opts     *bolt.Options
+	syncer   *syncer // background fsync for DurabilityBatched, nil otherwise
+	closed   bool
+
+	logMu  sync.Mutex
+	logger Logger
+}
+
+// openBoltStore opens or creates the bbolt file at path with the file-level
+// settings in o.
+func openBoltStore(path string, o *Options) (Store, error) {
+	boltOpts := o.boltOptions()
+	db, err := bolt.Open(path, o.FileMode, boltOpts)
+	if errors.Is(err, bolt.ErrTimeout) {
+		err = lockedError(path, path+pidFileSuffix)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	s := &boltStore{db: db, path: path, fileMode: o.FileMode, opts: boltOpts, logger: o.Logger}
+	if o.ReadOnly {
+		return s, nil
+	}
+	// 记下持有写锁的进程，别的进程打开超时时可以报出来
+	if err := writePIDFile(path+pidFileSuffix, o.FileMode); err != nil {
+		s.log().Warn("bunnymq: writing pid file", "path", path+pidFileSuffix, "err", err)
+	}
+	if o.Durability == DurabilityBatched {
+		s.syncer = startSyncer(s, path, o.SyncInterval)
+	}
+	return s, nil
+}
+
+func (s *boltStore) setLogger(logger Logger) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.logger = logger
+}
+
+func (s *boltStore) log() Logger {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	return s.logger
+}
+
+func (s *boltStore) Update(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	// 如果在fn(tx)执行时出现错误，事务会回滚
+	if err := fn(newBoltTx(tx)); err != nil {
+		tx.Rollback() // 手动回滚
+		return err
+	}
+
+	// 如果提交时出现错误，事务也会回滚
+	if err := tx.Commit(); err != nil {
+		tx.Rollback() // 手动回滚
+		return err
+	}
+	s.syncer.markDirty()
+	return nil
+}
+
+func (s *boltStore) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(newBoltTx(tx))
+	})
+}
+
+func (s *boltStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	// 先停掉后台 fsync，它最后一次 flush 还需要打开的文件
+	s.syncer.close()
+	if !s.db.IsReadOnly() {
+		os.Remove(s.path + pidFileSuffix)
+	}
+	return s.db.Close()
+}
+
+func (s *boltStore) sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.Sync()
+}
+
+// compact rewrites the file so that space freed by cleanup is returned to the
+// file system.
+func (s *boltStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	return s.backupAndReopen()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+	// decimalKeys is set for files older than format version 2, whose message
+	// keys are decimal strings.
+	decimalKeys bool
+}
+
+func newBoltTx(tx *bolt.Tx) *boltTx {
+	t := &boltTx{tx: tx}
+	// 格式版本坏了的文件打开时就会报错，这里按旧格式读
+	version, _ := readFormatVersion(t)
+	t.decimalKeys = version < 2
+	return t
+}
+
+// seqKey returns the key of message seq.
+func seqKey(seq uint64, decimal bool) []byte {
+	if decimal {
+		return []byte(strconv.FormatUint(seq, 10))
+	}
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// parseSeqKey returns the sequence number in a message key, or false if k is
+// not one.
+func parseSeqKey(k []byte, decimal bool) (uint64, bool) {
+	if decimal {
+		seq, err := strconv.ParseUint(string(k), 10, 64)
+		return seq, err == nil
+	}
+	if len(k) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(k), true
+}
+
+func (t *boltTx) Get(bucketName, key string) ([]byte, error) {
+	bucket := t.tx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return nil, ErrKeyNotFound
+	}
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (t *boltTx) Put(bucketName, key string, value []byte) error {
+	bucket, err := t.tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), value)
+}
+
+func (t *boltTx) Delete(bucketName, key string) error {
+	bucket := t.tx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(key))
+}
+
+func (t *boltTx) ForEach(bucketName string, fn func(key string, value []byte) error) error {
+	bucket := t.tx.Bucket([]byte(bucketName))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+func (t *boltTx) Append(queue string, value []byte) (uint64, error) {
+	bucket, err := t.tx.CreateBucketIfNotExists(queueBucket(queue))
+	if err != nil {
+		return 0, err
+	}
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return 0, ErrFailedToCreate
+	}
+	return seq, bucket.Put(seqKey(seq, t.decimalKeys), value)
+}
+
+func (t *boltTx) Seek(queue string, from uint64) (uint64, []byte, error) {
+	bucket := t.tx.Bucket(queueBucket(queue))
+	if bucket == nil {
+		return 0, nil, ErrBucketNotFound
+	}
+	if from == 0 {
+		from = 1
+	}
+	// 绝大多数情况下要找的就是下一条，直接取
+	if value := bucket.Get(seqKey(from, t.decimalKeys)); value != nil {
+		return from, value, nil
+	}
+	if from > bucket.Sequence() {
+		return 0, nil, ErrKeyNotFound
+	}
+	// 中间的消息可能已被删除，找后面最近的一条
+	var (
+		seq   uint64
+		value []byte
+	)
+	t.scan(bucket, from, func(s uint64, v []byte) bool {
+		seq, value = s, v
+		return false
+	})
+	if value == nil {
+		return 0, nil, ErrKeyNotFound
+	}
+	return seq, value, nil
+}
+
+func (t *boltTx) Scan(queue string, from uint64, fn func(seq uint64, value []byte) bool) error {
+	bucket := t.tx.Bucket(queueBucket(queue))
+	if bucket == nil {
+		return nil
+	}
+	t.scan(bucket, from, fn)
+	return nil
+}
+
+// scan calls fn for the messages in bucket from seq from on, in order, until
+// fn returns false.
+func (t *boltTx) scan(bucket *bolt.Bucket, from uint64, fn func(seq uint64, value []byte) bool) {
+	if t.decimalKeys {
+		for _, seq := range sortedSeqs(bucket, from, ^uint64(0)) {
+			if !fn(seq, bucket.Get(seqKey(seq, true))) {
+				return
+			}
+		}
+		return
+	}
+	c := bucket.Cursor()
+	for k, v := c.Seek(seqKey(from, false)); k != nil; k, v = c.Next() {
+		seq, ok := parseSeqKey(k, false)
+		if !ok || v == nil {
+			continue
+		}
+		if !fn(seq, v) {
+			return
+		}
+	}
+}
+
+func (t *boltTx) DeleteRange(queue string, from, to uint64) error {
+	bucket := t.tx.Bucket(queueBucket(queue))
+	if bucket == nil {
+		return nil
+	}
+	// 边遍历边删会让游标跳过 key，先收集起来
+	var seqs []uint64
+	t.scan(bucket, from, func(seq uint64, _ []byte) bool {
+		if seq > to {
+			return false
+		}
+		seqs = append(seqs, seq)
+		return true
+	})
+	for _, seq := range seqs {
+		if err := bucket.Delete(seqKey(seq, t.decimalKeys)); err != nil {
+			return ErrFailedToDelete
+		}
+	}
+	return nil
+}
+
+func (t *boltTx) Stats(queue string) (QueueStats, error) {
+	bucket := t.tx.Bucket(queueBucket(queue))
+	if bucket == nil {
+		return QueueStats{}, ErrBucketNotFound
+	}
+	stats := QueueStats{LastSeq: bucket.Sequence()}
+	err := bucket.ForEach(func(k, _ []byte) error {
+		seq, ok := parseSeqKey(k, t.decimalKeys)
+		if !ok {
+			return nil
+		}
+		stats.Count++
+		if stats.FirstSeq == 0 || seq < stats.FirstSeq {
+			stats.FirstSeq = seq
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func (t *boltTx) Queues() ([]string, error) {
+	var names []string
+	err := t.tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if queue, ok := strings.CutPrefix(string(name), queueBucketPrefix); ok {
+			names = append(names, queue)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (t *boltTx) DeleteQueue(queue string) error {
+	if err := t.tx.DeleteBucket(queueBucket(queue)); err != nil {
+		if err == bolt.ErrBucketNotFound {
+			return ErrBucketNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *boltTx) RenameQueue(from, to string) error {
+	src := t.tx.Bucket(queueBucket(from))
+	if src == nil {
+		return ErrBucketNotFound
+	}
+	dst, err := t.tx.CreateBucket(queueBucket(to))
+	if err == bolt.ErrBucketExists {
+		return ErrQueueExists
+	} else if err != nil {
+		return err
+	}
+	if err := copyBucket(dst, src); err != nil {
+		return err
+	}
+	return t.tx.DeleteBucket(queueBucket(from))
+}
+
+func (t *boltTx) SetSequence(queue string, seq uint64) error {
+	bucket, err := t.tx.CreateBucketIfNotExists(queueBucket(queue))
+	if err != nil {
+		return err
+	}
+	if seq <= bucket.Sequence() {
+		return nil
+	}
+	return bucket.SetSequence(seq)
+}
+
+// copyBucket copies the keys and the sequence counter of src into dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	// 自增序号也要带过去，否则新消息会从 1 开始编号
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		return dst.Put(k, v)
+	})
+}
+
+// upgradeQueueBuckets moves queues written before queue buckets were prefixed
+// into their prefixed buckets. Any top-level bucket that is neither a
+// bookkeeping bucket nor prefixed is such a queue.
+func (t *boltTx) upgradeQueueBuckets() error {
+	var legacy []string
+	err := t.tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if !isInternalBucket(string(name)) && !strings.HasPrefix(string(name), queueBucketPrefix) {
+			legacy = append(legacy, string(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range legacy {
+		dst, err := t.tx.CreateBucket(queueBucket(name))
+		if err != nil {
+			return fmt.Errorf("upgrading queue %q: %w", name, err)
+		}
+		if err := copyBucket(dst, t.tx.Bucket([]byte(name))); err != nil {
+			return err
+		}
+		if err := t.tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeMessageKeys rewrites the decimal message keys of every queue as
+// big-endian sequence numbers. Keys that are not sequence numbers are left for
+// Check to report.
+func (t *boltTx) upgradeMessageKeys() error {
+	if !t.decimalKeys {
+		return nil
+	}
+	err := t.tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		if !strings.HasPrefix(string(name), queueBucketPrefix) {
+			return nil
+		}
+		// 改 bucket 时不能再用 ForEach 里拿到的值，先拷出来
+		var msgs []keyValue
+		err := bucket.ForEach(func(k, v []byte) error {
+			if _, ok := parseSeqKey(k, true); ok && v != nil {
+				msgs = append(msgs, keyValue{key: string(k), value: append([]byte(nil), v...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			seq, _ := parseSeqKey([]byte(m.key), true)
+			if err := bucket.Delete([]byte(m.key)); err != nil {
+				return err
+			}
+			if err := bucket.Put(seqKey(seq, false), m.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.decimalKeys = false
+	return nil
+}
+
+// sortedSeqs returns the sequence numbers in [from, to] stored in a bucket
+// with decimal keys, which bbolt does not keep in numeric order, so the whole
+// bucket is scanned.
+func sortedSeqs(bucket *bolt.Bucket, from, to uint64) []uint64 {
+	var seqs []uint64
+	_ = bucket.ForEach(func(k, _ []byte) error {
+		seq, ok := parseSeqKey(k, true)
+		if ok && seq >= from && seq <= to {
+			seqs = append(seqs, seq)
+		}
+		return nil
+	})
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
@@ -0,0 +1,318 @@
+package bunnymq
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var errTxNotWritable = errors.New("bunnymq: write in a read-only transaction")
+
+// memoryStore is a Store that keeps everything in process memory. Writers are
+// serialized and readers share a read lock, matching bbolt's one-writer,
+// many-readers model; a failed Update is undone from an undo log.
+type memoryStore struct {
+	mu      sync.RWMutex
+	queues  map[string]*memoryQueue
+	buckets map[string]map[string][]byte
+	closed  bool
+}
+
+type memoryQueue struct {
+	seq  uint64          // last sequence number handed out
+	msgs []memoryMessage // ascending by seq
+}
+
+type memoryMessage struct {
+	seq   uint64
+	value []byte
+}
+
+// NewMemoryStore returns an empty Store that keeps its data in memory. Nothing
+// is persisted; it is meant for tests and for queues that do not need to
+// survive a restart. See WithStore and WithMemoryStore.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		queues:  make(map[string]*memoryQueue),
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *memoryStore) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	tx := &memoryTx{store: s, writable: true}
+	defer func() { tx.done = true }()
+	if err := fn(tx); err != nil {
+		// 按相反顺序撤销本事务内的修改
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	tx := &memoryTx{store: s}
+	defer func() { tx.done = true }()
+	return fn(tx)
+}
+
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+type memoryTx struct {
+	store    *memoryStore
+	writable bool
+	done     bool
+	undo     []func()
+}
+
+func (t *memoryTx) check(write bool) error {
+	if t.done {
+		return ErrDatabaseClosed
+	}
+	if write && !t.writable {
+		return errTxNotWritable
+	}
+	return nil
+}
+
+func (t *memoryTx) Get(bucketName, key string) ([]byte, error) {
+	if err := t.check(false); err != nil {
+		return nil, err
+	}
+	value, ok := t.store.buckets[bucketName][key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (t *memoryTx) Put(bucketName, key string, value []byte) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	bucket, ok := t.store.buckets[bucketName]
+	if !ok {
+		bucket = make(map[string][]byte)
+		t.store.buckets[bucketName] = bucket
+		t.undo = append(t.undo, func() { delete(t.store.buckets, bucketName) })
+	}
+	old, existed := bucket[key]
+	bucket[key] = append([]byte(nil), value...)
+	t.undo = append(t.undo, func() {
+		if existed {
+			bucket[key] = old
+		} else {
+			delete(bucket, key)
+		}
+	})
+	return nil
+}
+
+func (t *memoryTx) Delete(bucketName, key string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	bucket := t.store.buckets[bucketName]
+	old, existed := bucket[key]
+	if !existed {
+		return nil
+	}
+	delete(bucket, key)
+	t.undo = append(t.undo, func() { bucket[key] = old })
+	return nil
+}
+
+func (t *memoryTx) ForEach(bucketName string, fn func(key string, value []byte) error) error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	bucket := t.store.buckets[bucketName]
+	keys := make([]string, 0, len(bucket))
+	for k := range bucket {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, bucket[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTx) Append(queue string, value []byte) (uint64, error) {
+	if err := t.check(true); err != nil {
+		return 0, err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		q = &memoryQueue{}
+		t.store.queues[queue] = q
+		t.undo = append(t.undo, func() { delete(t.store.queues, queue) })
+	}
+	q.seq++
+	q.msgs = append(q.msgs, memoryMessage{seq: q.seq, value: append([]byte(nil), value...)})
+	t.undo = append(t.undo, func() {
+		q.seq--
+		q.msgs = q.msgs[:len(q.msgs)-1]
+	})
+	return q.seq, nil
+}
+
+// search returns the index of the first message with a sequence number of at
+// least seq.
+func (q *memoryQueue) search(seq uint64) int {
+	return sort.Search(len(q.msgs), func(i int) bool { return q.msgs[i].seq >= seq })
+}
+
+func (t *memoryTx) Seek(queue string, from uint64) (uint64, []byte, error) {
+	if err := t.check(false); err != nil {
+		return 0, nil, err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return 0, nil, ErrBucketNotFound
+	}
+	i := q.search(from)
+	if i == len(q.msgs) {
+		return 0, nil, ErrKeyNotFound
+	}
+	return q.msgs[i].seq, q.msgs[i].value, nil
+}
+
+func (t *memoryTx) Scan(queue string, from uint64, fn func(seq uint64, value []byte) bool) error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return nil
+	}
+	// fn 可能在写事务中删除消息，先取一份快照
+	msgs := q.msgs[q.search(from):]
+	for _, m := range msgs {
+		if !fn(m.seq, m.value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (t *memoryTx) DeleteRange(queue string, from, to uint64) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok || from > to {
+		return nil
+	}
+	i, j := q.search(from), len(q.msgs)
+	if to < ^uint64(0) {
+		j = q.search(to + 1)
+	}
+	if i == j {
+		return nil
+	}
+	// 新建切片而不是原地移动，这样撤销时直接换回旧切片即可
+	old := q.msgs
+	msgs := make([]memoryMessage, 0, len(old)-(j-i))
+	msgs = append(msgs, old[:i]...)
+	q.msgs = append(msgs, old[j:]...)
+	t.undo = append(t.undo, func() { q.msgs = old })
+	return nil
+}
+
+func (t *memoryTx) Stats(queue string) (QueueStats, error) {
+	if err := t.check(false); err != nil {
+		return QueueStats{}, err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return QueueStats{}, ErrBucketNotFound
+	}
+	stats := QueueStats{Count: len(q.msgs), LastSeq: q.seq}
+	if len(q.msgs) > 0 {
+		stats.FirstSeq = q.msgs[0].seq
+	}
+	return stats, nil
+}
+
+func (t *memoryTx) Queues() ([]string, error) {
+	if err := t.check(false); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(t.store.queues))
+	for name := range t.store.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t *memoryTx) DeleteQueue(queue string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return ErrBucketNotFound
+	}
+	delete(t.store.queues, queue)
+	t.undo = append(t.undo, func() { t.store.queues[queue] = q })
+	return nil
+}
+
+func (t *memoryTx) RenameQueue(from, to string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	q, ok := t.store.queues[from]
+	if !ok {
+		return ErrBucketNotFound
+	}
+	if _, exists := t.store.queues[to]; exists {
+		return ErrQueueExists
+	}
+	delete(t.store.queues, from)
+	t.store.queues[to] = q
+	t.undo = append(t.undo, func() {
+		delete(t.store.queues, to)
+		t.store.queues[from] = q
+	})
+	return nil
+}
+
+func (t *memoryTx) SetSequence(queue string, seq uint64) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		q = &memoryQueue{}
+		t.store.queues[queue] = q
+		t.undo = append(t.undo, func() { delete(t.store.queues, queue) })
+	}
+	if seq <= q.seq {
+		return nil
+	}
+	old := q.seq
+	q.seq = seq
+	t.undo = append(t.undo, func() { q.seq = old })
+	return nil
+}
@@ -0,0 +1,1372 @@
+package bunnymq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSegmentSize is the file size at which the segment log starts a new
+// segment.
+const DefaultSegmentSize = 64 << 20
+
+// journalCheckpointSize is the journal size past which a commit rewrites the
+// journal as a single batch describing the current state. Every Ack appends a
+// record, so without checkpoints the journal would only shrink on cleanup.
+const journalCheckpointSize = 4 << 20
+
+const (
+	segmentExt     = ".seg"
+	indexExt       = ".idx"
+	journalName    = "journal"
+	lockName       = "LOCK"
+	queueDirPrefix = "q-"
+	trashDirPrefix = "x-"
+	recordHeader   = 8 // u32 payload length + u32 CRC-32C
+)
+
+// Journal operations.
+const (
+	opPut byte = iota + 1
+	opDelete
+	opHead
+	opDeleteRange
+	opDropQueue
+	opRenameQueue
+)
+
+var (
+	errLockTimeout = errors.New("timeout waiting for file lock")
+	crcTable       = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WithSegmentLog stores messages in an append-only segmented log instead of a
+// bbolt file; dbPath names a directory. Each queue is a sequence of segment
+// files with an offset index per segment, and cleanup deletes whole segments
+// once every message in them has been consumed. Enqueue appends to the end of
+// a file instead of rewriting B+tree pages, which suits queues whose messages
+// are written once and read in order.
+//
+// Consumer progress and other bookkeeping live in a journal next to the
+// segments. A transaction is committed by appending one record to the journal,
+// so a crash never leaves half of a transaction behind. Durability has the same
+// meaning as for bbolt.
+func WithSegmentLog() Option {
+	return func(o *Options) error {
+		o.openStore = openSegmentStore
+		return nil
+	}
+}
+
+// WithSegmentSize sets the file size at which WithSegmentLog starts a new
+// segment. Smaller segments let cleanup reclaim space sooner.
+func WithSegmentSize(n int64) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return invalidOption("segment size", "must be positive")
+		}
+		o.SegmentSize = n
+		return nil
+	}
+}
+
+// segmentStore is the Store behind WithSegmentLog. The directory holds:
+//
+//	LOCK                 flock held while the store is open, holding the PID
+//	journal              committed transactions: bookkeeping writes, the last
+//	                     committed sequence of each queue, deleted ranges;
+//	                     rewritten as one batch once it grows past a threshold
+//	q-<queue>/<seq>.seg  records of a segment, the first one numbered seq
+//	q-<queue>/<seq>.idx  byte offset of each record in the .seg file
+//
+// Appends are written to the segment files as the transaction runs and become
+// visible once the journal records the queue's new head; on open, records past
+// the committed head are truncated.
+type segmentStore struct {
+	mu         sync.RWMutex
+	dir        string
+	maxSize    int64
+	fileMode   os.FileMode
+	strict     bool
+	lock       *os.File
+	journal    *os.File
+	journalEnd int64
+	checkpoint int64 // journal size at which commit rewrites the journal
+	queues     map[string]*segmentQueue
+	buckets    map[string]map[string][]byte
+	unsynced   map[*segment]bool // committed but not fsynced, DurabilityBatched only
+	syncer     *syncer
+	closed     bool
+
+	logMu  sync.Mutex
+	logger Logger
+}
+
+type segmentQueue struct {
+	dir      string
+	segments []*segment // ascending by base
+	deleted  []seqRange // disjoint, ascending, not adjacent
+	lastSeq  uint64     // last sequence number handed out
+}
+
+type seqRange struct {
+	from, to uint64
+}
+
+type segment struct {
+	base    uint64
+	data    *os.File
+	index   *os.File
+	size    int64
+	offsets []int64
+}
+
+// queueState is a queue as recorded in the journal.
+type queueState struct {
+	head    uint64
+	deleted []seqRange
+	renamed []string // earlier names, oldest first; the directory may still use one
+}
+
+func openSegmentStore(dir string, o *Options) (Store, error) {
+	if o.ReadOnly {
+		return nil, invalidOption("read only", "not supported by the segment log")
+	}
+	dirMode := o.FileMode | (o.FileMode&0444)>>2
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, o.FileMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := lockFile(lock, o.OpenTimeout); err != nil {
+		lock.Close()
+		if errors.Is(err, errLockTimeout) {
+			err = lockedError(dir, lock.Name())
+		}
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := writePID(lock); err != nil {
+		unlockFile(lock)
+		lock.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	size := o.SegmentSize
+	if size <= 0 {
+		size = DefaultSegmentSize
+	}
+	s := &segmentStore{
+		dir:      dir,
+		maxSize:  size,
+		fileMode: o.FileMode,
+		strict:   o.Durability == DurabilityStrict,
+		lock:     lock,
+		queues:   make(map[string]*segmentQueue),
+		buckets:  make(map[string]map[string][]byte),
+		unsynced: make(map[*segment]bool),
+		logger:   o.Logger,
+	}
+	state, err := s.replayJournal()
+	if err == nil {
+		err = s.loadQueues(state)
+	}
+	if err == nil {
+		// 重写日志：丢掉不完整的尾部，也顺便压缩
+		err = s.rewriteJournal()
+	}
+	if err != nil {
+		s.closeFiles()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if o.Durability == DurabilityBatched {
+		s.syncer = startSyncer(s, dir, o.SyncInterval)
+	}
+	return s, nil
+}
+
+func (s *segmentStore) setLogger(logger Logger) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.logger = logger
+}
+
+func (s *segmentStore) log() Logger {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	return s.logger
+}
+
+func (s *segmentStore) Update(fn func(Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	tx := &segmentTx{
+		store:    s,
+		writable: true,
+		heads:    make(map[string]*segmentQueue),
+		written:  make(map[*segment]bool),
+	}
+	defer func() { tx.done = true }()
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+func (s *segmentStore) View(fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	tx := &segmentTx{store: s}
+	defer func() { tx.done = true }()
+	return fn(tx)
+}
+
+func (s *segmentStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	// 先停掉后台 fsync，它最后一次 flush 还需要打开的文件
+	s.syncer.close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFiles()
+}
+
+func (s *segmentStore) closeFiles() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, q := range s.queues {
+		for _, seg := range q.segments {
+			keep(seg.close())
+		}
+	}
+	if s.journal != nil {
+		keep(s.journal.Close())
+	}
+	keep(unlockFile(s.lock))
+	keep(s.lock.Close())
+	return firstErr
+}
+
+// sync fsyncs everything committed since the last sync.
+func (s *segmentStore) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for seg := range s.unsynced {
+		if err := seg.data.Sync(); err != nil {
+			return err
+		}
+		delete(s.unsynced, seg)
+	}
+	return s.journal.Sync()
+}
+
+// compact deletes segments whose messages have all been deleted, except the
+// newest segment of each queue, and rewrites the journal.
+func (s *segmentStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	removed := 0
+	for _, q := range s.queues {
+		n := len(q.segments)
+		kept := q.segments[:0:0]
+		for i, seg := range q.segments {
+			if i == n-1 || !q.allDeleted(seg) {
+				kept = append(kept, seg)
+				continue
+			}
+			delete(s.unsynced, seg)
+			if err := seg.remove(); err != nil {
+				return err
+			}
+			removed++
+		}
+		q.segments = kept
+		if len(kept) == 0 {
+			continue
+		}
+		// 已删除段之前的区间不再需要记录
+		for len(q.deleted) > 0 && q.deleted[0].to < kept[0].base {
+			q.deleted = q.deleted[1:]
+		}
+	}
+	if removed > 0 {
+		s.log().Info("bunnymq: removed consumed segments", "path", s.dir, "count", removed)
+	}
+	return s.rewriteJournal()
+}
+
+func (s *segmentStore) queueDir(name string) string {
+	return filepath.Join(s.dir, queueDirPrefix+url.PathEscape(name))
+}
+
+// replayJournal loads the bookkeeping buckets and returns the committed state
+// of every queue. A torn batch at the end of the journal is ignored.
+func (s *segmentStore) replayJournal() (map[string]*queueState, error) {
+	state := make(map[string]*queueState)
+	data, err := os.ReadFile(filepath.Join(s.dir, journalName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for len(data) >= recordHeader {
+		n := binary.LittleEndian.Uint32(data[0:4])
+		if uint64(n) > uint64(len(data)-recordHeader) {
+			break
+		}
+		body := data[recordHeader : recordHeader+int(n)]
+		if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(data[4:8]) {
+			break
+		}
+		data = data[recordHeader+int(n):]
+		if err := s.applyJournal(body, state); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) > 0 {
+		s.log().Warn("bunnymq: discarding torn journal tail", "path", s.dir, "bytes", len(data))
+	}
+	return state, nil
+}
+
+func (s *segmentStore) applyJournal(body []byte, state map[string]*queueState) error {
+	r := envelopeReader{buf: body}
+	for len(r.buf) > 0 && r.err == nil {
+		op := r.buf[0]
+		r.buf = r.buf[1:]
+		switch op {
+		case opPut:
+			bucket, key, value := string(r.bytes()), string(r.bytes()), r.bytes()
+			if r.err != nil {
+				break
+			}
+			if s.buckets[bucket] == nil {
+				s.buckets[bucket] = make(map[string][]byte)
+			}
+			s.buckets[bucket][key] = append([]byte(nil), value...)
+		case opDelete:
+			bucket, key := string(r.bytes()), string(r.bytes())
+			delete(s.buckets[bucket], key)
+		case opHead:
+			name, head := string(r.bytes()), r.uvarint()
+			if state[name] == nil {
+				state[name] = &queueState{}
+			}
+			state[name].head = head
+		case opDeleteRange:
+			name, from, to := string(r.bytes()), r.uvarint(), r.uvarint()
+			if st := state[name]; st != nil && r.err == nil {
+				st.deleted = addRange(st.deleted, seqRange{from, to})
+			}
+		case opDropQueue:
+			delete(state, string(r.bytes()))
+		case opRenameQueue:
+			from, to := string(r.bytes()), string(r.bytes())
+			if st := state[from]; st != nil && r.err == nil {
+				delete(state, from)
+				st.renamed = append(st.renamed, from)
+				state[to] = st
+			}
+		default:
+			return fmt.Errorf("%w: unknown journal operation %d", ErrFailedToDeserialize, op)
+		}
+	}
+	return r.err
+}
+
+// loadQueues opens the segments of every committed queue, truncating records
+// past the committed head, and removes queue directories the journal does not
+// know about.
+func (s *segmentStore) loadQueues(state map[string]*queueState) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	// 先处理删除到一半的队列：提交了就删掉，没提交就恢复
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), trashDirPrefix) {
+			continue
+		}
+		trash := filepath.Join(s.dir, e.Name())
+		escaped := strings.TrimPrefix(e.Name(), trashDirPrefix)
+		if i := strings.LastIndexByte(escaped, '-'); i >= 0 {
+			escaped = escaped[:i]
+		}
+		name, err := url.PathUnescape(escaped)
+		if err == nil && state[name] != nil {
+			if _, err := os.Stat(s.queueDir(name)); os.IsNotExist(err) {
+				if err := os.Rename(trash, s.queueDir(name)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if err := os.RemoveAll(trash); err != nil {
+			return err
+		}
+	}
+
+	// 改名已提交但目录还没改过来
+	for name, st := range state {
+		if err := s.recoverRename(name, st, state); err != nil {
+			return err
+		}
+	}
+
+	entries, err = os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), queueDirPrefix) {
+			continue
+		}
+		dir := filepath.Join(s.dir, e.Name())
+		name, err := url.PathUnescape(strings.TrimPrefix(e.Name(), queueDirPrefix))
+		st := state[name]
+		if err != nil || st == nil {
+			// 创建队列的事务没有提交
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			continue
+		}
+		q, err := s.loadQueue(dir, st)
+		if err != nil {
+			return fmt.Errorf("loading queue %q: %w", name, err)
+		}
+		s.queues[name] = q
+	}
+	for name := range state {
+		if s.queues[name] == nil {
+			s.log().Warn("bunnymq: queue directory missing", "path", s.dir, "queue", name)
+		}
+	}
+	return nil
+}
+
+// recoverRename moves the directory of a renamed queue to its new name if a
+// crash or an error kept the rename from reaching the file system.
+func (s *segmentStore) recoverRename(name string, st *queueState, state map[string]*queueState) error {
+	if len(st.renamed) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(s.queueDir(name)); !os.IsNotExist(err) {
+		return nil
+	}
+	for i := len(st.renamed) - 1; i >= 0; i-- {
+		old := st.renamed[i]
+		if state[old] != nil {
+			continue
+		}
+		if _, err := os.Stat(s.queueDir(old)); err == nil {
+			return os.Rename(s.queueDir(old), s.queueDir(name))
+		}
+	}
+	return nil
+}
+
+// moveQueueDir renames the directory of a queue renamed by a committed
+// transaction and reopens its segments from there. If the rename fails the
+// queue keeps working from its old directory and the next open retries.
+func (s *segmentStore) moveQueueDir(name string, q *segmentQueue) error {
+	dir := s.queueDir(name)
+	if q.dir == dir {
+		return nil
+	}
+	for _, seg := range q.segments {
+		if s.unsynced[seg] {
+			if err := seg.data.Sync(); err != nil {
+				return err
+			}
+			delete(s.unsynced, seg)
+		}
+	}
+	// 先关掉段文件，有的系统不能改名打开着文件的目录
+	q.close()
+	err := os.Rename(q.dir, dir)
+	if err == nil {
+		q.dir = dir
+		err = syncDir(s.dir)
+	}
+	reopened, loadErr := s.loadQueue(q.dir, &queueState{head: q.lastSeq, deleted: q.deleted})
+	if loadErr != nil {
+		return loadErr
+	}
+	q.segments = reopened.segments
+	return err
+}
+
+func (s *segmentStore) loadQueue(dir string, st *queueState) (*segmentQueue, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var bases []uint64
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentExt), 10, 64)
+		if err != nil || base == 0 {
+			continue
+		}
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	q := &segmentQueue{dir: dir, deleted: st.deleted, lastSeq: st.head}
+	for _, base := range bases {
+		if base > st.head {
+			// 整段都在已提交的位置之后
+			if err := removeSegmentFiles(dir, base); err != nil {
+				q.close()
+				return nil, err
+			}
+			continue
+		}
+		seg, err := openSegment(dir, base, s.fileMode)
+		if err != nil {
+			q.close()
+			return nil, err
+		}
+		q.segments = append(q.segments, seg)
+		if seg.last() > st.head {
+			if err := seg.truncate(int(st.head - base + 1)); err != nil {
+				q.close()
+				return nil, err
+			}
+		}
+	}
+	return q, nil
+}
+
+// rewriteJournal replaces the journal with a single batch describing the
+// current state. Segments are fsynced first, since the new journal is and
+// must not record heads past what is on disk.
+func (s *segmentStore) rewriteJournal() error {
+	for seg := range s.unsynced {
+		if err := seg.data.Sync(); err != nil {
+			return err
+		}
+		delete(s.unsynced, seg)
+	}
+	var ops []byte
+	bucketNames := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		bucketNames = append(bucketNames, name)
+	}
+	sort.Strings(bucketNames)
+	for _, name := range bucketNames {
+		bucket := s.buckets[name]
+		keys := make([]string, 0, len(bucket))
+		for k := range bucket {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ops = appendPutOp(ops, name, k, bucket[k])
+		}
+	}
+	for _, name := range s.queueNames() {
+		q := s.queues[name]
+		// 目录还没改名的队列先按旧名记录，再记一次改名
+		recorded := name
+		if q.dir != s.queueDir(name) {
+			if old, err := url.PathUnescape(strings.TrimPrefix(filepath.Base(q.dir), queueDirPrefix)); err == nil {
+				recorded = old
+			}
+		}
+		ops = appendHeadOp(ops, recorded, q.lastSeq)
+		for _, r := range q.deleted {
+			ops = appendDeleteRangeOp(ops, recorded, r.from, r.to)
+		}
+		if recorded != name {
+			ops = appendRenameQueueOp(ops, recorded, name)
+		}
+	}
+
+	path := filepath.Join(s.dir, journalName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.fileMode)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if len(ops) > 0 {
+		batch := frame(ops)
+		if _, err := f.Write(batch); err != nil {
+			f.Close()
+			return err
+		}
+		size = int64(len(batch))
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return err
+	}
+	// 改名之后旧文件已经不在了，后面的提交必须写新文件
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	s.journal, s.journalEnd = f, size
+	// 状态本身很大时不要每次提交都重写
+	s.checkpoint = max(2*size, journalCheckpointSize)
+	return syncDir(s.dir)
+}
+
+func (s *segmentStore) queueNames() []string {
+	names := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendPutOp(b []byte, bucket, key string, value []byte) []byte {
+	b = append(b, opPut)
+	b = appendString(b, bucket)
+	b = appendString(b, key)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendDeleteOp(b []byte, bucket, key string) []byte {
+	b = append(b, opDelete)
+	b = appendString(b, bucket)
+	return appendString(b, key)
+}
+
+func appendHeadOp(b []byte, queue string, head uint64) []byte {
+	b = append(b, opHead)
+	b = appendString(b, queue)
+	return binary.AppendUvarint(b, head)
+}
+
+func appendDeleteRangeOp(b []byte, queue string, from, to uint64) []byte {
+	b = append(b, opDeleteRange)
+	b = appendString(b, queue)
+	b = binary.AppendUvarint(b, from)
+	return binary.AppendUvarint(b, to)
+}
+
+func appendDropQueueOp(b []byte, queue string) []byte {
+	b = append(b, opDropQueue)
+	return appendString(b, queue)
+}
+
+func appendRenameQueueOp(b []byte, from, to string) []byte {
+	b = append(b, opRenameQueue)
+	b = appendString(b, from)
+	return appendString(b, to)
+}
+
+// frameBatch prefixes a journal batch or segment record with its length and
+// checksum.
+func frame(body []byte) []byte {
+	buf := make([]byte, recordHeader, recordHeader+len(body))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(body, crcTable))
+	return append(buf, body...)
+}
+
+// addRange returns ranges with r merged in. The input slice is not modified.
+func addRange(ranges []seqRange, r seqRange) []seqRange {
+	out := make([]seqRange, 0, len(ranges)+1)
+	for _, cur := range ranges {
+		switch {
+		case cur.to+1 < r.from:
+			out = append(out, cur)
+		case r.to+1 < cur.from:
+			out = append(out, r)
+			r = cur
+		default:
+			r = seqRange{min(r.from, cur.from), max(r.to, cur.to)}
+		}
+	}
+	return append(out, r)
+}
+
+// skipDeleted returns seq, or the first sequence after the deleted range that
+// contains it.
+func (q *segmentQueue) skipDeleted(seq uint64) uint64 {
+	i := sort.Search(len(q.deleted), func(i int) bool { return q.deleted[i].to >= seq })
+	if i < len(q.deleted) && q.deleted[i].from <= seq {
+		return q.deleted[i].to + 1
+	}
+	return seq
+}
+
+func (q *segmentQueue) allDeleted(seg *segment) bool {
+	if len(seg.offsets) == 0 {
+		return true
+	}
+	return q.skipDeleted(seg.base) > seg.last()
+}
+
+// next returns the first stored, undeleted sequence number of at least from.
+func (q *segmentQueue) next(from uint64) (uint64, bool) {
+	if from == 0 {
+		from = 1
+	}
+	i := sort.Search(len(q.segments), func(i int) bool { return q.segments[i].last() >= from })
+	for ; i < len(q.segments); i++ {
+		seg := q.segments[i]
+		if seq := q.skipDeleted(max(from, seg.base)); seq <= seg.last() {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+func (q *segmentQueue) read(seq uint64) ([]byte, error) {
+	i := sort.Search(len(q.segments), func(i int) bool { return q.segments[i].last() >= seq })
+	if i == len(q.segments) || seq < q.segments[i].base {
+		return nil, ErrKeyNotFound
+	}
+	return q.segments[i].read(int(seq - q.segments[i].base))
+}
+
+func (q *segmentQueue) count() int {
+	n := 0
+	for _, seg := range q.segments {
+		n += len(seg.offsets)
+		for _, r := range q.deleted {
+			if lo, hi := max(r.from, seg.base), min(r.to, seg.last()); lo <= hi {
+				n -= int(hi - lo + 1)
+			}
+		}
+	}
+	return n
+}
+
+func (q *segmentQueue) close() {
+	for _, seg := range q.segments {
+		seg.close()
+	}
+}
+
+func segmentPaths(dir string, base uint64) (data, index string) {
+	name := filepath.Join(dir, fmt.Sprintf("%020d", base))
+	return name + segmentExt, name + indexExt
+}
+
+func removeSegmentFiles(dir string, base uint64) error {
+	data, index := segmentPaths(dir, base)
+	if err := os.Remove(index); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(data)
+}
+
+func createSegment(dir string, base uint64, mode os.FileMode) (*segment, error) {
+	dataPath, indexPath := segmentPaths(dir, base)
+	data, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		data.Close()
+		os.Remove(dataPath)
+		return nil, err
+	}
+	return &segment{base: base, data: data, index: index}, nil
+}
+
+// openSegment opens an existing segment and loads its index. Records written
+// after the last index entry are recovered by scanning the data file, and a
+// torn record at the end is cut off.
+func openSegment(dir string, base uint64, mode os.FileMode) (*segment, error) {
+	dataPath, indexPath := segmentPaths(dir, base)
+	data, err := os.OpenFile(dataPath, os.O_RDWR, mode)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{base: base, data: data}
+	if seg.index, err = os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, mode); err != nil {
+		data.Close()
+		return nil, err
+	}
+	if err := seg.load(); err != nil {
+		seg.close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func (seg *segment) load() error {
+	info, err := seg.data.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	raw, err := io.ReadAll(seg.index)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+8 <= len(raw); i += 8 {
+		off := int64(binary.LittleEndian.Uint64(raw[i:]))
+		if off >= fileSize || (i == 0 && off != 0) || (i > 0 && off <= seg.offsets[len(seg.offsets)-1]) {
+			break
+		}
+		seg.offsets = append(seg.offsets, off)
+	}
+	// 从最后一条已索引记录开始往后扫描：验证它，并补上索引落后的记录
+	var pos int64
+	if n := len(seg.offsets); n > 0 {
+		pos = seg.offsets[n-1]
+		seg.offsets = seg.offsets[:n-1]
+	}
+	r := bufio.NewReader(io.NewSectionReader(seg.data, pos, fileSize-pos))
+	header := make([]byte, recordHeader)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			break
+		}
+		n := int64(binary.LittleEndian.Uint32(header[0:4]))
+		if pos+recordHeader+n > fileSize {
+			break
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+		seg.offsets = append(seg.offsets, pos)
+		pos += recordHeader + n
+	}
+	seg.size = pos
+	if pos != fileSize {
+		if err := seg.data.Truncate(pos); err != nil {
+			return err
+		}
+	}
+	return seg.writeIndex()
+}
+
+// writeIndex rewrites the index file from the in-memory offsets.
+func (seg *segment) writeIndex() error {
+	buf := make([]byte, 8*len(seg.offsets))
+	for i, off := range seg.offsets {
+		binary.LittleEndian.PutUint64(buf[8*i:], uint64(off))
+	}
+	if _, err := seg.index.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return seg.index.Truncate(int64(len(buf)))
+}
+
+// last returns the sequence number of the last record, or base-1 if the
+// segment is empty.
+func (seg *segment) last() uint64 {
+	return seg.base + uint64(len(seg.offsets)) - 1
+}
+
+func (seg *segment) append(record []byte) error {
+	if _, err := seg.data.WriteAt(record, seg.size); err != nil {
+		seg.data.Truncate(seg.size)
+		return err
+	}
+	var entry [8]byte
+	binary.LittleEndian.PutUint64(entry[:], uint64(seg.size))
+	if _, err := seg.index.WriteAt(entry[:], int64(8*len(seg.offsets))); err != nil {
+		seg.data.Truncate(seg.size)
+		return err
+	}
+	seg.offsets = append(seg.offsets, seg.size)
+	seg.size += int64(len(record))
+	return nil
+}
+
+// truncate keeps the first n records.
+func (seg *segment) truncate(n int) error {
+	size := seg.size
+	if n < len(seg.offsets) {
+		size = seg.offsets[n]
+	}
+	if err := seg.data.Truncate(size); err != nil {
+		return err
+	}
+	if err := seg.index.Truncate(int64(8 * n)); err != nil {
+		return err
+	}
+	seg.size, seg.offsets = size, seg.offsets[:n]
+	return nil
+}
+
+func (seg *segment) read(i int) ([]byte, error) {
+	start, end := seg.offsets[i], seg.size
+	if i+1 < len(seg.offsets) {
+		end = seg.offsets[i+1]
+	}
+	buf := make([]byte, end-start)
+	if _, err := seg.data.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+	payload := buf[recordHeader:]
+	if int(binary.LittleEndian.Uint32(buf[0:4])) != len(payload) ||
+		crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(buf[4:8]) {
+		return nil, NewDBError(CodeFailedToDeserialize, errors.New("segment record checksum mismatch"), seg.data.Name())
+	}
+	return payload, nil
+}
+
+func (seg *segment) close() error {
+	err := seg.data.Close()
+	if ierr := seg.index.Close(); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+func (seg *segment) remove() error {
+	seg.close()
+	if err := os.Remove(seg.index.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(seg.data.Name())
+}
+
+type segmentTx struct {
+	store    *segmentStore
+	writable bool
+	done     bool
+	undo     []func()
+	ops      []byte                   // journal records of this transaction
+	heads    map[string]*segmentQueue // queues appended to
+	written  map[*segment]bool        // segments appended to
+	trash    []*segmentQueue          // queues dropped, removed from disk on commit
+	moved    map[*segmentQueue]bool   // queues renamed, whose directories move on commit
+}
+
+func (t *segmentTx) check(write bool) error {
+	if t.done {
+		return ErrDatabaseClosed
+	}
+	if write && !t.writable {
+		return errTxNotWritable
+	}
+	return nil
+}
+
+func (t *segmentTx) commit() error {
+	s := t.store
+	names := make([]string, 0, len(t.heads))
+	for name := range t.heads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if q := t.heads[name]; s.queues[name] == q {
+			t.ops = appendHeadOp(t.ops, name, q.lastSeq)
+		}
+	}
+	if len(t.ops) == 0 {
+		return nil
+	}
+	if s.strict {
+		// 数据先落盘，再写提交记录
+		for seg := range t.written {
+			if err := seg.data.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	batch := frame(t.ops)
+	if _, err := s.journal.WriteAt(batch, s.journalEnd); err != nil {
+		s.journal.Truncate(s.journalEnd)
+		return err
+	}
+	if s.strict {
+		if err := s.journal.Sync(); err != nil {
+			s.journal.Truncate(s.journalEnd)
+			return err
+		}
+	} else if s.syncer != nil {
+		for seg := range t.written {
+			s.unsynced[seg] = true
+		}
+		s.syncer.markDirty()
+	}
+	s.journalEnd += int64(len(batch))
+	for _, q := range t.trash {
+		q.close()
+		if err := os.RemoveAll(q.dir); err != nil {
+			s.log().Warn("bunnymq: removing deleted queue", "path", q.dir, "err", err)
+		}
+	}
+	for name, q := range s.queues {
+		if t.moved[q] {
+			if err := s.moveQueueDir(name, q); err != nil {
+				s.log().Error("bunnymq: moving renamed queue", "path", q.dir, "queue", name, "err", err)
+			}
+		}
+	}
+	if s.journalEnd >= s.checkpoint {
+		// 提交已经生效，重写失败只记日志，下次提交再试
+		if err := s.rewriteJournal(); err != nil {
+			s.log().Warn("bunnymq: checkpointing journal", "path", s.dir, "err", err)
+		}
+	}
+	return nil
+}
+
+func (t *segmentTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+}
+
+func (t *segmentTx) Get(bucketName, key string) ([]byte, error) {
+	if err := t.check(false); err != nil {
+		return nil, err
+	}
+	value, ok := t.store.buckets[bucketName][key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (t *segmentTx) Put(bucketName, key string, value []byte) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	buckets := t.store.buckets
+	bucket, ok := buckets[bucketName]
+	if !ok {
+		bucket = make(map[string][]byte)
+		buckets[bucketName] = bucket
+		t.undo = append(t.undo, func() { delete(buckets, bucketName) })
+	}
+	old, existed := bucket[key]
+	bucket[key] = append([]byte(nil), value...)
+	t.ops = appendPutOp(t.ops, bucketName, key, value)
+	t.undo = append(t.undo, func() {
+		if existed {
+			bucket[key] = old
+		} else {
+			delete(bucket, key)
+		}
+	})
+	return nil
+}
+
+func (t *segmentTx) Delete(bucketName, key string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	bucket := t.store.buckets[bucketName]
+	old, existed := bucket[key]
+	if !existed {
+		return nil
+	}
+	delete(bucket, key)
+	t.ops = appendDeleteOp(t.ops, bucketName, key)
+	t.undo = append(t.undo, func() { bucket[key] = old })
+	return nil
+}
+
+func (t *segmentTx) ForEach(bucketName string, fn func(key string, value []byte) error) error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	bucket := t.store.buckets[bucketName]
+	keys := make([]string, 0, len(bucket))
+	for k := range bucket {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, bucket[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *segmentTx) Append(queue string, value []byte) (uint64, error) {
+	if err := t.check(true); err != nil {
+		return 0, err
+	}
+	s := t.store
+	q, err := t.queue(queue)
+	if err != nil {
+		return 0, err
+	}
+
+	seq := q.lastSeq + 1
+	record := frame(value)
+	var seg *segment
+	if n := len(q.segments); n > 0 {
+		seg = q.segments[n-1]
+	}
+	if seg == nil || seg.last()+1 != seq || (seg.size > 0 && seg.size+int64(len(record)) > s.maxSize) {
+		var err error
+		if seg, err = createSegment(q.dir, seq, s.fileMode); err != nil {
+			return 0, err
+		}
+		if s.strict {
+			if err := syncDir(q.dir); err != nil {
+				seg.remove()
+				return 0, err
+			}
+		}
+		q.segments = append(q.segments, seg)
+		newSeg := seg
+		t.undo = append(t.undo, func() {
+			q.segments = q.segments[:len(q.segments)-1]
+			newSeg.remove()
+		})
+	}
+	if err := seg.append(record); err != nil {
+		return 0, err
+	}
+	q.lastSeq = seq
+	t.undo = append(t.undo, func() {
+		seg.truncate(len(seg.offsets) - 1)
+		q.lastSeq = seq - 1
+	})
+	t.written[seg] = true
+	t.heads[queue] = q
+	return seq, nil
+}
+
+// queue returns the queue, creating its directory if it does not exist.
+func (t *segmentTx) queue(name string) (*segmentQueue, error) {
+	s := t.store
+	if q, ok := s.queues[name]; ok {
+		return q, nil
+	}
+	dir := s.queueDir(name)
+	if err := os.Mkdir(dir, s.fileMode|(s.fileMode&0444)>>2); err != nil {
+		return nil, err
+	}
+	if s.strict {
+		if err := syncDir(s.dir); err != nil {
+			return nil, err
+		}
+	}
+	q := &segmentQueue{dir: dir}
+	s.queues[name] = q
+	t.undo = append(t.undo, func() {
+		delete(s.queues, name)
+		os.RemoveAll(dir)
+	})
+	return q, nil
+}
+
+func (t *segmentTx) Seek(queue string, from uint64) (uint64, []byte, error) {
+	if err := t.check(false); err != nil {
+		return 0, nil, err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return 0, nil, ErrBucketNotFound
+	}
+	seq, ok := q.next(from)
+	if !ok {
+		return 0, nil, ErrKeyNotFound
+	}
+	value, err := q.read(seq)
+	if err != nil {
+		return 0, nil, err
+	}
+	return seq, value, nil
+}
+
+func (t *segmentTx) Scan(queue string, from uint64, fn func(seq uint64, value []byte) bool) error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return nil
+	}
+	for seq, ok := q.next(from); ok; seq, ok = q.next(seq + 1) {
+		value, err := q.read(seq)
+		if err != nil {
+			return err
+		}
+		if !fn(seq, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (t *segmentTx) DeleteRange(queue string, from, to uint64) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return nil
+	}
+	// 只能删除已经写入的消息
+	from, to = max(from, 1), min(to, q.lastSeq)
+	if from > to {
+		return nil
+	}
+	old := q.deleted
+	q.deleted = addRange(old, seqRange{from, to})
+	t.ops = appendDeleteRangeOp(t.ops, queue, from, to)
+	t.undo = append(t.undo, func() { q.deleted = old })
+	return nil
+}
+
+func (t *segmentTx) Stats(queue string) (QueueStats, error) {
+	if err := t.check(false); err != nil {
+		return QueueStats{}, err
+	}
+	q, ok := t.store.queues[queue]
+	if !ok {
+		return QueueStats{}, ErrBucketNotFound
+	}
+	stats := QueueStats{Count: q.count(), LastSeq: q.lastSeq}
+	if seq, ok := q.next(1); ok {
+		stats.FirstSeq = seq
+	}
+	return stats, nil
+}
+
+func (t *segmentTx) Queues() ([]string, error) {
+	if err := t.check(false); err != nil {
+		return nil, err
+	}
+	return t.store.queueNames(), nil
+}
+
+func (t *segmentTx) DeleteQueue(queue string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	s := t.store
+	q, ok := s.queues[queue]
+	if !ok {
+		return ErrBucketNotFound
+	}
+	// 先改名移走，提交后再删除；回滚时改回来
+	liveDir := q.dir
+	trash := filepath.Join(s.dir, fmt.Sprintf("%s%s-%d", trashDirPrefix, url.PathEscape(queue), time.Now().UnixNano()))
+	if err := os.Rename(liveDir, trash); err != nil {
+		return err
+	}
+	q.dir = trash
+	delete(s.queues, queue)
+	t.ops = appendDropQueueOp(t.ops, queue)
+	t.trash = append(t.trash, q)
+	t.undo = append(t.undo, func() {
+		if err := os.Rename(trash, liveDir); err != nil {
+			s.log().Error("bunnymq: restoring queue directory", "path", liveDir, "err", err)
+		}
+		q.dir = liveDir
+		s.queues[queue] = q
+		t.trash = t.trash[:len(t.trash)-1]
+	})
+	return nil
+}
+
+func (t *segmentTx) RenameQueue(from, to string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	s := t.store
+	q, ok := s.queues[from]
+	if !ok {
+		return ErrBucketNotFound
+	}
+	if _, exists := s.queues[to]; exists {
+		return ErrQueueExists
+	}
+	// 目录在提交后才改名，事务内继续用原来的目录
+	delete(s.queues, from)
+	s.queues[to] = q
+	head := t.heads[from] == q
+	if head {
+		// 本事务追加的消息先按旧名提交，否则改名记录找不到这个队列
+		t.ops = appendHeadOp(t.ops, from, q.lastSeq)
+		delete(t.heads, from)
+		t.heads[to] = q
+	}
+	t.ops = appendRenameQueueOp(t.ops, from, to)
+	if t.moved == nil {
+		t.moved = make(map[*segmentQueue]bool)
+	}
+	wasMoved := t.moved[q]
+	t.moved[q] = true
+	t.undo = append(t.undo, func() {
+		delete(s.queues, to)
+		s.queues[from] = q
+		if head {
+			delete(t.heads, to)
+			t.heads[from] = q
+		}
+		t.moved[q] = wasMoved
+	})
+	return nil
+}
+
+func (t *segmentTx) SetSequence(queue string, seq uint64) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	q, err := t.queue(queue)
+	if err != nil {
+		return err
+	}
+	if seq <= q.lastSeq {
+		return nil
+	}
+	// 只挪动计数器，下一次追加会从 seq+1 另起一段
+	old := q.lastSeq
+	q.lastSeq = seq
+	t.undo = append(t.undo, func() { q.lastSeq = old })
+	t.heads[queue] = q
+	return nil
+}
@@ -0,0 +1,351 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestSegmentStore(t testing.TB, dir string) *segmentStore {
+	t.Helper()
+	opts := defaultOptions("q")
+	opts.SegmentSize = 64
+	opts.OpenTimeout = 100 * time.Millisecond
+	store, err := openSegmentStore(dir, &opts)
+	if err != nil {
+		t.Fatalf("open segment store: %v", err)
+	}
+	return store.(*segmentStore)
+}
+
+func appendN(t *testing.T, store Store, queue string, n int) {
+	t.Helper()
+	err := store.Update(func(tx Tx) error {
+		for i := 0; i < n; i++ {
+			if _, err := tx.Append(queue, []byte(fmt.Sprintf("message %02d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "q-q", "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSegmentStoreReopenAndCompact(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	store := openTestSegmentStore(t, dir)
+	appendN(t, store, "q", 10)
+	before := len(segmentFiles(t, dir))
+	if before < 3 {
+		t.Fatalf("expected several segments, got %d", before)
+	}
+	err := store.Update(func(tx Tx) error {
+		if err := tx.Put(consumerProgressBucket, "c:q", []byte("6")); err != nil {
+			return err
+		}
+		return tx.DeleteRange("q", 1, 6)
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := store.compact(); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if after := len(segmentFiles(t, dir)); after >= before {
+		t.Errorf("compact kept %d of %d segments", after, before)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := store.View(func(Tx) error { return nil }); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("View after Close: got %v, want ErrDatabaseClosed", err)
+	}
+
+	store = openTestSegmentStore(t, dir)
+	defer store.Close()
+	appendN(t, store, "q", 1)
+	err = store.View(func(tx Tx) error {
+		stats, err := tx.Stats("q")
+		if err != nil {
+			return err
+		}
+		if stats != (QueueStats{Count: 5, FirstSeq: 7, LastSeq: 11}) {
+			t.Errorf("Stats after reopen = %+v", stats)
+		}
+		seq, value, err := tx.Seek("q", 1)
+		if err != nil || seq != 7 || string(value) != "message 06" {
+			t.Errorf("Seek(1) = %d, %q, %v", seq, value, err)
+		}
+		if progress, err := tx.Get(consumerProgressBucket, "c:q"); err != nil || string(progress) != "6" {
+			t.Errorf("progress after reopen = %q, %v", progress, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("view: %v", err)
+	}
+}
+
+func TestSegmentStoreDiscardsUncommittedWrites(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	store := openTestSegmentStore(t, dir)
+	appendN(t, store, "q", 3)
+	// 模拟崩溃：记录写进了段文件，但提交记录只写了一半
+	seg := store.queues["q"].segments[len(store.queues["q"].segments)-1]
+	if err := seg.append(frame([]byte("uncommitted"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.journal.WriteAt([]byte{0xff, 0, 0, 0, 1}, store.journalEnd); err != nil {
+		t.Fatal(err)
+	}
+	store.closeFiles()
+
+	store = openTestSegmentStore(t, dir)
+	defer store.Close()
+	var seq uint64
+	err := store.Update(func(tx Tx) error {
+		var err error
+		seq, err = tx.Append("q", []byte("next"))
+		return err
+	})
+	if err != nil || seq != 4 {
+		t.Fatalf("Append after recovery = %d, %v; want 4", seq, err)
+	}
+	err = store.View(func(tx Tx) error {
+		_, value, err := tx.Seek("q", 4)
+		if err != nil || string(value) != "next" {
+			t.Errorf("Seek(4) = %q, %v", value, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentStoreDeleteQueue(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	store := openTestSegmentStore(t, dir)
+	defer store.Close()
+	appendN(t, store, "q", 3)
+
+	errAbort := errors.New("abort")
+	err := store.Update(func(tx Tx) error {
+		if err := tx.DeleteQueue("q"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("Update returned %v", err)
+	}
+	if len(segmentFiles(t, dir)) == 0 {
+		t.Fatalf("rolled back DeleteQueue removed the segments")
+	}
+	appendN(t, store, "q", 1)
+
+	if err := store.Update(func(tx Tx) error { return tx.DeleteQueue("q") }); err != nil {
+		t.Fatalf("DeleteQueue: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "q-q")); !os.IsNotExist(err) {
+		t.Errorf("queue directory still present: %v", err)
+	}
+	var seq uint64
+	err = store.Update(func(tx Tx) error {
+		seq, err = tx.Append("q", []byte("again"))
+		return err
+	})
+	if err != nil || seq != 1 {
+		t.Errorf("Append after DeleteQueue = %d, %v; want 1", seq, err)
+	}
+}
+
+func TestSegmentStoreSetSequenceSurvivesReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	store := openTestSegmentStore(t, dir)
+	appendN(t, store, "q", 2)
+	if err := store.Update(func(tx Tx) error { return tx.SetSequence("q", 40) }); err != nil {
+		t.Fatalf("SetSequence: %v", err)
+	}
+	appendN(t, store, "q", 1)
+	store.Close()
+
+	store = openTestSegmentStore(t, dir)
+	var seqs []uint64
+	err := store.View(func(tx Tx) error {
+		return tx.Scan("q", 1, func(seq uint64, _ []byte) bool {
+			seqs = append(seqs, seq)
+			return true
+		})
+	})
+	if err != nil || len(seqs) != 3 || seqs[1] != 2 || seqs[2] != 41 {
+		t.Fatalf("Scan after reopen = %v, %v; want [1 2 41]", seqs, err)
+	}
+	if err := store.Update(func(tx Tx) error { return tx.SetSequence("q", 50) }); err != nil {
+		t.Fatalf("SetSequence: %v", err)
+	}
+	store.Close()
+	store = openTestSegmentStore(t, dir)
+	defer store.Close()
+	appendN(t, store, "q", 1)
+	if err := store.View(func(tx Tx) error {
+		stats, err := tx.Stats("q")
+		if stats.LastSeq != 51 {
+			t.Errorf("LastSeq after a bare SetSequence and reopen = %d, want 51", stats.LastSeq)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentStoreLocksDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	store := openTestSegmentStore(t, dir)
+	defer store.Close()
+	opts := defaultOptions("q")
+	opts.OpenTimeout = 50 * time.Millisecond
+	other, err := openSegmentStore(dir, &opts)
+	if err == nil {
+		other.Close()
+		t.Fatalf("second open of a locked directory succeeded")
+	}
+	if !errors.Is(err, ErrDatabaseLocked) || !strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())) {
+		t.Errorf("second open: got %v, want ErrDatabaseLocked naming this process", err)
+	}
+}
+
+// BenchmarkEnqueue compares the bbolt and segment log stores on the same
+// workload: 256-byte messages enqueued one per transaction.
+func BenchmarkEnqueue(b *testing.B) {
+	stores := []struct {
+		name string
+		opts []Option
+	}{
+		{"bolt", nil},
+		{"segment", []Option{WithSegmentLog()}},
+	}
+	payload := make([]byte, 256)
+	for _, store := range stores {
+		for _, mode := range []Durability{DurabilityStrict, DurabilityBatched, DurabilityNone} {
+			b.Run(store.name+"/"+mode.String(), func(b *testing.B) {
+				opts := append([]Option{WithDurability(mode)}, store.opts...)
+				queue, err := NewQueue[[]byte]("bench", filepath.Join(b.TempDir(), "bench"), RawCoder{}, opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer queue.Close()
+				b.SetBytes(int64(len(payload)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := queue.Enqueue(payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSegmentStoreRenameQueue(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	store := openTestSegmentStore(t, dir)
+	appendN(t, store, "q", 3)
+	// 追加和改名在同一个事务里
+	err := store.Update(func(tx Tx) error {
+		if _, err := tx.Append("q", []byte("message 03")); err != nil {
+			return err
+		}
+		return tx.RenameQueue("q", "r")
+	})
+	if err != nil {
+		t.Fatalf("RenameQueue: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "q-r")); err != nil {
+		t.Fatalf("queue directory not moved: %v", err)
+	}
+	appendN(t, store, "r", 1)
+	store.Close()
+
+	// 模拟改名提交后、目录改名前崩溃
+	if err := os.Rename(filepath.Join(dir, "q-r"), filepath.Join(dir, "q-q")); err != nil {
+		t.Fatal(err)
+	}
+	store = openTestSegmentStore(t, dir)
+	defer store.Close()
+	err = store.View(func(tx Tx) error {
+		if names, _ := tx.Queues(); len(names) != 1 || names[0] != "r" {
+			t.Errorf("Queues after recovery = %v", names)
+		}
+		stats, err := tx.Stats("r")
+		if err != nil || stats != (QueueStats{Count: 5, FirstSeq: 1, LastSeq: 5}) {
+			t.Errorf("Stats after recovery = %+v, %v", stats, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 每次 Ack 都往日志追加一条记录，日志超过阈值后要重写成一批，不能一直长下去
+func TestSegmentStoreCheckpointsJournal(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	store := openTestSegmentStore(t, dir)
+	appendN(t, store, "q", 3)
+	store.checkpoint = store.journalEnd + 512
+
+	rewritten := false
+	for i := 1; i <= 200; i++ {
+		before := store.journalEnd
+		err := store.Update(func(tx Tx) error {
+			return tx.Put(consumerProgressBucket, "c:q", []byte(fmt.Sprint(i)))
+		})
+		if err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if store.journalEnd < before {
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		t.Errorf("journal grew to %d bytes without being rewritten", store.journalEnd)
+	}
+	info, err := os.Stat(filepath.Join(dir, journalName))
+	if err != nil || info.Size() != store.journalEnd {
+		t.Fatalf("journal file = %v, %v; want %d bytes", info, err, store.journalEnd)
+	}
+	store.Close()
+
+	store = openTestSegmentStore(t, dir)
+	defer store.Close()
+	err = store.View(func(tx Tx) error {
+		progress, err := tx.Get(consumerProgressBucket, "c:q")
+		if err != nil || string(progress) != "200" {
+			t.Errorf("progress after reopen = %q, %v; want 200", progress, err)
+		}
+		stats, err := tx.Stats("q")
+		if err != nil || stats.LastSeq != 3 {
+			t.Errorf("Stats after reopen = %+v, %v; want LastSeq 3", stats, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
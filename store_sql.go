@@ -0,0 +1,444 @@
+package bunnymq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"sync"
+)
+
+// Statements creating the tables used by sqlStore, in SQLite syntax. Drivers
+// differ in whether one Exec may run several statements, so NewSQLStore runs
+// them one at a time.
+const (
+	sqlCreateQueues = `CREATE TABLE IF NOT EXISTS bunnymq_queues (
+	name     TEXT PRIMARY KEY,
+	last_seq INTEGER NOT NULL
+)`
+	sqlCreateMessages = `CREATE TABLE IF NOT EXISTS bunnymq_messages (
+	queue TEXT NOT NULL,
+	seq   INTEGER NOT NULL,
+	body  BLOB NOT NULL,
+	PRIMARY KEY (queue, seq)
+)`
+	sqlCreateProgress = `CREATE TABLE IF NOT EXISTS bunnymq_progress (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+)`
+	sqlCreateLeases = `CREATE TABLE IF NOT EXISTS bunnymq_leases (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+)`
+	sqlCreateBuckets = `CREATE TABLE IF NOT EXISTS bunnymq_buckets (
+	bucket TEXT NOT NULL,
+	key    TEXT NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+)`
+)
+
+var sqlSchema = []string{sqlCreateQueues, sqlCreateMessages, sqlCreateProgress, sqlCreateLeases, sqlCreateBuckets}
+
+// SQLSchema creates the tables used by NewSQLStore, in SQLite syntax, for
+// applications that manage their schema themselves.
+const SQLSchema = sqlCreateQueues + ";\n" + sqlCreateMessages + ";\n" + sqlCreateProgress + ";\n" + sqlCreateLeases + ";\n" + sqlCreateBuckets + ";\n"
+
+// Statements used by sqlStore. Consumer progress and leases have their own
+// tables; any other bucket goes to bunnymq_buckets.
+const (
+	sqlNextSeq      = `INSERT INTO bunnymq_queues (name, last_seq) VALUES (?, 1) ON CONFLICT (name) DO UPDATE SET last_seq = bunnymq_queues.last_seq + 1`
+	sqlSetSeq       = `INSERT INTO bunnymq_queues (name, last_seq) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET last_seq = MAX(bunnymq_queues.last_seq, excluded.last_seq)`
+	sqlLastSeq      = `SELECT last_seq FROM bunnymq_queues WHERE name = ?`
+	sqlQueues       = `SELECT name FROM bunnymq_queues ORDER BY name`
+	sqlDropQueue    = `DELETE FROM bunnymq_queues WHERE name = ?`
+	sqlRenameQueue  = `UPDATE bunnymq_queues SET name = ? WHERE name = ?`
+	sqlRenameMsgs   = `UPDATE bunnymq_messages SET queue = ? WHERE queue = ?`
+	sqlInsertMsg    = `INSERT INTO bunnymq_messages (queue, seq, body) VALUES (?, ?, ?)`
+	sqlSelectMsgs   = `SELECT seq, body FROM bunnymq_messages WHERE queue = ? AND seq >= ? ORDER BY seq LIMIT ?`
+	sqlDeleteMsgs   = `DELETE FROM bunnymq_messages WHERE queue = ? AND seq >= ? AND seq <= ?`
+	sqlQueueStats   = `SELECT COUNT(*), COALESCE(MIN(seq), 0) FROM bunnymq_messages WHERE queue = ?`
+	sqlGetBucket    = `SELECT value FROM bunnymq_buckets WHERE bucket = ? AND key = ?`
+	sqlPutBucket    = `INSERT INTO bunnymq_buckets (bucket, key, value) VALUES (?, ?, ?) ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`
+	sqlDeleteBucket = `DELETE FROM bunnymq_buckets WHERE bucket = ? AND key = ?`
+	sqlListBucket   = `SELECT key, value FROM bunnymq_buckets WHERE bucket = ? ORDER BY key`
+)
+
+// sqlTable holds the statements for a bucket that has a table of its own.
+type sqlTable struct {
+	get, put, del, list string
+}
+
+var sqlTables = map[string]sqlTable{
+	consumerProgressBucket: {
+		get:  `SELECT value FROM bunnymq_progress WHERE key = ?`,
+		put:  `INSERT INTO bunnymq_progress (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`,
+		del:  `DELETE FROM bunnymq_progress WHERE key = ?`,
+		list: `SELECT key, value FROM bunnymq_progress ORDER BY key`,
+	},
+	consumerLeaseBucket: {
+		get:  `SELECT value FROM bunnymq_leases WHERE key = ?`,
+		put:  `INSERT INTO bunnymq_leases (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value`,
+		del:  `DELETE FROM bunnymq_leases WHERE key = ?`,
+		list: `SELECT key, value FROM bunnymq_leases ORDER BY key`,
+	},
+}
+
+// sqlScanBatch is how many messages Scan reads per query.
+const sqlScanBatch = 256
+
+// sqlStore is a Store over database/sql.
+type sqlStore struct {
+	db      *sql.DB
+	writeMu sync.Mutex // one writer at a time, so SQLite does not report SQLITE_BUSY
+	mu      sync.RWMutex
+	closed  bool
+}
+
+type sqlMessage struct {
+	seq  uint64
+	body []byte
+}
+
+// NewSQLStore returns a Store that keeps queues in db, creating the tables in
+// SQLSchema if they do not exist, one statement per Exec. Any database/sql driver can be used as long
+// as it accepts ? placeholders and INSERT ... ON CONFLICT DO UPDATE, as SQLite
+// does. Closing the store does not close db.
+func NewSQLStore(db *sql.DB) (Store, error) {
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, NewDBError(CodeFailedToCreate, err, "creating bunnymq tables")
+		}
+	}
+	return &sqlStore{db: db}, nil
+}
+
+// WithSQLStore keeps the queue in db; see NewSQLStore. The tables are created
+// when dbPath is first opened, and dbPath only identifies the store within the
+// process.
+func WithSQLStore(db *sql.DB) Option {
+	return func(o *Options) error {
+		if db == nil {
+			return invalidOption("sql store", "db must not be nil")
+		}
+		o.openStore = func(string, *Options) (Store, error) { return NewSQLStore(db) }
+		return nil
+	}
+}
+
+func (s *sqlStore) Update(fn func(Tx) error) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.run(true, fn)
+}
+
+func (s *sqlStore) View(fn func(Tx) error) error {
+	return s.run(false, fn)
+}
+
+func (s *sqlStore) run(writable bool, fn func(Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrDatabaseClosed
+	}
+	ctx := context.Background()
+	dbTx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tx := &sqlTx{ctx: ctx, tx: dbTx, writable: writable}
+	defer func() { tx.done = true }()
+	if err := fn(tx); err != nil {
+		dbTx.Rollback()
+		return err
+	}
+	if !writable {
+		return dbTx.Rollback()
+	}
+	return dbTx.Commit()
+}
+
+func (s *sqlStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+type sqlTx struct {
+	ctx      context.Context
+	tx       *sql.Tx
+	writable bool
+	done     bool
+}
+
+func (t *sqlTx) check(write bool) error {
+	if t.done {
+		return ErrDatabaseClosed
+	}
+	if write && !t.writable {
+		return errTxNotWritable
+	}
+	return nil
+}
+
+// sqlSeq converts a sequence number to a query argument. database/sql does
+// not accept uint64 values with the high bit set.
+func sqlSeq(seq uint64) int64 {
+	if seq > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(seq)
+}
+
+func (t *sqlTx) Get(bucketName, key string) ([]byte, error) {
+	if err := t.check(false); err != nil {
+		return nil, err
+	}
+	var value []byte
+	var err error
+	if table, ok := sqlTables[bucketName]; ok {
+		err = t.tx.QueryRowContext(t.ctx, table.get, key).Scan(&value)
+	} else {
+		err = t.tx.QueryRowContext(t.ctx, sqlGetBucket, bucketName, key).Scan(&value)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	}
+	return value, err
+}
+
+func (t *sqlTx) Put(bucketName, key string, value []byte) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	var err error
+	if table, ok := sqlTables[bucketName]; ok {
+		_, err = t.tx.ExecContext(t.ctx, table.put, key, value)
+	} else {
+		_, err = t.tx.ExecContext(t.ctx, sqlPutBucket, bucketName, key, value)
+	}
+	return err
+}
+
+func (t *sqlTx) Delete(bucketName, key string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	var err error
+	if table, ok := sqlTables[bucketName]; ok {
+		_, err = t.tx.ExecContext(t.ctx, table.del, key)
+	} else {
+		_, err = t.tx.ExecContext(t.ctx, sqlDeleteBucket, bucketName, key)
+	}
+	return err
+}
+
+func (t *sqlTx) ForEach(bucketName string, fn func(key string, value []byte) error) error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if table, ok := sqlTables[bucketName]; ok {
+		rows, err = t.tx.QueryContext(t.ctx, table.list)
+	} else {
+		rows, err = t.tx.QueryContext(t.ctx, sqlListBucket, bucketName)
+	}
+	if err != nil {
+		return err
+	}
+	// 先读出全部结果再回调，避免回调里在同一事务上再发查询
+	var kvs []keyValue
+	for rows.Next() {
+		var kv keyValue
+		if err := rows.Scan(&kv.key, &kv.value); err != nil {
+			rows.Close()
+			return err
+		}
+		kvs = append(kvs, kv)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		if err := fn(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sqlTx) lastSeq(queue string) (uint64, error) {
+	var last int64
+	err := t.tx.QueryRowContext(t.ctx, sqlLastSeq, queue).Scan(&last)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrBucketNotFound
+	}
+	return uint64(last), err
+}
+
+func (t *sqlTx) Append(queue string, value []byte) (uint64, error) {
+	if err := t.check(true); err != nil {
+		return 0, err
+	}
+	if _, err := t.tx.ExecContext(t.ctx, sqlNextSeq, queue); err != nil {
+		return 0, err
+	}
+	seq, err := t.lastSeq(queue)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := t.tx.ExecContext(t.ctx, sqlInsertMsg, queue, sqlSeq(seq), value); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// messages returns up to limit messages with sequence numbers of at least from.
+func (t *sqlTx) messages(queue string, from uint64, limit int) ([]sqlMessage, error) {
+	rows, err := t.tx.QueryContext(t.ctx, sqlSelectMsgs, queue, sqlSeq(from), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []sqlMessage
+	for rows.Next() {
+		var seq int64
+		var body []byte
+		if err := rows.Scan(&seq, &body); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, sqlMessage{seq: uint64(seq), body: body})
+	}
+	return msgs, rows.Err()
+}
+
+func (t *sqlTx) Seek(queue string, from uint64) (uint64, []byte, error) {
+	if err := t.check(false); err != nil {
+		return 0, nil, err
+	}
+	msgs, err := t.messages(queue, from, 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(msgs) == 0 {
+		if _, err := t.lastSeq(queue); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, ErrKeyNotFound
+	}
+	return msgs[0].seq, msgs[0].body, nil
+}
+
+func (t *sqlTx) Scan(queue string, from uint64, fn func(seq uint64, value []byte) bool) error {
+	if err := t.check(false); err != nil {
+		return err
+	}
+	for {
+		msgs, err := t.messages(queue, from, sqlScanBatch)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if !fn(m.seq, m.body) {
+				return nil
+			}
+		}
+		if len(msgs) < sqlScanBatch {
+			return nil
+		}
+		from = msgs[len(msgs)-1].seq + 1
+	}
+}
+
+func (t *sqlTx) DeleteRange(queue string, from, to uint64) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	_, err := t.tx.ExecContext(t.ctx, sqlDeleteMsgs, queue, sqlSeq(from), sqlSeq(to))
+	return err
+}
+
+func (t *sqlTx) Stats(queue string) (QueueStats, error) {
+	if err := t.check(false); err != nil {
+		return QueueStats{}, err
+	}
+	last, err := t.lastSeq(queue)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	var count, first int64
+	if err := t.tx.QueryRowContext(t.ctx, sqlQueueStats, queue).Scan(&count, &first); err != nil {
+		return QueueStats{}, err
+	}
+	return QueueStats{Count: int(count), FirstSeq: uint64(first), LastSeq: last}, nil
+}
+
+func (t *sqlTx) Queues() ([]string, error) {
+	if err := t.check(false); err != nil {
+		return nil, err
+	}
+	rows, err := t.tx.QueryContext(t.ctx, sqlQueues)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (t *sqlTx) DeleteQueue(queue string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	res, err := t.tx.ExecContext(t.ctx, sqlDropQueue, queue)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrBucketNotFound
+	}
+	_, err = t.tx.ExecContext(t.ctx, sqlDeleteMsgs, queue, 0, int64(math.MaxInt64))
+	return err
+}
+
+func (t *sqlTx) RenameQueue(from, to string) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	if _, err := t.lastSeq(from); err != nil {
+		return err
+	}
+	if _, err := t.lastSeq(to); err == nil {
+		return ErrQueueExists
+	} else if !errors.Is(err, ErrBucketNotFound) {
+		return err
+	}
+	if _, err := t.tx.ExecContext(t.ctx, sqlRenameQueue, to, from); err != nil {
+		return err
+	}
+	_, err := t.tx.ExecContext(t.ctx, sqlRenameMsgs, to, from)
+	return err
+}
+
+func (t *sqlTx) SetSequence(queue string, seq uint64) error {
+	if err := t.check(true); err != nil {
+		return err
+	}
+	_, err := t.tx.ExecContext(t.ctx, sqlSetSeq, queue, sqlSeq(seq))
+	return err
+}
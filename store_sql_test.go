@@ -0,0 +1,61 @@
+package bunnymq
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite" // registers the pure-Go "sqlite" driver
+)
+
+// openTestSQL opens a fresh SQLite database in a temporary directory. WAL and
+// a busy timeout let View run while another connection writes.
+func openTestSQL(t *testing.T) *sql.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bunnymq.sqlite")
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLStoreTables(t *testing.T) {
+	db := openTestSQL(t)
+	queue, err := NewQueue[testStruct]("orders", filepath.Join(t.TempDir(), "sql"), &JsonCoder[testStruct]{},
+		WithSQLStore(db), WithMaxDeliveries(1))
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+	for i := 0; i < 2; i++ {
+		if err := queue.Enqueue(testStruct{Message: fmt.Sprintf("m%d", i)}); err != nil {
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+	}
+	msg, err := queue.Dequeue("c")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Error acknowledging message: %v", err)
+	}
+	if _, err := queue.Dequeue("c"); err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+
+	var progress string
+	if err := db.QueryRow(sqlTables[consumerProgressBucket].get, "c:orders").Scan(&progress); err != nil || progress != "1" {
+		t.Errorf("progress row = %q, %v; want 1", progress, err)
+	}
+	var lease []byte
+	if err := db.QueryRow(sqlTables[consumerLeaseBucket].get, "c:orders").Scan(&lease); err != nil || string(lease) != "2:1" {
+		t.Errorf("lease row = %q, %v; want 2:1", lease, err)
+	}
+	var last int64
+	if err := db.QueryRow(sqlLastSeq, "orders").Scan(&last); err != nil || last != 2 {
+		t.Errorf("last_seq = %d, %v; want 2", last, err)
+	}
+}
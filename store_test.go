@@ -0,0 +1,275 @@
+package bunnymq
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// forEachStore runs fn against every store: a bbolt file, an in-memory store, a
+// segment log and database/sql. dbPath is unique to the subtest; opts selects
+// the store.
+func forEachStore(t *testing.T, fn func(t *testing.T, dbPath string, opts ...Option)) {
+	t.Run("bolt", func(t *testing.T) {
+		fn(t, filepath.Join(t.TempDir(), "bolt.db"))
+	})
+	t.Run("memory", func(t *testing.T) {
+		fn(t, filepath.Join(t.TempDir(), "memory.db"), WithMemoryStore())
+	})
+	t.Run("segment", func(t *testing.T) {
+		fn(t, filepath.Join(t.TempDir(), "segments"), WithSegmentLog(), WithSegmentSize(1024))
+	})
+	t.Run("sql", func(t *testing.T) {
+		fn(t, filepath.Join(t.TempDir(), "sql"), WithSQLStore(openTestSQL(t)))
+	})
+}
+
+func openTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+	opts := defaultOptions("q")
+	bolt, err := openBoltStore(filepath.Join(t.TempDir(), "store.db"), &opts)
+	if err != nil {
+		t.Fatalf("open bolt store: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	if err := migrate(bolt, "store.db", false, opts.Logger); err != nil {
+		t.Fatalf("migrate bolt store: %v", err)
+	}
+	opts.SegmentSize = 64
+	segments, err := openSegmentStore(filepath.Join(t.TempDir(), "segments"), &opts)
+	if err != nil {
+		t.Fatalf("open segment store: %v", err)
+	}
+	t.Cleanup(func() { segments.Close() })
+	sqlStore, err := NewSQLStore(openTestSQL(t))
+	if err != nil {
+		t.Fatalf("open sql store: %v", err)
+	}
+	return map[string]Store{"bolt": bolt, "memory": NewMemoryStore(), "segment": segments, "sql": sqlStore}
+}
+
+func TestStoreQueueOperations(t *testing.T) {
+	for name, store := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := store.Update(func(tx Tx) error {
+				for _, v := range []string{"a", "b", "c", "d", "e"} {
+					if _, err := tx.Append("q", []byte(v)); err != nil {
+						return err
+					}
+				}
+				return tx.DeleteRange("q", 2, 3)
+			})
+			if err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			err = store.View(func(tx Tx) error {
+				seq, value, err := tx.Seek("q", 2)
+				if err != nil || seq != 4 || string(value) != "d" {
+					t.Errorf("Seek(2) = %d, %q, %v; want 4, \"d\"", seq, value, err)
+				}
+				if _, _, err := tx.Seek("q", 6); !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("Seek past the end: got %v, want ErrKeyNotFound", err)
+				}
+				if _, _, err := tx.Seek("missing", 1); !errors.Is(err, ErrBucketNotFound) {
+					t.Errorf("Seek on missing queue: got %v, want ErrBucketNotFound", err)
+				}
+				var got []uint64
+				if err := tx.Scan("q", 0, func(seq uint64, _ []byte) bool {
+					got = append(got, seq)
+					return true
+				}); err != nil {
+					return err
+				}
+				if len(got) != 3 || got[0] != 1 || got[1] != 4 || got[2] != 5 {
+					t.Errorf("Scan = %v, want [1 4 5]", got)
+				}
+				stats, err := tx.Stats("q")
+				if err != nil {
+					return err
+				}
+				if stats != (QueueStats{Count: 3, FirstSeq: 1, LastSeq: 5}) {
+					t.Errorf("Stats = %+v", stats)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("view: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateRollsBack(t *testing.T) {
+	errAbort := errors.New("abort")
+	for name, store := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := store.Update(func(tx Tx) error {
+				if _, err := tx.Append("q", []byte("kept")); err != nil {
+					return err
+				}
+				return tx.Put(consumerProgressBucket, "c:q", []byte("1"))
+			})
+			if err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			err = store.Update(func(tx Tx) error {
+				if _, err := tx.Append("q", []byte("dropped")); err != nil {
+					return err
+				}
+				if err := tx.DeleteRange("q", 1, 1); err != nil {
+					return err
+				}
+				if err := tx.Put(consumerProgressBucket, "c:q", []byte("2")); err != nil {
+					return err
+				}
+				if _, err := tx.Append("other", []byte("dropped")); err != nil {
+					return err
+				}
+				return errAbort
+			})
+			if !errors.Is(err, errAbort) {
+				t.Fatalf("Update returned %v, want the error from fn", err)
+			}
+			err = store.View(func(tx Tx) error {
+				stats, err := tx.Stats("q")
+				if err != nil {
+					return err
+				}
+				if stats != (QueueStats{Count: 1, FirstSeq: 1, LastSeq: 1}) {
+					t.Errorf("Stats after rollback = %+v", stats)
+				}
+				if value, err := tx.Get(consumerProgressBucket, "c:q"); err != nil || string(value) != "1" {
+					t.Errorf("progress after rollback = %q, %v", value, err)
+				}
+				if queues, err := tx.Queues(); err != nil || len(queues) != 1 {
+					t.Errorf("Queues after rollback = %v, %v", queues, err)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("view: %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreIsShared(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "shared.db")
+	producer, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}, WithMemoryStore())
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer producer.Close()
+	consumer, err := NewQueue[testStruct]("q", dbPath, &JsonCoder[testStruct]{}, WithMemoryStore())
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer consumer.Close()
+
+	if err := producer.Enqueue(testStruct{Message: "hello"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+	msg, err := consumer.Dequeue("c")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if msg.Data().Message != "hello" {
+		t.Errorf("got %q, want hello", msg.Data().Message)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(dbPath), "*")); len(matches) != 0 {
+		t.Errorf("memory store wrote files: %v", matches)
+	}
+}
+
+func TestBoltStoreUpgradesLegacyQueues(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本直接用队列名作为 bucket 名
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("legacy"))
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= 2; i++ {
+			seq, _ := bucket.NextSequence()
+			if err := bucket.Put([]byte(strconv.FormatUint(seq, 10)), []byte(fmt.Sprintf(`{"message":"m%d"}`, i))); err != nil {
+				return err
+			}
+		}
+		progress, err := tx.CreateBucket([]byte(consumerProgressBucket))
+		if err != nil {
+			return err
+		}
+		return progress.Put([]byte("c:legacy"), []byte("1"))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := NewQueue[testStruct]("legacy", dbPath, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("NewQueue: %v", err)
+	}
+	defer queue.Close()
+	msg, err := queue.Dequeue("c")
+	if err != nil || msg.Data().Message != "m2" {
+		t.Fatalf("Dequeue from upgraded queue = %v, %v; want m2", msg, err)
+	}
+	if err := queue.Enqueue(testStruct{Message: "m3"}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	err = queue.db.view(func(tx Tx) error {
+		stats, err := tx.Stats("legacy")
+		if err != nil || stats.LastSeq != 3 {
+			t.Errorf("Stats after upgrade = %+v, %v; want LastSeq 3", stats, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreSetSequence(t *testing.T) {
+	for name, store := range openTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := store.Update(func(tx Tx) error {
+				if err := tx.SetSequence("q", 10); err != nil {
+					return err
+				}
+				if err := tx.SetSequence("q", 3); err != nil {
+					return err
+				}
+				seq, err := tx.Append("q", []byte("k"))
+				if err != nil || seq != 11 {
+					t.Errorf("Append after SetSequence(10) = %d, %v; want 11", seq, err)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			err = store.View(func(tx Tx) error {
+				stats, err := tx.Stats("q")
+				if err != nil {
+					return err
+				}
+				if stats != (QueueStats{Count: 1, FirstSeq: 11, LastSeq: 11}) {
+					t.Errorf("Stats = %+v", stats)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("view: %v", err)
+			}
+		})
+	}
+}
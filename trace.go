@@ -0,0 +1,117 @@
+package bunnymq
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// HeaderCarrier is the storage a Propagator reads from and writes to. Headers
+// implements it; it mirrors OpenTelemetry's TextMapCarrier so an OTel
+// propagator can be adapted with a few lines of glue.
+type HeaderCarrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// Propagator injects trace context into message headers on Enqueue and
+// extracts it again on Dequeue.
+type Propagator interface {
+	Inject(ctx context.Context, carrier HeaderCarrier)
+	Extract(ctx context.Context, carrier HeaderCarrier) context.Context
+}
+
+// W3C Trace Context header names.
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// SpanContext identifies a span in the W3C Trace Context format.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte
+	TraceState string
+}
+
+// IsValid reports whether both the trace and span IDs are non-zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats sc as a version-00 traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// ParseTraceParent parses a traceparent header value. Unknown future versions
+// are accepted as long as the version-00 fields are well formed.
+func ParseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context stored in ctx, if any.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// TraceContext is a Propagator for the W3C traceparent and tracestate headers.
+// It reads and writes the SpanContext stored with ContextWithSpanContext.
+type TraceContext struct{}
+
+// Inject writes the span context from ctx into carrier, if ctx has one.
+func (TraceContext) Inject(ctx context.Context, carrier HeaderCarrier) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return
+	}
+	carrier.Set(TraceParentHeader, sc.TraceParent())
+	if sc.TraceState != "" {
+		carrier.Set(TraceStateHeader, sc.TraceState)
+	}
+}
+
+// Extract returns ctx carrying the span context found in carrier. ctx is
+// returned unchanged when the headers are missing or malformed.
+func (TraceContext) Extract(ctx context.Context, carrier HeaderCarrier) context.Context {
+	sc, ok := ParseTraceParent(carrier.Get(TraceParentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = carrier.Get(TraceStateHeader)
+	return ContextWithSpanContext(ctx, sc)
+}
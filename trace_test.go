@@ -0,0 +1,149 @@
+package bunnymq
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// memoryTracer is an in-memory Propagator that records the span names it
+// injected and hands consumers a context carrying the producer's span name.
+type memoryTracer struct {
+	injected []string
+}
+
+type memorySpanKey struct{}
+
+func (m *memoryTracer) Inject(ctx context.Context, carrier HeaderCarrier) {
+	if span, ok := ctx.Value(memorySpanKey{}).(string); ok {
+		m.injected = append(m.injected, span)
+		carrier.Set("x-span", span)
+	}
+}
+
+func (m *memoryTracer) Extract(ctx context.Context, carrier HeaderCarrier) context.Context {
+	if span := carrier.Get("x-span"); span != "" {
+		return context.WithValue(ctx, memorySpanKey{}, span)
+	}
+	return ctx
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	queue, err := NewQueue[testStruct]("trace_queue", filepath.Join(t.TempDir(), "trace.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+	queue.SetPropagator(TraceContext{})
+
+	sc, ok := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatalf("failed to parse traceparent")
+	}
+	sc.TraceState = "vendor=value"
+	ctx := ContextWithSpanContext(context.Background(), sc)
+
+	if err := queue.EnqueueContext(ctx, testStruct{Message: "traced"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+	if err := queue.Enqueue(testStruct{Message: "untraced"}); err != nil {
+		t.Fatalf("Error enqueuing message: %v", err)
+	}
+
+	msg, err := queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if got := msg.Headers().Get(TraceParentHeader); got != sc.TraceParent() {
+		t.Errorf("traceparent header = %q, want %q", got, sc.TraceParent())
+	}
+	got, ok := SpanContextFromContext(msg.Context())
+	if !ok || got != sc {
+		t.Errorf("extracted span context = %+v (%v), want %+v", got, ok, sc)
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("Error acknowledging message: %v", err)
+	}
+
+	msg, err = queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing message: %v", err)
+	}
+	if _, ok := SpanContextFromContext(msg.Context()); ok {
+		t.Errorf("untraced message carried a span context")
+	}
+}
+
+func TestCustomPropagator(t *testing.T) {
+	queue, err := NewQueue[testStruct]("trace_custom", filepath.Join(t.TempDir(), "trace.db"), &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+	tracer := &memoryTracer{}
+	queue.SetPropagator(tracer)
+
+	for i := 0; i < 3; i++ {
+		ctx := context.WithValue(context.Background(), memorySpanKey{}, fmt.Sprintf("span-%d", i))
+		if err := queue.EnqueueContext(ctx, testStruct{Message: "m"}); err != nil {
+			t.Fatalf("Error enqueuing message: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := queue.Dequeue("c1")
+		if err != nil {
+			t.Fatalf("Error dequeuing message: %v", err)
+		}
+		if span := msg.Context().Value(memorySpanKey{}); span != fmt.Sprintf("span-%d", i) {
+			t.Errorf("message %d carried span %v", i, span)
+		}
+		if err := msg.Ack(); err != nil {
+			t.Fatalf("Error acknowledging message: %v", err)
+		}
+	}
+	if len(tracer.injected) != 3 {
+		t.Errorf("expected 3 injected spans, got %v", tracer.injected)
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		ok    bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"", false},
+	} {
+		if _, ok := ParseTraceParent(tc.value); ok != tc.ok {
+			t.Errorf("ParseTraceParent(%q) ok = %v, want %v", tc.value, ok, tc.ok)
+		}
+	}
+}
+
+func TestLegacyMessagesWithoutEnvelope(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+	queue, err := NewQueue[testStruct]("legacy_queue", dbPath, &JsonCoder[testStruct]{})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	defer queue.Close()
+
+	// 模拟旧版本直接写入的 JSON 数据
+	if _, _, err := queue.db.putWithAutoIncrementKey("legacy_queue", []byte(`{"Message":"old"}`)); err != nil {
+		t.Fatalf("Error writing legacy message: %v", err)
+	}
+	msg, err := queue.Dequeue("c1")
+	if err != nil {
+		t.Fatalf("Error dequeuing legacy message: %v", err)
+	}
+	if msg.Data().Message != "old" || msg.Headers() != nil {
+		t.Errorf("unexpected legacy message %+v headers %v", msg.Data(), msg.Headers())
+	}
+}